@@ -6,25 +6,36 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
 	github.com/alecthomas/units v0.0.0-20190717042225-c3de453c63f4 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/caarlos0/env v3.5.0+incompatible
 	github.com/cskr/pubsub v1.0.2
 	github.com/danielkrainas/gobag v0.0.0-20190904181107-0c8a1ae51691
+	github.com/go-redis/redis v6.15.5+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/go-yaml/yaml v2.1.0+incompatible
-	github.com/gogo/protobuf v1.3.0 // indirect
+	github.com/gogo/protobuf v1.3.0
 	github.com/golang/protobuf v1.3.2
 	github.com/google/wire v0.3.0
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/go-memdb v1.0.3
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/nats-io/gnatsd v1.4.1 // indirect
 	github.com/nats-io/go-nats v1.7.2 // indirect
 	github.com/nats-io/go-nats-streaming v0.4.4
 	github.com/nats-io/nats-server v1.4.1 // indirect
 	github.com/nats-io/nats-streaming-server v0.16.0 // indirect
+	github.com/nats-io/nats.go v1.22.1
 	github.com/prometheus/common v0.6.0
+	github.com/segmentio/kafka-go v0.3.4
 	github.com/segmentio/ksuid v1.0.2 // indirect
 	github.com/spf13/cobra v0.0.5
+	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
 	github.com/urfave/negroni v1.0.0
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
 )
+
+// nats-streaming-server v0.16.0 requires a malformed pseudo-version of this commit
+replace golang.org/x/sys v0.0.0-20190726091711-fde4db37ae7a => golang.org/x/sys v0.0.0-20190813064441-fde4db37ae7a
@@ -8,6 +8,11 @@ import (
 	gobagcontext "github.com/danielkrainas/gobag/context"
 	"go.uber.org/zap"
 
+	// database/sql drivers of the sql storage driver
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
 	"github.com/danielkrainas/sake/pkg/cmd"
 	"github.com/danielkrainas/sake/pkg/util/log"
 )
@@ -18,9 +18,14 @@ type RequestContext struct {
 	RequestID string
 	StartedAt time.Time
 	Errors    errcode.Errors
+	// Operator is the name of the operator the request authenticated as.
+	Operator string
+	// Route is the name of the route that matched the request, if any.
+	Route string
 
 	Coordinator service.CoordinatorService
 	Cache       service.CacheService
+	Storage     service.StorageService
 }
 
 type ContextKey int
@@ -105,8 +110,12 @@ func ParseAndValidate(rc *RequestContext, r *http.Request, options interface{})
 }
 
 func SendJSON(w http.ResponseWriter, data interface{}) {
+	SendJSONStatus(w, http.StatusOK, data)
+}
+
+func SendJSONStatus(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Error("result json encoding failed", zap.Error(err))
 	}
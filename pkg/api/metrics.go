@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danielkrainas/gobag/http"
+	"github.com/danielkrainas/sake/pkg/util/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec(
+		"sake_http_requests_total",
+		"HTTP requests served by the API, by route and status.",
+		"method", "route", "status")
+
+	httpRequestDuration = metrics.NewHistogramVec(
+		"sake_http_request_duration_seconds",
+		"Latency of the HTTP requests served by the API.",
+		nil,
+		"method", "route")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(httpRequests, httpRequestDuration)
+}
+
+// observeRequest reports a served request. Requests that matched no route
+// are grouped under "unmatched" to keep the label set bounded.
+func observeRequest(rc *RequestContext, r *http.Request, resp baghttp.ResponseInstrumentationInfo) {
+	route := rc.Route
+	if route == "" {
+		route = "unmatched"
+	}
+
+	httpRequests.Inc(r.Method, route, strconv.Itoa(int(resp.Status)))
+	httpRequestDuration.Observe(time.Since(rc.StartedAt).Seconds(), r.Method, route)
+}
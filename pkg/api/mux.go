@@ -25,8 +25,19 @@ func NewMux() (*Mux, error) {
 
 	api.register(v1.RouteNameBase, http.HandlerFunc(baseHandler))
 	mappings := map[string]func() HttpHandler{
-		v1.RouteNameRecipes: RecipesAPI,
-		v1.RouteNameRecipe:  RecipeAPI,
+		v1.RouteNameRecipes:            RecipesAPI,
+		v1.RouteNameRecipe:             RecipeAPI,
+		v1.RouteNameRecipeValidate:     RecipeValidateAPI,
+		v1.RouteNameRecipeTransactions: RecipeTransactionsAPI,
+		v1.RouteNameRecipeVersions:     RecipeVersionsAPI,
+		v1.RouteNameRecipeVersion:      RecipeVersionAPI,
+		v1.RouteNameRecipeDiff:         RecipeDiffAPI,
+		v1.RouteNameRecipeRollback:     RecipeRollbackAPI,
+		v1.RouteNameTransactions:       TransactionsAPI,
+		v1.RouteNameTransaction:        TransactionAPI,
+		v1.RouteNameTransactionActions: TransactionActionsAPI,
+		v1.RouteNameTransactionHistory: TransactionHistoryAPI,
+		v1.RouteNameReplies:            RepliesAPI,
 	}
 
 	for routeName, dispatchFactory := range mappings {
@@ -37,19 +48,26 @@ func NewMux() (*Mux, error) {
 }
 
 func (api *Mux) register(routeName string, dispatch interface{}) {
-	api.router.GetRoute(routeName).Handler(api.dispatcher(dispatch))
+	api.router.GetRoute(routeName).Handler(api.dispatcher(routeName, dispatch))
 }
 
-func (api *Mux) dispatcher(dispatch interface{}) http.Handler {
+func (api *Mux) dispatcher(routeName string, dispatch interface{}) http.Handler {
 	if httpDispatch, ok := dispatch.(http.Handler); ok {
-		// NOTE: a spot to wrap HTTP handler logic here
-		return httpDispatch
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rc := GetRequestContext(r); rc != nil {
+				rc.Route = routeName
+			}
+
+			httpDispatch.ServeHTTP(w, r)
+		})
 	}
 
 	// NOTE: a spot to add logic and decorate the route's http handler
 	if handlerDispatch, ok := dispatch.(HttpHandler); ok {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			handlerDispatch(GetRequestContext(r), w, r)
+			rc := GetRequestContext(r)
+			rc.Route = routeName
+			handlerDispatch(rc, w, r)
 		})
 	}
 
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/danielkrainas/sake/pkg/api/v1"
+	"github.com/danielkrainas/sake/pkg/service"
+)
+
+func RepliesAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodPost: PostReply,
+	})
+}
+
+// PostReply accepts the reply of an endpoint that accepted a request. The
+// callback URL of the request carries its reply topic and the signature of
+// the topic, which authenticates the endpoint instead of an operator token.
+func PostReply(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail("topic is required"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	err = ctx.Coordinator.DeliverReply(topic, query.Get("signature"), r.Header.Get("Content-Type"), body)
+	if err == service.ErrInvalidReplySignature {
+		SendError(ctx, v1.ErrorCodeReplySignatureInvalid)
+	} else if err != nil {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(err.Error()))
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -2,9 +2,12 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/danielkrainas/gobag/context"
@@ -13,15 +16,18 @@ import (
 	"github.com/danielkrainas/gobag/util/uid"
 	"github.com/danielkrainas/sake/pkg/service"
 	"github.com/danielkrainas/sake/pkg/util/log"
+	"github.com/danielkrainas/sake/pkg/util/metrics"
 	"github.com/urfave/negroni"
 	"go.uber.org/zap"
 )
 
 type ServerConfig struct {
 	Addr string
+	// Operators maps bearer tokens to operator names.
+	Operators map[string]string
 }
 
-func NewServer(ctx context.Context, mux http.Handler, cache service.CacheService, coordinator service.CoordinatorService, config ServerConfig) (*Server, error) {
+func NewServer(ctx context.Context, mux http.Handler, cache service.CacheService, storage service.StorageService, coordinator service.CoordinatorService, config ServerConfig) (*Server, error) {
 	n := negroni.New()
 	srv := &Server{
 		config: config,
@@ -38,7 +44,9 @@ func NewServer(ctx context.Context, mux http.Handler, cache service.CacheService
 	})
 
 	n.Use(aliveHandler("/"))
-	n.Use(contextHandler(cache, coordinator))
+	n.Use(metricsHandler("/metrics"))
+	n.Use(healthHandler("/health", cache))
+	n.Use(contextHandler(cache, storage, coordinator, config.Operators))
 	n.Use(loggingHandler())
 	n.UseHandler(mux)
 
@@ -108,6 +116,9 @@ func loggingHandler() negroni.Handler {
 
 					log.Info("response error", responseErrorLogFields(rc, info)...)
 				}
+
+				// errors are served above, so the status is taken again.
+				observeRequest(rc, r, iw.Info())
 			}()
 		}
 
@@ -115,20 +126,43 @@ func loggingHandler() negroni.Handler {
 	})
 }
 
-func contextHandler(cache service.CacheService, coordinator service.CoordinatorService) negroni.Handler {
+func contextHandler(cache service.CacheService, storage service.StorageService, coordinator service.CoordinatorService, operators map[string]string) negroni.Handler {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		rc := &RequestContext{
 			Errors:      make(errcode.Errors, 0),
 			Cache:       cache,
+			Storage:     storage,
 			Coordinator: coordinator,
 			RequestID:   uid.Generate(),
 			StartedAt:   time.Now(),
+			Operator:    authenticateOperator(r, operators),
 		}
 
 		next(w, AppendRequestContext(rc, r))
 	})
 }
 
+// authenticateOperator returns the operator whose token the request bears, or
+// an empty string.
+func authenticateOperator(r *http.Request, operators map[string]string) string {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+
+	bearer := []byte(strings.TrimPrefix(auth, prefix))
+	operator := ""
+	for token, name := range operators {
+		if subtle.ConstantTimeCompare([]byte(token), bearer) == 1 {
+			operator = name
+		}
+	}
+
+	return operator
+}
+
 func aliveHandler(path string) negroni.Handler {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		if r.URL.Path == path {
@@ -141,6 +175,53 @@ func aliveHandler(path string) negroni.Handler {
 	})
 }
 
+func metricsHandler(path string) negroni.Handler {
+	handler := metrics.DefaultRegistry.Handler()
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if r.URL.Path == path && r.Method == http.MethodGet {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// Health is the response of the health endpoint. Storage describes why
+// storage is degraded.
+type Health struct {
+	Status  string `json:"status"`
+	Storage string `json:"storage,omitempty"`
+}
+
+// healthHandler reports whether the engine's storage keeps up with it. It
+// responds with 503 while the cache reports being unhealthy.
+func healthHandler(path string, cache service.CacheService) negroni.Handler {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if r.URL.Path != path || r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+
+		health := &Health{Status: "ok"}
+		status := http.StatusOK
+		if checker, ok := cache.(service.HealthChecker); ok {
+			if err := checker.CheckHealth(); err != nil {
+				health.Status = "degraded"
+				health.Storage = err.Error()
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			log.Error("health encoding failed", zap.Error(err))
+		}
+	})
+}
+
 func requestLogFields(rc *RequestContext, r *http.Request) []zap.Field {
 	fields := []zap.Field{
 		zap.Namespace("http.req"),
@@ -0,0 +1,433 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/api/v1"
+	"github.com/danielkrainas/sake/pkg/service"
+	"github.com/gorilla/mux"
+)
+
+type TransactionSummary struct {
+	ID           string                   `json:"id"`
+	RecipeID     string                   `json:"recipe_id"`
+	Recipe       string                   `json:"recipe"`
+	State        service.TransactionState `json:"state"`
+	Stage        string                   `json:"stage"`
+	Topic        string                   `json:"topic,omitempty"`
+	ExecutedPath []*service.PathNode      `json:"executed_path"`
+	Branches     []service.ActiveBranch   `json:"branches,omitempty"`
+	Started      time.Time                `json:"started"`
+	StageStarted time.Time                `json:"stage_started"`
+	Expires      *time.Time               `json:"expires,omitempty"`
+	RetryAt      *time.Time               `json:"retry_at,omitempty"`
+	Attempt      int                      `json:"attempt"`
+	DataSize     int                      `json:"data_size"`
+	Reason       string                   `json:"reason,omitempty"`
+	Failures     []service.StageFailure   `json:"failures,omitempty"`
+
+	// RecipeVersion is the version of the recipe the transaction runs.
+	RecipeVersion int `json:"recipe_version,omitempty"`
+
+	// CorrelationID, Traceparent and Metadata are sent with every request of
+	// the transaction.
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Traceparent   string            `json:"traceparent,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// TransactionResult is a transaction started through the API. Data is only
+// set once the transaction completed.
+type TransactionResult struct {
+	*TransactionSummary
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type TransactionList struct {
+	Transactions []*TransactionSummary `json:"transactions"`
+	NextCursor   string                `json:"next_cursor,omitempty"`
+}
+
+// MaxStartWait bounds how long a start request waits for its transaction
+// to complete.
+const MaxStartWait = 5 * time.Minute
+
+func RecipeTransactionsAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodPost: StartTransaction,
+	})
+}
+
+func TransactionsAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: ListTransactions,
+	})
+}
+
+func TransactionAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: GetTransaction,
+	})
+}
+
+func TransactionActionsAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodPost: RunTransactionAction,
+	})
+}
+
+func TransactionHistoryAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: GetTransactionHistory,
+	})
+}
+
+type TransactionAction struct {
+	Action string          `json:"action"`
+	Reason string          `json:"reason"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func (action *TransactionAction) Validate() error {
+	switch action.Action {
+	case service.ActionAbort, service.ActionRetry, service.ActionResume:
+		if action.Data != nil {
+			return fmt.Errorf("data is only accepted by %s and %s", service.ActionSucceed, service.ActionFail)
+		}
+
+	case service.ActionSucceed, service.ActionFail:
+	default:
+		return fmt.Errorf("unknown action %q", action.Action)
+	}
+
+	if strings.TrimSpace(action.Reason) == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	return nil
+}
+
+type TransactionHistory struct {
+	Events []*service.TransactionEvent `json:"events"`
+}
+
+// ListTransactions serves stored transactions. Filters apply to the stored
+// snapshots; transactions that are still running are shown in their live
+// state.
+func ListTransactions(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	query, err := parseTransactionQuery(r)
+	if err != nil {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	page, err := ctx.Storage.FindTransactions(r.Context(), query)
+	if err != nil {
+		SendError(ctx, err)
+		return
+	}
+
+	list := &TransactionList{
+		Transactions: make([]*TransactionSummary, 0, len(page.Transactions)),
+		NextCursor:   page.NextCursor,
+	}
+
+	for _, trx := range page.Transactions {
+		live, err := ctx.Cache.GetTransaction(r.Context(), trx.ID)
+		if err != nil {
+			SendError(ctx, err)
+			return
+		} else if live != nil {
+			trx = live
+		}
+
+		list.Transactions = append(list.Transactions, SummarizeTransaction(trx))
+	}
+
+	SendJSON(w, list)
+}
+
+func GetTransaction(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail("url id parameter missing or invalid"))
+		return
+	}
+
+	trx, err := findTransaction(r.Context(), ctx, id)
+	if err != nil {
+		SendError(ctx, err)
+	} else if trx == nil {
+		SendError(ctx, v1.ErrorCodeTransactionUnknown.WithArgs(id))
+	} else {
+		SendJSON(w, SummarizeTransaction(trx))
+	}
+}
+
+// StartTransaction starts a transaction of a recipe with the request body as
+// its trigger payload. With a wait duration the response is held until the
+// transaction completes or the duration passes.
+func StartTransaction(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > MaxStartWait {
+			SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(fmt.Sprintf("wait must be a duration of at most %s", MaxStartWait)))
+			return
+		}
+
+		wait = d
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	trx, created, err := ctx.Coordinator.Start(name, data, r.Header.Get(v1.IdempotencyKeyHeader.Name), messageContext(r))
+	if err != nil {
+		SendError(ctx, err)
+		return
+	}
+
+	if wait > 0 {
+		waitCtx, cancel := context.WithTimeout(r.Context(), wait)
+		err := ctx.Coordinator.Await(waitCtx, trx)
+		cancel()
+		if err != nil && r.Context().Err() != nil {
+			return
+		}
+	}
+
+	if !created {
+		w.Header().Set(v1.IdempotentReplayedHeader.Name, "true")
+	}
+
+	w.Header().Set(v1.CorrelationIDHeader.Name, trx.CorrelationID)
+
+	result := &TransactionResult{}
+	status := http.StatusAccepted
+	trx.Lock()
+	if trx.IsCompleted() {
+		status = http.StatusOK
+		result.Data = service.RawJSON(trx.Data)
+	}
+
+	trx.Unlock()
+	result.TransactionSummary = SummarizeTransaction(trx)
+
+	w.Header().Set("Location", "/v1/transactions/"+trx.ID)
+	SendJSONStatus(w, status, result)
+}
+
+// messageContext reads the correlation ID, trace context and metadata of a
+// start request from its headers.
+func messageContext(r *http.Request) *service.MessageContext {
+	mc := &service.MessageContext{
+		CorrelationID: r.Header.Get(v1.CorrelationIDHeader.Name),
+		Traceparent:   r.Header.Get(v1.TraceparentHeader.Name),
+		Tracestate:    r.Header.Get(v1.TracestateHeader.Name),
+	}
+
+	prefix := http.CanonicalHeaderKey(v1.MetadataHeaderPrefix.Name)
+	for name, values := range r.Header {
+		if len(values) < 1 || !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+
+		if mc.Metadata == nil {
+			mc.Metadata = make(map[string]string)
+		}
+
+		mc.Metadata[strings.ToLower(name[len(prefix):])] = values[0]
+	}
+
+	return mc
+}
+
+// findTransaction prefers the live copy of a running transaction over the
+// stored one.
+func findTransaction(ctx context.Context, rc *RequestContext, id string) (*service.Transaction, error) {
+	trx, err := rc.Cache.GetTransaction(ctx, id)
+	if err != nil || trx != nil {
+		return trx, err
+	}
+
+	return rc.Storage.LoadTransaction(ctx, id)
+}
+
+// RunTransactionAction lets an authenticated operator intervene in a running
+// transaction.
+func RunTransactionAction(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	if ctx.Operator == "" {
+		SendError(ctx, v1.ErrorCodeUnauthorized)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	action := &TransactionAction{}
+	if !ParseAndValidate(ctx, r, action) {
+		return
+	}
+
+	op := service.Operation{
+		Operator: ctx.Operator,
+		Reason:   action.Reason,
+	}
+
+	var trx *service.Transaction
+	var err error
+	switch action.Action {
+	case service.ActionAbort:
+		trx, err = ctx.Coordinator.Abort(id, op)
+	case service.ActionRetry:
+		trx, err = ctx.Coordinator.RetryStage(id, op)
+	case service.ActionSucceed, service.ActionFail:
+		var data []byte
+		if action.Data != nil {
+			data = []byte(action.Data)
+		}
+
+		trx, err = ctx.Coordinator.ResolveStage(id, action.Action == service.ActionSucceed, data, op)
+	case service.ActionResume:
+		trx, err = ctx.Coordinator.Resume(id, op)
+	}
+
+	if err != nil {
+		SendError(ctx, err)
+	} else {
+		SendJSON(w, SummarizeTransaction(trx))
+	}
+}
+
+// GetTransactionHistory serves the journaled events of a transaction,
+// including operator actions.
+func GetTransactionHistory(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	journal, ok := ctx.Storage.(service.EventJournal)
+	if !ok {
+		SendError(ctx, v1.ErrorCodeTransactionUnknown.WithArgs(id))
+		return
+	}
+
+	events, err := journal.LoadEvents(r.Context(), id, 0)
+	if err != nil {
+		SendError(ctx, err)
+	} else if len(events) < 1 {
+		SendError(ctx, v1.ErrorCodeTransactionUnknown.WithArgs(id))
+	} else {
+		SendJSON(w, &TransactionHistory{Events: events})
+	}
+}
+
+func SummarizeTransaction(trx *service.Transaction) *TransactionSummary {
+	trx.Lock()
+	defer trx.Unlock()
+	summary := &TransactionSummary{
+		ID:           trx.ID,
+		RecipeID:     trx.RecipeID,
+		Recipe:       trx.RecipeName,
+		State:        trx.State,
+		Stage:        trx.StageKey,
+		Topic:        trx.StageTopic,
+		ExecutedPath: copyPath(trx.ExecutedPath),
+		Started:      trx.Started,
+		StageStarted: trx.StageStarted,
+		Expires:      trx.Expires,
+		RetryAt:      trx.RetryAt,
+		Attempt:      trx.Attempt,
+		DataSize:     len(trx.Data),
+		Reason:       trx.Reason,
+	}
+
+	summary.RecipeVersion = trx.RecipeVersion
+	summary.CorrelationID = trx.CorrelationID
+	summary.Traceparent = trx.Traceparent
+	if len(trx.Metadata) > 0 {
+		summary.Metadata = make(map[string]string, len(trx.Metadata))
+		for k, v := range trx.Metadata {
+			summary.Metadata[k] = v
+		}
+	}
+
+	for _, branch := range trx.Branches {
+		summary.Branches = append(summary.Branches, *branch)
+	}
+
+	for _, failure := range trx.Failures {
+		summary.Failures = append(summary.Failures, *failure)
+	}
+
+	return summary
+}
+
+func copyPath(path []*service.PathNode) []*service.PathNode {
+	if path == nil {
+		return []*service.PathNode{}
+	}
+
+	result := make([]*service.PathNode, 0, len(path))
+	for _, node := range path {
+		result = append(result, &service.PathNode{
+			Key:      node.Key,
+			Outcome:  node.Outcome,
+			Branches: copyPath(node.Branches),
+		})
+	}
+
+	return result
+}
+
+func parseTransactionQuery(r *http.Request) (*service.TransactionQuery, error) {
+	values := r.URL.Query()
+	query := &service.TransactionQuery{
+		Recipe: values.Get("recipe"),
+		Cursor: values.Get("cursor"),
+	}
+
+	for _, value := range values["state"] {
+		for _, state := range strings.Split(value, ",") {
+			if state != "" {
+				query.States = append(query.States, service.TransactionState(state))
+			}
+		}
+	}
+
+	for name, target := range map[string]**time.Time{
+		"started_after":  &query.StartedAfter,
+		"started_before": &query.StartedBefore,
+	} {
+		if value := values.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+
+			*target = &t
+		}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("limit must be a positive number")
+		}
+
+		query.Limit = limit
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
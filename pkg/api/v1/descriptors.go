@@ -12,6 +12,54 @@ var (
 		Format:      "<version>",
 		Examples:    []string{"0.0.0-dev"},
 	}
+
+	IdempotencyKeyHeader = describe.Parameter{
+		Name:        "Idempotency-Key",
+		Type:        "string",
+		Description: "Client chosen key that identifies a transaction start. Repeated starts with the same key return the first transaction.",
+		Format:      "<key>",
+		Examples:    []string{"order-1234"},
+	}
+
+	IdempotentReplayedHeader = describe.Parameter{
+		Name:        "Idempotent-Replayed",
+		Type:        "boolean",
+		Description: "Set when the response describes a transaction started by an earlier request with the same idempotency key.",
+		Format:      "true",
+		Examples:    []string{"true"},
+	}
+
+	CorrelationIDHeader = describe.Parameter{
+		Name:        "X-Correlation-ID",
+		Type:        "string",
+		Description: "Correlation ID sent with every request of the transaction. Defaults to the transaction's ID.",
+		Format:      "<id>",
+		Examples:    []string{"checkout-5678"},
+	}
+
+	TraceparentHeader = describe.Parameter{
+		Name:        "traceparent",
+		Type:        "string",
+		Description: "W3C trace context propagated to every request of the transaction.",
+		Format:      "<version>-<trace-id>-<parent-id>-<flags>",
+		Examples:    []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+
+	TracestateHeader = describe.Parameter{
+		Name:        "tracestate",
+		Type:        "string",
+		Description: "Vendor specific W3C trace state, propagated along with traceparent.",
+		Format:      "<key>=<value>[,<key>=<value>]",
+		Examples:    []string{"congo=t61rcWkgMzE"},
+	}
+
+	MetadataHeaderPrefix = describe.Parameter{
+		Name:        "Sake-Metadata-",
+		Type:        "string",
+		Description: "Headers with this prefix are added to the transaction's metadata, named by the rest of the header name in lower case.",
+		Format:      "Sake-Metadata-<name>: <value>",
+		Examples:    []string{"Sake-Metadata-Tenant: acme"},
+	}
 )
 
 var (
@@ -41,7 +89,18 @@ var API = struct {
 var routeDescriptors = []Route{
 	{"/v1", RouteNameBase},
 	{"/v1/recipes", RouteNameRecipes},
+	{"/v1/recipes/validate", RouteNameRecipeValidate},
 	{"/v1/recipes/{name}", RouteNameRecipe},
+	{"/v1/recipes/{name}/transactions", RouteNameRecipeTransactions},
+	{"/v1/recipes/{name}/versions", RouteNameRecipeVersions},
+	{"/v1/recipes/{name}/versions/{version}", RouteNameRecipeVersion},
+	{"/v1/recipes/{name}/diff", RouteNameRecipeDiff},
+	{"/v1/recipes/{name}/rollback", RouteNameRecipeRollback},
+	{"/v1/transactions", RouteNameTransactions},
+	{"/v1/transactions/{id}", RouteNameTransaction},
+	{"/v1/transactions/{id}/actions", RouteNameTransactionActions},
+	{"/v1/transactions/{id}/history", RouteNameTransactionHistory},
+	{"/v1/replies", RouteNameReplies},
 }
 
 var APIDescriptor map[string]Route
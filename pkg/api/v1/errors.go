@@ -22,4 +22,46 @@ var (
 		Description:    "",
 		HTTPStatusCode: http.StatusBadRequest,
 	})
+
+	ErrorCodeRecipeUnknown = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "RECIPE_UNKNOWN",
+		Message:        "recipe %q not found",
+		Description:    "",
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	ErrorCodeRecipeVersionUnknown = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "RECIPE_VERSION_UNKNOWN",
+		Message:        "version %d of recipe %q not found",
+		Description:    "",
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	ErrorCodeTransactionUnknown = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "TRANSACTION_UNKNOWN",
+		Message:        "transaction %q not found",
+		Description:    "",
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	ErrorCodeTransactionActionInvalid = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "TRANSACTION_ACTION_INVALID",
+		Message:        "transaction %q can't %s while %s",
+		Description:    "",
+		HTTPStatusCode: http.StatusConflict,
+	})
+
+	ErrorCodeUnauthorized = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "UNAUTHORIZED",
+		Message:        "operator authentication required",
+		Description:    "",
+		HTTPStatusCode: http.StatusUnauthorized,
+	})
+
+	ErrorCodeReplySignatureInvalid = errcode.Register(ErrorGroup, errcode.ErrorDescriptor{
+		Value:          "REPLY_SIGNATURE_INVALID",
+		Message:        "reply signature doesn't match the reply topic",
+		Description:    "",
+		HTTPStatusCode: http.StatusForbidden,
+	})
 )
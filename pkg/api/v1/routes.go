@@ -3,9 +3,20 @@ package v1
 import "github.com/gorilla/mux"
 
 const (
-	RouteNameBase      = "base"
-	RouteNameRecipes = "recipes"
-	RouteNameRecipe  = "recipe"
+	RouteNameBase               = "base"
+	RouteNameRecipes            = "recipes"
+	RouteNameRecipe             = "recipe"
+	RouteNameRecipeValidate     = "recipe-validate"
+	RouteNameRecipeTransactions = "recipe-transactions"
+	RouteNameRecipeVersions     = "recipe-versions"
+	RouteNameRecipeVersion      = "recipe-version"
+	RouteNameRecipeDiff         = "recipe-diff"
+	RouteNameRecipeRollback     = "recipe-rollback"
+	RouteNameTransactions       = "transactions"
+	RouteNameTransaction        = "transaction"
+	RouteNameTransactionActions = "transaction-actions"
+	RouteNameTransactionHistory = "transaction-history"
+	RouteNameReplies            = "replies"
 )
 
 func Router() *mux.Router {
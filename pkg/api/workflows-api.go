@@ -1,7 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/danielkrainas/sake/pkg/api/v1"
 	"github.com/danielkrainas/sake/pkg/service"
@@ -36,13 +39,55 @@ func CreateRecipe(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// versions are numbered by the engine.
+	wf.Version = 0
+	wf.Created = time.Time{}
+	wf.RollbackOf = 0
 	if err := ctx.Coordinator.Register(wf); err != nil {
-		SendError(ctx, err)
+		sendRecipeError(ctx, err)
 	} else {
 		SendJSON(w, wf)
 	}
 }
 
+// RecipeValidation is the result of a dry run of a recipe's registration.
+type RecipeValidation struct {
+	Valid bool `json:"valid"`
+	*service.RecipeReport
+}
+
+func RecipeValidateAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodPost: ValidateRecipe,
+	})
+}
+
+// ValidateRecipe reports the errors and warnings of a recipe without
+// registering it.
+func ValidateRecipe(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	wf := &service.Recipe{}
+	if !Parse(ctx, r, wf) {
+		return
+	}
+
+	report, err := ctx.Coordinator.AnalyzeRecipe(wf)
+	if err != nil {
+		SendError(ctx, err)
+	} else {
+		SendJSON(w, &RecipeValidation{Valid: report.Valid(), RecipeReport: report})
+	}
+}
+
+// sendRecipeError serves the report of an invalid recipe as an invalid
+// request.
+func sendRecipeError(ctx *RequestContext, err error) {
+	if report, ok := err.(*service.RecipeReport); ok {
+		err = v1.ErrorCodeRequestInvalid.WithDetail(report)
+	}
+
+	SendError(ctx, err)
+}
+
 func RemoveRecipe(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name, ok := vars["name"]
@@ -56,3 +101,175 @@ func RemoveRecipe(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+type RecipeVersionList struct {
+	Versions []*service.Recipe `json:"versions"`
+}
+
+// RecipeDiff lists the changes to a recipe's definition from one version to
+// another.
+type RecipeDiff struct {
+	Recipe  string                  `json:"recipe"`
+	From    int                     `json:"from"`
+	To      int                     `json:"to"`
+	Changes []*service.RecipeChange `json:"changes"`
+}
+
+type RecipeRollback struct {
+	Version int `json:"version"`
+}
+
+func (rollback *RecipeRollback) Validate() error {
+	if rollback.Version < 1 {
+		return fmt.Errorf("version must be a positive number")
+	}
+
+	return nil
+}
+
+func RecipeVersionsAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: GetRecipeVersions,
+	})
+}
+
+func RecipeVersionAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: GetRecipeVersion,
+	})
+}
+
+func RecipeDiffAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodGet: DiffRecipeVersions,
+	})
+}
+
+func RecipeRollbackAPI() HttpHandler {
+	return MethodRouter(map[string]HttpHandler{
+		http.MethodPost: RollbackRecipe,
+	})
+}
+
+func GetRecipeVersions(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	versions, err := ctx.Coordinator.RecipeVersions(mux.Vars(r)["name"])
+	if err != nil {
+		SendError(ctx, err)
+	} else {
+		SendJSON(w, &RecipeVersionList{Versions: versions})
+	}
+}
+
+func GetRecipeVersion(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version, err := parseVersion(vars["version"])
+	if err != nil {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	recipe, err := ctx.Coordinator.RecipeVersion(vars["name"], version)
+	if err != nil {
+		SendError(ctx, err)
+	} else {
+		SendJSON(w, recipe)
+	}
+}
+
+// DiffRecipeVersions compares the versions given by the from and to query
+// parameters. From defaults to the version before to, and to to the active
+// version.
+func DiffRecipeVersions(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	values := r.URL.Query()
+	versions, err := ctx.Coordinator.RecipeVersions(name)
+	if err != nil {
+		SendError(ctx, err)
+		return
+	}
+
+	to := latestActiveVersion(versions)
+	if value := values.Get("to"); value != "" {
+		if to, err = parseVersion(value); err != nil {
+			SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail("to: "+err.Error()))
+			return
+		}
+	}
+
+	from := to - 1
+	if value := values.Get("from"); value != "" {
+		if from, err = parseVersion(value); err != nil {
+			SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail("from: "+err.Error()))
+			return
+		}
+	} else if from < 1 {
+		SendError(ctx, v1.ErrorCodeRequestInvalid.WithDetail("from is required to compare the first version"))
+		return
+	}
+
+	fromRecipe, err := findVersion(versions, name, from)
+	if err != nil {
+		SendError(ctx, err)
+		return
+	}
+
+	toRecipe, err := findVersion(versions, name, to)
+	if err != nil {
+		SendError(ctx, err)
+		return
+	}
+
+	changes, err := service.DiffRecipes(fromRecipe, toRecipe)
+	if err != nil {
+		SendError(ctx, err)
+	} else {
+		SendJSON(w, &RecipeDiff{Recipe: name, From: from, To: to, Changes: changes})
+	}
+}
+
+// RollbackRecipe registers an earlier version's definition as the recipe's
+// newest version.
+func RollbackRecipe(ctx *RequestContext, w http.ResponseWriter, r *http.Request) {
+	rollback := &RecipeRollback{}
+	if !ParseAndValidate(ctx, r, rollback) {
+		return
+	}
+
+	recipe, err := ctx.Coordinator.Rollback(mux.Vars(r)["name"], rollback.Version)
+	if err != nil {
+		sendRecipeError(ctx, err)
+	} else {
+		SendJSON(w, recipe)
+	}
+}
+
+func parseVersion(value string) (int, error) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("version must be a positive number")
+	}
+
+	return version, nil
+}
+
+// latestActiveVersion is the active version of a recipe, or its latest version
+// when none is active.
+func latestActiveVersion(versions []*service.Recipe) int {
+	for _, recipe := range versions {
+		if recipe.Status() == service.StatusActive {
+			return recipe.Version
+		}
+	}
+
+	return versions[len(versions)-1].Version
+}
+
+func findVersion(versions []*service.Recipe, name string, version int) (*service.Recipe, error) {
+	for _, recipe := range versions {
+		if recipe.Version == version {
+			return recipe, nil
+		}
+	}
+
+	return nil, v1.ErrorCodeRecipeVersionUnknown.WithArgs(version, name)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/danielkrainas/sake/pkg/service"
+	"github.com/danielkrainas/sake/pkg/util/log"
+)
+
+var (
+	migrateStatusOnly bool
+)
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateStatusOnly, "status", false, "only report the current schema version")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "apply sql storage schema migrations",
+	Long:  "apply pending sql storage schema migrations and report the schema version",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := service.ResolveConfig(configPath)
+		if err != nil {
+			log.Fatal("configuration failure", zap.Error(err))
+		}
+
+		if config.StorageDriver != "sql" {
+			log.Fatal("migrations are only supported by the sql storage driver", zap.String("storage", config.StorageDriver))
+		}
+
+		db, err := service.OpenSQL(rootContext, config.SQL.Driver, config.SQL.DSN)
+		if err != nil {
+			log.Fatal("database connection failed", zap.Error(err))
+		}
+
+		defer db.Close()
+		var version int
+		if migrateStatusOnly {
+			version, err = service.SQLSchemaVersion(rootContext, db)
+		} else {
+			version, err = service.MigrateSQL(rootContext, db, config.SQL.Driver)
+		}
+
+		if err != nil {
+			log.Fatal("migration failed", zap.Error(err))
+		}
+
+		fmt.Printf("schema version %d (latest %d)\n", version, service.LatestSQLSchemaVersion())
+	},
+}
@@ -3,6 +3,7 @@ package factory
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/danielkrainas/sake/pkg/api"
@@ -11,9 +12,16 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-func InitializeComponentManager(ctx context.Context, coordinator service.CoordinatorService, server *api.Server) (*service.ComponentManager, error) {
+func InitializeComponentManager(ctx context.Context, coordinator service.CoordinatorService, server *api.Server, tracer *service.Tracer, cache service.CacheService) (*service.ComponentManager, error) {
 	cm := service.NewComponentManager()
 	cm.MustUse(server)
+	if tracer != nil {
+		cm.MustUse(tracer)
+	}
+
+	if thru, ok := cache.(*service.WriteThruCache); ok && thru.Writer != nil {
+		cm.MustUse(thru.Writer)
+	}
 	if coordinator != nil {
 		cm.MustUse(service.NewTaskComponent("expiration_trigger", 1*time.Second, zapcore.DebugLevel, &service.ExpirationTriggerTask{
 			Coordinator: coordinator,
@@ -29,15 +37,84 @@ func InitializeComponentManager(ctx context.Context, coordinator service.Coordin
 	return cm, nil
 }
 
-func InitializeCoordinator(ctx context.Context, hub service.HubConnector, storage service.StorageService, cache service.CacheService) (service.CoordinatorService, error) {
-	coordinator, err := service.NewCoordinator(ctx, hub, cache, storage)
+func InitializeCoordinator(ctx context.Context, config *service.Config, hub service.HubConnector, storage service.StorageService, cache service.CacheService, tracer *service.Tracer) (service.CoordinatorService, error) {
+	var dedupWindow time.Duration
+	if config.Dedup.Window != "" {
+		var err error
+		if dedupWindow, err = time.ParseDuration(config.Dedup.Window); err != nil || dedupWindow <= 0 {
+			return nil, fmt.Errorf("invalid dedup window %q", config.Dedup.Window)
+		}
+	}
+
+	coordinator, err := service.NewCoordinator(ctx, hub, cache, storage, service.CoordinatorConfig{
+		AlertTopic:  config.AlertTopic,
+		DedupWindow: dedupWindow,
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
+	coordinator.Tracer = tracer
+	if coordinator.Webhooks, err = initializeWebhooks(config); err != nil {
+		return nil, err
+	}
+
 	return coordinator, nil
 }
 
+func initializeWebhooks(config *service.Config) (*service.WebhookTransport, error) {
+	webhookConfig := service.WebhookConfig{
+		Secret:      config.Webhooks.Secret,
+		CallbackURL: config.Webhooks.CallbackURL,
+	}
+
+	if config.Webhooks.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Webhooks.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid webhooks timeout %q", config.Webhooks.Timeout)
+		}
+
+		webhookConfig.Timeout = timeout
+	}
+
+	return service.NewWebhookTransport(webhookConfig), nil
+}
+
+// InitializeTracer returns nil when tracing is off.
+func InitializeTracer(ctx context.Context, config *service.Config) (*service.Tracer, error) {
+	var exporter service.SpanExporter
+	var err error
+	switch config.Tracing.Exporter {
+	case "":
+		return nil, nil
+	case service.TraceExporterStdout:
+		exporter = service.NewJSONExporter(os.Stdout)
+	case service.TraceExporterFile:
+		if config.Tracing.Path == "" {
+			return nil, fmt.Errorf("tracing path is required by the %s exporter", service.TraceExporterFile)
+		}
+
+		exporter, err = service.OpenJSONExporter(config.Tracing.Path)
+	case service.TraceExporterOTLP:
+		exporter, err = service.NewOTLPExporter(config.Tracing.Endpoint, config.Tracing.Headers)
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %q", config.Tracing.Exporter)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("tracer init failed: %v", err)
+	}
+
+	serviceName := config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "sake"
+	}
+
+	log.InfoS("%s trace exporter ready", config.Tracing.Exporter)
+	return service.NewTracer(serviceName, exporter), nil
+}
+
 func InitializeHub(ctx context.Context, config *service.Config) (service.HubConnector, error) {
 	var hub service.HubConnector
 	var err error
@@ -46,6 +123,22 @@ func InitializeHub(ctx context.Context, config *service.Config) (service.HubConn
 		hub = service.NewDebugHub()
 	case "stan":
 		hub, err = service.NewStanHub(config.Nats.ClusterID, config.Nats.Server, config.Nats.ClientID, config.Nats.DurableName)
+	case "jetstream":
+		hub, err = initializeJetStreamHub(config)
+	case "kafka":
+		hub, err = service.NewKafkaHub(service.KafkaConfig{
+			Brokers:    config.Kafka.Brokers,
+			GroupID:    config.Kafka.GroupID,
+			Instance:   config.Kafka.Instance,
+			ReplyTopic: config.Kafka.ReplyTopic,
+		})
+	case "amqp":
+		hub, err = service.NewAmqpHub(service.AmqpConfig{
+			URL:      config.Amqp.URL,
+			Exchange: config.Amqp.Exchange,
+		})
+	case "redis":
+		hub, err = initializeRedisHub(config)
 	default:
 		return nil, fmt.Errorf("invalid hub provider %q", config.HubProvider)
 	}
@@ -55,15 +148,66 @@ func InitializeHub(ctx context.Context, config *service.Config) (service.HubConn
 	}
 
 	log.InfoS("%s hub ready", config.HubProvider)
-	return hub, nil
+	return &service.MeteredHub{HubConnector: hub}, nil
+}
+
+func initializeJetStreamHub(config *service.Config) (service.HubConnector, error) {
+	jsConfig := service.JetStreamConfig{
+		Server:     config.JetStream.Server,
+		Stream:     config.JetStream.Stream,
+		Subjects:   config.JetStream.Subjects,
+		Durable:    config.JetStream.Durable,
+		Instance:   config.JetStream.Instance,
+		MaxDeliver: config.JetStream.MaxDeliver,
+	}
+
+	if config.JetStream.AckWait != "" {
+		ackWait, err := time.ParseDuration(config.JetStream.AckWait)
+		if err != nil || ackWait <= 0 {
+			return nil, fmt.Errorf("invalid jetstream ack wait %q", config.JetStream.AckWait)
+		}
+
+		jsConfig.AckWait = ackWait
+	}
+
+	return service.NewJetStreamHub(jsConfig)
+}
+
+func initializeRedisHub(config *service.Config) (service.HubConnector, error) {
+	redisConfig := service.RedisConfig{
+		Addr:        config.Redis.Addr,
+		Password:    config.Redis.Password,
+		DB:          config.Redis.DB,
+		Group:       config.Redis.Group,
+		Consumer:    config.Redis.Consumer,
+		ReplyStream: config.Redis.ReplyStream,
+		MaxLen:      config.Redis.MaxLen,
+	}
+
+	if config.Redis.ClaimIdle != "" {
+		claimIdle, err := time.ParseDuration(config.Redis.ClaimIdle)
+		if err != nil || claimIdle <= 0 {
+			return nil, fmt.Errorf("invalid redis claim idle %q", config.Redis.ClaimIdle)
+		}
+
+		redisConfig.ClaimIdle = claimIdle
+	}
+
+	return service.NewRedisHub(redisConfig)
 }
 
 func InitializeStorage(ctx context.Context, config *service.Config) (service.StorageService, error) {
-	storage, err := service.NewDebugStorage([]*service.Recipe{service.Recipes[1]}, nil)
+	storage, err := service.NewStorage(ctx, config)
 	if err != nil {
 		return nil, fmt.Errorf("storage init failed: %v", err)
 	}
 
+	driver := config.StorageDriver
+	if driver == "" {
+		driver = service.DefaultStorageDriver
+	}
+
+	log.InfoS("%s storage ready", driver)
 	return storage, nil
 }
 
@@ -75,17 +219,81 @@ func InitializeCache(ctx context.Context, config *service.Config, storage servic
 		return nil, fmt.Errorf("cache init failed: %v", err)
 	}
 
+	writer, err := InitializeWriteBehind(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
 	cache = &service.WriteThruCache{
-		CacheService: cache,
-		Storage:      storage,
+		CacheService:     cache,
+		Storage:          storage,
+		SnapshotInterval: config.Journal.SnapshotInterval,
+		Writer:           writer,
 	}
 
 	return cache, nil
 }
 
-func InitializeServer(ctx context.Context, config *service.Config, mux *api.Mux, cache service.CacheService, coordinator service.CoordinatorService) (*api.Server, error) {
-	return api.NewServer(ctx, mux, cache, coordinator, api.ServerConfig{
-		Addr: config.HTTP.Addr,
+func InitializeWriteBehind(ctx context.Context, config *service.Config) (*service.WriteBehind, error) {
+	writes := service.DefaultWriteBehindConfig()
+	writes.Mode = config.Writes.Mode
+	if config.Writes.QueueSize > 0 {
+		writes.QueueSize = config.Writes.QueueSize
+	}
+
+	if config.Writes.Workers > 0 {
+		writes.Workers = config.Writes.Workers
+	}
+
+	if config.Writes.MaxRetries > 0 {
+		writes.MaxRetries = config.Writes.MaxRetries
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"retry backoff", config.Writes.RetryBackoff, &writes.RetryBackoff},
+		{"max backoff", config.Writes.MaxBackoff, &writes.MaxBackoff},
+		{"lag threshold", config.Writes.LagThreshold, &writes.LagThreshold},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(d.value)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid writes %s %q", d.name, d.value)
+		}
+
+		*d.field = value
+	}
+
+	writer, err := service.NewWriteBehind(ctx, writes)
+	if err != nil {
+		return nil, fmt.Errorf("writer init failed: %v", err)
+	}
+
+	log.InfoS("%s storage writes ready", writer.Config.Mode)
+	return writer, nil
+}
+
+func InitializeServer(ctx context.Context, config *service.Config, mux *api.Mux, cache service.CacheService, storage service.StorageService, coordinator service.CoordinatorService) (*api.Server, error) {
+	operators := make(map[string]string)
+	for _, operator := range config.Operators {
+		if operator.Token == "" {
+			return nil, fmt.Errorf("operator %q has no token", operator.Name)
+		}
+
+		operators[operator.Token] = operator.Name
+	}
+
+	return api.NewServer(ctx, mux, cache, storage, coordinator, api.ServerConfig{
+		Addr:      config.HTTP.Addr,
+		Operators: operators,
 	})
 }
 
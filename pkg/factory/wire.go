@@ -10,11 +10,11 @@ import (
 )
 
 func Coordinator(ctx context.Context, config *service.Config) (service.CoordinatorService, error) {
-	wire.Build(InitializeCoordinator, InitializeCache, InitializeStorage, InitializeHub)
+	wire.Build(InitializeCoordinator, InitializeTracer, InitializeCache, InitializeStorage, InitializeHub)
 	return &service.Coordinator{}, nil
 }
 
 func ComponentManagerWithCoordinator(ctx context.Context, config *service.Config) (*service.ComponentManager, error) {
-	wire.Build(InitializeComponentManager, InitializeServer, InitializeAPI, InitializeCoordinator, InitializeCache, InitializeStorage, InitializeHub)
+	wire.Build(InitializeComponentManager, InitializeServer, InitializeAPI, InitializeCoordinator, InitializeTracer, InitializeCache, InitializeStorage, InitializeHub)
 	return &service.ComponentManager{}, nil
 }
@@ -25,7 +25,11 @@ func Coordinator(ctx context.Context, config *service.Config) (service.Coordinat
 	if err != nil {
 		return nil, err
 	}
-	coordinatorService, err := InitializeCoordinator(ctx, hubConnector, storageService, cacheService)
+	tracer, err := InitializeTracer(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	coordinatorService, err := InitializeCoordinator(ctx, config, hubConnector, storageService, cacheService, tracer)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +49,11 @@ func ComponentManagerWithCoordinator(ctx context.Context, config *service.Config
 	if err != nil {
 		return nil, err
 	}
-	coordinatorService, err := InitializeCoordinator(ctx, hubConnector, storageService, cacheService)
+	tracer, err := InitializeTracer(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	coordinatorService, err := InitializeCoordinator(ctx, config, hubConnector, storageService, cacheService, tracer)
 	if err != nil {
 		return nil, err
 	}
@@ -53,11 +61,11 @@ func ComponentManagerWithCoordinator(ctx context.Context, config *service.Config
 	if err != nil {
 		return nil, err
 	}
-	server, err := InitializeServer(ctx, config, mux, cacheService, coordinatorService)
+	server, err := InitializeServer(ctx, config, mux, cacheService, storageService, coordinatorService)
 	if err != nil {
 		return nil, err
 	}
-	componentManager, err := InitializeComponentManager(ctx, coordinatorService, server)
+	componentManager, err := InitializeComponentManager(ctx, coordinatorService, server, tracer, cacheService)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,613 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker is an in-memory stand-in of an AMQP broker with a single topic
+// exchange, whose bindings match routing keys exactly. Its queues outlive the
+// connections to it.
+type fakeBroker struct {
+	mutex    sync.Mutex
+	queues   map[string]*fakeQueue
+	bindings map[string][]string
+	conns    []*fakeConnection
+	dials    int
+	// nacks is the number of publishes the broker rejects next.
+	nacks int
+}
+
+type fakeQueue struct {
+	msgs      []amqp.Delivery
+	consumers []*fakeConsumer
+}
+
+type fakeConsumer struct {
+	ch         *fakeChannel
+	queue      string
+	tag        string
+	deliveries chan amqp.Delivery
+}
+
+// fakeDelivery is a delivery that wasn't acknowledged yet.
+type fakeDelivery struct {
+	queue string
+	amqp.Delivery
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues:   make(map[string]*fakeQueue),
+		bindings: make(map[string][]string),
+	}
+}
+
+func (broker *fakeBroker) dial(url string) (amqpConnection, error) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	broker.dials++
+	conn := &fakeConnection{broker: broker}
+	broker.conns = append(broker.conns, conn)
+	return conn, nil
+}
+
+func (broker *fakeBroker) dialCount() int {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	return broker.dials
+}
+
+// drop closes every connection as if the broker went away.
+func (broker *fakeBroker) drop() {
+	broker.mutex.Lock()
+	conns := broker.conns
+	broker.conns = nil
+	broker.mutex.Unlock()
+	for _, conn := range conns {
+		conn.close(amqp.ErrClosed)
+	}
+}
+
+// route queues a message published to the exchange with the routing key.
+func (broker *fakeBroker) route(key string, body []byte) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	for _, name := range broker.bindings[key] {
+		if queue, ok := broker.queues[name]; ok {
+			queue.msgs = append(queue.msgs, amqp.Delivery{RoutingKey: key, Body: body})
+			broker.dispatch(queue)
+		}
+	}
+}
+
+// dispatch hands the queue's messages to its first consumer. The broker's
+// mutex must be held.
+func (broker *fakeBroker) dispatch(queue *fakeQueue) {
+	for len(queue.msgs) > 0 && len(queue.consumers) > 0 {
+		consumer := queue.consumers[0]
+		d := queue.msgs[0]
+		queue.msgs = queue.msgs[1:]
+		d.Acknowledger = consumer.ch
+		d.ConsumerTag = consumer.tag
+		d.DeliveryTag = consumer.ch.track(consumer.queue, d)
+		consumer.deliveries <- d
+	}
+}
+
+func (broker *fakeBroker) queued(name string) int {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if queue, ok := broker.queues[name]; ok {
+		return len(queue.msgs)
+	}
+
+	return -1
+}
+
+// requeue puts a delivery back at the head of its queue. The broker's mutex
+// must be held.
+func (broker *fakeBroker) requeue(d fakeDelivery) {
+	if queue, ok := broker.queues[d.queue]; ok {
+		d.Redelivered = true
+		queue.msgs = append([]amqp.Delivery{d.Delivery}, queue.msgs...)
+		broker.dispatch(queue)
+	}
+}
+
+type fakeConnection struct {
+	broker   *fakeBroker
+	mutex    sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (conn *fakeConnection) Channel() (amqpChannel, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &fakeChannel{broker: conn.broker, unacked: make(map[uint64]fakeDelivery)}
+	conn.channels = append(conn.channels, ch)
+	return ch, nil
+}
+
+func (conn *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.notify = append(conn.notify, receiver)
+	return receiver
+}
+
+func (conn *fakeConnection) Close() error {
+	conn.close(nil)
+	return nil
+}
+
+func (conn *fakeConnection) close(err *amqp.Error) {
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.mutex.Unlock()
+		return
+	}
+
+	conn.closed = true
+	notify := conn.notify
+	channels := conn.channels
+	conn.mutex.Unlock()
+	for _, ch := range channels {
+		ch.close(err)
+	}
+
+	for _, receiver := range notify {
+		if err != nil {
+			receiver <- err
+		}
+
+		close(receiver)
+	}
+}
+
+type fakeChannel struct {
+	broker   *fakeBroker
+	mutex    sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	confirms []chan amqp.Confirmation
+	tag      uint64
+	unacked  map[uint64]fakeDelivery
+	// published counts the publishes that are confirmed.
+	published uint64
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+	queue, ok := ch.broker.queues[name]
+	if !ok {
+		queue = &fakeQueue{}
+		ch.broker.queues[name] = queue
+	}
+
+	return amqp.Queue{Name: name, Messages: len(queue.msgs)}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+	for _, bound := range ch.broker.bindings[key] {
+		if bound == name {
+			return nil
+		}
+	}
+
+	ch.broker.bindings[key] = append(ch.broker.bindings[key], name)
+	return nil
+}
+
+func (ch *fakeChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+	queue, ok := ch.broker.queues[name]
+	if !ok {
+		return 0, nil
+	}
+
+	delete(ch.broker.queues, name)
+	return len(queue.msgs), nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if ch.isClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+	q, ok := ch.broker.queues[queue]
+	if !ok {
+		return nil, errors.New("no queue " + queue)
+	}
+
+	c := &fakeConsumer{ch: ch, queue: queue, tag: consumer, deliveries: make(chan amqp.Delivery, 64)}
+	q.consumers = append(q.consumers, c)
+	ch.broker.dispatch(q)
+	return c.deliveries, nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	if ch.isClosed() {
+		return amqp.ErrClosed
+	}
+
+	ch.broker.mutex.Lock()
+	defer ch.broker.mutex.Unlock()
+	ch.removeConsumers(func(c *fakeConsumer) bool { return c.tag == consumer })
+	return nil
+}
+
+// removeConsumers stops the channel's consumers that match. The broker's
+// mutex must be held.
+func (ch *fakeChannel) removeConsumers(match func(c *fakeConsumer) bool) {
+	for _, queue := range ch.broker.queues {
+		kept := queue.consumers[:0]
+		for _, c := range queue.consumers {
+			if c.ch == ch && match(c) {
+				close(c.deliveries)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+
+		queue.consumers = kept
+	}
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if ch.isClosed() {
+		return amqp.ErrClosed
+	}
+
+	ch.broker.mutex.Lock()
+	ack := ch.broker.nacks == 0
+	if !ack {
+		ch.broker.nacks--
+	}
+
+	ch.broker.mutex.Unlock()
+	if ack {
+		ch.broker.route(key, msg.Body)
+	}
+
+	ch.mutex.Lock()
+	ch.published++
+	confirmation := amqp.Confirmation{DeliveryTag: ch.published, Ack: ack}
+	confirms := ch.confirms
+	ch.mutex.Unlock()
+	for _, confirm := range confirms {
+		confirm <- confirmation
+	}
+
+	return nil
+}
+
+func (ch *fakeChannel) isClosed() bool {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return ch.closed
+}
+
+// track keeps a delivery until it's acknowledged and returns its tag.
+func (ch *fakeChannel) track(queue string, d amqp.Delivery) uint64 {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.tag++
+	ch.unacked[ch.tag] = fakeDelivery{queue: queue, Delivery: d}
+	return ch.tag
+}
+
+// pending is the number of deliveries that weren't acknowledged.
+func (ch *fakeChannel) pending() int {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return len(ch.unacked)
+}
+
+func (ch *fakeChannel) settle(tag uint64) (fakeDelivery, error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.closed {
+		return fakeDelivery{}, amqp.ErrClosed
+	}
+
+	d, ok := ch.unacked[tag]
+	if !ok {
+		return d, errors.New("unknown delivery tag")
+	}
+
+	delete(ch.unacked, tag)
+	return d, nil
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	_, err := ch.settle(tag)
+	return err
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	d, err := ch.settle(tag)
+	if err == nil && requeue {
+		ch.broker.mutex.Lock()
+		ch.broker.requeue(d)
+		ch.broker.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// close stops the channel's consumers and requeues what they didn't
+// acknowledge.
+func (ch *fakeChannel) close(err *amqp.Error) {
+	ch.mutex.Lock()
+	if ch.closed {
+		ch.mutex.Unlock()
+		return
+	}
+
+	ch.closed = true
+	unacked := ch.unacked
+	ch.unacked = make(map[uint64]fakeDelivery)
+	notify := ch.notify
+	confirms := ch.confirms
+	ch.mutex.Unlock()
+	ch.broker.mutex.Lock()
+	ch.removeConsumers(func(c *fakeConsumer) bool { return true })
+	for _, d := range unacked {
+		ch.broker.requeue(d)
+	}
+
+	ch.broker.mutex.Unlock()
+	for _, receiver := range notify {
+		if err != nil {
+			receiver <- err
+		}
+
+		close(receiver)
+	}
+
+	for _, confirm := range confirms {
+		close(confirm)
+	}
+}
+
+func newTestAmqpHub(t *testing.T, broker *fakeBroker) *AmqpHub {
+	hub, err := newAmqpHub(AmqpConfig{}, broker.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hub
+}
+
+func TestAmqpPublishConfirms(t *testing.T) {
+	broker := newFakeBroker()
+	hub := newTestAmqpHub(t, broker)
+	defer hub.Close()
+	broker.nacks = 1
+	if err := hub.PubRaw("checkout.start", []byte("rejected")); err == nil {
+		t.Fatal("expected the rejected message to fail")
+	}
+
+	if err := hub.PubRaw("checkout.start", []byte("trigger")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := broker.queued("checkout.start"); n != 1 {
+		t.Fatalf("expected the confirmed message to be queued, got %d messages", n)
+	}
+}
+
+func TestAmqpRequeue(t *testing.T) {
+	broker := newFakeBroker()
+	hub := newTestAmqpHub(t, broker)
+	defer hub.Close()
+	attempts := make(chan bool, 2)
+	failed := false
+	err := hub.SubGroup("r1", RawGroup{
+		"checkout.start": func(data []byte) error {
+			if !failed {
+				failed = true
+				attempts <- false
+				return errors.New("not now")
+			}
+
+			attempts <- true
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hub.PubRaw("checkout.start", []byte("trigger")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{false, true} {
+		select {
+		case handled := <-attempts:
+			if handled != want {
+				t.Fatalf("attempt %d: expected handled %v", i+1, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d didn't happen", i+1)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for broker.queued("checkout.start") != 0 || hub.consumeCh.(*fakeChannel).pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the handled trigger to be acknowledged")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAmqpReplyRouting(t *testing.T) {
+	broker := newFakeBroker()
+	hub := newTestAmqpHub(t, broker)
+	defer hub.Close()
+	outcomes := make(chan string, 2)
+	finalized := make(chan struct{}, 1)
+	handler := func(topic string) func(reply *protocol.Reply) error {
+		return func(reply *protocol.Reply) error {
+			outcomes <- topic
+			return nil
+		}
+	}
+
+	err := hub.SubReply("q1", func() { finalized <- struct{}{} }, ReplyGroup{
+		"sake.reply.ok.t1@pay":   handler("ok"),
+		"sake.reply.fail.t1@pay": handler("fail"),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a participant replies through the exchange by the failure topic
+	data, err := MarshalReply(&protocol.Reply{RequestID: "q1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.route("sake.reply.fail.t1@pay", data)
+	select {
+	case <-finalized:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply wasn't handled")
+	}
+
+	if topic := <-outcomes; topic != "fail" {
+		t.Fatalf("expected the failure handler, got %s", topic)
+	}
+
+	if err := hub.CancelGroup("q1"); err != nil {
+		t.Fatal(err)
+	} else if n := broker.queued("sake-reply-q1"); n != -1 {
+		t.Fatal("expected the reply queue to be deleted with its group")
+	}
+}
+
+func TestAmqpReconnect(t *testing.T) {
+	broker := newFakeBroker()
+	hub := newTestAmqpHub(t, broker)
+	defer hub.Close()
+	triggers := make(chan string, 2)
+	finalized := make(chan struct{}, 1)
+	err := hub.SubGroup("r1", RawGroup{
+		"checkout.start": func(data []byte) error {
+			triggers <- string(data)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hub.SubReply("q1", func() { finalized <- struct{}{} }, ReplyGroup{
+		"sake.reply.ok.t1@pay": func(reply *protocol.Reply) error { return nil },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.drop()
+	if err := hub.PubRaw("checkout.start", []byte("lost")); err == nil {
+		t.Fatal("expected publishing to fail while disconnected")
+	}
+
+	// the reply queue keeps replies while the engine reconnects
+	data, err := MarshalReply(&protocol.Reply{RequestID: "q1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.route("sake.reply.ok.t1@pay", data)
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.dialCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("hub didn't reconnect")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-finalized:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply queued while disconnected wasn't handled")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if err := hub.PubRaw("checkout.start", []byte("trigger")); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("publishing still fails after reconnecting: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case data := <-triggers:
+		if data != "trigger" {
+			t.Fatalf("expected the trigger, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("trigger consumer wasn't resumed")
+	}
+}
@@ -2,9 +2,12 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
 	"github.com/danielkrainas/sake/pkg/util/log"
 	memdb "github.com/hashicorp/go-memdb"
+	"go.uber.org/zap"
 )
 
 type CacheService interface {
@@ -18,41 +21,109 @@ type CacheService interface {
 	FilterRecipes(ctx context.Context, predicate func(recipe *Recipe) (bool, error)) ([]*Recipe, error)
 }
 
+// WriteThruCache persists the changes made to its cache. Without a Writer,
+// changes are written to storage before they're acknowledged.
 type WriteThruCache struct {
 	CacheService
 	Storage StorageService
+	// SnapshotInterval is the number of journaled events between transaction
+	// snapshots when the storage keeps an event journal. Every change is
+	// snapshotted when it's zero.
+	SnapshotInterval int
+	// Writer persists changes in the background.
+	Writer *WriteBehind
 }
 
 var _ CacheService = &WriteThruCache{}
+var _ HealthChecker = &WriteThruCache{}
+
+const (
+	writeSaveRecipe      = "save_recipe"
+	writeRemoveRecipe    = "remove_recipe"
+	writeSaveTransaction = "save_transaction"
+)
 
 func (thru *WriteThruCache) RemoveRecipe(ctx context.Context, recipe *Recipe) error {
-	go func(recipe *Recipe) {
-		if err := thru.Storage.RemoveRecipe(ctx, recipe); err != nil {
-			//
-		}
-	}(recipe)
+	if err := thru.CacheService.RemoveRecipe(ctx, recipe); err != nil {
+		return err
+	}
 
-	return thru.CacheService.RemoveRecipe(ctx, recipe)
+	return thru.persist(ctx, "recipe/"+recipe.ID, writeRemoveRecipe, func(ctx context.Context) error {
+		return thru.Storage.RemoveRecipe(ctx, recipe)
+	}, RecipeField(recipe))
 }
 
 func (thru *WriteThruCache) PutTransaction(ctx context.Context, trx *Transaction) error {
-	go func(trx *Transaction) {
-		if err := thru.Storage.SaveTransaction(ctx, trx); err != nil {
-			//
+	if err := thru.CacheService.PutTransaction(ctx, trx); err != nil {
+		return err
+	}
+
+	if !thru.snapshotDue(trx) {
+		return nil
+	}
+
+	trx.snapshotSeq = trx.Seq
+	snapshot := trx
+	if thru.Writer != nil {
+		// the transaction keeps changing while the write is queued.
+		var err error
+		if snapshot, err = trx.snapshot(); err != nil {
+			return fmt.Errorf("snapshot transaction failed: %v", err)
 		}
-	}(trx)
+	}
+
+	return thru.persist(ctx, "transaction/"+trx.ID, writeSaveTransaction, func(ctx context.Context) error {
+		return thru.Storage.SaveTransaction(ctx, snapshot)
+	}, TransactionFields(trx)...)
+}
+
+// snapshotDue reports whether a transaction should be written to storage.
+// The first snapshot and those of transactions that aren't in progress are
+// always written, so that every transaction can be found in storage.
+func (thru *WriteThruCache) snapshotDue(trx *Transaction) bool {
+	if _, ok := thru.Storage.(EventJournal); !ok || thru.SnapshotInterval < 1 || !trx.IsInProgress() || trx.snapshotSeq == 0 {
+		return true
+	}
 
-	return thru.CacheService.PutTransaction(ctx, trx)
+	return trx.Seq-trx.snapshotSeq >= int64(thru.SnapshotInterval)
 }
 
 func (thru *WriteThruCache) PutRecipe(ctx context.Context, recipe *Recipe) error {
-	go func(recipe *Recipe) {
-		if err := thru.Storage.SaveRecipe(ctx, recipe); err != nil {
-			//
-		}
-	}(recipe)
+	if err := thru.CacheService.PutRecipe(ctx, recipe); err != nil {
+		return err
+	}
+
+	return thru.persist(ctx, "recipe/"+recipe.ID, writeSaveRecipe, func(ctx context.Context) error {
+		return thru.Storage.SaveRecipe(ctx, recipe)
+	}, RecipeField(recipe))
+}
 
-	return thru.CacheService.PutRecipe(ctx, recipe)
+// persist writes a change to storage, through the Writer when there is one.
+// Writes of the same key are made in order.
+func (thru *WriteThruCache) persist(ctx context.Context, key string, op string, write func(ctx context.Context) error, fields ...zap.Field) error {
+	if thru.Writer != nil {
+		return thru.Writer.Write(key, op, write, fields...)
+	}
+
+	err := observeWrite(op, func() error {
+		return write(ctx)
+	})
+
+	if err != nil {
+		log.Error("storage write failed", log.CombineAll([]zap.Field{zap.String("operation", op), zap.Error(err)}, fields)...)
+		return fmt.Errorf("storage write failed: %v", err)
+	}
+
+	return nil
+}
+
+// CheckHealth reports whether storage keeps up with the cache's changes.
+func (thru *WriteThruCache) CheckHealth() error {
+	if thru.Writer == nil {
+		return nil
+	}
+
+	return thru.Writer.CheckHealth()
 }
 
 type InMemoryCache struct {
@@ -231,3 +302,19 @@ func (cache *InMemoryCache) FilterRecipes(ctx context.Context, predicate func(re
 
 	return result, nil
 }
+
+// snapshot copies the stored state of a transaction. The transaction must be
+// locked.
+func (trx *Transaction) snapshot() (*Transaction, error) {
+	data, err := json.Marshal(trx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Transaction{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
@@ -16,6 +16,11 @@ type Component interface {
 	Run(ctx ComponentRunContext) error
 }
 
+// HealthChecker is implemented by services that can report being degraded.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
 func ComponentField(c Component) zap.Field {
 	return zap.String("component", c.ComponentName())
 }
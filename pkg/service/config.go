@@ -23,6 +23,8 @@ type Config struct {
 		Addr string `yaml:"addr" toml:"addr" env:"SAKE_HTTP_ADDR"`
 	} `yaml:"http" toml:"http"`
 
+	Operators []OperatorConfig `yaml:"operators" toml:"operators"`
+
 	Nats struct {
 		ClusterID   string `yaml:"cluster" toml:"cluster" env:"SAKE_NATS_CLUSTER"`
 		Server      string `yaml:"server" toml:"server" env:"SAKE_NATS_SERVER"`
@@ -30,8 +32,93 @@ type Config struct {
 		DurableName string `yaml:"durable_name" toml:"durable_name" env:"SAKE_NATS_DURABLE_NAME"`
 	} `yaml:"nats" toml:"nats"`
 
+	JetStream struct {
+		Server     string   `yaml:"server" toml:"server" env:"SAKE_JETSTREAM_SERVER"`
+		Stream     string   `yaml:"stream" toml:"stream" env:"SAKE_JETSTREAM_STREAM"`
+		Subjects   []string `yaml:"subjects" toml:"subjects"`
+		Durable    string   `yaml:"durable_name" toml:"durable_name" env:"SAKE_JETSTREAM_DURABLE_NAME"`
+		Instance   string   `yaml:"instance" toml:"instance" env:"SAKE_JETSTREAM_INSTANCE"`
+		AckWait    string   `yaml:"ack_wait" toml:"ack_wait" env:"SAKE_JETSTREAM_ACK_WAIT"`
+		MaxDeliver int      `yaml:"max_deliver" toml:"max_deliver" env:"SAKE_JETSTREAM_MAX_DELIVER"`
+	} `yaml:"jetstream" toml:"jetstream"`
+
+	Kafka struct {
+		Brokers    []string `yaml:"brokers" toml:"brokers"`
+		GroupID    string   `yaml:"group_id" toml:"group_id" env:"SAKE_KAFKA_GROUP_ID"`
+		Instance   string   `yaml:"instance" toml:"instance" env:"SAKE_KAFKA_INSTANCE"`
+		ReplyTopic string   `yaml:"reply_topic" toml:"reply_topic" env:"SAKE_KAFKA_REPLY_TOPIC"`
+	} `yaml:"kafka" toml:"kafka"`
+
+	Amqp struct {
+		URL      string `yaml:"url" toml:"url" env:"SAKE_AMQP_URL"`
+		Exchange string `yaml:"exchange" toml:"exchange" env:"SAKE_AMQP_EXCHANGE"`
+	} `yaml:"amqp" toml:"amqp"`
+
+	Redis struct {
+		Addr        string `yaml:"addr" toml:"addr" env:"SAKE_REDIS_ADDR"`
+		Password    string `yaml:"password" toml:"password" env:"SAKE_REDIS_PASSWORD"`
+		DB          int    `yaml:"db" toml:"db" env:"SAKE_REDIS_DB"`
+		Group       string `yaml:"group" toml:"group" env:"SAKE_REDIS_GROUP"`
+		Consumer    string `yaml:"consumer" toml:"consumer" env:"SAKE_REDIS_CONSUMER"`
+		ReplyStream string `yaml:"reply_stream" toml:"reply_stream" env:"SAKE_REDIS_REPLY_STREAM"`
+		MaxLen      int64  `yaml:"max_len" toml:"max_len" env:"SAKE_REDIS_MAX_LEN"`
+		ClaimIdle   string `yaml:"claim_idle" toml:"claim_idle" env:"SAKE_REDIS_CLAIM_IDLE"`
+	} `yaml:"redis" toml:"redis"`
+
+	Webhooks struct {
+		Secret      string `yaml:"secret" toml:"secret" env:"SAKE_WEBHOOKS_SECRET"`
+		CallbackURL string `yaml:"callback_url" toml:"callback_url" env:"SAKE_WEBHOOKS_CALLBACK_URL"`
+		Timeout     string `yaml:"timeout" toml:"timeout" env:"SAKE_WEBHOOKS_TIMEOUT"`
+	} `yaml:"webhooks" toml:"webhooks"`
+
+	File struct {
+		Path      string `yaml:"path" toml:"path" env:"SAKE_FILE_PATH"`
+		Fsync     string `yaml:"fsync" toml:"fsync" env:"SAKE_FILE_FSYNC"`
+		Retention string `yaml:"retention" toml:"retention" env:"SAKE_FILE_RETENTION"`
+	} `yaml:"file" toml:"file"`
+
+	SQL struct {
+		Driver      string `yaml:"driver" toml:"driver" env:"SAKE_SQL_DRIVER"`
+		DSN         string `yaml:"dsn" toml:"dsn" env:"SAKE_SQL_DSN"`
+		AutoMigrate bool   `yaml:"auto_migrate" toml:"auto_migrate" env:"SAKE_SQL_AUTO_MIGRATE"`
+	} `yaml:"sql" toml:"sql"`
+
+	Journal struct {
+		SnapshotInterval int `yaml:"snapshot_interval" toml:"snapshot_interval" env:"SAKE_JOURNAL_SNAPSHOT_INTERVAL"`
+	} `yaml:"journal" toml:"journal"`
+
+	Writes struct {
+		Mode         string `yaml:"mode" toml:"mode" env:"SAKE_WRITES_MODE"`
+		QueueSize    int    `yaml:"queue_size" toml:"queue_size" env:"SAKE_WRITES_QUEUE_SIZE"`
+		Workers      int    `yaml:"workers" toml:"workers" env:"SAKE_WRITES_WORKERS"`
+		MaxRetries   int    `yaml:"max_retries" toml:"max_retries" env:"SAKE_WRITES_MAX_RETRIES"`
+		RetryBackoff string `yaml:"retry_backoff" toml:"retry_backoff" env:"SAKE_WRITES_RETRY_BACKOFF"`
+		MaxBackoff   string `yaml:"max_backoff" toml:"max_backoff" env:"SAKE_WRITES_MAX_BACKOFF"`
+		LagThreshold string `yaml:"lag_threshold" toml:"lag_threshold" env:"SAKE_WRITES_LAG_THRESHOLD"`
+	} `yaml:"writes" toml:"writes"`
+
+	Dedup struct {
+		Window string `yaml:"window" toml:"window" env:"SAKE_DEDUP_WINDOW"`
+	} `yaml:"dedup" toml:"dedup"`
+
+	Tracing struct {
+		Exporter    string            `yaml:"exporter" toml:"exporter" env:"SAKE_TRACING_EXPORTER"`
+		Path        string            `yaml:"path" toml:"path" env:"SAKE_TRACING_PATH"`
+		Endpoint    string            `yaml:"endpoint" toml:"endpoint" env:"SAKE_TRACING_ENDPOINT"`
+		Headers     map[string]string `yaml:"headers" toml:"headers"`
+		ServiceName string            `yaml:"service_name" toml:"service_name" env:"SAKE_TRACING_SERVICE_NAME"`
+	} `yaml:"tracing" toml:"tracing"`
+
 	StorageDriver string `yaml:"storage" toml:"storage" env:"SAKE_STORAGE"`
 	HubProvider   string `yaml:"hub" toml:"hub" env:"SAKE_HUB"`
+	AlertTopic    string `yaml:"alert_topic" toml:"alert_topic" env:"SAKE_ALERT_TOPIC"`
+}
+
+// OperatorConfig grants a named operator access to the operator actions of the
+// API with a bearer token.
+type OperatorConfig struct {
+	Name  string `yaml:"name" toml:"name"`
+	Token string `yaml:"token" toml:"token"`
 }
 
 func DefaultConfig() *Config {
@@ -41,6 +128,12 @@ func DefaultConfig() *Config {
 	config.Log.Formatter = "text"
 	config.StorageDriver = ""
 	config.HubProvider = "in-memory"
+	config.AlertTopic = "sake.alerts"
+	config.File.Fsync = FsyncAlways
+	config.File.Retention = DefaultFileRetention.String()
+	config.Dedup.Window = DefaultDedupWindow.String()
+	config.Writes.Mode = WriteModeAsync
+	config.Tracing.ServiceName = "sake"
 
 	return config
 }
@@ -66,7 +159,6 @@ func ResolveConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("error parsing %s: %v", configPath, err)
 	}
 
-	fmt.Fprintf(os.Stderr, "%+v\n====\n", config)
 	return config, nil
 }
 
@@ -2,9 +2,11 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/danielkrainas/gobag/util/token"
 	"github.com/danielkrainas/gobag/util/uid"
@@ -20,22 +22,84 @@ type CoordinatorService interface {
 	UpdateExpired() error
 	ClearInactive() error
 	UnloadRecipe(name string) (bool, error)
+	RecipeVersions(name string) ([]*Recipe, error)
+	RecipeVersion(name string, version int) (*Recipe, error)
+	Rollback(name string, version int) (*Recipe, error)
+	AnalyzeRecipe(recipe *Recipe) (*RecipeReport, error)
+	Abort(id string, op Operation) (*Transaction, error)
+	RetryStage(id string, op Operation) (*Transaction, error)
+	ResolveStage(id string, success bool, data []byte, op Operation) (*Transaction, error)
+	Resume(id string, op Operation) (*Transaction, error)
+	Start(recipeName string, data []byte, idempotencyKey string, mc *MessageContext) (*Transaction, bool, error)
+	Await(ctx context.Context, trx *Transaction) error
+	DeliverReply(topic string, signature string, contentType string, body []byte) error
+}
+
+type CoordinatorConfig struct {
+	// AlertTopic receives an Alert for every transaction that needs operator
+	// attention. Alerts are only logged when it's empty.
+	AlertTopic string
+	// DedupWindow is how long a deduplication key is held by the transaction
+	// it started, unless the recipe sets its own window.
+	DedupWindow time.Duration
+}
+
+const AlertCompensationFailed = "compensation_failed"
+
+type Alert struct {
+	Type          string    `json:"type"`
+	TransactionID string    `json:"transaction_id"`
+	Recipe        string    `json:"recipe"`
+	Stage         string    `json:"stage"`
+	Reason        string    `json:"reason"`
+	Time          time.Time `json:"time"`
 }
 
 type Coordinator struct {
-	Hub            HubConnector
-	Context        context.Context
-	Cache          CacheService
+	Hub     HubConnector
+	Context context.Context
+	Cache   CacheService
+	Config  CoordinatorConfig
+	Journal EventJournal
+	Storage StorageService
+	// Tracer reports the spans of transactions. Tracing is off when it's
+	// nil.
+	Tracer *Tracer
+	// Webhooks posts the requests of stages with an endpoint. Such stages
+	// can't be dispatched when it's nil.
+	Webhooks       *WebhookTransport
 	readyWaitGroup sync.WaitGroup
+
+	// registerMutex serializes registrations, so that every version of a
+	// recipe gets its own number.
+	registerMutex sync.Mutex
+
+	startMutex sync.Mutex
+	starting   map[string]*Transaction
+	waitMutex  sync.Mutex
+	waiters    map[string][]chan struct{}
+	replyStats ReplyStats
+	awaitMutex sync.Mutex
+	awaits     map[string]*awaitSpan
 }
 
 var _ CoordinatorService = &Coordinator{}
 
-func NewCoordinator(ctx context.Context, hub HubConnector, cache CacheService, storage StorageService) (*Coordinator, error) {
+func NewCoordinator(ctx context.Context, hub HubConnector, cache CacheService, storage StorageService, config CoordinatorConfig) (*Coordinator, error) {
 	c := &Coordinator{
 		Hub:     hub,
 		Context: ctx,
 		Cache:   cache,
+		Config:  config,
+		Storage: storage,
+
+		starting: make(map[string]*Transaction),
+		waiters:  make(map[string][]chan struct{}),
+		awaits:   make(map[string]*awaitSpan),
+	}
+
+	if journal, ok := storage.(EventJournal); ok {
+		c.Journal = journal
 	}
 
 	c.readyWaitGroup.Add(1)
@@ -59,6 +123,18 @@ func NewCoordinator(ctx context.Context, hub HubConnector, cache CacheService, s
 
 	log.Info("active transactions restored", zap.Int("count", len(activeTransactions)))
 	for _, trx := range activeTransactions {
+		if trx.Recipe == nil {
+			recipe, err := c.findRecipe(trx.RecipeID, trx.RecipeName)
+			if err != nil {
+				return nil, fmt.Errorf("restoring transaction %s failed: %v", trx.ID, err)
+			} else if recipe == nil {
+				log.Error("recipe for stored transaction not found, skipping", TransactionFields(trx, zap.String("recipe_id", trx.RecipeID), zap.String("recipe", trx.RecipeName))...)
+				continue
+			}
+
+			trx.Bind(recipe)
+		}
+
 		if err := c.load(trx); err != nil {
 			return nil, fmt.Errorf("restoring transaction %s failed: %v", trx.ID, err)
 		}
@@ -67,6 +143,48 @@ func NewCoordinator(ctx context.Context, hub HubConnector, cache CacheService, s
 	return c, nil
 }
 
+// findRecipe looks up the version of a recipe a stored transaction runs. A
+// retired version is registered again as draining, so that the transaction
+// completes on the version it started on. Transactions stored before recipes
+// were versioned fall back to the active recipe with the same name.
+func (c *Coordinator) findRecipe(id string, name string) (*Recipe, error) {
+	recipes, err := c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
+		return recipe.ID == id, nil
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(recipes) > 0 {
+		return recipes[0], nil
+	}
+
+	versions, err := c.Storage.LoadRecipeVersions(c.Context, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range versions {
+		if recipe.ID == id {
+			log.Info("registering retired recipe version", RecipeField(recipe), zap.Int("version", recipe.Version))
+			recipe.SetStatus(StatusDraining)
+			return recipe, c.Register(recipe)
+		}
+	}
+
+	recipes, err = c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
+		return recipe.Name == name && recipe.Status() == StatusActive, nil
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(recipes) > 0 {
+		log.Warn("recipe version of stored transaction not found, using the active version", zap.String("recipe_id", id), RecipeField(recipes[0]))
+		return recipes[0], nil
+	}
+
+	return nil, nil
+}
+
 func (c *Coordinator) ComponentName() string {
 	return "coordinator"
 }
@@ -86,6 +204,10 @@ func (c *Coordinator) shutdown() error {
 		log.Error("failed to cancel all hub subscriptions", zap.Error(err))
 	}
 
+	if c.Webhooks != nil {
+		c.Webhooks.CancelAll()
+	}
+
 	// shutdown hub
 	// clear cache
 	return nil
@@ -117,40 +239,99 @@ func (c *Coordinator) UnloadRecipe(name string) (bool, error) {
 	return found, c.Cache.PutRecipe(c.Context, recipe)
 }
 
+// Register numbers new recipes with the next version of their name and
+// activates them, draining the version they replace. Invalid new recipes, and
+// new recipes triggered by the trigger of another recipe, are rejected with a
+// RecipeReport. Stored versions are registered with the status they were
+// stored with, even when they don't pass the checks of this release, so that
+// their transactions can complete.
 func (c *Coordinator) Register(recipe *Recipe) error {
+	c.registerMutex.Lock()
+	defer c.registerMutex.Unlock()
+	if recipe.ID == "" {
+		report, err := c.AnalyzeRecipe(recipe)
+		if err != nil {
+			return err
+		} else if !report.Valid() {
+			return report
+		}
+	} else if report := recipe.Analyze(); !report.Valid() {
+		log.Warn("stored recipe is invalid, registering it anyway", RecipeField(recipe), zap.Int("version", recipe.Version), zap.Reflect("report", report))
+	}
+
+	if err := recipe.prepare(); err != nil {
+		return err
+	}
+
 	recipe.NumActiveTransactions = 0
 	if recipe.ID == "" {
 		recipe.ID = uid.Generate()
 		recipe.SetStatus(StatusActive)
 	}
 
-	upgraded, err := c.UnloadRecipe(recipe.Name)
-	if err != nil {
-		return err
+	if recipe.Version == 0 {
+		latest, err := c.latestVersion(recipe.Name)
+		if err != nil {
+			return err
+		}
+
+		recipe.Version = latest + 1
+	}
+
+	if recipe.Created.IsZero() {
+		recipe.Created = time.Now()
+	}
+
+	upgraded := false
+	if recipe.Status() == StatusActive {
+		found, err := c.UnloadRecipe(recipe.Name)
+		if err != nil {
+			return err
+		}
+
+		upgraded = found
 	}
 
 	if err := c.Cache.PutRecipe(c.Context, recipe); err != nil {
 		return err
 	}
 
-	if recipe.Status() == StatusActive {
-		err = c.Hub.SubGroup(recipe.ID, RawGroup{
-			recipe.TriggeredBy: c.createRecipeTriggerHandler(recipe),
-		})
+	if recipe.Status() != StatusActive {
+		return nil
+	}
 
-		if err == nil {
-			if upgraded {
-				log.Info("recipe upgraded", RecipeField(recipe))
-			} else {
-				log.Info("recipe registered", RecipeField(recipe))
-			}
-		}
+	err := c.Hub.SubGroup(recipe.ID, RawGroup{
+		recipe.TriggeredBy: c.createRecipeTriggerHandler(recipe),
+	})
+
+	if err != nil {
+		return err
 	}
 
-	return err
+	if upgraded {
+		log.Info("recipe upgraded", RecipeField(recipe), zap.Int("version", recipe.Version))
+	} else {
+		log.Info("recipe registered", RecipeField(recipe), zap.Int("version", recipe.Version))
+	}
+
+	return nil
 }
 
 func (c *Coordinator) ClearInactive() error {
+	if n, err := c.Storage.PurgeTriggerKeys(c.Context, time.Now()); err != nil {
+		log.Error("purging expired dedup keys failed", zap.Error(err))
+	} else if n > 0 {
+		log.Debug("expired dedup keys purged", zap.Int("count", n))
+	}
+
+	if purger, ok := c.Storage.(TransactionPurger); ok {
+		if n, err := purger.PurgeTransactions(c.Context); err != nil {
+			log.Error("purging completed transactions failed", zap.Error(err))
+		} else if n > 0 {
+			log.Debug("completed transactions purged", zap.Int("count", n))
+		}
+	}
+
 	wfs, err := c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
 		return recipe.Status() != StatusActive, nil
 	})
@@ -168,6 +349,10 @@ func (c *Coordinator) ClearInactive() error {
 			}
 		}
 
+		if recipe.Status() != StatusInactive {
+			continue
+		}
+
 		log.Debug("unloading inactive recipe", RecipeField(recipe))
 		if err := c.Cache.RemoveRecipe(c.Context, recipe); err != nil {
 			return err
@@ -179,6 +364,7 @@ func (c *Coordinator) ClearInactive() error {
 
 func (c *Coordinator) UpdateExpired() error {
 	n := 0
+	retried := 0
 	err := c.Cache.TransactAll(c.Context, func(trx *Transaction) error {
 		log.Debug("waiting on transaction lock", TransactionFields(trx)...)
 		trx.Lock()
@@ -187,9 +373,50 @@ func (c *Coordinator) UpdateExpired() error {
 			log.Debug("unlocked transaction", TransactionFields(trx)...)
 		}()
 
-		if trx.IsExpired() && trx.State == IsExecuting {
+		if trx.IsRetryDue() && trx.IsInProgress() {
+			log.Info("retrying stage", TransactionFields(trx, zap.String("stage", trx.StageKey), zap.Int("attempt", trx.Attempt))...)
+			trx.BeginRetry()
+			c.record(trx, &TransactionEvent{
+				Type:    EventRetryStarted,
+				Time:    trx.StageStarted,
+				Expires: trx.Expires,
+			})
+
+			trx.RequestID = token.Generate()
+			if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+				return fmt.Errorf("record transaction state failed: %v", err)
+			}
+
+			c.dispatchStage(trx)
+			retried++
+		} else if trx.IsExpired() && trx.IsInProgress() {
 			log.Debug("transaction expired", TransactionFields(trx)...)
-			if err := trx.Commit(false); err != nil {
+			c.traceTimeout(trx)
+			observeStage(trx, StageResultTimeout)
+			c.cancelRequests(trx)
+			c.record(trx, &TransactionEvent{
+				Type:      EventTimedOut,
+				StageKey:  trx.StageKey,
+				RequestID: trx.RequestID,
+			})
+
+			if trx.ScheduleRetry(FailureTimeout) {
+				log.Info("stage timed out, retry scheduled", TransactionFields(trx, zap.String("stage", trx.StageKey), zap.Time("retry_at", *trx.RetryAt))...)
+				c.recordRetry(trx)
+				if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+					return fmt.Errorf("record transaction state failed: %v", err)
+				}
+
+				n++
+				return nil
+			}
+
+			if trx.State == IsReverting {
+				n++
+				return c.park(trx, "compensation timed out")
+			}
+
+			if err := c.commit(trx, false); err != nil {
 				log.Error("couldn't commit expired transaction", zap.Error(err))
 				return err
 			}
@@ -205,7 +432,7 @@ func (c *Coordinator) UpdateExpired() error {
 		return nil
 	})
 
-	log.Info("expired transactions updated", zap.Int("expired", n))
+	log.Info("expired transactions updated", zap.Int("expired", n), zap.Int("retried", retried))
 	return err
 }
 
@@ -216,31 +443,70 @@ func (c *Coordinator) createRecipeTriggerHandler(recipe *Recipe) func([]byte) er
 			return fmt.Errorf("recipe %q (id=%s) is inactive", recipe.Name, recipe.ID)
 		}
 
-		atomic.AddInt32(&recipe.NumActiveTransactions, 1)
-		trx := NewTransaction(recipe, nil)
-		log.Info("start transaction", log.Combine(RecipeField(recipe), TransactionFields(trx)...)...)
-		trx.Lock()
-		defer trx.Unlock()
-		if err := c.transition(trx); err != nil {
-			log.Error("transition failed", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
-			return fmt.Errorf("failed to transition transaction: %v", err)
+		payload, mc, err := recipe.DecodeTrigger(data)
+		if err != nil {
+			log.Warn("trigger rejected", RecipeField(recipe), zap.Error(err))
+			return c.deadLetter(recipe, data)
 		}
 
+		key, err := recipe.DedupKey(data)
+		if err != nil {
+			log.Warn("trigger rejected", RecipeField(recipe), zap.Error(err))
+			return c.deadLetter(recipe, data)
+		}
+
+		trx, created, err := c.start(recipe, payload, key, mc)
+		if err == nil && !created {
+			log.Info("duplicate trigger ignored", TransactionFields(trx, zap.String("dedup_key", key))...)
+		}
+
+		return err
+	}
+}
+
+func (c *Coordinator) deadLetter(recipe *Recipe, data []byte) error {
+	if recipe.DeadLetterTopic == "" {
+		log.Warn("no dead-letter topic configured, dropping trigger", RecipeField(recipe))
 		return nil
 	}
+
+	if err := c.Hub.PubRaw(recipe.DeadLetterTopic, data); err != nil {
+		log.Error("dead-letter publish failed", RecipeField(recipe), zap.String("topic", recipe.DeadLetterTopic), zap.Error(err))
+		return fmt.Errorf("failed to dead-letter trigger: %v", err)
+	}
+
+	log.Info("trigger dead-lettered", RecipeField(recipe), zap.String("topic", recipe.DeadLetterTopic))
+	return nil
 }
 
-func (c *Coordinator) createTransactionSuccessHandler(trx *Transaction) func(*protocol.Reply) error {
+func (c *Coordinator) createTransactionSuccessHandler(trx *Transaction, reqID string) func(*protocol.Reply) error {
 	return func(reply *protocol.Reply) error {
 		log.Info("stage success", TransactionFields(trx)...)
 		trx.Lock()
 		defer trx.Unlock()
+		if !c.acceptReply(trx, nil, reqID, reply) {
+			return ErrReplyDiscarded
+		}
+
+		trx.RepliedRequestID = reqID
+		c.traceReply(trx, reqID, nil)
+		observeStage(trx, StageResultSuccess)
 		if reply.NewData != nil {
 			log.Info("updating transaction data", TransactionFields(trx)...)
 			trx.Data = reply.NewData
 		}
 
-		if err := trx.Commit(true); err != nil {
+		trx.SetOutcome(reply.Outcome)
+		c.record(trx, &TransactionEvent{
+			Type:      EventReplied,
+			RequestID: trx.RequestID,
+			Success:   true,
+			Outcome:   reply.Outcome,
+			Data:      reply.NewData,
+			Metadata:  trx.mergeMetadata(reply.Metadata),
+		})
+
+		if err := c.commit(trx, true); err != nil {
 			log.Error("commit failed", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
 			return fmt.Errorf("failed to commit reply: %v", err)
 		}
@@ -254,12 +520,45 @@ func (c *Coordinator) createTransactionSuccessHandler(trx *Transaction) func(*pr
 	}
 }
 
-func (c *Coordinator) createTransactionFailureHandler(trx *Transaction) func(*protocol.Reply) error {
+func (c *Coordinator) createTransactionFailureHandler(trx *Transaction, reqID string) func(*protocol.Reply) error {
 	return func(reply *protocol.Reply) error {
 		log.Info("stage failed", TransactionFields(trx)...)
 		trx.Lock()
 		defer trx.Unlock()
-		if err := trx.Commit(false); err != nil {
+		if !c.acceptReply(trx, nil, reqID, reply) {
+			return ErrReplyDiscarded
+		}
+
+		trx.RepliedRequestID = reqID
+		failure := newStageFailure(trx, nil, reqID, reply)
+		trx.Failures = append(trx.Failures, failure)
+		c.traceReply(trx, reqID, failure)
+		observeStage(trx, StageResultFailure)
+		c.record(trx, &TransactionEvent{
+			Type:      EventReplied,
+			RequestID: trx.RequestID,
+			Failure:   failure,
+			Metadata:  trx.mergeMetadata(reply.Metadata),
+		})
+
+		log.Info("stage failure reported", TransactionFields(trx, failureFields(failure)...)...)
+		if trx.ScheduleRetry(FailureClass(reply)) {
+			log.Info("retry scheduled", TransactionFields(trx, zap.String("stage", trx.StageKey), zap.Time("retry_at", *trx.RetryAt))...)
+			c.recordRetry(trx)
+			return c.Cache.PutTransaction(c.Context, trx)
+		}
+
+		if trx.State == IsReverting {
+			return c.park(trx, failureReason("compensation failed", failure))
+		}
+
+		success := false
+		if trx.RouteFailure(failure.Code) {
+			log.Info("failure routed", TransactionFields(trx, zap.String("error_code", failure.Code))...)
+			success = true
+		}
+
+		if err := c.commit(trx, success); err != nil {
 			log.Error("commit failed", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
 			return fmt.Errorf("failed to commit reply: %v", err)
 		}
@@ -273,10 +572,206 @@ func (c *Coordinator) createTransactionFailureHandler(trx *Transaction) func(*pr
 	}
 }
 
+func (c *Coordinator) createBranchReplyHandler(trx *Transaction, branch *ActiveBranch, success bool) func(*protocol.Reply) error {
+	reqID := branch.RequestID
+	return func(reply *protocol.Reply) error {
+		fields := TransactionFields(trx, zap.String("branch", branch.Key), zap.Bool("success", success))
+		log.Info("branch reply", fields...)
+		trx.Lock()
+		defer trx.Unlock()
+		if !c.acceptReply(trx, branch, reqID, reply) {
+			return ErrReplyDiscarded
+		}
+
+		event := &TransactionEvent{
+			Type:      EventReplied,
+			RequestID: branch.RequestID,
+			Branch:    branch.Key,
+			Success:   success,
+			Metadata:  trx.mergeMetadata(reply.Metadata),
+		}
+
+		var failure *StageFailure
+		if !success {
+			failure = newStageFailure(trx, branch, reqID, reply)
+			trx.Failures = append(trx.Failures, failure)
+			event.Failure = failure
+			log.Info("branch failure reported", log.CombineAll(fields, failureFields(failure))...)
+		}
+
+		c.traceReply(trx, reqID, failure)
+		observeStage(trx, stageResult(failure))
+
+		if success && reply.NewData != nil && trx.State == IsExecuting {
+			log.Info("merging branch data", fields...)
+			trx.Data = mergeData(trx.Data, reply.NewData)
+			event.Data = trx.Data
+		}
+
+		joined, succeeded := trx.ResolveBranch(branch, success)
+		c.record(trx, event)
+		if !joined {
+			return c.Cache.PutTransaction(c.Context, trx)
+		}
+
+		c.cancelPendingBranches(trx)
+		if trx.State == IsReverting && !succeeded {
+			return c.park(trx, failureReason(fmt.Sprintf("compensation of branch %q failed", branch.Key), failure))
+		}
+
+		if err := c.commit(trx, succeeded); err != nil {
+			log.Error("commit failed", log.Combine(zap.Error(err), fields...)...)
+			return fmt.Errorf("failed to commit reply: %v", err)
+		}
+
+		if err := c.transition(trx); err != nil {
+			log.Error("transition failed", log.Combine(zap.Error(err), fields...)...)
+			return fmt.Errorf("failed to transition transaction: %v", err)
+		}
+
+		return nil
+	}
+}
+
+// cancelRequests drops the reply subscriptions of every request of the
+// current stage that is still outstanding.
+func (c *Coordinator) cancelRequests(trx *Transaction) {
+	if trx.RequestID != "" {
+		c.dropAwait(trx.RequestID)
+		if err := c.cancelReplies(trx.RequestID); err != nil {
+			log.Error("failed to unsubscribe request", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
+		}
+	}
+
+	c.cancelPendingBranches(trx)
+}
+
+// cancelPendingBranches drops the reply subscriptions of branches that were
+// still outstanding when their stage joined.
+func (c *Coordinator) cancelPendingBranches(trx *Transaction) {
+	for _, branch := range trx.Branches {
+		if branch.State != BranchPending || branch.RequestID == "" {
+			continue
+		}
+
+		c.dropAwait(branch.RequestID)
+		if err := c.cancelReplies(branch.RequestID); err != nil {
+			log.Error("failed to unsubscribe branch", log.Combine(zap.Error(err), TransactionFields(trx, zap.String("branch", branch.Key))...)...)
+		}
+	}
+}
+
+// load resumes a stored transaction once the coordinator is running.
+// Transactions that already started have their outstanding requests
+// published again rather than being stepped.
 func (c *Coordinator) load(trx *Transaction) error {
-	trx.Lock()
-	defer trx.Unlock()
-	return c.transition(trx)
+	addActive(trx.Recipe, 1)
+	if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+		return fmt.Errorf("record transaction state failed: %v", err)
+	}
+
+	go func() {
+		c.readyWaitGroup.Wait()
+		trx.Lock()
+		defer trx.Unlock()
+		if trx.State == IsInitializing {
+			if err := c.transition(trx); err != nil {
+				log.Error("transition failed", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
+			}
+		} else if trx.IsInProgress() && trx.RetryAt == nil {
+			c.dispatchStage(trx)
+		}
+	}()
+
+	return nil
+}
+
+// park stops a transaction whose compensation can't complete and raises an
+// alert so that an operator can resolve it.
+func (c *Coordinator) park(trx *Transaction, reason string) error {
+	c.cancelRequests(trx)
+	trx.Park(reason)
+	c.record(trx, &TransactionEvent{
+		Type:     EventParked,
+		StageKey: trx.StageKey,
+		Reason:   reason,
+	})
+
+	log.Error("transaction parked", TransactionFields(trx, zap.String("stage", trx.StageKey), zap.String("reason", reason))...)
+	if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+		return fmt.Errorf("record transaction state failed: %v", err)
+	}
+
+	c.alert(&Alert{
+		Type:          AlertCompensationFailed,
+		TransactionID: trx.ID,
+		Recipe:        trx.Recipe.Name,
+		Stage:         trx.StageKey,
+		Reason:        reason,
+		Time:          time.Now(),
+	})
+
+	return nil
+}
+
+func (c *Coordinator) alert(alert *Alert) {
+	if c.Config.AlertTopic == "" {
+		return
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		log.Error("alert encoding failed", zap.Error(err))
+		return
+	}
+
+	if err := c.Hub.PubRaw(c.Config.AlertTopic, data); err != nil {
+		log.Error("alert publish failed", zap.String("topic", c.Config.AlertTopic), zap.Error(err))
+	}
+}
+
+// record appends an event to the transaction's journal. Journal failures are
+// logged but don't stop the transaction; the snapshot is still stored.
+func (c *Coordinator) record(trx *Transaction, event *TransactionEvent) {
+	trx.Seq++
+	event.TransactionID = trx.ID
+	event.Seq = trx.Seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if c.Journal == nil {
+		return
+	}
+
+	if err := c.Journal.AppendEvents(c.Context, event); err != nil {
+		log.Error("journal append failed", TransactionFields(trx, zap.String("event", string(event.Type)), zap.Error(err))...)
+	}
+}
+
+func (c *Coordinator) recordRetry(trx *Transaction) {
+	c.record(trx, &TransactionEvent{
+		Type:     EventRetryScheduled,
+		StageKey: trx.StageKey,
+		Attempt:  trx.Attempt,
+		RetryAt:  trx.RetryAt,
+	})
+}
+
+func (c *Coordinator) commit(trx *Transaction, success bool) error {
+	previousState := trx.State
+	if err := trx.Commit(success); err != nil {
+		return err
+	}
+
+	observeCommit(trx, previousState)
+	c.record(trx, &TransactionEvent{
+		Type:    EventCommitted,
+		Success: success,
+		State:   trx.State,
+	})
+
+	return nil
 }
 
 func (c *Coordinator) unload(trx *Transaction) error {
@@ -285,46 +780,186 @@ func (c *Coordinator) unload(trx *Transaction) error {
 
 func (c *Coordinator) transition(trx *Transaction) error {
 	c.readyWaitGroup.Wait()
+	previousStep := trx.State
+	c.traceStage(trx)
+	trx.Step()
+	c.traceStep(trx)
+	observeStep(trx)
+	log.Debug("step transaction", TransactionFields(trx, zap.String("prev_state", string(previousStep)))...)
+	if trx.IsCompleted() {
+		c.record(trx, &TransactionEvent{
+			Type:  EventCompleted,
+			State: trx.State,
+		})
+	} else {
+		c.record(trx, &TransactionEvent{
+			Type:       EventStepped,
+			Time:       trx.StageStarted,
+			State:      trx.State,
+			StageKey:   trx.StageKey,
+			StageTopic: trx.StageTopic,
+			Expires:    trx.Expires,
+			Path:       trx.ExecutedPath,
+			Branches:   trx.Branches,
+			Trace:      trx.Trace.copy(),
+		})
+
+		c.assignRequestIDs(trx)
+	}
+
 	if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
 		return fmt.Errorf("record transaction state failed: %v", err)
 	}
 
 	log.Info("record transaction", TransactionFields(trx)...)
-	previousStep := trx.State
-	trx.Step()
-	log.Debug("step transaction", TransactionFields(trx, zap.String("prev_state", string(previousStep)))...)
 	if !trx.IsCompleted() {
-		successTopic := successReplyAddress(trx)
-		failureTopic := failureReplyAddress(trx)
-		req := &protocol.Request{
-			ID:                token.Generate(),
-			TransactionID:     trx.ID,
-			SuccessReplyTopic: successTopic,
-			FailureReplyTopic: failureTopic,
-			Data:              trx.Data,
-		}
-
-		log.Debug("dispatch request", log.CombineAll([]zap.Field{zap.String("req", req.ID), zap.String("topic", trx.StageTopic)}, TransactionFields(trx))...)
-		finalizer := c.createReplyFinalizer(trx, trx.StageTopic, req.ID)
-		err := c.Hub.SubReply(req.ID, finalizer, ReplyGroup{
-			successTopic: c.createTransactionSuccessHandler(trx),
-			failureTopic: c.createTransactionFailureHandler(trx),
+		c.dispatchStage(trx)
+	} else {
+		addActive(trx.Recipe, -1)
+		log.Info("completed transaction", TransactionFields(trx)...)
+		if err := c.unload(trx); err != nil {
+			return err
+		}
+
+		c.notifyCompleted(trx)
+	}
+
+	return nil
+}
+
+// dispatchStage publishes the outstanding requests of the current stage.
+func (c *Coordinator) dispatchStage(trx *Transaction) {
+	if len(trx.Branches) > 0 {
+		for _, branch := range trx.Branches {
+			if branch.State == BranchPending {
+				c.record(trx, &TransactionEvent{
+					Type:       EventDispatched,
+					StageKey:   trx.StageKey,
+					StageTopic: branch.Topic,
+					RequestID:  branch.RequestID,
+					Branch:     branch.Key,
+					Attempt:    trx.Attempt,
+				})
+
+				c.dispatch(trx, branch.Topic, branch.RequestID, c.createBranchReplyHandler(trx, branch, true), c.createBranchReplyHandler(trx, branch, false))
+			}
+		}
+	} else {
+		c.record(trx, &TransactionEvent{
+			Type:       EventDispatched,
+			StageKey:   trx.StageKey,
+			StageTopic: trx.StageTopic,
+			RequestID:  trx.RequestID,
+			Attempt:    trx.Attempt,
 		})
 
+		c.dispatch(trx, trx.StageTopic, trx.RequestID, c.createTransactionSuccessHandler(trx, trx.RequestID), c.createTransactionFailureHandler(trx, trx.RequestID))
+	}
+}
+
+func (c *Coordinator) dispatch(trx *Transaction, topic string, reqID string, successHandler func(*protocol.Reply) error, failureHandler func(*protocol.Reply) error) {
+	successTopic := successReplyAddress(trx, topic)
+	failureTopic := failureReplyAddress(trx, topic)
+	req := &protocol.Request{
+		ID:                reqID,
+		TransactionID:     trx.ID,
+		SuccessReplyTopic: successTopic,
+		FailureReplyTopic: failureTopic,
+		Data:              trx.Data,
+		Attempt:           int32(trx.Attempt),
+		Metadata:          trx.requestMetadata(),
+		CorrelationID:     trx.CorrelationID,
+		Traceparent:       trx.Traceparent,
+		Tracestate:        trx.Tracestate,
+	}
+
+	spanID := ""
+	if c.Tracer != nil && trx.Trace != nil {
+		spanID = newSpanID()
+		req.Traceparent = trx.Trace.Traceparent(spanID)
+	}
+
+	log.Debug("dispatch request", log.CombineAll([]zap.Field{zap.String("req", req.ID), zap.String("topic", topic), zap.Int32("attempt", req.Attempt)}, TransactionFields(trx))...)
+	finalizer := c.createReplyFinalizer(trx, topic, req.ID)
+	replyGroup := ReplyGroup{
+		successTopic: successHandler,
+		failureTopic: failureHandler,
+	}
+
+	if trx.Stage != nil && topic == trx.StageTopic {
+		if endpointURL := trx.Stage.EndpointURL(trx.State); endpointURL != "" {
+			c.post(trx, endpointURL, req, spanID, finalizer, replyGroup)
+			return
+		}
+	}
+
+	err := c.Hub.SubReply(req.ID, finalizer, replyGroup)
+	if err != nil {
+		log.Error("failed to attach reply subscribers", zap.Error(err))
+	}
+
+	published := time.Now()
+	err = c.Hub.Pub(topic, req)
+	if err != nil {
+		log.Error("failed to publish request", log.Combine(zap.Error(err), TransactionFields(trx, zap.String("topic", topic))...)...)
+	}
+
+	c.tracePublish(trx, topic, req, spanID, published, err)
+}
+
+// post sends a request to the endpoint of its stage. The reply of the
+// response is handled once the request is traced, like a reply from the hub;
+// replies to accepted requests arrive through DeliverReply.
+func (c *Coordinator) post(trx *Transaction, endpointURL string, req *protocol.Request, spanID string, finalizer func(), replyGroup ReplyGroup) {
+	if c.Webhooks == nil {
+		log.Error("no webhook transport to post request", TransactionFields(trx, zap.String("url", endpointURL))...)
+		return
+	}
+
+	if err := c.Webhooks.SubReply(req.ID, finalizer, replyGroup); err != nil {
+		log.Error("failed to attach reply routes", zap.Error(err))
+	}
+
+	endpoint := trx.Stage.Endpoint
+	fields := TransactionFields(trx, zap.String("url", endpointURL))
+	go func() {
+		posted := time.Now()
+		reply, replyTopic, err := c.Webhooks.Post(endpointURL, endpoint, req)
 		if err != nil {
-			log.Error("failed to attach reply subscribers", zap.Error(err))
+			log.Error("failed to post request", log.Combine(zap.Error(err), fields...)...)
 		}
 
-		c.Hub.Pub(trx.StageTopic, req)
-	} else {
-		atomic.AddInt32(&trx.Recipe.NumActiveTransactions, -1)
-		log.Info("completed transaction", TransactionFields(trx)...)
-		if err := c.unload(trx); err != nil {
+		c.tracePublish(trx, endpointURL, req, spanID, posted, err)
+		if replyTopic == "" {
+			return
+		}
+
+		if err := c.Webhooks.Route(replyTopic, reply); err != nil {
+			log.Error("failed to route response", log.Combine(zap.Error(err), fields...)...)
+		}
+	}()
+}
+
+// DeliverReply hands the reply posted to the callback URL of a request to
+// the request's reply group.
+func (c *Coordinator) DeliverReply(topic string, signature string, contentType string, body []byte) error {
+	if c.Webhooks == nil {
+		return ErrInvalidReplySignature
+	}
+
+	return c.Webhooks.Deliver(topic, signature, contentType, body)
+}
+
+// cancelReplies drops the reply subscriptions of a request, whether it was
+// published to the hub or posted to an endpoint.
+func (c *Coordinator) cancelReplies(reqID string) error {
+	if c.Webhooks != nil {
+		if err := c.Webhooks.CancelGroup(reqID); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return c.Hub.CancelGroup(reqID)
 }
 
 func (c *Coordinator) createReplyFinalizer(trx *Transaction, stageTopic string, reqID string) func() {
@@ -332,7 +967,7 @@ func (c *Coordinator) createReplyFinalizer(trx *Transaction, stageTopic string,
 	return func() {
 		oncer.Do(func() {
 			for {
-				if err := c.Hub.CancelGroup(reqID); err != nil {
+				if err := c.cancelReplies(reqID); err != nil {
 					log.Error("failed to unsubscribe group", log.Combine(zap.Error(err), TransactionFields(trx, zap.String("topic", stageTopic))...)...)
 					continue
 				}
@@ -343,10 +978,10 @@ func (c *Coordinator) createReplyFinalizer(trx *Transaction, stageTopic string,
 	}
 }
 
-func successReplyAddress(trx *Transaction) string {
-	return fmt.Sprintf("sake.reply.ok.%s@%s", trx.ID, trx.StageTopic)
+func successReplyAddress(trx *Transaction, topic string) string {
+	return fmt.Sprintf("sake.reply.ok.%s@%s", trx.ID, topic)
 }
 
-func failureReplyAddress(trx *Transaction) string {
-	return fmt.Sprintf("sake.reply.fail.%s@%s", trx.ID, trx.StageTopic)
+func failureReplyAddress(trx *Transaction, topic string) string {
+	return fmt.Sprintf("sake.reply.fail.%s@%s", trx.ID, topic)
 }
@@ -0,0 +1,491 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a compiled condition evaluated against JSON-decoded
+// transaction data. The grammar is intentionally small:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = path | string | number | "true" | "false" | "null"
+//	path       = ident { "." ident | "[" int "]" }
+//
+// Strings are quoted with " or ' and unescaped like Go strings. A path that
+// doesn't exist in the data evaluates to null.
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(data interface{}) interface{}
+}
+
+func CompileExpression(source string) (*Expression, error) {
+	p := &exprParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("expression %q: unexpected %q", source, p.tokens[p.pos].text)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+func (expr *Expression) String() string {
+	return expr.source
+}
+
+// Match evaluates the expression against data, which must be JSON. Data that
+// can't be decoded is treated as null.
+func (expr *Expression) Match(data []byte) bool {
+	var v interface{}
+	if len(data) > 0 {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			v = nil
+		}
+	}
+
+	return truthy(expr.root.eval(v))
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", "."}
+
+func (p *exprParser) tokenize() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && rune(s[j]) != c {
+				if s[j] == '\\' {
+					j++
+				}
+
+				j++
+			}
+
+			if j >= len(s) {
+				return fmt.Errorf("expression %q: unterminated string", p.source)
+			}
+
+			text, err := unquoteString(s[i : j+1])
+			if err != nil {
+				return fmt.Errorf("expression %q: invalid string %s", p.source, s[i:j+1])
+			}
+
+			p.tokens = append(p.tokens, exprToken{tokenString, text})
+			i = j + 1
+
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1]))):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				// the exponent may be signed
+				if (s[j] == 'e' || s[j] == 'E') && j+1 < len(s) && (s[j+1] == '-' || s[j+1] == '+') {
+					j++
+				}
+
+				j++
+			}
+
+			p.tokens = append(p.tokens, exprToken{tokenNumber, s[i:j]})
+			i = j
+
+		case unicode.IsLetter(c) || c == '_' || c == '$':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+
+			p.tokens = append(p.tokens, exprToken{tokenIdent, s[i:j]})
+			i = j
+
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					p.tokens = append(p.tokens, exprToken{tokenOp, op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return fmt.Errorf("expression %q: unexpected character %q", p.source, c)
+			}
+		}
+	}
+
+	if len(p.tokens) < 1 {
+		return fmt.Errorf("expression is empty")
+	}
+
+	return nil
+}
+
+// unquoteString unescapes a quoted string the way Go does. Single-quoted
+// strings may hold any number of characters and escape ' rather than ".
+func unquoteString(quoted string) (string, error) {
+	if quoted[0] == '"' {
+		return strconv.Unquote(quoted)
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	body := quoted[1 : len(quoted)-1]
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '"':
+			b.WriteString(`\"`)
+		case body[i] == '\\' && i+1 < len(body) && body[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case body[i] == '\\' && i+1 < len(body):
+			b.WriteString(body[i : i+2])
+			i++
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+
+	b.WriteByte('"')
+	return strconv.Unquote(b.String())
+}
+
+func (p *exprParser) peek(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOp && p.tokens[p.pos].text == op
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek("!") {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{operand}, nil
+	}
+
+	if p.peek("(") {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.peek(")") {
+			return nil, fmt.Errorf("expression %q: missing )", p.source)
+		}
+
+		p.pos++
+		return inner, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOp {
+		switch op := p.tokens[p.pos].text; op {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.pos++
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+
+			return &compareNode{op: op, left: left, right: right}, nil
+		}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("expression %q: unexpected end", p.source)
+	}
+
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case tokenString:
+		return &literalNode{tok.text}, nil
+
+	case tokenNumber:
+		if _, err := strconv.ParseFloat(tok.text, 64); err != nil {
+			return nil, fmt.Errorf("expression %q: invalid number %q", p.source, tok.text)
+		}
+
+		return &literalNode{json.Number(tok.text)}, nil
+
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+
+		path := &pathNode{}
+		if tok.text != "$" {
+			path.segments = append(path.segments, tok.text)
+		}
+
+		for {
+			if p.peek(".") {
+				p.pos++
+				if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenIdent {
+					return nil, fmt.Errorf("expression %q: expected field name after .", p.source)
+				}
+
+				path.segments = append(path.segments, p.tokens[p.pos].text)
+				p.pos++
+			} else if p.peek("[") {
+				p.pos++
+				if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenNumber {
+					return nil, fmt.Errorf("expression %q: expected index after [", p.source)
+				}
+
+				index, err := strconv.Atoi(p.tokens[p.pos].text)
+				if err != nil {
+					return nil, fmt.Errorf("expression %q: invalid index %q", p.source, p.tokens[p.pos].text)
+				}
+
+				path.segments = append(path.segments, index)
+				p.pos++
+				if !p.peek("]") {
+					return nil, fmt.Errorf("expression %q: missing ]", p.source)
+				}
+
+				p.pos++
+			} else {
+				break
+			}
+		}
+
+		return path, nil
+	}
+
+	return nil, fmt.Errorf("expression %q: unexpected %q", p.source, tok.text)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(data interface{}) interface{} {
+	return n.value
+}
+
+type pathNode struct {
+	segments []interface{}
+}
+
+func (n *pathNode) eval(data interface{}) interface{} {
+	v := data
+	for _, segment := range n.segments {
+		switch key := segment.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+
+			v = obj[key]
+
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || key < 0 || key >= len(arr) {
+				return nil
+			}
+
+			v = arr[key]
+		}
+	}
+
+	return v
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) eval(data interface{}) interface{} {
+	return !truthy(n.operand.eval(data))
+}
+
+type logicalNode struct {
+	or    bool
+	left  exprNode
+	right exprNode
+}
+
+func (n *logicalNode) eval(data interface{}) interface{} {
+	left := truthy(n.left.eval(data))
+	if n.or {
+		return left || truthy(n.right.eval(data))
+	}
+
+	return left && truthy(n.right.eval(data))
+}
+
+type compareNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (n *compareNode) eval(data interface{}) interface{} {
+	left := n.left.eval(data)
+	right := n.right.eval(data)
+	if ln, ok := left.(json.Number); ok {
+		if rn, ok := right.(json.Number); ok {
+			lf, lerr := ln.Float64()
+			rf, rerr := rn.Float64()
+			if lerr != nil || rerr != nil {
+				return false
+			}
+
+			switch n.op {
+			case "==":
+				return lf == rf
+			case "!=":
+				return lf != rf
+			case "<":
+				return lf < rf
+			case "<=":
+				return lf <= rf
+			case ">":
+				return lf > rf
+			case ">=":
+				return lf >= rf
+			}
+		}
+	}
+
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			switch n.op {
+			case "<":
+				return ls < rs
+			case "<=":
+				return ls <= rs
+			case ">":
+				return ls > rs
+			case ">=":
+				return ls >= rs
+			}
+		}
+	}
+
+	switch n.op {
+	case "==":
+		return jsonEqual(left, right)
+	case "!=":
+		return !jsonEqual(left, right)
+	}
+
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case json.Number:
+		f, err := value.Float64()
+		return err == nil && f != 0
+	}
+
+	return true
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		source string
+		want   []exprToken
+	}{
+		{`a.b == "x"`, []exprToken{{tokenIdent, "a"}, {tokenOp, "."}, {tokenIdent, "b"}, {tokenOp, "=="}, {tokenString, "x"}}},
+		{`items[0] >= -1.5`, []exprToken{{tokenIdent, "items"}, {tokenOp, "["}, {tokenNumber, "0"}, {tokenOp, "]"}, {tokenOp, ">="}, {tokenNumber, "-1.5"}}},
+		{`!(a||b)&&c`, []exprToken{{tokenOp, "!"}, {tokenOp, "("}, {tokenIdent, "a"}, {tokenOp, "||"}, {tokenIdent, "b"}, {tokenOp, ")"}, {tokenOp, "&&"}, {tokenIdent, "c"}}},
+		{`"a\"b" != 'c'`, []exprToken{{tokenString, `a"b`}, {tokenOp, "!="}, {tokenString, "c"}}},
+		{`$ <= 2e3`, []exprToken{{tokenIdent, "$"}, {tokenOp, "<="}, {tokenNumber, "2e3"}}},
+		{`a > 1e-3 && b < -2E+2`, []exprToken{{tokenIdent, "a"}, {tokenOp, ">"}, {tokenNumber, "1e-3"}, {tokenOp, "&&"}, {tokenIdent, "b"}, {tokenOp, "<"}, {tokenNumber, "-2E+2"}}},
+		{`'it\'s "x"\t' == ''`, []exprToken{{tokenString, "it's \"x\"\t"}, {tokenOp, "=="}, {tokenString, ""}}},
+		{`order_id`, []exprToken{{tokenIdent, "order_id"}}},
+	}
+
+	for _, c := range cases {
+		p := &exprParser{source: c.source}
+		if err := p.tokenize(); err != nil {
+			t.Errorf("%s: %v", c.source, err)
+		} else if !reflect.DeepEqual(p.tokens, c.want) {
+			t.Errorf("%s: got tokens %v, want %v", c.source, p.tokens, c.want)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`"open`,
+		`a ==`,
+		`(a`,
+		`a.`,
+		`a[b]`,
+		`a[0`,
+		`a b`,
+		`a # b`,
+		`1.2.3 == a`,
+		`1e-`,
+		`a-b == 1`,
+		`'\q' == a`,
+	} {
+		if _, err := CompileExpression(source); err == nil {
+			t.Errorf("expected %q not to compile", source)
+		}
+	}
+}
+
+func TestExpressionMatch(t *testing.T) {
+	data := []byte(`{
+		"total": 120,
+		"currency": "EUR",
+		"express": true,
+		"note": "",
+		"items": [{"sku": "a", "qty": 2}, {"sku": "b", "qty": 0}],
+		"customer": {"tier": "gold", "tags": ["vip"]},
+		"discount": null
+	}`)
+
+	cases := []struct {
+		source string
+		want   bool
+	}{
+		// paths
+		{`customer.tier == "gold"`, true},
+		{`items[1].sku == "b"`, true},
+		{`customer.tags[0] == "vip"`, true},
+		{`items[2].sku == null`, true},
+		{`customer.missing.deeper == null`, true},
+		{`total.field == null`, true},
+		{`items.sku == null`, true},
+		{`$.currency == "EUR"`, true},
+
+		// precedence: && binds tighter than ||, ! tighter than &&
+		{`false && false || true`, true},
+		{`true || false && false`, true},
+		{`!true || true`, true},
+		{`!(true || true)`, false},
+		{`!express && total > 100 || currency == "EUR"`, true},
+		{`!express && (total > 100 || currency == "EUR")`, false},
+
+		// numbers compare by value, strings lexically
+		{`total > 100`, true},
+		{`total == 120.0`, true},
+		{`total <= 1.2e2`, true},
+		{`total < 1.2e+2`, false},
+		{`total > 1.2e-2`, true},
+		{`items[0].qty >= 2`, true},
+		{`currency < "USD"`, true},
+		{`"b" >= "a"`, true},
+		{`currency == 'EUR'`, true},
+		{`'it\'s' == "it's"`, true},
+
+		// mixed types are only ever unequal
+		{`total == "120"`, false},
+		{`total != "120"`, true},
+		{`total < "200"`, false},
+		{`currency > 1`, false},
+		{`express == 1`, false},
+		{`discount == false`, false},
+		{`discount == null`, true},
+		{`customer == customer`, true},
+		{`customer.tags == customer.tags`, true},
+
+		// truthiness of operands
+		{`total`, true},
+		{`items[1].qty`, false},
+		{`note`, false},
+		{`currency`, true},
+		{`discount`, false},
+		{`customer`, true},
+		{`customer.tags`, true},
+		{`missing`, false},
+		{`!missing`, true},
+	}
+
+	for _, c := range cases {
+		expr, err := CompileExpression(c.source)
+		if err != nil {
+			t.Errorf("%s: %v", c.source, err)
+			continue
+		}
+
+		if got := expr.Match(data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.source, got, c.want)
+		}
+	}
+}
+
+func TestExpressionMatchInvalidData(t *testing.T) {
+	expr, err := CompileExpression(`a == null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{``, `not json`, `[1]`} {
+		if !expr.Match([]byte(data)) {
+			t.Errorf("expected %q to be treated as null", data)
+		}
+	}
+}
@@ -0,0 +1,647 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+const (
+	FsyncAlways = "always"
+	FsyncNever  = "never"
+
+	DefaultFileRetention = 7 * 24 * time.Hour
+)
+
+const (
+	recipesDir        = "recipes"
+	recipeVersionsDir = "recipe-versions"
+	transactionsDir   = "transactions"
+	eventsDir         = "events"
+	keysDir           = "trigger-keys"
+	eventLogExt       = ".log"
+	tempFileMarker    = ".tmp-"
+)
+
+func init() {
+	RegisterStorageDriver("file", func(ctx context.Context, config *Config) (StorageService, error) {
+		storage, err := NewFileStorage(config.File.Path, config.File.Fsync)
+		if err != nil {
+			return nil, err
+		}
+
+		if storage.Retention, err = parseFileRetention(config.File.Retention); err != nil {
+			return nil, err
+		}
+
+		return storage, nil
+	})
+}
+
+// parseFileRetention parses the configured retention, which is
+// DefaultFileRetention when it's empty. Only an explicit zero keeps
+// completed transactions forever.
+func parseFileRetention(value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultFileRetention, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid file retention %q", value)
+	}
+
+	return retention, nil
+}
+
+// FileStorage keeps recipes and transactions as JSON documents in a data
+// directory. Every write goes to a temporary file that is renamed over the
+// previous document, so a crash leaves either the old or the new version.
+// Transaction events are appended to a log file per transaction.
+type FileStorage struct {
+	// Retention is how long completed transactions are kept after their last
+	// change. They're kept forever when it's zero.
+	Retention time.Duration
+
+	root  string
+	fsync bool
+
+	keysMutex sync.Mutex
+}
+
+var _ StorageService = &FileStorage{}
+var _ EventJournal = &FileStorage{}
+var _ TransactionPurger = &FileStorage{}
+
+func NewFileStorage(root string, fsyncPolicy string) (*FileStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("file storage path is required")
+	}
+
+	storage := &FileStorage{
+		root: root,
+	}
+
+	switch fsyncPolicy {
+	case "", FsyncAlways:
+		storage.fsync = true
+	case FsyncNever:
+		storage.fsync = false
+	default:
+		return nil, fmt.Errorf("invalid fsync policy %q", fsyncPolicy)
+	}
+
+	for _, dir := range []string{recipesDir, recipeVersionsDir, transactionsDir, eventsDir, keysDir} {
+		path := filepath.Join(root, dir)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+
+		if err := removeTempFiles(path); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Info("file storage ready", zap.String("path", root), zap.Bool("fsync", storage.fsync))
+	return storage, nil
+}
+
+// removeTempFiles cleans up writes that were interrupted by a crash.
+func removeTempFiles(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if strings.Contains(f.Name(), tempFileMarker) {
+			log.Warn("removing incomplete write", zap.String("file", f.Name()))
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func documentName(key string) string {
+	return url.PathEscape(key) + ".json"
+}
+
+func (storage *FileStorage) write(dir string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(storage.root, dir)
+	name := documentName(key)
+	f, err := ioutil.TempFile(path, name+tempFileMarker)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if storage.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(path, name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return storage.syncDir(path)
+}
+
+func (storage *FileStorage) remove(dir string, key string) error {
+	path := filepath.Join(storage.root, dir)
+	if err := os.Remove(filepath.Join(path, documentName(key))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return storage.syncDir(path)
+}
+
+func (storage *FileStorage) syncDir(path string) error {
+	if !storage.fsync {
+		return nil
+	}
+
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
+
+// each decodes every document in dir with decode.
+func (storage *FileStorage) each(dir string, decode func(data []byte) error) error {
+	path := filepath.Join(storage.root, dir)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(path, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		if err := decode(data); err != nil {
+			return fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (storage *FileStorage) SaveTransaction(ctx context.Context, trx *Transaction) error {
+	return storage.write(transactionsDir, trx.ID, trx)
+}
+
+func recipeVersionKey(recipe *Recipe) string {
+	return fmt.Sprintf("%s/%d", recipe.Name, recipe.Version)
+}
+
+// SaveRecipe writes a document per version of a recipe. The document that
+// kept the recipe before it was versioned is removed once its version is
+// written.
+func (storage *FileStorage) SaveRecipe(ctx context.Context, recipe *Recipe) error {
+	if err := storage.write(recipeVersionsDir, recipeVersionKey(recipe), recipe); err != nil {
+		return err
+	}
+
+	return storage.remove(recipesDir, recipe.Name)
+}
+
+func (storage *FileStorage) RemoveRecipe(ctx context.Context, recipe *Recipe) error {
+	return storage.write(recipeVersionsDir, recipeVersionKey(recipe), recipe.retired())
+}
+
+func (storage *FileStorage) LoadAllRecipes(ctx context.Context) ([]*Recipe, error) {
+	return storage.filterRecipes(func(recipe *Recipe) bool {
+		return recipe.Status() != StatusInactive
+	})
+}
+
+func (storage *FileStorage) LoadRecipeVersions(ctx context.Context, name string) ([]*Recipe, error) {
+	return storage.filterRecipes(func(recipe *Recipe) bool {
+		return recipe.Name == name
+	})
+}
+
+// filterRecipes returns the matching versions, ordered by name and version,
+// along with the recipes stored before they were versioned.
+func (storage *FileStorage) filterRecipes(match func(recipe *Recipe) bool) ([]*Recipe, error) {
+	result := make([]*Recipe, 0)
+	versioned := make(map[string]bool)
+	err := storage.each(recipeVersionsDir, func(data []byte) error {
+		recipe := &Recipe{}
+		if err := json.Unmarshal(data, recipe); err != nil {
+			return err
+		}
+
+		versioned[recipe.ID] = true
+		if match(recipe) {
+			result = append(result, recipe)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.each(recipesDir, func(data []byte) error {
+		recipe := &Recipe{}
+		if err := json.Unmarshal(data, recipe); err != nil {
+			return err
+		}
+
+		if !versioned[recipe.ID] && match(recipe) {
+			result = append(result, recipe)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortRecipes(result)
+	return result, nil
+}
+
+func (storage *FileStorage) LoadActiveTransactions(ctx context.Context) ([]*Transaction, error) {
+	snapshots := make([]*Transaction, 0)
+	err := storage.each(transactionsDir, func(data []byte) error {
+		trx := &Transaction{}
+		if err := json.Unmarshal(data, trx); err != nil {
+			return err
+		}
+
+		if !trx.IsCompleted() {
+			snapshots = append(snapshots, trx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(storage.root, eventsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	unsnapshotted := make([]string, 0)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), eventLogExt) {
+			continue
+		}
+
+		trxID, err := url.PathUnescape(strings.TrimSuffix(f.Name(), eventLogExt))
+		if err != nil {
+			continue
+		}
+
+		_, err = os.Stat(filepath.Join(storage.root, transactionsDir, documentName(trxID)))
+		if os.IsNotExist(err) {
+			unsnapshotted = append(unsnapshotted, trxID)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return replayActive(ctx, storage, snapshots, unsnapshotted)
+}
+
+func (storage *FileStorage) LoadTransaction(ctx context.Context, id string) (*Transaction, error) {
+	var snapshot *Transaction
+	data, err := ioutil.ReadFile(filepath.Join(storage.root, transactionsDir, documentName(id)))
+	if err == nil {
+		snapshot = &Transaction{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var after int64
+	if snapshot != nil {
+		after = snapshot.Seq
+	}
+
+	events, err := storage.LoadEvents(ctx, id, after)
+	if err != nil {
+		return nil, err
+	} else if snapshot == nil && len(events) < 1 {
+		return nil, nil
+	}
+
+	return ReplayTransaction(snapshot, events), nil
+}
+
+// FindTransactions scans every snapshot, so its cost grows with the number
+// of stored transactions.
+func (storage *FileStorage) FindTransactions(ctx context.Context, query *TransactionQuery) (*TransactionPage, error) {
+	matched := make([]*Transaction, 0)
+	err := storage.each(transactionsDir, func(data []byte) error {
+		trx := &Transaction{}
+		if err := json.Unmarshal(data, trx); err != nil {
+			return err
+		}
+
+		if query.Match(trx) {
+			matched = append(matched, trx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return query.paginate(matched)
+}
+
+func (storage *FileStorage) eventLogPath(trxID string) string {
+	return filepath.Join(storage.root, eventsDir, url.PathEscape(trxID)+eventLogExt)
+}
+
+func (storage *FileStorage) AppendEvents(ctx context.Context, events ...*TransactionEvent) error {
+	logs := make(map[string]*bytes.Buffer)
+	order := make([]string, 0)
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		buf, ok := logs[event.TransactionID]
+		if !ok {
+			buf = &bytes.Buffer{}
+			logs[event.TransactionID] = buf
+			order = append(order, event.TransactionID)
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	for _, trxID := range order {
+		f, err := os.OpenFile(storage.eventLogPath(trxID), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		if err := truncatePartialLine(f); err != nil {
+			f.Close()
+			return fmt.Errorf("event log %s: %v", trxID, err)
+		}
+
+		if _, err := f.Write(logs[trxID].Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+
+		if storage.fsync {
+			if err := f.Sync(); err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncatePartialLine drops a partial last line, left by a crash in the
+// middle of an append, so that the next event starts on a line of its own. It
+// leaves the file's offset at its end.
+func truncatePartialLine(f *os.File) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return err
+	} else if last[0] == '\n' {
+		return nil
+	}
+
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	end := int64(bytes.LastIndexByte(data, '\n') + 1)
+	log.Warn("truncating partial event", zap.String("file", f.Name()), zap.Int64("bytes", size-end))
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+
+	_, err = f.Seek(end, io.SeekStart)
+	return err
+}
+
+// LoadEvents reads the transaction's event log. A partial last line, left by
+// a crash in the middle of an append, is ignored.
+func (storage *FileStorage) LoadEvents(ctx context.Context, trxID string, afterSeq int64) ([]*TransactionEvent, error) {
+	f, err := os.Open(storage.eventLogPath(trxID))
+	if os.IsNotExist(err) {
+		return []*TransactionEvent{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	result := make([]*TransactionEvent, 0)
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		event := &TransactionEvent{}
+		if err := json.Unmarshal(line, event); err != nil {
+			return nil, fmt.Errorf("event log %s: %v", trxID, err)
+		}
+
+		if event.Seq > afterSeq {
+			result = append(result, event)
+		}
+	}
+
+	return result, nil
+}
+
+// triggerKeyName hashes the recipe and key, which are chosen by clients and
+// can be longer than a file name allows.
+func triggerKeyName(recipeName string, key string) string {
+	sum := sha256.Sum256([]byte(triggerKeyIndex(recipeName, key)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (storage *FileStorage) ClaimTriggerKey(ctx context.Context, claim *TriggerKey) (string, error) {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	name := triggerKeyName(claim.Recipe, claim.Key)
+	data, err := ioutil.ReadFile(filepath.Join(storage.root, keysDir, documentName(name)))
+	if err == nil {
+		existing := &TriggerKey{}
+		if err := json.Unmarshal(data, existing); err != nil {
+			return "", err
+		}
+
+		if time.Now().Before(existing.Expires) {
+			return existing.TransactionID, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := storage.write(keysDir, name, claim); err != nil {
+		return "", err
+	}
+
+	return claim.TransactionID, nil
+}
+
+func (storage *FileStorage) ReleaseTriggerKey(ctx context.Context, recipeName string, key string) error {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	return storage.remove(keysDir, triggerKeyName(recipeName, key))
+}
+
+func (storage *FileStorage) PurgeTriggerKeys(ctx context.Context, before time.Time) (int, error) {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	expired := make([]string, 0)
+	err := storage.each(keysDir, func(data []byte) error {
+		claim := &TriggerKey{}
+		if err := json.Unmarshal(data, claim); err != nil {
+			return err
+		}
+
+		if claim.Expires.Before(before) {
+			expired = append(expired, triggerKeyName(claim.Recipe, claim.Key))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range expired {
+		if err := storage.remove(keysDir, name); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// PurgeTransactions removes the snapshots and event logs of completed
+// transactions whose snapshot wasn't written for the retention period.
+// Completed transactions are always snapshotted, so the snapshot's
+// modification time is the time the transaction completed.
+func (storage *FileStorage) PurgeTransactions(ctx context.Context) (int, error) {
+	if storage.Retention <= 0 {
+		return 0, nil
+	}
+
+	before := time.Now().Add(-storage.Retention)
+	files, err := ioutil.ReadDir(filepath.Join(storage.root, transactionsDir))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, f := range files {
+		if f.IsDir() || !f.ModTime().Before(before) || strings.Contains(f.Name(), tempFileMarker) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(storage.root, transactionsDir, f.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+
+		trx := &Transaction{}
+		if err := json.Unmarshal(data, trx); err != nil {
+			return purged, err
+		} else if !trx.IsCompleted() {
+			continue
+		}
+
+		if err := os.Remove(storage.eventLogPath(trx.ID)); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+
+		if err := storage.remove(transactionsDir, trx.ID); err != nil {
+			return purged, err
+		}
+
+		purged++
+	}
+
+	return purged, nil
+}
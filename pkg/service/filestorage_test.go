@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileStorage(t *testing.T) (*FileStorage, func()) {
+	dir, cleanup := newTestDir(t)
+	storage, err := NewFileStorage(dir, FsyncNever)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return storage, cleanup
+}
+
+func TestFileStorageReopen(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	checkout := &Recipe{ID: "r1", Name: "checkout", Version: 1}
+	refund := &Recipe{ID: "r2", Name: "refund", Version: 1}
+	checkout.SetStatus(StatusActive)
+	refund.SetStatus(StatusActive)
+	for _, recipe := range []*Recipe{checkout, refund} {
+		if err := storage.SaveRecipe(ctx, recipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storage.RemoveRecipe(ctx, refund); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, state := range map[string]TransactionState{"t/1": IsExecuting, "t2": IsSuccess} {
+		trx := NewTransaction(checkout, []byte(`{"total":12}`))
+		trx.ID = id
+		trx.State = state
+		if err := storage.SaveTransaction(ctx, trx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a write that was interrupted by a crash
+	partial := filepath.Join(storage.root, transactionsDir, documentName("t3")+tempFileMarker+"1")
+	if err := ioutil.WriteFile(partial, []byte(`{"id":"t3","sta`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStorage(storage.root, FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipes, err := reopened.LoadAllRecipes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recipes) != 1 || recipes[0].ID != "r1" || recipes[0].Status() != StatusActive {
+		t.Fatalf("expected only the active checkout recipe, got %d recipes", len(recipes))
+	}
+
+	active, err := reopened.LoadActiveTransactions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(active) != 1 || active[0].ID != "t/1" || string(active[0].Data) != `{"total":12}` {
+		t.Fatalf("expected only t/1 to be active, got %d transactions", len(active))
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(storage.root, transactionsDir))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("expected the interrupted write to be removed, got %d files", len(files))
+	}
+}
+
+func TestAppendEventsAfterPartialLine(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	if err := storage.AppendEvents(ctx, &TransactionEvent{TransactionID: "t1", Seq: 1, Type: EventCreated}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of an append
+	f, err := os.OpenFile(storage.eventLogPath("t1"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(`{"transaction_id":"t1","se`)
+	f.Close()
+
+	if err := storage.AppendEvents(ctx, &TransactionEvent{TransactionID: "t1", Seq: 2, Type: EventDispatched}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := storage.LoadEvents(ctx, "t1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Seq != 1 || events[1].Seq != 2 {
+		t.Fatalf("expected events 1 and 2, got %+v", events)
+	}
+}
+
+func TestPurgeTransactions(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	storage.Retention = time.Hour
+	recipe := &Recipe{ID: "r1", Name: "checkout"}
+	for id, state := range map[string]TransactionState{"done": IsSuccess, "running": IsExecuting, "recent": IsFailed} {
+		trx := NewTransaction(recipe, nil)
+		trx.ID = id
+		trx.State = state
+		if err := storage.SaveTransaction(ctx, trx); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.AppendEvents(ctx, &TransactionEvent{TransactionID: id, Seq: 1, Type: EventCreated}); err != nil {
+			t.Fatal(err)
+		}
+
+		if id != "recent" {
+			old := time.Now().Add(-2 * time.Hour)
+			os.Chtimes(filepath.Join(storage.root, transactionsDir, documentName(id)), old, old)
+		}
+	}
+
+	n, err := storage.PurgeTransactions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1 purged transaction, got %d", n)
+	}
+
+	for id, kept := range map[string]bool{"done": false, "running": true, "recent": true} {
+		trx, err := storage.LoadTransaction(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (trx != nil) != kept {
+			t.Errorf("transaction %s: expected kept %v", id, kept)
+		}
+	}
+}
+
+func TestFileStorageRetention(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	for value, want := range map[string]time.Duration{"": DefaultFileRetention, "0s": 0, "24h": 24 * time.Hour} {
+		config := &Config{StorageDriver: "file"}
+		config.File.Path = dir
+		config.File.Retention = value
+		storage, err := NewStorage(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if retention := storage.(*FileStorage).Retention; retention != want {
+			t.Errorf("retention %q: expected %v, got %v", value, want, retention)
+		}
+	}
+
+	config := &Config{StorageDriver: "file"}
+	config.File.Path = dir
+	config.File.Retention = "-1h"
+	if _, err := NewStorage(context.Background(), config); err == nil {
+		t.Error("expected a negative retention to be refused")
+	}
+}
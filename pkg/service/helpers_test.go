@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newTestDir creates a temporary directory and returns it along with the
+// function that removes it.
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sake-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newTestCoordinator creates a coordinator on the debug hub and in-memory
+// storage.
+func newTestCoordinator(t *testing.T) *Coordinator {
+	storage, err := NewDebugStorage(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewInMemoryCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCoordinator(context.Background(), NewDebugHub(), cache, storage, CoordinatorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// released by Run, which the tests don't start
+	c.readyWaitGroup.Done()
+	return c
+}
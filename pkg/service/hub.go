@@ -16,6 +16,26 @@ import (
 
 type ReplyGroup map[string]func(req *protocol.Reply) error
 
+// ErrReplyDiscarded is returned by reply handlers for replies that don't
+// answer the outstanding request. The reply is acknowledged and the group
+// keeps waiting for a reply.
+var ErrReplyDiscarded = errors.New("reply discarded")
+
+// replyGate lets a reply group handle a single reply, not counting
+// discarded ones.
+type replyGate struct {
+	sync.Mutex
+	done bool
+}
+
+func (gate *replyGate) handle(fn func() bool) {
+	gate.Lock()
+	defer gate.Unlock()
+	if !gate.done {
+		gate.done = fn()
+	}
+}
+
 type RawGroup map[string]func(rawMessage []byte) error
 
 type HubConnector interface {
@@ -24,6 +44,7 @@ type HubConnector interface {
 	SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error
 	SubGroup(groupKey interface{}, group RawGroup) error
 	Pub(topic string, req *protocol.Request) error
+	PubRaw(topic string, data []byte) error
 	//Sub(topic string, handler func(rawMessage []byte) error) error
 }
 
@@ -38,7 +59,7 @@ var _ HubConnector = &DebugHub{}
 
 func NewDebugHub() *DebugHub {
 	return &DebugHub{
-		pubsub: pubsub.New(0),
+		pubsub: pubsub.New(64),
 		quits:  make(map[chan interface{}]chan struct{}),
 		groups: make(map[interface{}][]chan interface{}),
 	}
@@ -47,37 +68,37 @@ func NewDebugHub() *DebugHub {
 func (hub *DebugHub) CancelAll() error {
 	hub.chMutex.Lock()
 	defer hub.chMutex.Unlock()
-	for ch, quitCh := range hub.quits {
-		quitCh <- struct{}{}
-		close(quitCh)
-		close(ch)
+	for ch := range hub.quits {
+		hub.unsub(ch)
 	}
 
+	hub.groups = make(map[interface{}][]chan interface{})
 	return nil
 }
 
-func (hub *DebugHub) group(groupKey interface{}) []chan interface{} {
-	group, ok := hub.groups[groupKey]
-	if !ok {
-		group = make([]chan interface{}, 0)
+// unsub stops the listener of ch and removes the subscription. The caller
+// must hold chMutex.
+func (hub *DebugHub) unsub(ch chan interface{}) {
+	quitCh, ok := hub.quits[ch]
+	if ok {
+		close(quitCh)
+		delete(hub.quits, ch)
 	}
 
-	return group
+	go hub.pubsub.Unsub(ch)
 }
 
 func (hub *DebugHub) CancelGroup(groupKey interface{}) error {
 	hub.chMutex.Lock()
 	defer hub.chMutex.Unlock()
-	group := hub.group(groupKey)
+	group, ok := hub.groups[groupKey]
+	if !ok {
+		return nil
+	}
+
 	delete(hub.groups, groupKey)
 	for _, ch := range group {
-		quitCh, ok := hub.quits[ch]
-		if ok {
-			quitCh <- struct{}{}
-			close(quitCh)
-		}
-
-		close(ch)
+		hub.unsub(ch)
 	}
 
 	return nil
@@ -91,32 +112,17 @@ func (hub *DebugHub) SubReply(groupKey interface{}, finalizer func(), replyGroup
 		return errors.New("group already exists")
 	}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error("recovering failed subscription action", zap.Any("error", err))
-			return
-		}
-
-		defer func() {
-			if err := recover(); err != nil {
-				log.Error("recovering failed finalizer", zap.Any("error", err))
-			}
-		}()
-
-		if finalizer != nil {
-			finalizer()
-		}
-	}()
-
+	gate := &replyGate{}
 	group = make([]chan interface{}, 0)
 	for topic, handler := range replyGroup {
 		ch := hub.pubsub.Sub(topic)
-		hub.groups[groupKey] = group
+		group = append(group, ch)
 		quitCh := make(chan struct{})
 		hub.quits[ch] = quitCh
-		go hub.subscriptionListener(topic, ch, quitCh, hub.replyHandler(handler))
+		go hub.subscriptionListener(topic, ch, quitCh, hub.replyHandler(gate, finalizer, handler))
 	}
 
+	hub.groups[groupKey] = group
 	return nil
 }
 
@@ -155,21 +161,16 @@ func (hub *DebugHub) SubGroup(groupKey interface{}, handlerGroup RawGroup) error
 		return errors.New("group already exists")
 	}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error("recovering failed subscription action", zap.Any("error", err))
-		}
-	}()
-
 	group = make([]chan interface{}, 0)
 	for topic, handler := range handlerGroup {
 		ch := hub.pubsub.Sub(topic)
-		hub.groups[groupKey] = group
+		group = append(group, ch)
 		quitCh := make(chan struct{})
 		hub.quits[ch] = quitCh
 		go hub.subscriptionListener(topic, ch, quitCh, handler)
 	}
 
+	hub.groups[groupKey] = group
 	return nil
 }
 
@@ -190,10 +191,31 @@ func (hub *DebugHub) requestHandler(handler func(request *protocol.Request) erro
 	}
 }
 
-func (hub *DebugHub) replyHandler(handler func(reply *protocol.Reply) error) func(data []byte) error {
+func (hub *DebugHub) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) func(data []byte) error {
 	return func(data []byte) error {
-		reply, _ := UnmarshalReply(data)
-		return handler(reply)
+		var err error
+		gate.handle(func() bool {
+			reply, uerr := UnmarshalReply(data)
+			if uerr != nil {
+				log.Error("debug reply unmarshal failure", zap.Error(uerr))
+				return true
+			}
+
+			if err = handler(reply); err == ErrReplyDiscarded {
+				err = nil
+				return false
+			} else if err != nil {
+				return true
+			}
+
+			if finalizer != nil {
+				finalizer()
+			}
+
+			return true
+		})
+
+		return err
 	}
 }
 
@@ -201,11 +223,21 @@ func (hub *DebugHub) subscriptionListener(topic string, ch chan interface{}, qui
 	for {
 		select {
 		case <-quitCh:
+			// drain until the subscription is closed so publishers never block
+			go func() {
+				for range ch {
+				}
+			}()
+
 			return
-		case data := <-ch:
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+
 			if err := handler(data.([]byte)); err != nil {
 				log.Warn("subscriber failed", zap.String("topic", topic))
-				ch <- data
+				go hub.pubsub.Pub(data, topic)
 			}
 		}
 	}
@@ -282,7 +314,7 @@ func (hub *StanHub) CancelGroup(groupKey interface{}) error {
 func (hub *StanHub) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
 	hub.groupMutex.Lock()
 	defer hub.groupMutex.Unlock()
-	groupOncer := sync.Once{}
+	gate := &replyGate{}
 	subs, ok := hub.groups[groupKey]
 	if ok && len(subs) > 0 {
 		return fmt.Errorf("group already exists")
@@ -293,7 +325,7 @@ func (hub *StanHub) SubReply(groupKey interface{}, finalizer func(), replyGroup
 		log.Debug("stan new reply subscriber", zap.String("topic", topic), zap.Any("rgroup", groupKey))
 		sub, err := hub.Conn.Subscribe(
 			topic,
-			hub.replyHandler(&groupOncer, finalizer, handler),
+			hub.replyHandler(gate, finalizer, handler),
 			stan.DurableName(hub.DurableName),
 			stan.MaxInflight(1),
 			stan.SetManualAckMode(),
@@ -323,6 +355,10 @@ func (hub *StanHub) Pub(topic string, req *protocol.Request) error {
 	return nil
 }
 
+func (hub *StanHub) PubRaw(topic string, data []byte) error {
+	return hub.Conn.Publish(topic, data)
+}
+
 func (hub *StanHub) Sub(topic string, handler func(rawMessage []byte) error) error {
 	hub.subMutex.Lock()
 	defer hub.subMutex.Unlock()
@@ -386,27 +422,35 @@ func (hub *StanHub) rawHandler(handler func(rawMessage []byte) error) stan.MsgHa
 	})
 }
 
-func (hub *StanHub) replyHandler(oncer *sync.Once, finalizer func(), handler func(reply *protocol.Reply) error) stan.MsgHandler {
+func (hub *StanHub) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) stan.MsgHandler {
 	return stan.MsgHandler(func(msg *stan.Msg) {
-		oncer.Do(func() {
+		gate.handle(func() bool {
 			reply, err := UnmarshalReply(msg.Data)
 			if err != nil {
 				log.Error("stan reply unmarhsal failure", zap.Error(err))
-				return
+				return true
 			}
 
-			if err := handler(reply); err != nil {
+			discarded := false
+			if err := handler(reply); err == ErrReplyDiscarded {
+				discarded = true
+			} else if err != nil {
 				log.Error("stan handler failure", zap.Error(err))
-				return
+				return true
 			}
 
 			if err := msg.Ack(); err != nil {
 				log.Error("stan ack failure", zap.Error(err))
-				return
+				return true
 			}
 
 			log.Debug("stan ack")
+			if discarded {
+				return false
+			}
+
 			finalizer()
+			return true
 		})
 	})
 }
@@ -0,0 +1,508 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	nats "github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultJetStreamStream     = "SAKE"
+	DefaultJetStreamDurable    = "sake"
+	DefaultJetStreamAckWait    = 30 * time.Second
+	DefaultJetStreamMaxDeliver = -1
+
+	// jetStreamReplySubjects covers the reply topics of every request, see
+	// successReplyAddress and failureReplyAddress.
+	jetStreamReplySubjects = "sake.reply.>"
+
+	jetStreamAPITimeout  = 5 * time.Second
+	jetStreamPullExpiry  = 5 * time.Second
+	jetStreamReplyBatch  = 64
+	jetStreamRetryPeriod = time.Second
+)
+
+// JetStreamConfig configures the stream and consumers of a JetStreamHub.
+type JetStreamConfig struct {
+	Server string
+	// Stream is created with Subjects and the reply topics when it doesn't
+	// exist. Topics the hub publishes or subscribes to that the stream doesn't
+	// capture are added to its subjects.
+	Stream   string
+	Subjects []string
+	// Durable prefixes the names of the hub's consumers.
+	Durable string
+	// Instance names the engine in its reply consumer and must be unique to
+	// each engine and the same across restarts.
+	Instance   string
+	AckWait    time.Duration
+	MaxDeliver int
+}
+
+// JetStreamHub connects to NATS JetStream. Every topic of a raw group is read
+// by a durable pull consumer named after the group key, whose messages are
+// acknowledged once handled. Messages that aren't acknowledged within the ack
+// wait are delivered again, up to max deliver times.
+//
+// Replies are read by one durable consumer per engine,
+// "<durable>-replies-<instance>", which routes them to the reply groups of
+// its requests. A reply to a request that isn't waited for yet isn't
+// acknowledged while the engine starts, so that it's delivered again once
+// the request is resumed; later, such replies are acknowledged and dropped.
+type JetStreamHub struct {
+	Config JetStreamConfig
+	Conn   *nats.Conn
+	JS     nats.JetStreamContext
+
+	streamMutex sync.Mutex
+	// stream is the stream's config as the server last reported it and
+	// captured the topics known to be among its subjects.
+	stream   *nats.StreamConfig
+	captured map[string]bool
+
+	groupMutex sync.Mutex
+	groups     map[interface{}]*jetStreamGroup
+
+	replyMutex    sync.Mutex
+	replyConsumer *jetStreamConsumer
+	replies       *replyRouter
+}
+
+var _ HubConnector = &JetStreamHub{}
+
+// jetStreamGroup is either the consumers of a raw group or the routes of a
+// reply group.
+type jetStreamGroup struct {
+	consumers []*jetStreamConsumer
+	routes    []string
+}
+
+func NewJetStreamHub(config JetStreamConfig) (*JetStreamHub, error) {
+	if config.Stream == "" {
+		config.Stream = DefaultJetStreamStream
+	}
+
+	if config.Durable == "" {
+		config.Durable = DefaultJetStreamDurable
+	}
+
+	if config.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("jetstream instance name is required: %v", err)
+		}
+
+		config.Instance = hostname
+	}
+
+	if config.AckWait <= 0 {
+		config.AckWait = DefaultJetStreamAckWait
+	}
+
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = DefaultJetStreamMaxDeliver
+	}
+
+	conn, err := nats.Connect(config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+
+	js, err := conn.JetStream(nats.MaxWait(jetStreamAPITimeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	hub := &JetStreamHub{
+		Config:   config,
+		Conn:     conn,
+		JS:       js,
+		captured: make(map[string]bool),
+		groups:   make(map[interface{}]*jetStreamGroup),
+		replies:  newReplyRouter(),
+	}
+
+	if err := hub.ensureStream(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return hub, nil
+}
+
+// ensureStream loads the stream's config, creating the stream when it doesn't
+// exist. A created stream has interest retention: a message is removed once
+// every consumer that was interested in it when it was stored acknowledged
+// it, and messages nobody consumes aren't kept. Replies are removed once
+// every engine's reply consumer took them.
+func (hub *JetStreamHub) ensureStream() error {
+	info, err := hub.JS.StreamInfo(hub.Config.Stream)
+	if err == nil {
+		if info.Config.Retention == nats.LimitsPolicy && info.Config.MaxAge == 0 {
+			log.Warn("jetstream stream keeps messages until its limits are reached, replies will pile up", zap.String("stream", hub.Config.Stream))
+		}
+
+		hub.stream = &info.Config
+		return nil
+	} else if err != nats.ErrStreamNotFound {
+		return err
+	}
+
+	subjects := append([]string{jetStreamReplySubjects}, hub.Config.Subjects...)
+	info, err = hub.JS.AddStream(&nats.StreamConfig{
+		Name:      hub.Config.Stream,
+		Subjects:  subjects,
+		Storage:   nats.FileStorage,
+		Retention: nats.InterestPolicy,
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to create stream %q: %v", hub.Config.Stream, err)
+	}
+
+	hub.stream = &info.Config
+	log.Info("jetstream stream created", zap.String("stream", hub.Config.Stream), zap.Strings("subjects", subjects))
+	return nil
+}
+
+// capture adds topic to the stream's subjects unless one of them matches it
+// already. Publishing to a subject no stream captures would fail for lack of
+// a stream to acknowledge it.
+func (hub *JetStreamHub) capture(topic string) error {
+	hub.streamMutex.Lock()
+	defer hub.streamMutex.Unlock()
+	if hub.captured[topic] {
+		return nil
+	}
+
+	for _, subject := range hub.stream.Subjects {
+		if subjectMatches(subject, topic) {
+			hub.captured[topic] = true
+			return nil
+		}
+	}
+
+	config := *hub.stream
+	config.Subjects = append(append([]string{}, hub.stream.Subjects...), topic)
+	info, err := hub.JS.UpdateStream(&config)
+	if err != nil {
+		return fmt.Errorf("failed to add %q to stream %q: %v", topic, hub.Config.Stream, err)
+	}
+
+	hub.stream = &info.Config
+	hub.captured[topic] = true
+	log.Info("jetstream stream subject added", zap.String("stream", hub.Config.Stream), zap.String("subject", topic))
+	return nil
+}
+
+// subjectMatches reports whether the subject pattern, which may contain the
+// * and > wildcards, matches subject.
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		} else if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// consumerName derives a durable name from the group key and topic.
+func (hub *JetStreamHub) consumerName(groupKey interface{}, topic string) string {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return jetStreamName(fmt.Sprintf("%s-%v-%08x", hub.Config.Durable, groupKey, h.Sum32()))
+}
+
+// replyConsumerName is the durable name of the engine's reply consumer.
+func (hub *JetStreamHub) replyConsumerName() string {
+	return jetStreamName(hub.Config.Durable + "-replies-" + hub.Config.Instance)
+}
+
+// jetStreamName replaces the characters that names can't contain, the
+// separators and wildcards of subjects among them.
+func jetStreamName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// subscribe creates or resumes the durable consumer name, which reads the
+// subjects matching filter, and starts pulling its messages in batches. The
+// filter is added to the stream's subjects first. New consumers only receive
+// messages published from now on. The consumer is created before binding to
+// it, so that unsubscribing doesn't delete it.
+func (hub *JetStreamHub) subscribe(name string, filter string, batch int, handler func(msg *nats.Msg)) (*jetStreamConsumer, error) {
+	if err := hub.capture(filter); err != nil {
+		return nil, err
+	}
+
+	_, err := hub.JS.AddConsumer(hub.Config.Stream, &nats.ConsumerConfig{
+		Durable:       name,
+		DeliverPolicy: nats.DeliverNewPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       hub.Config.AckWait,
+		MaxDeliver:    hub.Config.MaxDeliver,
+		FilterSubject: filter,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %q: %v", name, err)
+	}
+
+	sub, err := hub.JS.PullSubscribe(filter, name, nats.Bind(hub.Config.Stream, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind consumer %q: %v", name, err)
+	}
+
+	consumer := &jetStreamConsumer{
+		name:   name,
+		sub:    sub,
+		quitCh: make(chan struct{}),
+	}
+
+	go consumer.pull(batch, handler)
+	return consumer, nil
+}
+
+func (hub *JetStreamHub) CancelAll() error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	for _, group := range hub.groups {
+		for _, consumer := range group.consumers {
+			consumer.stop()
+		}
+	}
+
+	// consumers are kept so they resume where they left off
+	hub.groups = make(map[interface{}]*jetStreamGroup)
+	hub.replyMutex.Lock()
+	defer hub.replyMutex.Unlock()
+	if hub.replyConsumer != nil {
+		hub.replyConsumer.stop()
+		hub.replyConsumer = nil
+	}
+
+	hub.replies.reset()
+	return nil
+}
+
+func (hub *JetStreamHub) CancelGroup(groupKey interface{}) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	log.Debug("jetstream cancel group", zap.Any("group", groupKey))
+	group, ok := hub.groups[groupKey]
+	if !ok {
+		return nil
+	}
+
+	delete(hub.groups, groupKey)
+	hub.replies.remove(group.routes)
+	for _, consumer := range group.consumers {
+		consumer.stop()
+	}
+
+	for _, consumer := range group.consumers {
+		if err := hub.JS.DeleteConsumer(hub.Config.Stream, consumer.name); err != nil && err != nats.ErrConsumerNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (hub *JetStreamHub) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	gate := &replyGate{}
+	group := &jetStreamGroup{}
+	handlers := make(map[string]func(data []byte))
+	for topic, handler := range replyGroup {
+		log.Debug("jetstream new reply route", zap.String("topic", topic), zap.Any("rgroup", groupKey))
+		handlers[topic] = hub.replyHandler(gate, finalizer, handler)
+		group.routes = append(group.routes, topic)
+	}
+
+	hub.replyMutex.Lock()
+	if hub.replyConsumer == nil {
+		consumer, err := hub.subscribe(hub.replyConsumerName(), jetStreamReplySubjects, jetStreamReplyBatch, hub.routeReply)
+		if err != nil {
+			hub.replyMutex.Unlock()
+			return err
+		}
+
+		hub.replyConsumer = consumer
+	}
+
+	hub.replyMutex.Unlock()
+	hub.replies.add(handlers)
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *JetStreamHub) SubGroup(groupKey interface{}, handlerGroup RawGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	group := &jetStreamGroup{}
+	for topic, handler := range handlerGroup {
+		name := hub.consumerName(groupKey, topic)
+		consumer, err := hub.subscribe(name, topic, 1, hub.rawHandler(handler))
+		if err != nil {
+			for _, c := range group.consumers {
+				c.stop()
+			}
+
+			return err
+		}
+
+		log.Debug("jetstream new consumer", zap.String("topic", topic), zap.String("consumer", name), zap.Any("group", groupKey))
+		group.consumers = append(group.consumers, consumer)
+	}
+
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *JetStreamHub) Pub(topic string, req *protocol.Request) error {
+	data, err := MarshalRequest(req)
+	if err != nil {
+		return err
+	}
+
+	return hub.PubRaw(topic, data)
+}
+
+// PubRaw publishes data and waits for the stream to store it.
+func (hub *JetStreamHub) PubRaw(topic string, data []byte) error {
+	if err := hub.capture(topic); err != nil {
+		return err
+	}
+
+	_, err := hub.JS.Publish(topic, data)
+	return err
+}
+
+// rawHandler acknowledges messages that were handled. Others are delivered
+// again once the ack wait passes.
+func (hub *JetStreamHub) rawHandler(handler func(rawMessage []byte) error) func(msg *nats.Msg) {
+	return func(msg *nats.Msg) {
+		if err := handler(msg.Data); err == nil {
+			if err := msg.Ack(); err != nil {
+				log.Error("jetstream ack failure", zap.Error(err))
+				return
+			}
+
+			log.Debug("jetstream ack")
+		}
+	}
+}
+
+// routeReply hands a reply to the reply group of its topic and acknowledges
+// it, unless its topic isn't routed yet while the engine starts.
+func (hub *JetStreamHub) routeReply(msg *nats.Msg) {
+	if err := hub.replies.deliver(msg.Subject, msg.Data); err != nil {
+		// delivered again once the ack wait passes
+		return
+	}
+
+	if err := msg.Ack(); err != nil {
+		log.Error("jetstream ack failure", zap.Error(err))
+	}
+}
+
+func (hub *JetStreamHub) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) func(data []byte) {
+	return func(data []byte) {
+		gate.handle(func() bool {
+			reply, err := UnmarshalReply(data)
+			if err != nil {
+				log.Error("jetstream reply unmarshal failure", zap.Error(err))
+				return true
+			}
+
+			if err := handler(reply); err == ErrReplyDiscarded {
+				return false
+			} else if err != nil {
+				log.Error("jetstream handler failure", zap.Error(err))
+				return true
+			}
+
+			finalizer()
+			return true
+		})
+	}
+}
+
+// jetStreamConsumer pulls the messages of a durable consumer.
+type jetStreamConsumer struct {
+	name   string
+	sub    *nats.Subscription
+	quitCh chan struct{}
+	once   sync.Once
+}
+
+func (consumer *jetStreamConsumer) pull(batch int, handler func(msg *nats.Msg)) {
+	for {
+		msgs, err := consumer.sub.Fetch(batch, nats.MaxWait(jetStreamPullExpiry))
+		select {
+		case <-consumer.quitCh:
+			// fetched messages are delivered again once the ack wait passes
+			return
+		default:
+		}
+
+		if err == nats.ErrTimeout {
+			continue
+		} else if err != nil {
+			log.Error("jetstream pull failure", zap.String("consumer", consumer.name), zap.Error(err))
+			select {
+			case <-consumer.quitCh:
+				return
+			case <-time.After(jetStreamRetryPeriod):
+			}
+
+			continue
+		}
+
+		for _, msg := range msgs {
+			handler(msg)
+		}
+	}
+}
+
+// stop ends the pull loop without waiting for a handler that is running.
+// The durable consumer is kept.
+func (consumer *jetStreamConsumer) stop() {
+	consumer.once.Do(func() {
+		close(consumer.quitCh)
+		if err := consumer.sub.Unsubscribe(); err != nil {
+			log.Error("jetstream unsubscribe failure", zap.String("consumer", consumer.name), zap.Error(err))
+		}
+	})
+}
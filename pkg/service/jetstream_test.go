@@ -0,0 +1,38 @@
+package service
+
+import "testing"
+
+func TestSubjectMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		subject string
+		want    bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.updated", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{"*.created", "orders.created", true},
+		{"sake.reply.>", "sake.reply.ok.t1@orders.create", true},
+		{"sake.>", "sake.reply.>", true},
+	}
+
+	for _, c := range cases {
+		if got := subjectMatches(c.pattern, c.subject); got != c.want {
+			t.Errorf("%s matching %s: got %v, want %v", c.pattern, c.subject, got, c.want)
+		}
+	}
+}
+
+func TestJetStreamNames(t *testing.T) {
+	hub := &JetStreamHub{Config: JetStreamConfig{Durable: "sake", Instance: "engine.1"}}
+	if name := hub.replyConsumerName(); name != "sake-replies-engine_1" {
+		t.Errorf("expected the reply consumer sake-replies-engine_1, got %s", name)
+	}
+
+	if a, b := hub.consumerName("r1", "orders.*"), hub.consumerName("r1", "orders.>"); a == b {
+		t.Errorf("expected the consumers of different topics to differ, both are %s", a)
+	}
+}
@@ -0,0 +1,4 @@
+// Package jetstreamtest tests the jetstream hub against an embedded NATS
+// server. It's a module of its own so that the server isn't among the
+// dependencies of sake; run its tests from this directory.
+package jetstreamtest
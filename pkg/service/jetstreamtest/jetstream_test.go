@@ -0,0 +1,289 @@
+package jetstreamtest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service"
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// testServer is an embedded NATS server with JetStream.
+type testServer struct {
+	*server.Server
+	dir string
+}
+
+func runServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "sake-jetstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		ns.Shutdown()
+		os.RemoveAll(dir)
+		t.Fatal("nats server isn't ready")
+	}
+
+	return &testServer{Server: ns, dir: dir}
+}
+
+func (ns *testServer) stop() {
+	ns.Shutdown()
+	os.RemoveAll(ns.dir)
+}
+
+// newHub connects the engine named instance to the server.
+func newHub(t *testing.T, ns *testServer, instance string, subjects ...string) *service.JetStreamHub {
+	hub, err := service.NewJetStreamHub(service.JetStreamConfig{
+		Server:   ns.ClientURL(),
+		Subjects: subjects,
+		Instance: instance,
+		AckWait:  200 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hub
+}
+
+func closeHub(hub *service.JetStreamHub) {
+	hub.CancelAll()
+	hub.Conn.Close()
+}
+
+func publishReply(t *testing.T, hub *service.JetStreamHub, topic string, requestID string) {
+	data, err := service.MarshalReply(&protocol.Reply{RequestID: requestID, Outcome: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hub.PubRaw(topic, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForEmptyStream fails unless the hub's stream drops every message.
+func waitForEmptyStream(t *testing.T, hub *service.JetStreamHub) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := hub.JS.StreamInfo(hub.Config.Stream)
+		if err != nil {
+			t.Fatal(err)
+		} else if info.State.Msgs == 0 {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("stream still holds %d messages", info.State.Msgs)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// consumerNames lists the consumers of the hub's stream.
+func consumerNames(hub *service.JetStreamHub) []string {
+	names := make([]string, 0)
+	for name := range hub.JS.ConsumerNames(hub.Config.Stream) {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func TestTriggers(t *testing.T) {
+	ns := runServer(t)
+	defer ns.stop()
+	hub := newHub(t, ns, "e1", "orders.>")
+	defer closeHub(hub)
+	received := make(chan string, 2)
+	err := hub.SubGroup("r1", service.RawGroup{
+		"checkout.start": func(data []byte) error {
+			received <- string(data)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkout.start isn't among the subjects the stream was created with
+	if err := hub.PubRaw("checkout.start", []byte("trigger")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if data != "trigger" {
+			t.Fatalf("expected the trigger, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("trigger wasn't received")
+	}
+
+	info, err := hub.JS.StreamInfo(hub.Config.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captured := false
+	for _, subject := range info.Config.Subjects {
+		captured = captured || subject == "checkout.start"
+	}
+
+	if !captured {
+		t.Errorf("expected checkout.start to be added to the stream, its subjects are %v", info.Config.Subjects)
+	}
+
+	if err := hub.PubRaw("orders.created", []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	// unloading the recipe version deletes its consumer
+	if err := hub.CancelGroup("r1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(consumerNames(hub)); n != 0 {
+		t.Fatalf("expected the trigger consumer to be deleted, %d consumers are left", n)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	ns := runServer(t)
+	defer ns.stop()
+	hub := newHub(t, ns, "e1")
+	defer closeHub(hub)
+	topic := "sake.reply.ok.t1@orders.create"
+	replies := make(chan *protocol.Reply, 2)
+	finalized := make(chan struct{}, 1)
+	err := hub.SubReply("q1", func() { finalized <- struct{}{} }, service.ReplyGroup{
+		topic: func(reply *protocol.Reply) error {
+			replies <- reply
+			if reply.RequestID != "q1" {
+				return service.ErrReplyDiscarded
+			}
+
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishReply(t, hub, topic, "q0")
+	publishReply(t, hub, topic, "q1")
+	select {
+	case <-finalized:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply wasn't handled")
+	}
+
+	if len(replies) != 2 {
+		t.Fatalf("expected the stale and the current reply, got %d replies", len(replies))
+	}
+
+	// acknowledged replies aren't kept by the stream
+	waitForEmptyStream(t, hub)
+	if err := hub.CancelGroup("q1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the engine's reply consumer is kept for the replies of other requests
+	names := consumerNames(hub)
+	if len(names) != 1 || names[0] != "sake-replies-e1" {
+		t.Fatalf("expected the reply consumer to be kept, the consumers are %v", names)
+	}
+}
+
+func TestUnroutedRepliesAreRedelivered(t *testing.T) {
+	ns := runServer(t)
+	defer ns.stop()
+	hub := newHub(t, ns, "e1")
+	defer closeHub(hub)
+	other := service.ReplyGroup{"sake.reply.ok.t0@a": func(*protocol.Reply) error { return nil }}
+	if err := hub.SubReply("q0", func() {}, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// t1 isn't resumed yet when its reply is delivered
+	publishReply(t, hub, "sake.reply.ok.t1@a", "q1")
+	time.Sleep(500 * time.Millisecond)
+	finalized := make(chan struct{}, 1)
+	err := hub.SubReply("q1", func() { finalized <- struct{}{} }, service.ReplyGroup{
+		"sake.reply.ok.t1@a": func(reply *protocol.Reply) error { return nil },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-finalized:
+	case <-time.After(5 * time.Second):
+		t.Fatal("redelivered reply wasn't handled")
+	}
+
+	waitForEmptyStream(t, hub)
+}
+
+func TestRepliesPerEngine(t *testing.T) {
+	ns := runServer(t)
+	defer ns.stop()
+	finalized := make(chan string, 2)
+	for _, instance := range []string{"e1", "e2"} {
+		instance := instance
+		hub := newHub(t, ns, instance)
+		defer closeHub(hub)
+		err := hub.SubReply("q-"+instance, func() { finalized <- instance }, service.ReplyGroup{
+			"sake.reply.ok.t-" + instance + "@a": func(reply *protocol.Reply) error { return nil },
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both engines read every reply, and each takes the one to its request
+	hub := newHub(t, ns, "e3")
+	defer closeHub(hub)
+	publishReply(t, hub, "sake.reply.ok.t-e1@a", "q-e1")
+	publishReply(t, hub, "sake.reply.ok.t-e2@a", "q-e2")
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		select {
+		case instance := <-finalized:
+			got[instance] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only the replies of %v were handled", got)
+		}
+	}
+}
+
+func TestUnconsumedReplies(t *testing.T) {
+	ns := runServer(t)
+	defer ns.stop()
+	hub := newHub(t, ns, "e1")
+	defer closeHub(hub)
+
+	// nobody is interested in replies before an engine waits for one
+	if err := hub.PubRaw("sake.reply.ok.t1@a", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForEmptyStream(t, hub)
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventCreated        EventType = "created"
+	EventStepped                  = "stepped"
+	EventDispatched               = "dispatched"
+	EventReplied                  = "replied"
+	EventTimedOut                 = "timed_out"
+	EventRetryScheduled           = "retry_scheduled"
+	EventRetryStarted             = "retry_started"
+	EventCommitted                = "committed"
+	EventParked                   = "parked"
+	EventCompleted                = "completed"
+	// EventOperator records a manual action; Action holds which one.
+	EventOperator = "operator"
+)
+
+// TransactionEvent is an immutable record of a change to a transaction.
+// Events carry the values the change produced, rather than its inputs, so
+// that replaying them doesn't depend on the recipe or the clock.
+type TransactionEvent struct {
+	TransactionID string           `json:"transaction_id"`
+	Seq           int64            `json:"seq"`
+	Type          EventType        `json:"type"`
+	Time          time.Time        `json:"time"`
+	State         TransactionState `json:"state,omitempty"`
+	StageKey      string           `json:"stage,omitempty"`
+	StageTopic    string           `json:"topic,omitempty"`
+	RequestID     string           `json:"request_id,omitempty"`
+	Branch        string           `json:"branch,omitempty"`
+	Attempt       int              `json:"attempt,omitempty"`
+	Success       bool             `json:"success,omitempty"`
+	Outcome       string           `json:"outcome,omitempty"`
+	Data          []byte           `json:"data,omitempty"`
+	Expires       *time.Time       `json:"expires,omitempty"`
+	RetryAt       *time.Time       `json:"retry_at,omitempty"`
+	Path          []*PathNode      `json:"path,omitempty"`
+	Branches      []*ActiveBranch  `json:"branches,omitempty"`
+	RecipeID      string           `json:"recipe_id,omitempty"`
+	RecipeName    string           `json:"recipe_name,omitempty"`
+	RecipeVersion int              `json:"recipe_version,omitempty"`
+	Reason        string           `json:"reason,omitempty"`
+	Action        string           `json:"action,omitempty"`
+	Operator      string           `json:"operator,omitempty"`
+	// IdempotencyKey and the trace context are only set on created events.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	CorrelationID  string `json:"correlation_id,omitempty"`
+	Traceparent    string `json:"traceparent,omitempty"`
+	Tracestate     string `json:"tracestate,omitempty"`
+	// Metadata is the transaction's metadata on created events and the
+	// metadata a reply added on replied events.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Trace is set on created and stepped events of traced transactions.
+	Trace *TraceSpans `json:"trace,omitempty"`
+	// Failure is set on replied events of failure replies.
+	Failure *StageFailure `json:"failure,omitempty"`
+}
+
+// EventJournal is implemented by storage services that keep the event history
+// of transactions. Events are appended in Seq order and never modified.
+type EventJournal interface {
+	AppendEvents(ctx context.Context, events ...*TransactionEvent) error
+	// LoadEvents returns the events of a transaction with a Seq after
+	// afterSeq, in order.
+	LoadEvents(ctx context.Context, trxID string, afterSeq int64) ([]*TransactionEvent, error)
+}
+
+// Apply replays an event onto the transaction.
+func (trx *Transaction) Apply(event *TransactionEvent) {
+	trx.Seq = event.Seq
+	switch event.Type {
+	case EventCreated:
+		trx.ID = event.TransactionID
+		trx.State = IsInitializing
+		trx.Data = event.Data
+		trx.Started = event.Time
+		trx.RecipeID = event.RecipeID
+		trx.RecipeName = event.RecipeName
+		trx.RecipeVersion = event.RecipeVersion
+		trx.IdempotencyKey = event.IdempotencyKey
+		trx.CorrelationID = event.CorrelationID
+		trx.Traceparent = event.Traceparent
+		trx.Tracestate = event.Tracestate
+		trx.Metadata = mergeMetadata(nil, event.Metadata)
+		trx.Trace = event.Trace.copy()
+
+	case EventStepped:
+		trx.State = event.State
+		trx.StageKey = event.StageKey
+		trx.StageTopic = event.StageTopic
+		trx.StageStarted = event.Time
+		trx.Expires = event.Expires
+		trx.ExecutedPath = event.Path
+		trx.Branches = event.Branches
+		if event.Trace != nil {
+			trx.Trace = event.Trace.copy()
+		}
+		trx.Outcome = ""
+		trx.RequestID = ""
+		trx.Attempt = 1
+		trx.RetryAt = nil
+
+	case EventDispatched:
+		if event.Branch == "" {
+			trx.RequestID = event.RequestID
+		} else if branch := trx.branch(event.Branch); branch != nil {
+			branch.RequestID = event.RequestID
+		}
+
+	case EventReplied:
+		if event.Branch == "" {
+			trx.RepliedRequestID = event.RequestID
+		}
+
+		trx.mergeMetadata(event.Metadata)
+		if event.Failure != nil {
+			trx.Failures = append(trx.Failures, event.Failure)
+		}
+
+		if event.Data != nil {
+			trx.Data = event.Data
+		}
+
+		if event.Branch != "" {
+			if branch := trx.branch(event.Branch); branch != nil {
+				trx.markBranch(branch, event.Success)
+			}
+		} else if event.Success {
+			trx.SetOutcome(event.Outcome)
+		}
+
+	case EventRetryScheduled:
+		trx.Attempt = event.Attempt
+		trx.RetryAt = event.RetryAt
+		trx.Expires = nil
+
+	case EventRetryStarted:
+		trx.RetryAt = nil
+		trx.StageStarted = event.Time
+		trx.Expires = event.Expires
+		trx.RequestID = ""
+
+	case EventCommitted, EventCompleted:
+		trx.State = event.State
+
+	case EventParked:
+		trx.Park(event.Reason)
+
+	case EventOperator:
+		trx.applyOperation(event)
+	}
+}
+
+func (trx *Transaction) applyOperation(event *TransactionEvent) {
+	switch event.Action {
+	case ActionRetry, ActionResume:
+		if event.Action == ActionResume {
+			trx.State = event.State
+			trx.Reason = ""
+			trx.Branches = event.Branches
+		}
+
+		trx.RetryAt = nil
+		trx.StageStarted = event.Time
+		trx.Expires = event.Expires
+		trx.Attempt = event.Attempt
+		trx.RequestID = ""
+
+	case ActionSucceed, ActionFail:
+		trx.State = event.State
+		trx.Reason = ""
+		if event.Data != nil {
+			trx.Data = event.Data
+		}
+	}
+}
+
+// ReplayTransaction rebuilds a transaction from a snapshot, which may be nil,
+// and the events recorded after it.
+func ReplayTransaction(snapshot *Transaction, events []*TransactionEvent) *Transaction {
+	trx := snapshot
+	if trx == nil {
+		trx = &Transaction{}
+	}
+
+	for _, event := range events {
+		if event.Seq > trx.Seq {
+			trx.Apply(event)
+		}
+	}
+
+	return trx
+}
+
+// replayActive rebuilds the transactions from their snapshots and, for
+// transactions that were never snapshotted, from their journal alone. Only
+// transactions that aren't completed are returned.
+func replayActive(ctx context.Context, journal EventJournal, snapshots []*Transaction, unsnapshotted []string) ([]*Transaction, error) {
+	result := make([]*Transaction, 0)
+	replay := func(trxID string, snapshot *Transaction) error {
+		var after int64
+		if snapshot != nil {
+			after = snapshot.Seq
+		}
+
+		events, err := journal.LoadEvents(ctx, trxID, after)
+		if err != nil {
+			return err
+		}
+
+		if snapshot == nil && len(events) < 1 {
+			return nil
+		}
+
+		trx := ReplayTransaction(snapshot, events)
+		trx.snapshotSeq = after
+		if !trx.IsCompleted() {
+			result = append(result, trx)
+		}
+
+		return nil
+	}
+
+	for _, snapshot := range snapshots {
+		if err := replay(snapshot.ID, snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, trxID := range unsnapshotted {
+		if err := replay(trxID, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
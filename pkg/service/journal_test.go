@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// memoryJournal is an EventJournal of events kept in memory.
+type memoryJournal map[string][]*TransactionEvent
+
+func (journal memoryJournal) AppendEvents(ctx context.Context, events ...*TransactionEvent) error {
+	for _, event := range events {
+		journal[event.TransactionID] = append(journal[event.TransactionID], event)
+	}
+
+	return nil
+}
+
+func (journal memoryJournal) LoadEvents(ctx context.Context, trxID string, afterSeq int64) ([]*TransactionEvent, error) {
+	events := make([]*TransactionEvent, 0)
+	for _, event := range journal[trxID] {
+		if event.Seq > afterSeq {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// checkoutEvents is the journal of a transaction that ran a parallel stage,
+// retried a stage and succeeded.
+func checkoutEvents(trxID string, start time.Time) []*TransactionEvent {
+	expires := start.Add(time.Minute)
+	retryAt := start.Add(2 * time.Second)
+	events := []*TransactionEvent{
+		{Type: EventCreated, Time: start, Data: []byte(`{"n":1}`), RecipeID: "r1", RecipeName: "checkout"},
+		{Type: EventStepped, Time: start, State: IsExecuting, StageKey: "reserve", Path: []*PathNode{{Key: "reserve"}}, Branches: []*ActiveBranch{
+			{Key: "stock", Topic: "stock.reserve", State: BranchPending},
+			{Key: "credit", Topic: "credit.reserve", State: BranchPending},
+		}},
+		{Type: EventDispatched, StageKey: "reserve", Branch: "stock", RequestID: "q1"},
+		{Type: EventDispatched, StageKey: "reserve", Branch: "credit", RequestID: "q2"},
+		{Type: EventReplied, Branch: "stock", Success: true},
+		{Type: EventReplied, Branch: "credit", Success: true, Data: []byte(`{"n":2}`)},
+		{Type: EventStepped, Time: start.Add(time.Second), State: IsExecuting, StageKey: "pay", StageTopic: "pay", Expires: &expires, Path: []*PathNode{
+			{Key: "reserve", Branches: []*PathNode{{Key: "stock"}, {Key: "credit"}}},
+			{Key: "pay"},
+		}},
+		{Type: EventDispatched, StageKey: "pay", StageTopic: "pay", RequestID: "q3", Attempt: 1},
+		{Type: EventRetryScheduled, StageKey: "pay", Attempt: 2, RetryAt: &retryAt},
+		{Type: EventRetryStarted, Time: retryAt, Expires: &expires},
+		{Type: EventDispatched, StageKey: "pay", StageTopic: "pay", RequestID: "q4", Attempt: 2},
+		{Type: EventReplied, RequestID: "q4", Success: true, Outcome: "paid"},
+		{Type: EventCompleted, State: IsSuccess},
+	}
+
+	for i, event := range events {
+		event.TransactionID = trxID
+		event.Seq = int64(i + 1)
+	}
+
+	return events
+}
+
+func TestReplayTransaction(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	events := checkoutEvents("t1", start)
+	trx := ReplayTransaction(nil, events[:11])
+	if trx.ID != "t1" || trx.RecipeName != "checkout" || trx.State != IsExecuting || trx.StageKey != "pay" {
+		t.Fatalf("unexpected transaction %s of %q in %s at %q", trx.ID, trx.RecipeName, trx.State, trx.StageKey)
+	}
+
+	if string(trx.Data) != `{"n":2}` {
+		t.Errorf("expected the data of the last reply, got %s", trx.Data)
+	}
+
+	if trx.Seq != 11 || trx.Attempt != 2 || trx.RequestID != "q4" || trx.RetryAt != nil {
+		t.Errorf("expected the second attempt q4 at seq 11, got attempt %d %q at seq %d retrying at %v", trx.Attempt, trx.RequestID, trx.Seq, trx.RetryAt)
+	}
+
+	want := []*PathNode{{Key: "reserve", Branches: []*PathNode{{Key: "stock"}, {Key: "credit"}}}, {Key: "pay"}}
+	if !reflect.DeepEqual(trx.ExecutedPath, want) {
+		t.Errorf("unexpected path %+v", trx.ExecutedPath)
+	}
+
+	trx = ReplayTransaction(trx, events)
+	if trx.State != IsSuccess || trx.Outcome != "paid" || trx.Seq != 13 {
+		t.Fatalf("expected success with outcome paid at seq 13, got %s with %q at seq %d", trx.State, trx.Outcome, trx.Seq)
+	}
+
+	if trx.ExecutedPath[1].Outcome != "paid" {
+		t.Errorf("expected the outcome on the path, got %+v", trx.ExecutedPath[1])
+	}
+}
+
+func TestReplayBranches(t *testing.T) {
+	events := checkoutEvents("t1", time.Now())
+	trx := ReplayTransaction(nil, events[:5])
+	if len(trx.Branches) != 2 {
+		t.Fatalf("expected 2 branches, got %d", len(trx.Branches))
+	}
+
+	stock, credit := trx.Branches[0], trx.Branches[1]
+	if stock.State != BranchSucceeded || stock.RequestID != "q1" {
+		t.Errorf("expected stock to have succeeded on q1, got %s on %q", stock.State, stock.RequestID)
+	}
+
+	if credit.State != BranchPending || credit.RequestID != "q2" {
+		t.Errorf("expected credit to be pending on q2, got %s on %q", credit.State, credit.RequestID)
+	}
+
+	if branches := trx.ExecutedPath[0].Branches; len(branches) != 1 || branches[0].Key != "stock" {
+		t.Errorf("expected only stock on the path, got %+v", branches)
+	}
+}
+
+func TestReplayActive(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	journal := memoryJournal{}
+	for _, trxID := range []string{"t1", "t2", "t3"} {
+		events := checkoutEvents(trxID, start)
+		if trxID == "t3" {
+			events = events[:11]
+		}
+
+		if err := journal.AppendEvents(ctx, events...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// t1 was snapshotted mid-way and completed since, t2 was never
+	// snapshotted and completed, t3 is still running
+	snapshot := ReplayTransaction(nil, journal["t1"][:4])
+	active, err := replayActive(ctx, journal, []*Transaction{snapshot}, []string{"t2", "t3", "t4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(active) != 1 || active[0].ID != "t3" {
+		t.Fatalf("expected only t3 to be active, got %d transactions", len(active))
+	}
+
+	if trx := active[0]; trx.snapshotSeq != 0 || trx.Seq != 11 || trx.StageKey != "pay" {
+		t.Errorf("expected t3 at stage pay replayed to seq 11, got %q at seq %d from %d", trx.StageKey, trx.Seq, trx.snapshotSeq)
+	}
+
+	snapshot = ReplayTransaction(nil, journal["t3"][:4])
+	active, err = replayActive(ctx, journal, []*Transaction{snapshot}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(active) != 1 || active[0] != snapshot || snapshot.snapshotSeq != 4 || snapshot.Seq != 11 {
+		t.Fatalf("expected the t3 snapshot to be replayed from seq 4, got %d transactions", len(active))
+	}
+}
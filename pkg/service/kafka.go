@@ -0,0 +1,403 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	kafka "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultKafkaGroupID    = "sake"
+	DefaultKafkaReplyTopic = "sake.replies"
+
+	// KafkaReplyTopicHeader names the topic that replies to a request are
+	// produced to, keyed by the reply topic of the request.
+	KafkaReplyTopicHeader = "Sake-Reply-Topic"
+
+	kafkaRetryBackoff    = time.Second
+	kafkaMaxRetryBackoff = 30 * time.Second
+)
+
+// KafkaConfig configures the brokers and consumer groups of a KafkaHub.
+type KafkaConfig struct {
+	Brokers []string
+	// GroupID prefixes the consumer groups of triggers and replies. Engines
+	// with the same GroupID share the triggers of their recipes.
+	GroupID string
+	// Instance names the engine in its reply consumer group and must be
+	// unique to each engine and the same across restarts.
+	Instance   string
+	ReplyTopic string
+}
+
+// KafkaHub connects to Kafka. Topics of a group are consumed by the consumer
+// group "<group_id>.<topic>", whose offsets are committed once messages are
+// handled, so that a new version of a recipe continues where the previous one
+// stopped. Requests are keyed by their transaction ID, which keeps the
+// requests of a transaction in order.
+//
+// Replies aren't produced to the reply topics of requests, which would be a
+// topic per request, but to the shared reply topic keyed by the reply topic.
+// Each engine reads every reply in its own consumer group,
+// "<group_id>.<reply_topic>.<instance>", routes the replies to the reply
+// groups of its requests and drops the others. Replies to requests that
+// aren't waited for yet are parked while the engine starts, and a reply's
+// offset is only committed once it and the replies before it in its
+// partition were handled or dropped.
+type KafkaHub struct {
+	Config KafkaConfig
+
+	groupMutex sync.Mutex
+	groups     map[interface{}]*kafkaGroup
+
+	writerMutex sync.Mutex
+	writers     map[string]*kafka.Writer
+
+	replyMutex  sync.Mutex
+	replyReader *kafkaReader
+	replies     *replyRouter
+}
+
+var _ HubConnector = &KafkaHub{}
+
+// kafkaGroup is either the readers of a raw group or the routes of a reply
+// group.
+type kafkaGroup struct {
+	readers []*kafkaReader
+	routes  []string
+}
+
+func NewKafkaHub(config KafkaConfig) (*KafkaHub, error) {
+	if len(config.Brokers) < 1 {
+		return nil, errors.New("kafka brokers are required")
+	}
+
+	if config.GroupID == "" {
+		config.GroupID = DefaultKafkaGroupID
+	}
+
+	if config.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("kafka instance name is required: %v", err)
+		}
+
+		config.Instance = hostname
+	}
+
+	if config.ReplyTopic == "" {
+		config.ReplyTopic = DefaultKafkaReplyTopic
+	}
+
+	return &KafkaHub{
+		Config:  config,
+		groups:  make(map[interface{}]*kafkaGroup),
+		writers: make(map[string]*kafka.Writer),
+		replies: newReplyRouter(),
+	}, nil
+}
+
+func (hub *KafkaHub) CancelAll() error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	for _, group := range hub.groups {
+		for _, reader := range group.readers {
+			reader.stop()
+		}
+	}
+
+	hub.groups = make(map[interface{}]*kafkaGroup)
+	hub.replyMutex.Lock()
+	defer hub.replyMutex.Unlock()
+	if hub.replyReader != nil {
+		hub.replyReader.stop()
+		hub.replyReader = nil
+	}
+
+	hub.replies.reset()
+	return nil
+}
+
+func (hub *KafkaHub) CancelGroup(groupKey interface{}) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	log.Debug("kafka cancel group", zap.Any("group", groupKey))
+	group, ok := hub.groups[groupKey]
+	if !ok {
+		return nil
+	}
+
+	delete(hub.groups, groupKey)
+	for _, reader := range group.readers {
+		reader.stop()
+	}
+
+	hub.replies.remove(group.routes)
+	return nil
+}
+
+func (hub *KafkaHub) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	gate := &replyGate{}
+	group := &kafkaGroup{}
+	handlers := make(map[string]func(data []byte))
+	for topic, handler := range replyGroup {
+		log.Debug("kafka new reply route", zap.String("topic", topic), zap.Any("rgroup", groupKey))
+		handlers[topic] = hub.replyHandler(gate, finalizer, handler)
+		group.routes = append(group.routes, topic)
+	}
+
+	hub.replyMutex.Lock()
+	if hub.replyReader == nil {
+		hub.replyReader = hub.readReplies()
+	}
+
+	hub.replyMutex.Unlock()
+	hub.replies.add(handlers)
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *KafkaHub) SubGroup(groupKey interface{}, handlerGroup RawGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	group := &kafkaGroup{}
+	for topic, handler := range handlerGroup {
+		log.Debug("kafka new raw subscriber", zap.String("topic", topic), zap.Any("group", groupKey))
+		handler := handler
+		group.readers = append(group.readers, hub.read(topic, func(msg kafka.Message) error {
+			return handler(msg.Value)
+		}))
+	}
+
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *KafkaHub) Pub(topic string, req *protocol.Request) error {
+	data, err := MarshalRequest(req)
+	if err != nil {
+		return err
+	}
+
+	return hub.write(topic, kafka.Message{
+		Key:   []byte(req.TransactionID),
+		Value: data,
+		Headers: []kafka.Header{
+			{Key: KafkaReplyTopicHeader, Value: []byte(hub.Config.ReplyTopic)},
+		},
+	})
+}
+
+func (hub *KafkaHub) PubRaw(topic string, data []byte) error {
+	return hub.write(topic, kafka.Message{Value: data})
+}
+
+// write produces a message and waits for every in-sync replica to store it.
+func (hub *KafkaHub) write(topic string, msg kafka.Message) error {
+	hub.writerMutex.Lock()
+	writer, ok := hub.writers[topic]
+	if !ok {
+		writer = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      hub.Config.Brokers,
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: -1,
+		})
+
+		hub.writers[topic] = writer
+	}
+
+	hub.writerMutex.Unlock()
+	return writer.WriteMessages(context.Background(), msg)
+}
+
+func (hub *KafkaHub) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) func(data []byte) {
+	return func(data []byte) {
+		gate.handle(func() bool {
+			reply, err := UnmarshalReply(data)
+			if err != nil {
+				log.Error("kafka reply unmarshal failure", zap.Error(err))
+				return true
+			}
+
+			if err := handler(reply); err == ErrReplyDiscarded {
+				return false
+			} else if err != nil {
+				log.Error("kafka handler failure", zap.Error(err))
+				return true
+			}
+
+			finalizer()
+			return true
+		})
+	}
+}
+
+// read consumes topic in the topic's consumer group until the reader is
+// stopped. A message is committed once handled; when the handler fails, it's
+// handled again after a backoff.
+func (hub *KafkaHub) read(topic string, handler func(msg kafka.Message) error) *kafkaReader {
+	ctx, reader := hub.newReader(hub.Config.GroupID+"."+topic, topic)
+	go func() {
+		for {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("kafka fetch failure", zap.String("topic", topic), zap.Error(err))
+				}
+
+				return
+			}
+
+			backoff := kafkaRetryBackoff
+			for {
+				if err := handler(msg); err == nil {
+					break
+				}
+
+				log.Warn("subscriber failed", zap.String("topic", topic), zap.Duration("backoff", backoff))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+
+				if backoff *= 2; backoff > kafkaMaxRetryBackoff {
+					backoff = kafkaMaxRetryBackoff
+				}
+			}
+
+			if err := reader.CommitMessages(ctx, msg); err != nil {
+				log.Error("kafka commit failure", zap.String("topic", topic), zap.Error(err))
+			}
+		}
+	}()
+
+	return reader
+}
+
+// readReplies consumes the reply topic in the engine's reply group until the
+// reader is stopped. Replies are parked by the reply router rather than
+// retried, and committed in order once they were handled or dropped.
+func (hub *KafkaHub) readReplies() *kafkaReader {
+	topic := hub.Config.ReplyTopic
+	ctx, reader := hub.newReader(hub.Config.GroupID+"."+topic+"."+hub.Config.Instance, topic)
+	offsets := newKafkaOffsets(func(msg kafka.Message) {
+		if err := reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+			log.Error("kafka commit failure", zap.String("topic", topic), zap.Error(err))
+		}
+	})
+
+	go func() {
+		for {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("kafka fetch failure", zap.String("topic", topic), zap.Error(err))
+				}
+
+				return
+			}
+
+			offset := offsets.fetched(msg)
+			hub.replies.park(string(msg.Key), msg.Value, func() {
+				offsets.handled(offset)
+			})
+		}
+	}()
+
+	return reader
+}
+
+func (hub *KafkaHub) newReader(groupID string, topic string) (context.Context, *kafkaReader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, &kafkaReader{
+		Reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     hub.Config.Brokers,
+			GroupID:     groupID,
+			Topic:       topic,
+			StartOffset: kafka.LastOffset,
+		}),
+		cancel: cancel,
+	}
+}
+
+type kafkaReader struct {
+	*kafka.Reader
+	cancel context.CancelFunc
+}
+
+func (reader *kafkaReader) stop() {
+	reader.cancel()
+	logCloser(reader.Reader)
+}
+
+// kafkaOffsets commits the messages of a partition in the order they were
+// fetched, although they may be handled out of order: a message is committed
+// once it and every message fetched before it from its partition were
+// handled.
+type kafkaOffsets struct {
+	mutex      sync.Mutex
+	commit     func(msg kafka.Message)
+	partitions map[int][]*kafkaOffset
+}
+
+type kafkaOffset struct {
+	msg     kafka.Message
+	handled bool
+}
+
+func newKafkaOffsets(commit func(msg kafka.Message)) *kafkaOffsets {
+	return &kafkaOffsets{
+		commit:     commit,
+		partitions: make(map[int][]*kafkaOffset),
+	}
+}
+
+func (offsets *kafkaOffsets) fetched(msg kafka.Message) *kafkaOffset {
+	offsets.mutex.Lock()
+	defer offsets.mutex.Unlock()
+	offset := &kafkaOffset{msg: msg}
+	offsets.partitions[msg.Partition] = append(offsets.partitions[msg.Partition], offset)
+	return offset
+}
+
+// handled marks a message handled and commits the newest message of its
+// partition that has no unhandled message before it. Commits are made with
+// the mutex held, so that they reach the broker in order.
+func (offsets *kafkaOffsets) handled(offset *kafkaOffset) {
+	offsets.mutex.Lock()
+	defer offsets.mutex.Unlock()
+	offset.handled = true
+	pending := offsets.partitions[offset.msg.Partition]
+	n := 0
+	for n < len(pending) && pending[n].handled {
+		n++
+	}
+
+	if n < 1 {
+		return
+	}
+
+	offsets.commit(pending[n-1].msg)
+	offsets.partitions[offset.msg.Partition] = pending[n:]
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func TestKafkaOffsets(t *testing.T) {
+	committed := make([]int64, 0)
+	offsets := newKafkaOffsets(func(msg kafka.Message) {
+		committed = append(committed, msg.Offset)
+	})
+
+	fetched := make([]*kafkaOffset, 0)
+	for i := int64(0); i < 4; i++ {
+		fetched = append(fetched, offsets.fetched(kafka.Message{Partition: 0, Offset: i}))
+	}
+
+	other := offsets.fetched(kafka.Message{Partition: 1, Offset: 7})
+	// 0 is parked while the ones after it are handled
+	offsets.handled(fetched[1])
+	offsets.handled(fetched[2])
+	offsets.handled(other)
+	if !reflect.DeepEqual(committed, []int64{7}) {
+		t.Fatalf("expected only the other partition to be committed, got %v", committed)
+	}
+
+	offsets.handled(fetched[0])
+	offsets.handled(fetched[3])
+	if !reflect.DeepEqual(committed, []int64{7, 2, 3}) {
+		t.Fatalf("expected partition 0 to be committed up to 2, then 3, got %v", committed)
+	}
+}
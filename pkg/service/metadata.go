@@ -0,0 +1,128 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+// MessageContext is passed by a transaction with every request of its saga,
+// including compensation requests. It's taken from the trigger envelope or
+// the request that started the transaction.
+type MessageContext struct {
+	// CorrelationID defaults to the ID of the transaction.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Traceparent and Tracestate are the W3C trace context of the trigger.
+	Traceparent string            `json:"traceparent,omitempty"`
+	Tracestate  string            `json:"tracestate,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// Merge overrides the context with the values that are set in other.
+func (mc *MessageContext) Merge(other *MessageContext) {
+	if other == nil {
+		return
+	}
+
+	if other.CorrelationID != "" {
+		mc.CorrelationID = other.CorrelationID
+	}
+
+	if other.Traceparent != "" {
+		mc.Traceparent = other.Traceparent
+		mc.Tracestate = other.Tracestate
+	}
+
+	mc.Metadata = mergeMetadata(mc.Metadata, other.Metadata)
+}
+
+// ValidTraceparent reports whether value is a W3C traceparent header that can
+// be propagated.
+func ValidTraceparent(value string) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" {
+		return false
+	} else if parts[0] == "00" && len(parts) != 4 {
+		return false
+	}
+
+	return isHex(parts[1], 32) && strings.Trim(parts[1], "0") != "" &&
+		isHex(parts[2], 16) && strings.Trim(parts[2], "0") != "" &&
+		isHex(parts[3], 2)
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setContext attaches the message context to a new transaction. A malformed
+// traceparent is dropped along with its tracestate, as the trace context
+// spec requires.
+func (trx *Transaction) setContext(mc *MessageContext) {
+	if mc == nil {
+		mc = &MessageContext{}
+	}
+
+	trx.CorrelationID = mc.CorrelationID
+	if trx.CorrelationID == "" {
+		trx.CorrelationID = trx.ID
+	}
+
+	if mc.Traceparent != "" && !ValidTraceparent(mc.Traceparent) {
+		log.Warn("dropping invalid traceparent", TransactionFields(trx, zap.String("traceparent", mc.Traceparent))...)
+	} else {
+		trx.Traceparent = mc.Traceparent
+		trx.Tracestate = mc.Tracestate
+	}
+
+	trx.Metadata = mergeMetadata(nil, mc.Metadata)
+}
+
+// mergeMetadata adds the metadata of a reply to the transaction's and returns
+// it so that it can be journaled.
+func (trx *Transaction) mergeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) < 1 {
+		return nil
+	}
+
+	trx.Metadata = mergeMetadata(trx.Metadata, metadata)
+	return metadata
+}
+
+// requestMetadata is the metadata of a request to the current stage. The
+// stage's headers take precedence over the transaction's metadata.
+func (trx *Transaction) requestMetadata() map[string]string {
+	var headers map[string]string
+	if trx.Stage != nil {
+		headers = trx.Stage.Headers
+	}
+
+	return mergeMetadata(mergeMetadata(nil, trx.Metadata), headers)
+}
+
+func mergeMetadata(dst map[string]string, src map[string]string) map[string]string {
+	if len(src) < 1 {
+		return dst
+	}
+
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+
+	for k, v := range src {
+		dst[k] = v
+	}
+
+	return dst
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/metrics"
+)
+
+// Stage results of the stage duration histogram.
+const (
+	StageResultSuccess = "success"
+	StageResultFailure = "failure"
+	StageResultTimeout = "timeout"
+)
+
+var (
+	transactionsStarted = metrics.NewCounterVec(
+		"sake_transactions_started_total",
+		"Transactions started.",
+		"recipe")
+
+	transactionsSucceeded = metrics.NewCounterVec(
+		"sake_transactions_succeeded_total",
+		"Transactions that completed successfully.",
+		"recipe")
+
+	transactionsFailed = metrics.NewCounterVec(
+		"sake_transactions_failed_total",
+		"Transactions that completed after compensating.",
+		"recipe")
+
+	transactionsCompensated = metrics.NewCounterVec(
+		"sake_transactions_compensated_total",
+		"Transactions that started compensating.",
+		"recipe")
+
+	activeTransactions = metrics.NewGaugeVec(
+		"sake_active_transactions",
+		"Transactions in progress.",
+		"recipe")
+
+	stageDuration = metrics.NewHistogramVec(
+		"sake_stage_duration_seconds",
+		"Time from publishing a stage's requests until its reply or timeout.",
+		nil,
+		"recipe", "stage", "result")
+
+	replyTimeouts = metrics.NewCounterVec(
+		"sake_reply_timeouts_total",
+		"Stages that timed out waiting on a reply.",
+		"recipe", "stage")
+
+	repliesDiscarded = metrics.NewCounterVec(
+		"sake_replies_discarded_total",
+		"Replies discarded as stale, duplicate or mismatched.",
+		"reason")
+
+	hubErrors = metrics.NewCounterVec(
+		"sake_hub_errors_total",
+		"Hub operations and subscription handlers that failed.",
+		"operation")
+
+	storageWriteDuration = metrics.NewHistogramVec(
+		"sake_storage_write_duration_seconds",
+		"Latency of the storage writes made by the write-through cache.",
+		nil,
+		"operation")
+
+	storageWriteFailures = metrics.NewCounterVec(
+		"sake_storage_write_failures_total",
+		"Storage write attempts made by the write-through cache that failed.",
+		"operation")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(
+		transactionsStarted,
+		transactionsSucceeded,
+		transactionsFailed,
+		transactionsCompensated,
+		activeTransactions,
+		stageDuration,
+		replyTimeouts,
+		repliesDiscarded,
+		hubErrors,
+		storageWriteDuration,
+		storageWriteFailures,
+	)
+}
+
+// addActive changes the number of active transactions of a recipe. The gauge
+// counts those of every version of the recipe.
+func addActive(recipe *Recipe, delta int32) {
+	atomic.AddInt32(&recipe.NumActiveTransactions, delta)
+	activeTransactions.Add(float64(delta), recipe.Name)
+}
+
+// observeCommit counts the transactions that a commit started compensating.
+func observeCommit(trx *Transaction, previousState TransactionState) {
+	if previousState == IsExecuting && trx.State == IsReverting {
+		transactionsCompensated.Inc(trx.RecipeName)
+	}
+}
+
+// observeStep counts the transactions that completed with their last step.
+func observeStep(trx *Transaction) {
+	switch trx.State {
+	case IsSuccess:
+		transactionsSucceeded.Inc(trx.RecipeName)
+	case IsFailed:
+		transactionsFailed.Inc(trx.RecipeName)
+	}
+}
+
+// observeStage reports how long the current attempt of a stage took.
+func observeStage(trx *Transaction, result string) {
+	stageDuration.Observe(time.Since(trx.StageStarted).Seconds(), trx.RecipeName, trx.StageKey, result)
+	if result == StageResultTimeout {
+		replyTimeouts.Inc(trx.RecipeName, trx.StageKey)
+	}
+}
+
+func stageResult(failure *StageFailure) string {
+	if failure != nil {
+		return StageResultFailure
+	}
+
+	return StageResultSuccess
+}
+
+// Hub operations of the hub errors counter.
+const (
+	HubOpPublish   = "publish"
+	HubOpSubscribe = "subscribe"
+	HubOpCancel    = "cancel"
+	HubOpHandle    = "handle"
+)
+
+// MeteredHub counts the errors of the hub it wraps, including those of the
+// handlers it delivers messages to.
+type MeteredHub struct {
+	HubConnector
+}
+
+var _ HubConnector = &MeteredHub{}
+
+func (hub *MeteredHub) CancelAll() error {
+	return countHubError(HubOpCancel, hub.HubConnector.CancelAll())
+}
+
+func (hub *MeteredHub) CancelGroup(groupKey interface{}) error {
+	return countHubError(HubOpCancel, hub.HubConnector.CancelGroup(groupKey))
+}
+
+func (hub *MeteredHub) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
+	group := make(ReplyGroup, len(replyGroup))
+	for topic, handler := range replyGroup {
+		group[topic] = meteredReplyHandler(handler)
+	}
+
+	return countHubError(HubOpSubscribe, hub.HubConnector.SubReply(groupKey, finalizer, group))
+}
+
+func (hub *MeteredHub) SubGroup(groupKey interface{}, rawGroup RawGroup) error {
+	group := make(RawGroup, len(rawGroup))
+	for topic, handler := range rawGroup {
+		group[topic] = meteredRawHandler(handler)
+	}
+
+	return countHubError(HubOpSubscribe, hub.HubConnector.SubGroup(groupKey, group))
+}
+
+func (hub *MeteredHub) Pub(topic string, req *protocol.Request) error {
+	return countHubError(HubOpPublish, hub.HubConnector.Pub(topic, req))
+}
+
+func (hub *MeteredHub) PubRaw(topic string, data []byte) error {
+	return countHubError(HubOpPublish, hub.HubConnector.PubRaw(topic, data))
+}
+
+func meteredReplyHandler(handler func(*protocol.Reply) error) func(*protocol.Reply) error {
+	return func(reply *protocol.Reply) error {
+		err := handler(reply)
+		if err == ErrReplyDiscarded {
+			return err
+		}
+
+		return countHubError(HubOpHandle, err)
+	}
+}
+
+func meteredRawHandler(handler func([]byte) error) func([]byte) error {
+	return func(data []byte) error {
+		return countHubError(HubOpHandle, handler(data))
+	}
+}
+
+func countHubError(op string, err error) error {
+	if err != nil {
+		hubErrors.Inc(op)
+	}
+
+	return err
+}
+
+// observeWrite times a storage write and counts it when it fails.
+func observeWrite(op string, write func() error) error {
+	started := time.Now()
+	err := write()
+	storageWriteDuration.Observe(time.Since(started).Seconds(), op)
+	if err != nil {
+		storageWriteFailures.Inc(op)
+	}
+
+	return err
+}
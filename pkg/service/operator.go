@@ -0,0 +1,195 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/danielkrainas/gobag/util/token"
+	"github.com/danielkrainas/sake/pkg/api/v1"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+const (
+	ActionAbort   = "abort"
+	ActionRetry   = "retry"
+	ActionSucceed = "succeed"
+	ActionFail    = "fail"
+	ActionResume  = "resume"
+)
+
+// Operation identifies the operator behind a manual action on a transaction
+// and why it was taken. Both are recorded in the transaction's history.
+type Operation struct {
+	Operator string
+	Reason   string
+}
+
+// operate runs a manual action on a running transaction while holding its
+// lock. It returns the transaction the action changed, which is no longer
+// cached once the action completes it.
+func (c *Coordinator) operate(id string, action string, op Operation, fn func(trx *Transaction) error) (*Transaction, error) {
+	trx, err := c.Cache.GetTransaction(c.Context, id)
+	if err != nil {
+		return nil, err
+	} else if trx == nil {
+		return nil, v1.ErrorCodeTransactionUnknown.WithArgs(id)
+	}
+
+	trx.Lock()
+	defer trx.Unlock()
+	if trx.IsCompleted() {
+		return nil, v1.ErrorCodeTransactionActionInvalid.WithArgs(id, action, trx.State)
+	}
+
+	log.Info("operator action", TransactionFields(trx, zap.String("action", action), zap.String("operator", op.Operator), zap.String("reason", op.Reason))...)
+	if err := fn(trx); err != nil {
+		return nil, err
+	}
+
+	return trx, nil
+}
+
+func (c *Coordinator) recordOperation(trx *Transaction, action string, op Operation, event *TransactionEvent) {
+	event.Type = EventOperator
+	event.Action = action
+	event.Operator = op.Operator
+	event.Reason = op.Reason
+	c.record(trx, event)
+}
+
+// Abort stops a running saga and starts compensating it immediately.
+func (c *Coordinator) Abort(id string, op Operation) (*Transaction, error) {
+	return c.operate(id, ActionAbort, op, func(trx *Transaction) error {
+		if trx.State != IsExecuting {
+			return v1.ErrorCodeTransactionActionInvalid.WithArgs(id, ActionAbort, trx.State)
+		}
+
+		c.cancelRequests(trx)
+		c.recordOperation(trx, ActionAbort, op, &TransactionEvent{StageKey: trx.StageKey})
+		if err := c.commit(trx, false); err != nil {
+			return err
+		}
+
+		return c.transition(trx)
+	})
+}
+
+// RetryStage publishes the outstanding requests of the current stage again
+// with new request IDs, right away.
+func (c *Coordinator) RetryStage(id string, op Operation) (*Transaction, error) {
+	return c.operate(id, ActionRetry, op, func(trx *Transaction) error {
+		if !trx.IsInProgress() {
+			return v1.ErrorCodeTransactionActionInvalid.WithArgs(id, ActionRetry, trx.State)
+		}
+
+		c.cancelRequests(trx)
+		trx.BeginRetry()
+		trx.Attempt++
+		c.recordOperation(trx, ActionRetry, op, &TransactionEvent{
+			StageKey: trx.StageKey,
+			Time:     trx.StageStarted,
+			Expires:  trx.Expires,
+			Attempt:  trx.Attempt,
+		})
+
+		c.assignRequestIDs(trx)
+		if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+			return fmt.Errorf("record transaction state failed: %v", err)
+		}
+
+		c.dispatchStage(trx)
+		return nil
+	})
+}
+
+// ResolveStage completes the current stage as if its participant had replied
+// with success or failure. Data, when given, replaces the transaction data.
+// Resolving a parked transaction's stage as succeeded skips its compensation.
+func (c *Coordinator) ResolveStage(id string, success bool, data []byte, op Operation) (*Transaction, error) {
+	action := ActionFail
+	if success {
+		action = ActionSucceed
+	}
+
+	return c.operate(id, action, op, func(trx *Transaction) error {
+		if trx.State == IsCompensationFailed {
+			trx.State = IsReverting
+			trx.Reason = ""
+		} else if !trx.IsInProgress() {
+			return v1.ErrorCodeTransactionActionInvalid.WithArgs(id, action, trx.State)
+		}
+
+		c.cancelRequests(trx)
+		if data != nil {
+			trx.Data = data
+		}
+
+		c.recordOperation(trx, action, op, &TransactionEvent{
+			StageKey: trx.StageKey,
+			State:    trx.State,
+			Success:  success,
+			Data:     data,
+		})
+
+		if trx.State == IsReverting && !success {
+			return c.park(trx, fmt.Sprintf("compensation failed by %s: %s", op.Operator, op.Reason))
+		}
+
+		if err := c.commit(trx, success); err != nil {
+			return err
+		}
+
+		return c.transition(trx)
+	})
+}
+
+// Resume restarts the compensation of a parked transaction from the stage it
+// was parked on. Branches whose compensation failed are requested again.
+func (c *Coordinator) Resume(id string, op Operation) (*Transaction, error) {
+	return c.operate(id, ActionResume, op, func(trx *Transaction) error {
+		if trx.State != IsCompensationFailed {
+			return v1.ErrorCodeTransactionActionInvalid.WithArgs(id, ActionResume, trx.State)
+		}
+
+		trx.State = IsReverting
+		trx.Reason = ""
+		trx.Attempt = 1
+		for _, branch := range trx.Branches {
+			if branch.State == BranchFailed {
+				branch.State = BranchPending
+			}
+		}
+
+		trx.BeginRetry()
+		c.recordOperation(trx, ActionResume, op, &TransactionEvent{
+			StageKey: trx.StageKey,
+			State:    trx.State,
+			Time:     trx.StageStarted,
+			Expires:  trx.Expires,
+			Attempt:  trx.Attempt,
+			Branches: trx.Branches,
+		})
+
+		c.assignRequestIDs(trx)
+		if err := c.Cache.PutTransaction(c.Context, trx); err != nil {
+			return fmt.Errorf("record transaction state failed: %v", err)
+		}
+
+		c.dispatchStage(trx)
+		return nil
+	})
+}
+
+// assignRequestIDs gives every outstanding request of the current stage a
+// new ID so that replies to earlier attempts are told apart.
+func (c *Coordinator) assignRequestIDs(trx *Transaction) {
+	if len(trx.Branches) > 0 {
+		for _, branch := range trx.Branches {
+			if branch.State == BranchPending {
+				branch.RequestID = token.Generate()
+			}
+		}
+	} else {
+		trx.RequestID = token.Generate()
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import "testing"
+
+func TestResolveStageReturnsCompletedTransaction(t *testing.T) {
+	c := newTestCoordinator(t)
+	recipe := &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "checkout.start",
+		StartAt:     "a",
+		Stages: map[string]*Stage{
+			"a": {Rollback: "a.undo", Terminate: true},
+		},
+	}
+
+	if err := c.Register(recipe); err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _, err := c.Start("checkout", []byte(`{}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := c.ResolveStage(trx.ID, true, nil, Operation{Operator: "alice", Reason: "manual"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolved.ID != trx.ID || resolved.State != IsSuccess {
+		t.Fatalf("expected %s to have succeeded, got %s in state %s", trx.ID, resolved.ID, resolved.State)
+	}
+
+	if _, err := c.Abort(trx.ID, Operation{Operator: "alice", Reason: "too late"}); err == nil {
+		t.Fatal("expected completed transaction to refuse actions")
+	}
+}
@@ -0,0 +1,11 @@
+package protocol
+
+// NewReply creates a reply to the request that echoes its ID and attempt.
+// The coordinator discards echoed replies that don't match the request it's
+// waiting on.
+func (m *Request) NewReply() *Reply {
+	return &Reply{
+		RequestID: m.ID,
+		Attempt:   m.Attempt,
+	}
+}
@@ -11,6 +11,7 @@ It is generated from these files:
 
 It has these top-level messages:
 	Reply
+	ReplyError
 	Request
 */
 package protocol
@@ -29,7 +30,12 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion1
 
 type Reply struct {
-	NewData []byte `protobuf:"bytes,1,opt,name=NewData,proto3" json:"NewData,omitempty"`
+	NewData   []byte            `protobuf:"bytes,1,opt,name=NewData,proto3" json:"NewData,omitempty"`
+	Outcome   string            `protobuf:"bytes,2,opt,name=Outcome" json:"Outcome,omitempty"`
+	RequestID string            `protobuf:"bytes,3,opt,name=RequestID" json:"RequestID,omitempty"`
+	Attempt   int32             `protobuf:"varint,4,opt,name=Attempt,proto3" json:"Attempt,omitempty"`
+	Error     *ReplyError       `protobuf:"bytes,5,opt,name=Error" json:"Error,omitempty"`
+	Metadata  map[string]string `protobuf:"bytes,6,rep,name=Metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *Reply) Reset()                    { *m = Reply{} }
@@ -37,16 +43,55 @@ func (m *Reply) String() string            { return proto.CompactTextString(m) }
 func (*Reply) ProtoMessage()               {}
 func (*Reply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
+func (m *Reply) GetError() *ReplyError {
+	if m != nil {
+		return m.Error
+	}
+	return nil
+}
+
+func (m *Reply) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+type ReplyError struct {
+	Code      string `protobuf:"bytes,1,opt,name=Code" json:"Code,omitempty"`
+	Message   string `protobuf:"bytes,2,opt,name=Message" json:"Message,omitempty"`
+	Retryable bool   `protobuf:"varint,3,opt,name=Retryable,proto3" json:"Retryable,omitempty"`
+	Details   []byte `protobuf:"bytes,4,opt,name=Details,proto3" json:"Details,omitempty"`
+}
+
+func (m *ReplyError) Reset()                    { *m = ReplyError{} }
+func (m *ReplyError) String() string            { return proto.CompactTextString(m) }
+func (*ReplyError) ProtoMessage()               {}
+func (*ReplyError) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
 func init() {
 	proto.RegisterType((*Reply)(nil), "protocol.Reply")
+	proto.RegisterType((*ReplyError)(nil), "protocol.ReplyError")
 }
 
 var fileDescriptor0 = []byte{
-	// 81 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x29, 0x28, 0xca, 0x2f,
-	0xc9, 0x4f, 0x2a, 0x4d, 0xd3, 0x2f, 0x4a, 0x2d, 0xc8, 0xa9, 0xd4, 0x03, 0x73, 0x85, 0x38, 0xc0,
-	0x54, 0x72, 0x7e, 0x8e, 0x92, 0x22, 0x17, 0x6b, 0x10, 0x48, 0x42, 0x48, 0x82, 0x8b, 0xdd, 0x2f,
-	0xb5, 0xdc, 0x25, 0xb1, 0x24, 0x51, 0x82, 0x51, 0x81, 0x51, 0x83, 0x27, 0x08, 0xc6, 0x4d, 0x62,
-	0x03, 0x2b, 0x36, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x6b, 0x4d, 0xbb, 0xe7, 0x4b, 0x00, 0x00,
+	// 273 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5d, 0x50, 0xcb, 0x4e, 0xc3, 0x30,
+	0x10, 0x54, 0x92, 0xba, 0x24, 0x0b, 0x48, 0xc8, 0xca, 0xc1, 0xaa, 0x40, 0xaa, 0x7a, 0x42, 0x1c,
+	0x82, 0x04, 0x17, 0x1e, 0x27, 0x44, 0x7a, 0xe0, 0xd0, 0x22, 0xf9, 0x0f, 0x9c, 0x76, 0x41, 0x08,
+	0x17, 0x07, 0xc7, 0x01, 0xe5, 0x4b, 0xf8, 0x5d, 0x6c, 0x27, 0x6e, 0x04, 0x27, 0xef, 0xec, 0xcc,
+	0xca, 0x33, 0x03, 0x79, 0xad, 0x95, 0x51, 0x55, 0xfb, 0x72, 0xa9, 0xb1, 0x96, 0x5d, 0xe1, 0x21,
+	0x4d, 0xfd, 0xb3, 0x51, 0x72, 0xf1, 0x13, 0x03, 0xe1, 0x8e, 0xa1, 0x0c, 0x0e, 0xd6, 0xf8, 0x5d,
+	0x0a, 0x23, 0x58, 0x34, 0x8f, 0xce, 0x8f, 0x78, 0x80, 0x8e, 0x79, 0x6e, 0xcd, 0x46, 0xed, 0x90,
+	0xc5, 0x96, 0xc9, 0x78, 0x80, 0xf4, 0x14, 0x32, 0x8e, 0x9f, 0x2d, 0x36, 0xe6, 0xa9, 0x64, 0x89,
+	0xe7, 0xc6, 0x85, 0xbb, 0x7b, 0x30, 0x06, 0x77, 0xb5, 0x61, 0x13, 0xcb, 0x11, 0x1e, 0x20, 0xbd,
+	0x00, 0xb2, 0xd4, 0x5a, 0x69, 0x46, 0xec, 0xfe, 0xf0, 0x2a, 0x2f, 0x82, 0x9f, 0xc2, 0x7b, 0xf1,
+	0x1c, 0xef, 0x25, 0xf4, 0x16, 0xd2, 0x15, 0x1a, 0xb1, 0x75, 0xc6, 0xa6, 0xf3, 0xc4, 0xca, 0xcf,
+	0xfe, 0xc9, 0x8b, 0xc0, 0x2f, 0x3f, 0x8c, 0xee, 0xf8, 0x5e, 0x3e, 0xbb, 0x87, 0xe3, 0x3f, 0x14,
+	0x3d, 0x81, 0xe4, 0x1d, 0x3b, 0x9f, 0x2f, 0xe3, 0x6e, 0xa4, 0x39, 0x90, 0x2f, 0x21, 0xdb, 0x90,
+	0xac, 0x07, 0x77, 0xf1, 0x4d, 0xb4, 0xd0, 0x00, 0xa3, 0x19, 0x4a, 0x61, 0xf2, 0xa8, 0xb6, 0x38,
+	0x9c, 0xfa, 0xd9, 0xe5, 0x5b, 0x61, 0xd3, 0x88, 0xd7, 0x7d, 0x2f, 0x03, 0xec, 0x7b, 0xb1, 0x1f,
+	0x8a, 0x4a, 0xa2, 0xef, 0x25, 0xe5, 0xe3, 0xc2, 0xdd, 0x95, 0xd6, 0xd6, 0x9b, 0x6c, 0x7c, 0x2f,
+	0xb6, 0xe9, 0x01, 0x56, 0x53, 0x1f, 0xec, 0xfa, 0x17, 0xc9, 0x0c, 0x4c, 0x4b, 0xb6, 0x01, 0x00,
 	0x00,
 }
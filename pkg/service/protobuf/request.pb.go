@@ -14,11 +14,16 @@ var _ = fmt.Errorf
 var _ = math.Inf
 
 type Request struct {
-	ID                string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
-	TransactionID     string `protobuf:"bytes,2,opt,name=TransactionID" json:"TransactionID,omitempty"`
-	SuccessReplyTopic string `protobuf:"bytes,3,opt,name=SuccessReplyTopic" json:"SuccessReplyTopic,omitempty"`
-	FailureReplyTopic string `protobuf:"bytes,4,opt,name=FailureReplyTopic" json:"FailureReplyTopic,omitempty"`
-	Data              []byte `protobuf:"bytes,5,opt,name=Data,proto3" json:"Data,omitempty"`
+	ID                string            `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	TransactionID     string            `protobuf:"bytes,2,opt,name=TransactionID" json:"TransactionID,omitempty"`
+	SuccessReplyTopic string            `protobuf:"bytes,3,opt,name=SuccessReplyTopic" json:"SuccessReplyTopic,omitempty"`
+	FailureReplyTopic string            `protobuf:"bytes,4,opt,name=FailureReplyTopic" json:"FailureReplyTopic,omitempty"`
+	Data              []byte            `protobuf:"bytes,5,opt,name=Data,proto3" json:"Data,omitempty"`
+	Attempt           int32             `protobuf:"varint,6,opt,name=Attempt,proto3" json:"Attempt,omitempty"`
+	Metadata          map[string]string `protobuf:"bytes,7,rep,name=Metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	CorrelationID     string            `protobuf:"bytes,8,opt,name=CorrelationID" json:"CorrelationID,omitempty"`
+	Traceparent       string            `protobuf:"bytes,9,opt,name=Traceparent" json:"Traceparent,omitempty"`
+	Tracestate        string            `protobuf:"bytes,10,opt,name=Tracestate" json:"Tracestate,omitempty"`
 }
 
 func (m *Request) Reset()                    { *m = Request{} }
@@ -26,21 +31,35 @@ func (m *Request) String() string            { return proto.CompactTextString(m)
 func (*Request) ProtoMessage()               {}
 func (*Request) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
 
+func (m *Request) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "protocol.Request")
 }
 
 var fileDescriptor1 = []byte{
-	// 164 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2b, 0x28, 0xca, 0x2f,
-	0xc9, 0x4f, 0x2a, 0x4d, 0xd3, 0x2f, 0x4a, 0x2d, 0x2c, 0x4d, 0x2d, 0x2e, 0xd1, 0x03, 0x0b, 0x08,
-	0x71, 0x80, 0xa9, 0xe4, 0xfc, 0x1c, 0xa5, 0xf5, 0x8c, 0x5c, 0xec, 0x41, 0x10, 0x39, 0x21, 0x3e,
-	0x2e, 0x26, 0x4f, 0x17, 0x09, 0x46, 0x05, 0x46, 0x0d, 0xce, 0x20, 0x26, 0x4f, 0x17, 0x21, 0x15,
-	0x2e, 0xde, 0x90, 0xa2, 0xc4, 0xbc, 0xe2, 0xc4, 0xe4, 0x92, 0xcc, 0xfc, 0x3c, 0x4f, 0x17, 0x09,
-	0x26, 0xb0, 0x14, 0xaa, 0xa0, 0x90, 0x0e, 0x97, 0x60, 0x70, 0x69, 0x72, 0x72, 0x6a, 0x71, 0x71,
-	0x50, 0x6a, 0x41, 0x4e, 0x65, 0x48, 0x7e, 0x41, 0x66, 0xb2, 0x04, 0x33, 0x58, 0x25, 0xa6, 0x04,
-	0x48, 0xb5, 0x5b, 0x62, 0x66, 0x4e, 0x69, 0x51, 0x2a, 0x92, 0x6a, 0x16, 0x88, 0x6a, 0x0c, 0x09,
-	0x21, 0x21, 0x2e, 0x16, 0x97, 0xc4, 0x92, 0x44, 0x09, 0x56, 0x05, 0x46, 0x0d, 0x9e, 0x20, 0x30,
-	0x3b, 0x89, 0x0d, 0xec, 0x76, 0x63, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x1a, 0x7c, 0xf7, 0x10,
-	0xdc, 0x00, 0x00, 0x00,
+	// 284 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x65, 0x90, 0x41, 0x4b, 0xc3, 0x40,
+	0x10, 0x85, 0x49, 0xd2, 0x34, 0xe9, 0xd4, 0x8a, 0x2e, 0x22, 0x8b, 0x07, 0x0d, 0xe2, 0xa1, 0x07,
+	0x89, 0x60, 0x2f, 0x62, 0x4f, 0x62, 0x15, 0x3c, 0x78, 0x59, 0xfb, 0x07, 0xb6, 0xeb, 0x08, 0xc1,
+	0x98, 0x8d, 0x9b, 0x89, 0x90, 0xdf, 0xe4, 0x9f, 0x34, 0xd9, 0x24, 0x92, 0xd0, 0xd3, 0xbe, 0x79,
+	0xef, 0x1b, 0xd8, 0x37, 0x70, 0x9a, 0x1b, 0x4d, 0x7a, 0x57, 0x7e, 0xdc, 0x18, 0xfc, 0x2e, 0xb1,
+	0xa0, 0xd8, 0x1a, 0x2c, 0xb4, 0x8f, 0xd2, 0xe9, 0xe5, 0xaf, 0x07, 0x81, 0x68, 0x33, 0x76, 0x08,
+	0xee, 0xcb, 0x86, 0x3b, 0x91, 0xb3, 0x9c, 0x89, 0x5a, 0xb1, 0x2b, 0x58, 0x6c, 0x8d, 0xcc, 0x0a,
+	0xa9, 0x28, 0xd1, 0x59, 0x1d, 0xb9, 0x36, 0x1a, 0x9b, 0xec, 0x1a, 0x8e, 0xdf, 0x4a, 0xa5, 0xb0,
+	0x28, 0x04, 0xe6, 0x69, 0xb5, 0xd5, 0x79, 0xa2, 0xb8, 0x67, 0xc9, 0xfd, 0xa0, 0xa1, 0x9f, 0x65,
+	0x92, 0x96, 0x06, 0x07, 0xf4, 0xa4, 0xa5, 0xf7, 0x02, 0xc6, 0x60, 0xb2, 0x91, 0x24, 0xb9, 0x5f,
+	0x03, 0x07, 0xc2, 0x6a, 0xc6, 0x21, 0x78, 0x20, 0xc2, 0xaf, 0x9c, 0xf8, 0xb4, 0xb6, 0x7d, 0xd1,
+	0x8f, 0x6c, 0x0d, 0xe1, 0x2b, 0x92, 0x7c, 0x6f, 0x36, 0x82, 0xc8, 0x5b, 0xce, 0x6f, 0x2f, 0xe2,
+	0xbe, 0x68, 0xdc, 0x95, 0x8c, 0x7b, 0xe2, 0x29, 0x23, 0x53, 0x89, 0xff, 0x85, 0xa6, 0xec, 0xa3,
+	0x36, 0x06, 0x53, 0xd9, 0x95, 0x0d, 0xdb, 0xb2, 0x23, 0x93, 0x45, 0x30, 0xaf, 0xdb, 0x2b, 0xcc,
+	0xa5, 0xc1, 0x8c, 0xf8, 0xcc, 0x32, 0x43, 0x8b, 0x9d, 0x03, 0xd8, 0xb1, 0x20, 0x49, 0xc8, 0xc1,
+	0x02, 0x03, 0xe7, 0x6c, 0x0d, 0x8b, 0xd1, 0x17, 0xd8, 0x11, 0x78, 0x9f, 0x58, 0x75, 0x67, 0x6f,
+	0x24, 0x3b, 0x01, 0xff, 0x47, 0xa6, 0x25, 0x76, 0xf7, 0x6e, 0x87, 0x7b, 0xf7, 0xce, 0xd9, 0x4d,
+	0x6d, 0x9d, 0xd5, 0x1f, 0x87, 0x9a, 0xf1, 0xaf, 0xd8, 0x01, 0x00, 0x00,
 }
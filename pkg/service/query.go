@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 500
+)
+
+// TransactionQuery filters stored transactions. Results are ordered from the
+// most recently started and are paginated with an opaque cursor.
+type TransactionQuery struct {
+	Recipe        string
+	States        []TransactionState
+	StartedAfter  *time.Time
+	StartedBefore *time.Time
+	Cursor        string
+	Limit         int
+}
+
+type TransactionPage struct {
+	Transactions []*Transaction
+	// NextCursor fetches the following page. It's empty on the last page.
+	NextCursor string
+}
+
+// queryCursor is the position of the last transaction of a page.
+type queryCursor struct {
+	Started int64
+	ID      string
+}
+
+func (query *TransactionQuery) limit() int {
+	if query.Limit < 1 {
+		return DefaultQueryLimit
+	} else if query.Limit > MaxQueryLimit {
+		return MaxQueryLimit
+	}
+
+	return query.Limit
+}
+
+func (query *TransactionQuery) cursor() (*queryCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	started, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &queryCursor{Started: started, ID: parts[1]}, nil
+}
+
+func encodeCursor(trx *Transaction) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", trx.Started.UnixNano(), trx.ID)))
+}
+
+// Validate checks the query's cursor and time range.
+func (query *TransactionQuery) Validate() error {
+	if _, err := query.cursor(); err != nil {
+		return err
+	}
+
+	if query.StartedAfter != nil && query.StartedBefore != nil && query.StartedBefore.Before(*query.StartedAfter) {
+		return fmt.Errorf("started_before is before started_after")
+	}
+
+	return nil
+}
+
+// Match reports whether the transaction satisfies the query's filters.
+func (query *TransactionQuery) Match(trx *Transaction) bool {
+	if query.Recipe != "" && trx.RecipeName != query.Recipe {
+		return false
+	}
+
+	if len(query.States) > 0 {
+		found := false
+		for _, state := range query.States {
+			if trx.State == state {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if query.StartedAfter != nil && trx.Started.Before(*query.StartedAfter) {
+		return false
+	}
+
+	if query.StartedBefore != nil && !trx.Started.Before(*query.StartedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// paginate sorts the transactions that matched the query and cuts the page
+// that follows the query's cursor. It's used by storages that can't query.
+func (query *TransactionQuery) paginate(matched []*Transaction) (*TransactionPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i].Started.UnixNano(), matched[j].Started.UnixNano()
+		if a != b {
+			return a > b
+		}
+
+		return matched[i].ID > matched[j].ID
+	})
+
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			started := matched[i].Started.UnixNano()
+			return started < cursor.Started || (started == cursor.Started && matched[i].ID < cursor.ID)
+		})
+	}
+
+	page := &TransactionPage{}
+	end := start + query.limit()
+	if end < len(matched) {
+		page.Transactions = matched[start:end]
+		page.NextCursor = encodeCursor(matched[end-1])
+	} else {
+		page.Transactions = matched[start:]
+	}
+
+	return page, nil
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/api/v1"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+// copy returns a copy of the recipe that shares its stages.
+func (recipe *Recipe) copy() *Recipe {
+	copied := *recipe
+	copied.StatusCode = atomic.LoadInt32(&recipe.StatusCode)
+	copied.NumActiveTransactions = atomic.LoadInt32(&recipe.NumActiveTransactions)
+	return &copied
+}
+
+// retired returns a copy of the recipe marked inactive.
+func (recipe *Recipe) retired() *Recipe {
+	retired := recipe.copy()
+	retired.StatusCode = int32(StatusInactive)
+	return retired
+}
+
+// definition returns a copy of the recipe's definition that can be registered
+// as a new version.
+func (recipe *Recipe) definition() (*Recipe, error) {
+	data, err := json.Marshal(recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	definition := &Recipe{}
+	if err := json.Unmarshal(data, definition); err != nil {
+		return nil, err
+	}
+
+	definition.ID = ""
+	definition.Version = 0
+	definition.RollbackOf = 0
+	definition.NumActiveTransactions = 0
+	definition.StatusCode = int32(StatusInactive)
+	definition.Created = time.Time{}
+	return definition, nil
+}
+
+// sortRecipes orders recipes by name and version.
+func sortRecipes(recipes []*Recipe) {
+	sort.Slice(recipes, func(i, j int) bool {
+		if recipes[i].Name != recipes[j].Name {
+			return recipes[i].Name < recipes[j].Name
+		}
+
+		return recipes[i].Version < recipes[j].Version
+	})
+}
+
+// recipeVersions returns the stored and registered versions of a recipe,
+// oldest first. Registered versions are returned with their live status.
+func (c *Coordinator) recipeVersions(name string) ([]*Recipe, error) {
+	stored, err := c.Storage.LoadRecipeVersions(c.Context, name)
+	if err != nil {
+		return nil, err
+	}
+
+	registered, err := c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
+		return recipe.Name == name, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*Recipe)
+	for _, recipe := range stored {
+		byID[recipe.ID] = recipe
+	}
+
+	for _, recipe := range registered {
+		byID[recipe.ID] = recipe
+	}
+
+	versions := make([]*Recipe, 0, len(byID))
+	for _, recipe := range byID {
+		versions = append(versions, recipe)
+	}
+
+	sortRecipes(versions)
+	return versions, nil
+}
+
+// RecipeVersions returns every version of a recipe, oldest first.
+func (c *Coordinator) RecipeVersions(name string) ([]*Recipe, error) {
+	versions, err := c.recipeVersions(name)
+	if err != nil {
+		return nil, err
+	} else if len(versions) < 1 {
+		return nil, v1.ErrorCodeRecipeUnknown.WithArgs(name)
+	}
+
+	return versions, nil
+}
+
+// RecipeVersion returns a version of a recipe.
+func (c *Coordinator) RecipeVersion(name string, version int) (*Recipe, error) {
+	versions, err := c.RecipeVersions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range versions {
+		if recipe.Version == version {
+			return recipe, nil
+		}
+	}
+
+	return nil, v1.ErrorCodeRecipeVersionUnknown.WithArgs(version, name)
+}
+
+// latestVersion is the highest version of a recipe, or zero when the recipe
+// was never registered.
+func (c *Coordinator) latestVersion(name string) (int, error) {
+	versions, err := c.recipeVersions(name)
+	if err != nil || len(versions) < 1 {
+		return 0, err
+	}
+
+	return versions[len(versions)-1].Version, nil
+}
+
+// Rollback registers the definition of an earlier version of a recipe as its
+// newest version. The active version drains like on any upgrade.
+func (c *Coordinator) Rollback(name string, version int) (*Recipe, error) {
+	source, err := c.RecipeVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	recipe, err := source.definition()
+	if err != nil {
+		return nil, err
+	}
+
+	recipe.RollbackOf = source.Version
+	if err := c.Register(recipe); err != nil {
+		return nil, err
+	}
+
+	log.Info("recipe rolled back", RecipeField(recipe), zap.Int("version", recipe.Version), zap.Int("rollback_of", source.Version))
+	return recipe, nil
+}
+
+const (
+	RecipeChangeAdded   = "added"
+	RecipeChangeRemoved = "removed"
+	RecipeChangeChanged = "changed"
+)
+
+// RecipeChange is a difference between the definitions of two recipe
+// versions. Path addresses the changed field with the JSON names of the
+// fields and stages, separated by dots.
+type RecipeChange struct {
+	Path string          `json:"path"`
+	Type string          `json:"type"`
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// recipeVersionFields aren't part of a recipe's definition, so they're left
+// out of diffs.
+var recipeVersionFields = []string{"id", "version", "created", "rollback_of", "status", "num_active_transactions"}
+
+// DiffRecipes lists the changes to a recipe's definition between two of its
+// versions, ordered by path.
+func DiffRecipes(from *Recipe, to *Recipe) ([]*RecipeChange, error) {
+	fromDoc, err := recipeDocument(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toDoc, err := recipeDocument(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*RecipeChange, 0)
+	diffValues("", fromDoc, toDoc, &changes)
+	return changes, nil
+}
+
+func recipeDocument(recipe *Recipe) (map[string]interface{}, error) {
+	data, err := json.Marshal(recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, field := range recipeVersionFields {
+		delete(doc, field)
+	}
+
+	return doc, nil
+}
+
+// diffValues compares decoded JSON values, descending into objects. Arrays
+// and scalars are compared as a whole.
+func diffValues(path string, from interface{}, to interface{}, changes *[]*RecipeChange) {
+	fromObj, fromOk := from.(map[string]interface{})
+	toObj, toOk := to.(map[string]interface{})
+	if !fromOk || !toOk {
+		if !reflect.DeepEqual(from, to) {
+			*changes = append(*changes, &RecipeChange{Path: path, Type: RecipeChangeChanged, From: rawValue(from), To: rawValue(to)})
+		}
+
+		return
+	}
+
+	keys := make([]string, 0, len(fromObj)+len(toObj))
+	for key := range fromObj {
+		keys = append(keys, key)
+	}
+
+	for key := range toObj {
+		if _, ok := fromObj[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPath := strings.TrimPrefix(path+"."+key, ".")
+		fromValue, inFrom := fromObj[key]
+		toValue, inTo := toObj[key]
+		switch {
+		case !inTo:
+			*changes = append(*changes, &RecipeChange{Path: keyPath, Type: RecipeChangeRemoved, From: rawValue(fromValue)})
+		case !inFrom:
+			*changes = append(*changes, &RecipeChange{Path: keyPath, Type: RecipeChangeAdded, To: rawValue(toValue)})
+		default:
+			diffValues(keyPath, fromValue, toValue, changes)
+		}
+	}
+}
+
+// rawValue encodes a decoded JSON value again, which can't fail.
+func rawValue(v interface{}) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+)
+
+func checkoutRecipe(timeout time.Duration) *Recipe {
+	return &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "checkout.start",
+		StartAt:     "reserve",
+		Stages: map[string]*Stage{
+			"reserve": {Rollback: "reserve.undo", Next: "pay", Timeout: timeout},
+			"pay":     {Rollback: "pay.undo", Terminate: true, Timeout: timeout},
+		},
+	}
+}
+
+// subRequests collects the requests published to a topic of the debug hub.
+func subRequests(t *testing.T, c *Coordinator, topic string) chan *protocol.Request {
+	requests := make(chan *protocol.Request, 8)
+	err := c.Hub.(*DebugHub).SubReq(topic, func(req *protocol.Request) error {
+		requests <- req
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return requests
+}
+
+// reply answers the next request of a topic with a success.
+func reply(t *testing.T, c *Coordinator, requests chan *protocol.Request) {
+	select {
+	case req := <-requests:
+		if err := c.Hub.(*DebugHub).PubReply(req.SuccessReplyTopic, &protocol.Reply{RequestID: req.ID}); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request was published")
+	}
+}
+
+func TestDiffRecipes(t *testing.T) {
+	from := checkoutRecipe(time.Second)
+	from.ID, from.Version = "r1", 1
+	from.Stages["reserve"].Headers = map[string]string{"x-channel": "web"}
+	to := checkoutRecipe(2 * time.Second)
+	to.ID, to.Version = "r2", 2
+	to.Stages["pay"].Next = "notify"
+	to.Stages["pay"].Terminate = false
+	to.Stages["notify"] = &Stage{Terminate: true}
+	to.TriggeredBy = "orders.checkout"
+	changes, err := DiffRecipes(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path string
+		typ  string
+		from string
+		to   string
+	}{
+		{"stages.notify", RecipeChangeAdded, "", `{"next":"","rollback":"","terminate":true}`},
+		{"stages.pay.next", RecipeChangeChanged, `""`, `"notify"`},
+		{"stages.pay.terminate", RecipeChangeRemoved, "true", ""},
+		{"stages.pay.timeout", RecipeChangeChanged, "1000000000", "2000000000"},
+		{"stages.reserve.headers", RecipeChangeRemoved, `{"x-channel":"web"}`, ""},
+		{"stages.reserve.timeout", RecipeChangeChanged, "1000000000", "2000000000"},
+		{"trigger", RecipeChangeChanged, `"checkout.start"`, `"orders.checkout"`},
+	}
+
+	if len(changes) != len(want) {
+		for _, change := range changes {
+			t.Logf("%s %s %s -> %s", change.Type, change.Path, change.From, change.To)
+		}
+
+		t.Fatalf("expected %d changes, got %d", len(want), len(changes))
+	}
+
+	for i, w := range want {
+		change := changes[i]
+		if change.Path != w.path || change.Type != w.typ || string(change.From) != w.from || string(change.To) != w.to {
+			t.Errorf("change %d: got %s %s %s -> %s, want %s %s %s -> %s", i, change.Type, change.Path, change.From, change.To, w.typ, w.path, w.from, w.to)
+		}
+	}
+
+	if changes, err := DiffRecipes(from, from.copy()); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Fatalf("expected no changes between equal definitions, got %d", len(changes))
+	}
+}
+
+func TestRollbackRecipe(t *testing.T) {
+	c := newTestCoordinator(t)
+	v1 := checkoutRecipe(time.Second)
+	v2 := checkoutRecipe(2 * time.Second)
+	for _, recipe := range []*Recipe{v1, v2} {
+		if err := c.Register(recipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v1.Version != 1 || v2.Version != 2 || v1.Status() != StatusDraining || v2.Status() != StatusActive {
+		t.Fatalf("expected v1 draining and v2 active, got v%d %d and v%d %d", v1.Version, v1.Status(), v2.Version, v2.Status())
+	}
+
+	v3, err := c.Rollback("checkout", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v3.Version != 3 || v3.RollbackOf != 1 || v3.ID == v1.ID || v3.Status() != StatusActive || v2.Status() != StatusDraining {
+		t.Fatalf("expected v3 to be the active rollback of v1, got v%d of v%d, %d", v3.Version, v3.RollbackOf, v3.Status())
+	}
+
+	if changes, err := DiffRecipes(v1, v3); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Fatalf("expected v3 to have the definition of v1, got %d changes", len(changes))
+	}
+
+	if _, err := c.Rollback("checkout", 7); err == nil {
+		t.Fatal("expected rolling back to an unknown version to fail")
+	}
+
+	versions, err := c.RecipeVersions("checkout")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+}
+
+func TestDrainRecipeVersion(t *testing.T) {
+	c := newTestCoordinator(t)
+	reserves := subRequests(t, c, "reserve")
+	pays := subRequests(t, c, "pay")
+	v1 := checkoutRecipe(time.Minute)
+	if err := c.Register(v1); err != nil {
+		t.Fatal(err)
+	}
+
+	old, _, err := c.Start("checkout", []byte(`{}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply(t, c, reserves)
+	v2 := checkoutRecipe(time.Minute)
+	v2.Stages["pay"].Headers = map[string]string{"x-version": "2"}
+	if err := c.Register(v2); err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _, err := c.Start("checkout", []byte(`{}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if trx.RecipeVersion != 2 {
+		t.Fatalf("expected new transactions to start on v2, got v%d", trx.RecipeVersion)
+	}
+
+	if err := c.ClearInactive(); err != nil {
+		t.Fatal(err)
+	} else if v1.Status() != StatusDraining {
+		t.Fatalf("expected v1 to drain while its transaction runs, got %d", v1.Status())
+	}
+
+	// the running transaction finishes on the version it started with
+	select {
+	case req := <-pays:
+		if req.TransactionID != old.ID || req.Metadata["x-version"] != "" {
+			t.Fatalf("expected the v1 request of %s, got %s with %v", old.ID, req.TransactionID, req.Metadata)
+		}
+
+		if err := c.Hub.(*DebugHub).PubReply(req.SuccessReplyTopic, &protocol.Reply{RequestID: req.ID}); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request was published")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, old); err != nil {
+		t.Fatal(err)
+	} else if old.State != IsSuccess || old.RecipeVersion != 1 {
+		t.Fatalf("expected v1 transaction to succeed, got %s on v%d", old.State, old.RecipeVersion)
+	}
+
+	if err := c.ClearInactive(); err != nil {
+		t.Fatal(err)
+	} else if v1.Status() != StatusInactive {
+		t.Fatalf("expected v1 to be drained, got %d", v1.Status())
+	}
+
+	registered, err := c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
+		return recipe.ID == v1.ID, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if len(registered) != 0 {
+		t.Fatal("expected the drained version to be unloaded")
+	}
+}
@@ -0,0 +1,459 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRedisAddr        = "localhost:6379"
+	DefaultRedisGroup       = "sake"
+	DefaultRedisReplyStream = "sake.replies"
+	DefaultRedisClaimIdle   = 30 * time.Second
+
+	// fields of stream entries
+	RedisFieldData        = "data"
+	RedisFieldReplyStream = "reply_stream"
+	RedisFieldReplyTopic  = "topic"
+
+	redisBlock = 2 * time.Second
+)
+
+// RedisConfig configures the server, consumer group and trimming of a
+// RedisHub.
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	// Group is the consumer group of the trigger streams the hub reads,
+	// shared by the engines that share triggers.
+	Group string
+	// Consumer names the engine in its consumer groups and must be unique to
+	// each engine and the same across restarts to pick up the entries it
+	// didn't acknowledge.
+	Consumer    string
+	ReplyStream string
+	// MaxLen trims streams to about as many entries on every publish; zero
+	// doesn't trim.
+	MaxLen int64
+	// ClaimIdle is how long an entry may go unacknowledged before it's
+	// claimed and handled again.
+	ClaimIdle time.Duration
+}
+
+// RedisHub publishes and consumes through Redis Streams. Every topic is a
+// stream that is read by the hub's consumer group, and entries are
+// acknowledged once they're handled. Entries that stay pending for the claim
+// idle time, because their handler failed or the consumer that read them
+// crashed, are claimed and handled again.
+//
+// Replies go to a shared reply stream with the reply topic of the request.
+// Each engine reads every reply in its own consumer group,
+// "<group>.<consumer>", and routes the replies to the reply groups of its
+// requests. A reply stays pending until its group took it.
+type RedisHub struct {
+	Config RedisConfig
+	Client *redis.Client
+
+	groupMutex sync.Mutex
+	groups     map[interface{}]*redisGroup
+
+	replyMutex  sync.Mutex
+	replyReader *redisReader
+	replies     *replyRouter
+}
+
+var _ HubConnector = &RedisHub{}
+
+// redisGroup is either the readers of a raw group or the routes of a reply
+// group.
+type redisGroup struct {
+	readers []*redisReader
+	routes  []string
+}
+
+func NewRedisHub(config RedisConfig) (*RedisHub, error) {
+	if config.Addr == "" {
+		config.Addr = DefaultRedisAddr
+	}
+
+	if config.Group == "" {
+		config.Group = DefaultRedisGroup
+	}
+
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("redis consumer name is required: %v", err)
+		}
+
+		config.Consumer = hostname
+	}
+
+	if config.ReplyStream == "" {
+		config.ReplyStream = DefaultRedisReplyStream
+	}
+
+	if config.ClaimIdle <= 0 {
+		config.ClaimIdle = DefaultRedisClaimIdle
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Addr,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+
+	return &RedisHub{
+		Config:  config,
+		Client:  client,
+		groups:  make(map[interface{}]*redisGroup),
+		replies: newReplyRouter(),
+	}, nil
+}
+
+func (hub *RedisHub) CancelAll() error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	for _, group := range hub.groups {
+		for _, reader := range group.readers {
+			reader.stop()
+		}
+	}
+
+	hub.groups = make(map[interface{}]*redisGroup)
+	hub.replyMutex.Lock()
+	defer hub.replyMutex.Unlock()
+	if hub.replyReader != nil {
+		hub.replyReader.stop()
+		hub.replyReader = nil
+	}
+
+	hub.replies.reset()
+	return nil
+}
+
+func (hub *RedisHub) CancelGroup(groupKey interface{}) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	log.Debug("redis cancel group", zap.Any("group", groupKey))
+	group, ok := hub.groups[groupKey]
+	if !ok {
+		return nil
+	}
+
+	delete(hub.groups, groupKey)
+	for _, reader := range group.readers {
+		reader.stop()
+	}
+
+	hub.replies.remove(group.routes)
+	return nil
+}
+
+func (hub *RedisHub) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	gate := &replyGate{}
+	group := &redisGroup{}
+	handlers := make(map[string]func(data []byte))
+	for topic, handler := range replyGroup {
+		log.Debug("redis new reply route", zap.String("topic", topic), zap.Any("rgroup", groupKey))
+		handlers[topic] = hub.replyHandler(gate, finalizer, handler)
+		group.routes = append(group.routes, topic)
+	}
+
+	hub.replyMutex.Lock()
+	if hub.replyReader == nil {
+		reader, err := hub.read(hub.Config.ReplyStream, hub.replyGroup(), func(msg redis.XMessage) error {
+			topic, _ := msg.Values[RedisFieldReplyTopic].(string)
+			data, _ := msg.Values[RedisFieldData].(string)
+			return hub.replies.deliver(topic, []byte(data))
+		})
+
+		if err != nil {
+			hub.replyMutex.Unlock()
+			return err
+		}
+
+		hub.replyReader = reader
+	}
+
+	hub.replyMutex.Unlock()
+	hub.replies.add(handlers)
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *RedisHub) SubGroup(groupKey interface{}, handlerGroup RawGroup) error {
+	hub.groupMutex.Lock()
+	defer hub.groupMutex.Unlock()
+	if _, ok := hub.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	group := &redisGroup{}
+	for topic, handler := range handlerGroup {
+		log.Debug("redis new raw subscriber", zap.String("topic", topic), zap.Any("group", groupKey))
+		handler := handler
+		reader, err := hub.read(topic, hub.Config.Group, func(msg redis.XMessage) error {
+			data, _ := msg.Values[RedisFieldData].(string)
+			return handler([]byte(data))
+		})
+
+		if err != nil {
+			for _, reader := range group.readers {
+				reader.stop()
+			}
+
+			return err
+		}
+
+		group.readers = append(group.readers, reader)
+	}
+
+	hub.groups[groupKey] = group
+	return nil
+}
+
+func (hub *RedisHub) Pub(topic string, req *protocol.Request) error {
+	data, err := MarshalRequest(req)
+	if err != nil {
+		return err
+	}
+
+	return hub.add(topic, map[string]interface{}{
+		RedisFieldData:        data,
+		RedisFieldReplyStream: hub.Config.ReplyStream,
+	})
+}
+
+func (hub *RedisHub) PubRaw(topic string, data []byte) error {
+	return hub.add(topic, map[string]interface{}{
+		RedisFieldData: data,
+	})
+}
+
+// add appends an entry to the stream of topic, trimming the stream to about
+// MaxLen entries.
+func (hub *RedisHub) add(topic string, values map[string]interface{}) error {
+	return hub.Client.XAdd(&redis.XAddArgs{
+		Stream:       topic,
+		MaxLenApprox: hub.Config.MaxLen,
+		Values:       values,
+	}).Err()
+}
+
+func (hub *RedisHub) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) func(data []byte) {
+	return func(data []byte) {
+		gate.handle(func() bool {
+			reply, err := UnmarshalReply(data)
+			if err != nil {
+				log.Error("redis reply unmarshal failure", zap.Error(err))
+				return true
+			}
+
+			if err := handler(reply); err == ErrReplyDiscarded {
+				return false
+			} else if err != nil {
+				log.Error("redis handler failure", zap.Error(err))
+				return true
+			}
+
+			finalizer()
+			return true
+		})
+	}
+}
+
+// replyGroup is the engine's consumer group of the reply stream.
+func (hub *RedisHub) replyGroup() string {
+	return hub.Config.Group + "." + hub.Config.Consumer
+}
+
+// read creates the consumer group of the stream when it's missing and reads
+// the stream in it until the reader is stopped. The group of a new stream
+// starts at the entries added after it's created.
+func (hub *RedisHub) read(stream string, group string, handler func(msg redis.XMessage) error) (*redisReader, error) {
+	err := hub.Client.XGroupCreateMkStream(stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create consumer group of %q: %v", stream, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &redisReader{
+		hub:     hub,
+		stream:  stream,
+		group:   group,
+		handler: handler,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	go reader.run()
+	return reader, nil
+}
+
+type redisReader struct {
+	hub     *RedisHub
+	stream  string
+	group   string
+	handler func(msg redis.XMessage) error
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (reader *redisReader) stop() {
+	reader.cancel()
+}
+
+func (reader *redisReader) stopped() bool {
+	return reader.ctx.Err() != nil
+}
+
+// run handles the entries the consumer read before it last stopped, then
+// reads new entries and claims idle ones of any consumer in between.
+func (reader *redisReader) run() {
+	// entries that stay pending are read again from the same ID, so the
+	// backlog is read from after the last entry of every batch
+	for id := "0"; !reader.stopped(); {
+		last := reader.readGroup(id)
+		if last == "" {
+			break
+		}
+
+		id = last
+	}
+
+	lastClaim := time.Time{}
+	for !reader.stopped() {
+		if time.Since(lastClaim) >= reader.hub.Config.ClaimIdle/2 {
+			reader.claim()
+			lastClaim = time.Now()
+		}
+
+		reader.readGroup(">")
+	}
+}
+
+// readGroup reads from the given ID: "0" or the ID of an entry reads the
+// entries pending for the consumer after it, ">" waits for new ones. It
+// returns the ID of the last entry read, if any.
+func (reader *redisReader) readGroup(id string) string {
+	config := reader.hub.Config
+	streams, err := reader.hub.Client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    reader.group,
+		Consumer: config.Consumer,
+		Streams:  []string{reader.stream, id},
+		Count:    16,
+		Block:    redisBlock,
+	}).Result()
+
+	if err == redis.Nil {
+		return ""
+	} else if err != nil {
+		if !reader.stopped() {
+			log.Error("redis read failure", zap.String("stream", reader.stream), zap.Error(err))
+			time.Sleep(time.Second)
+		}
+
+		return ""
+	}
+
+	last := ""
+	for _, stream := range streams {
+		reader.handle(stream.Messages)
+		if len(stream.Messages) > 0 {
+			last = stream.Messages[len(stream.Messages)-1].ID
+		}
+	}
+
+	return last
+}
+
+// claim takes over entries that were pending for longer than ClaimIdle.
+func (reader *redisReader) claim() {
+	config := reader.hub.Config
+	pending, err := reader.hub.Client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: reader.stream,
+		Group:  reader.group,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+
+	if err == redis.Nil {
+		return
+	} else if err != nil {
+		log.Error("redis pending failure", zap.String("stream", reader.stream), zap.Error(err))
+		return
+	}
+
+	ids := make([]string, 0)
+	for _, entry := range pending {
+		if entry.Idle >= config.ClaimIdle {
+			ids = append(ids, entry.Id)
+		}
+	}
+
+	if len(ids) < 1 {
+		return
+	}
+
+	claimed, err := reader.hub.Client.XClaim(&redis.XClaimArgs{
+		Stream:   reader.stream,
+		Group:    reader.group,
+		Consumer: config.Consumer,
+		MinIdle:  config.ClaimIdle,
+		Messages: ids,
+	}).Result()
+
+	if err != nil {
+		log.Error("redis claim failure", zap.String("stream", reader.stream), zap.Error(err))
+		return
+	}
+
+	log.Debug("redis entries claimed", zap.String("stream", reader.stream), zap.Int("count", len(claimed)))
+	reader.handle(claimed)
+}
+
+// handle acknowledges the entries whose handler succeeded. The others stay
+// pending until they're claimed again.
+func (reader *redisReader) handle(msgs []redis.XMessage) {
+	for _, msg := range msgs {
+		if reader.stopped() {
+			return
+		}
+
+		if err := reader.handler(msg); err != nil {
+			log.Warn("subscriber failed", zap.String("topic", reader.stream))
+			continue
+		}
+
+		if err := reader.hub.Client.XAck(reader.stream, reader.group, msg.ID).Err(); err != nil {
+			log.Error("redis ack failure", zap.Error(err))
+			continue
+		}
+
+		log.Debug("redis ack")
+	}
+}
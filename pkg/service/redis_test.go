@@ -0,0 +1,263 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/go-redis/redis"
+)
+
+// newTestRedisHub connects a hub to an in-process stand-in of redis-server.
+func newTestRedisHub(t *testing.T, server *miniredis.Miniredis, consumer string) *RedisHub {
+	hub, err := NewRedisHub(RedisConfig{Addr: server.Addr(), Consumer: consumer, ClaimIdle: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hub
+}
+
+func addRedisReply(t *testing.T, hub *RedisHub, topic string, requestID string) {
+	data, err := MarshalReply(&protocol.Reply{RequestID: requestID, Outcome: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hub.Client.XAdd(&redis.XAddArgs{
+		Stream: hub.Config.ReplyStream,
+		Values: map[string]interface{}{RedisFieldReplyTopic: topic, RedisFieldData: data},
+	}).Err()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func redisPending(t *testing.T, hub *RedisHub, stream string, group string) int64 {
+	pending, err := hub.Client.XPending(stream, group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pending.Count
+}
+
+func TestRedisTriggers(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+	hub := newTestRedisHub(t, server, "e1")
+	defer hub.CancelAll()
+	received := make(chan string, 2)
+	err = hub.SubGroup("r1", RawGroup{
+		"checkout.start": func(data []byte) error {
+			received <- string(data)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hub.PubRaw("checkout.start", []byte("trigger")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if data != "trigger" {
+			t.Fatalf("expected the trigger, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("trigger wasn't received")
+	}
+}
+
+func TestRedisUnroutedRepliesStayPending(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+	hub := newTestRedisHub(t, server, "e1")
+	defer hub.CancelAll()
+	finalized := make(chan struct{}, 1)
+	other := ReplyGroup{"sake.reply.ok.t0@a": func(*protocol.Reply) error { return nil }}
+	if err := hub.SubReply("q0", func() {}, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// t1 isn't resumed yet when its reply is read
+	addRedisReply(t, hub, "sake.reply.ok.t1@a", "q1")
+	deadline := time.Now().Add(5 * time.Second)
+	for redisPending(t, hub, hub.Config.ReplyStream, hub.replyGroup()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the unrouted reply to stay pending")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	err = hub.SubReply("q1", func() { finalized <- struct{}{} }, ReplyGroup{
+		"sake.reply.ok.t1@a": func(reply *protocol.Reply) error { return nil },
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending reply is claimed again once it's idle
+	select {
+	case <-finalized:
+	case <-time.After(10 * time.Second):
+		t.Fatal("pending reply wasn't handled")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for redisPending(t, hub, hub.Config.ReplyStream, hub.replyGroup()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the handled reply to be acknowledged")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRedisRepliesPerEngine(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+	finalized := make(chan string, 2)
+	for _, consumer := range []string{"e1", "e2"} {
+		consumer := consumer
+		hub := newTestRedisHub(t, server, consumer)
+		defer hub.CancelAll()
+		topic := "sake.reply.ok.t-" + consumer + "@a"
+		err := hub.SubReply("q-"+consumer, func() { finalized <- consumer }, ReplyGroup{
+			topic: func(reply *protocol.Reply) error { return nil },
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both engines read every reply, and each takes the one to its request
+	hub := newTestRedisHub(t, server, "e3")
+	defer hub.CancelAll()
+	addRedisReply(t, hub, "sake.reply.ok.t-e1@a", "q-e1")
+	addRedisReply(t, hub, "sake.reply.ok.t-e2@a", "q-e2")
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		select {
+		case consumer := <-finalized:
+			got[consumer] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only the replies of %v were handled", got)
+		}
+	}
+}
+
+func TestRedisPendingBacklog(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+	hub := newTestRedisHub(t, server, "e1")
+	defer hub.CancelAll()
+	// the backlog isn't idle long enough to be claimed
+	hub.Config.ClaimIdle = time.Hour
+	stream := "checkout.start"
+	if err := hub.Client.XGroupCreateMkStream(stream, hub.Config.Group, "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// more entries than a read returns were read by the consumer before it
+	// stopped, and the first one can't be handled
+	const backlog = 40
+	for i := 0; i < backlog; i++ {
+		data := "trigger"
+		if i == 0 {
+			data = "poison"
+		}
+
+		if err := hub.PubRaw(stream, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = hub.Client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    hub.Config.Group,
+		Consumer: hub.Config.Consumer,
+		Streams:  []string{stream, ">"},
+		Count:    backlog,
+	}).Err()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, backlog)
+	err = hub.SubGroup("r1", RawGroup{
+		stream: func(data []byte) error {
+			if string(data) == "poison" {
+				return errors.New("invalid trigger")
+			}
+
+			handled <- string(data)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hub.PubRaw(stream, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry that stays pending doesn't hold up the rest of the backlog
+	// or new entries
+	for i := 1; i < backlog; i++ {
+		select {
+		case data := <-handled:
+			if data != "trigger" {
+				t.Fatalf("expected pending entry %d, got %q", i, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d pending entries were handled", i-1, backlog-1)
+		}
+	}
+
+	select {
+	case data := <-handled:
+		if data != "new" {
+			t.Fatalf("expected the new entry, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("new entry wasn't handled")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for redisPending(t, hub, stream, hub.Config.Group) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the failed entry to be pending, %d entries are", redisPending(t, hub, stream, hub.Config.Group))
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// ReplyStale is a reply to a request that is no longer outstanding, such
+	// as one that timed out and was retried.
+	ReplyStale = "stale"
+	// ReplyDuplicate is a reply to a request that was already replied to.
+	ReplyDuplicate = "duplicate"
+	// ReplyMismatched is a reply whose echoed request ID or attempt doesn't
+	// match the request it was delivered for.
+	ReplyMismatched = "mismatched"
+)
+
+// ReplyStats counts the replies the coordinator accepted and discarded.
+type ReplyStats struct {
+	Accepted   int64
+	Stale      int64
+	Duplicate  int64
+	Mismatched int64
+}
+
+// ReplyStats returns a copy of the reply counters.
+func (c *Coordinator) ReplyStats() ReplyStats {
+	return ReplyStats{
+		Accepted:   atomic.LoadInt64(&c.replyStats.Accepted),
+		Stale:      atomic.LoadInt64(&c.replyStats.Stale),
+		Duplicate:  atomic.LoadInt64(&c.replyStats.Duplicate),
+		Mismatched: atomic.LoadInt64(&c.replyStats.Mismatched),
+	}
+}
+
+// acceptReply checks that a reply belongs to the request reqID and that the
+// request is still outstanding. branch is nil for stages without branches.
+// The transaction must be locked.
+func (c *Coordinator) acceptReply(trx *Transaction, branch *ActiveBranch, reqID string, reply *protocol.Reply) bool {
+	reason := ""
+	switch {
+	case branch == nil && reqID == trx.RepliedRequestID,
+		branch != nil && branch.RequestID == reqID && branch.State != BranchPending:
+		reason = ReplyDuplicate
+	case !trx.IsInProgress(),
+		branch == nil && reqID != trx.RequestID,
+		branch != nil && (reqID != branch.RequestID || !trx.IsActiveBranch(branch)):
+		reason = ReplyStale
+	case reply.RequestID != "" && reply.RequestID != reqID,
+		reply.Attempt != 0 && int(reply.Attempt) != trx.Attempt:
+		reason = ReplyMismatched
+	}
+
+	if reason == "" {
+		atomic.AddInt64(&c.replyStats.Accepted, 1)
+		return true
+	}
+
+	repliesDiscarded.Inc(reason)
+	switch reason {
+	case ReplyStale:
+		atomic.AddInt64(&c.replyStats.Stale, 1)
+	case ReplyDuplicate:
+		atomic.AddInt64(&c.replyStats.Duplicate, 1)
+	case ReplyMismatched:
+		atomic.AddInt64(&c.replyStats.Mismatched, 1)
+	}
+
+	fields := []zap.Field{
+		zap.String("reason", reason),
+		zap.String("req", reqID),
+		zap.String("reply_req", reply.RequestID),
+		zap.Int32("reply_attempt", reply.Attempt),
+	}
+
+	if branch != nil {
+		fields = append(fields, zap.String("branch", branch.Key))
+	}
+
+	log.Warn("reply discarded", TransactionFields(trx, fields...)...)
+	return false
+}
+
+// newStageFailure describes a failure reply to the current stage, or to one
+// of its branches when branch is set.
+func newStageFailure(trx *Transaction, branch *ActiveBranch, reqID string, reply *protocol.Reply) *StageFailure {
+	failure := &StageFailure{
+		Stage:     trx.StageKey,
+		State:     trx.State,
+		RequestID: reqID,
+		Time:      time.Now(),
+	}
+
+	if branch != nil {
+		failure.Branch = branch.Key
+	} else {
+		failure.Attempt = trx.Attempt
+	}
+
+	if err := reply.GetError(); err != nil {
+		failure.Code = err.Code
+		failure.Message = err.Message
+		failure.Retryable = err.Retryable
+		failure.Details = RawJSON(err.Details)
+	}
+
+	return failure
+}
+
+// failureFields are the log fields of a failure's error.
+func failureFields(failure *StageFailure) []zap.Field {
+	fields := make([]zap.Field, 0, 3)
+	if failure.Code != "" {
+		fields = append(fields, zap.String("error_code", failure.Code))
+	}
+
+	if failure.Message != "" {
+		fields = append(fields, zap.String("error", failure.Message))
+	}
+
+	return append(fields, zap.Bool("retryable", failure.Retryable))
+}
+
+// failureReason appends the error message of a failure, if any, to a park
+// reason.
+func failureReason(reason string, failure *StageFailure) string {
+	if failure == nil || failure.Message == "" {
+		return reason
+	}
+
+	return reason + ": " + failure.Message
+}
+
+// RawJSON returns JSON as is and anything else encoded as a JSON string.
+func RawJSON(data []byte) json.RawMessage {
+	if len(data) < 1 {
+		return nil
+	} else if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+
+	encoded, _ := json.Marshal(string(data))
+	return json.RawMessage(encoded)
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+// replyHoldTime is how long a replyRouter expects replies to topics that
+// aren't routed yet, e.g. while transactions are resumed after a restart.
+const replyHoldTime = time.Minute
+
+// errReplyUnrouted is returned for a reply whose topic isn't routed yet.
+var errReplyUnrouted = errors.New("reply topic isn't routed")
+
+// replyRouter routes the replies of a shared reply topic to the reply groups
+// by their reply topic, for hubs that don't have a topic per request.
+type replyRouter struct {
+	mutex   sync.Mutex
+	routes  map[string]func(data []byte)
+	held    []*heldReply
+	started time.Time
+	expiry  *time.Timer
+}
+
+// heldReply is a reply that's held until its topic is routed or it's older
+// than replyHoldTime. done, when set, is called once the reply was handed to
+// its handler or dropped.
+type heldReply struct {
+	topic string
+	data  []byte
+	at    time.Time
+	done  func()
+}
+
+func newReplyRouter() *replyRouter {
+	return &replyRouter{
+		routes:  make(map[string]func(data []byte)),
+		started: time.Now(),
+	}
+}
+
+// add routes the topics to their handlers and hands them the replies that
+// are held for them.
+func (router *replyRouter) add(handlers map[string]func(data []byte)) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	for topic, handler := range handlers {
+		router.routes[topic] = handler
+	}
+
+	released := make([]*heldReply, 0)
+	held := router.held[:0]
+	for _, reply := range router.held {
+		if _, ok := handlers[reply.topic]; ok {
+			released = append(released, reply)
+		} else {
+			held = append(held, reply)
+		}
+	}
+
+	router.held = held
+	if len(released) > 0 {
+		go func() {
+			for _, reply := range released {
+				handlers[reply.topic](reply.data)
+				if reply.done != nil {
+					reply.done()
+				}
+			}
+		}()
+	}
+}
+
+func (router *replyRouter) remove(topics []string) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	for _, topic := range topics {
+		delete(router.routes, topic)
+	}
+}
+
+func (router *replyRouter) reset() {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.routes = make(map[string]func(data []byte))
+	router.held = nil
+	router.started = time.Now()
+	if router.expiry != nil {
+		router.expiry.Stop()
+		router.expiry = nil
+	}
+}
+
+// expire drops the held replies that are older than replyHoldTime. The
+// router's mutex must be held.
+func (router *replyRouter) expire() []*heldReply {
+	expired := time.Now().Add(-replyHoldTime)
+	dropped := make([]*heldReply, 0)
+	held := router.held[:0]
+	for _, reply := range router.held {
+		if reply.at.After(expired) {
+			held = append(held, reply)
+		} else {
+			dropped = append(dropped, reply)
+		}
+	}
+
+	router.held = held
+	return dropped
+}
+
+// deliver hands a reply to the handler of its topic. Until replyHoldTime
+// passed since the router started, a reply to a topic that isn't routed is
+// refused with errReplyUnrouted, so that the hub keeps it and delivers it
+// again. Later, every request that's waited for is routed and the reply is
+// dropped.
+func (router *replyRouter) deliver(topic string, data []byte) error {
+	router.mutex.Lock()
+	handler, ok := router.routes[topic]
+	started := router.started
+	router.mutex.Unlock()
+	if ok {
+		handler(data)
+		return nil
+	} else if time.Since(started) < replyHoldTime {
+		log.Debug("reply not routed yet", zap.String("topic", topic))
+		return errReplyUnrouted
+	}
+
+	log.Warn("reply to a request nobody waits for dropped", zap.String("topic", topic))
+	return nil
+}
+
+// route hands a reply published at the given time to the handler of its
+// topic, or holds it for replyHoldTime when the topic isn't routed. It's for
+// transports that can't deliver a reply again.
+func (router *replyRouter) route(topic string, data []byte, at time.Time) {
+	router.mutex.Lock()
+	handler, ok := router.routes[topic]
+	if !ok {
+		dropped := router.expire()
+		router.held = append(router.held, &heldReply{topic: topic, data: data, at: at})
+		router.mutex.Unlock()
+		log.Debug("reply held", zap.String("topic", topic))
+		dropReplies(dropped)
+		return
+	}
+
+	router.mutex.Unlock()
+	handler(data)
+}
+
+// park hands a reply to the handler of its topic and calls done once it was
+// handed over or dropped, so that the hub can acknowledge it. Until
+// replyHoldTime passed since the router started, a reply to a topic that
+// isn't routed is held until the topic is routed, instead of being refused
+// like by deliver, so that the hub can go on with the replies after it.
+// Later, the reply is dropped.
+func (router *replyRouter) park(topic string, data []byte, done func()) {
+	router.mutex.Lock()
+	handler, ok := router.routes[topic]
+	if ok {
+		router.mutex.Unlock()
+		handler(data)
+		done()
+		return
+	}
+
+	wait := replyHoldTime - time.Since(router.started)
+	if wait <= 0 {
+		router.mutex.Unlock()
+		log.Warn("reply to a request nobody waits for dropped", zap.String("topic", topic))
+		done()
+		return
+	}
+
+	// parked replies expire together, when the router's hold time ends
+	router.held = append(router.held, &heldReply{topic: topic, data: data, at: router.started, done: done})
+	if router.expiry == nil {
+		router.expiry = time.AfterFunc(wait, func() {
+			router.mutex.Lock()
+			router.expiry = nil
+			dropped := router.expire()
+			router.mutex.Unlock()
+			dropReplies(dropped)
+		})
+	}
+
+	router.mutex.Unlock()
+	log.Debug("reply parked", zap.String("topic", topic))
+}
+
+func dropReplies(replies []*heldReply) {
+	for _, reply := range replies {
+		log.Warn("reply to a request nobody waits for dropped", zap.String("topic", reply.topic))
+		if reply.done != nil {
+			reply.done()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplyRouterDeliver(t *testing.T) {
+	router := newReplyRouter()
+	received := make(chan string, 1)
+	if err := router.deliver("sake.reply.ok.t1@a", []byte("early")); err != errReplyUnrouted {
+		t.Fatalf("expected an unrouted reply to be refused, got %v", err)
+	}
+
+	router.add(map[string]func(data []byte){
+		"sake.reply.ok.t1@a": func(data []byte) { received <- string(data) },
+	})
+
+	if err := router.deliver("sake.reply.ok.t1@a", []byte("reply")); err != nil {
+		t.Fatal(err)
+	} else if data := <-received; data != "reply" {
+		t.Fatalf("expected the reply, got %q", data)
+	}
+
+	router.remove([]string{"sake.reply.ok.t1@a"})
+	router.started = time.Now().Add(-replyHoldTime)
+	if err := router.deliver("sake.reply.ok.t1@a", []byte("late")); err != nil {
+		t.Fatalf("expected a late reply to be dropped, got %v", err)
+	}
+
+	select {
+	case data := <-received:
+		t.Fatalf("expected no reply, got %q", data)
+	default:
+	}
+}
+
+func TestReplyRouterRouteHolds(t *testing.T) {
+	router := newReplyRouter()
+	received := make(chan string, 1)
+	router.route("sake.reply.ok.t1@a", []byte("early"), time.Now())
+	router.add(map[string]func(data []byte){
+		"sake.reply.ok.t1@a": func(data []byte) { received <- string(data) },
+	})
+
+	select {
+	case data := <-received:
+		if data != "early" {
+			t.Fatalf("expected the held reply, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held reply wasn't released")
+	}
+}
+
+func TestReplyRouterPark(t *testing.T) {
+	router := newReplyRouter()
+	// the router's hold time ends soon
+	router.started = time.Now().Add(200*time.Millisecond - replyHoldTime)
+	received := make(chan string, 2)
+	done := make(chan string, 3)
+	router.park("sake.reply.ok.t1@a", []byte("early"), func() { done <- "early" })
+	router.park("sake.reply.ok.t2@a", []byte("other"), func() { done <- "other" })
+	select {
+	case reply := <-done:
+		t.Fatalf("expected the replies to be parked, %s is done", reply)
+	default:
+	}
+
+	router.add(map[string]func(data []byte){
+		"sake.reply.ok.t1@a": func(data []byte) { received <- string(data) },
+	})
+
+	select {
+	case reply := <-done:
+		if reply != "early" {
+			t.Fatalf("expected the released reply to be done, got %s", reply)
+		} else if data := <-received; data != "early" {
+			t.Fatalf("expected the parked reply, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("parked reply wasn't released")
+	}
+
+	// the reply to t2 is dropped once the hold time ends
+	select {
+	case reply := <-done:
+		if reply != "other" {
+			t.Fatalf("expected the unclaimed reply to be dropped, got %s", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("parked reply wasn't dropped")
+	}
+
+	router.park("sake.reply.ok.t3@a", []byte("late"), func() { done <- "late" })
+	if reply := <-done; reply != "late" {
+		t.Fatalf("expected the late reply to be dropped, got %s", reply)
+	}
+}
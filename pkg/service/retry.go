@@ -0,0 +1,115 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+)
+
+const (
+	FailureTimeout = "timeout"
+	FailureReply   = "failure"
+	// FailureRejection is a failure reply with an error that isn't
+	// retryable. It's only retried when a policy lists it.
+	FailureRejection = "rejection"
+)
+
+// defaultRetryOn are the failure classes retried by policies that don't list
+// any.
+var defaultRetryOn = []string{FailureTimeout, FailureReply}
+
+// FailureClass classifies a failure reply by the error it carries. Replies
+// without an error are plain failures.
+func FailureClass(reply *protocol.Reply) string {
+	if err := reply.GetError(); err != nil && !err.Retryable {
+		return FailureRejection
+	}
+
+	return FailureReply
+}
+
+// RetryPolicy controls how often a stage request is re-published before the
+// transaction gives up on the stage.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts int           `json:"max_attempts"`
+	Backoff     time.Duration `json:"backoff,omitempty"`
+	MaxBackoff  time.Duration `json:"max_backoff,omitempty"`
+	Multiplier  float64       `json:"multiplier,omitempty"`
+	// Jitter randomizes each delay by up to the given fraction of it.
+	Jitter float64 `json:"jitter,omitempty"`
+	// RetryOn lists the failure classes that are retried. Defaults to
+	// timeouts and failures, but not rejections.
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+func (policy *RetryPolicy) validate() error {
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be at least 1")
+	}
+
+	if policy.Backoff < 0 || policy.MaxBackoff < 0 {
+		return fmt.Errorf("backoff can't be negative")
+	}
+
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+
+	for _, class := range policy.RetryOn {
+		switch class {
+		case FailureTimeout, FailureReply, FailureRejection:
+		default:
+			return fmt.Errorf("unknown failure class %q", class)
+		}
+	}
+
+	return nil
+}
+
+// Retries reports whether a failure of the given class on the given attempt
+// should be retried.
+func (policy *RetryPolicy) Retries(class string, attempt int) bool {
+	if policy == nil || attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	retryOn := policy.RetryOn
+	if len(retryOn) < 1 {
+		retryOn = defaultRetryOn
+	}
+
+	for _, c := range retryOn {
+		if c == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delay is the time to wait before making the attempt that follows attempt.
+func (policy *RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	delay := float64(policy.Backoff) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetries(t *testing.T) {
+	var none *RetryPolicy
+	if none.Retries(FailureTimeout, 1) {
+		t.Error("expected stages without a policy not to be retried")
+	}
+
+	policy := &RetryPolicy{MaxAttempts: 3}
+	cases := []struct {
+		class   string
+		attempt int
+		want    bool
+	}{
+		{FailureTimeout, 1, true},
+		{FailureReply, 2, true},
+		{FailureRejection, 1, false},
+		{FailureTimeout, 3, false},
+		{FailureReply, 4, false},
+	}
+
+	for _, c := range cases {
+		if got := policy.Retries(c.class, c.attempt); got != c.want {
+			t.Errorf("%s on attempt %d: got %v, want %v", c.class, c.attempt, got, c.want)
+		}
+	}
+
+	policy.RetryOn = []string{FailureRejection}
+	if policy.Retries(FailureTimeout, 1) || !policy.Retries(FailureRejection, 1) {
+		t.Error("expected only the listed failure classes to be retried")
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	cases := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{Backoff: time.Second}, 1, time.Second},
+		{RetryPolicy{Backoff: time.Second}, 2, 2 * time.Second},
+		{RetryPolicy{Backoff: time.Second}, 4, 8 * time.Second},
+		{RetryPolicy{Backoff: time.Second, Multiplier: 1}, 4, time.Second},
+		{RetryPolicy{Backoff: time.Second, Multiplier: 3}, 3, 9 * time.Second},
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}, 4, 5 * time.Second},
+		{RetryPolicy{}, 3, 0},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.Delay(c.attempt); got != c.want {
+			t.Errorf("%+v on attempt %d: got %v, want %v", c.policy, c.attempt, got, c.want)
+		}
+	}
+
+	policy := &RetryPolicy{Backoff: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if delay := policy.Delay(2); delay < time.Second || delay > 3*time.Second {
+			t.Fatalf("expected a delay within 50%% of 2s, got %v", delay)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := []*RetryPolicy{
+		{MaxAttempts: 1},
+		{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: time.Minute, Multiplier: 1.5, Jitter: 1, RetryOn: []string{FailureTimeout, FailureRejection}},
+	}
+
+	for _, policy := range valid {
+		if err := policy.validate(); err != nil {
+			t.Errorf("%+v: %v", policy, err)
+		}
+	}
+
+	invalid := []*RetryPolicy{
+		{},
+		{MaxAttempts: 2, Backoff: -time.Second},
+		{MaxAttempts: 2, Multiplier: 0.5},
+		{MaxAttempts: 2, Jitter: 1.5},
+		{MaxAttempts: 2, RetryOn: []string{"sometimes"}},
+	}
+
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", policy)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Schema is a compiled subset of JSON Schema used to validate trigger payloads.
+// Supported keywords: type, enum, required, properties, additionalProperties,
+// items, minimum, maximum, minLength, maxLength, minItems and maxItems.
+type Schema struct {
+	Type                 interface{}        `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	types []string
+}
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+func CompileSchema(raw []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(raw, schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+
+	if err := schema.compile("$"); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+func (schema *Schema) compile(path string) error {
+	switch t := schema.Type.(type) {
+	case nil:
+	case string:
+		schema.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s: type must be a string or list of strings", path)
+			}
+
+			schema.types = append(schema.types, name)
+		}
+
+	default:
+		return fmt.Errorf("%s: type must be a string or list of strings", path)
+	}
+
+	for _, name := range schema.types {
+		if !schemaTypes[name] {
+			return fmt.Errorf("%s: unsupported type %q", path, name)
+		}
+	}
+
+	for name, prop := range schema.Properties {
+		if prop == nil {
+			return fmt.Errorf("%s.%s: property schema is empty", path, name)
+		}
+
+		if err := prop.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+
+	if schema.Items != nil {
+		if err := schema.Items.compile(path + "[]"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateJSON decodes data and checks it against the schema.
+func (schema *Schema) ValidateJSON(data []byte) error {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return fmt.Errorf("payload is not valid json: %v", err)
+	}
+
+	return schema.validate("$", v)
+}
+
+func (schema *Schema) validate(path string, v interface{}) error {
+	if len(schema.types) > 0 {
+		matched := false
+		for _, t := range schema.types {
+			if jsonTypeMatches(t, v) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("%s: expected %s but got %s", path, strings.Join(schema.types, " or "), jsonTypeOf(v))
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		matched := false
+		for _, e := range schema.Enum {
+			if jsonEqual(e, v) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("%s: value is not one of the allowed values", path)
+		}
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := schema.Properties[k]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+
+				continue
+			}
+
+			if err := prop.validate(path+"."+k, value[k]); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			return fmt.Errorf("%s: expected at least %d items", path, *schema.MinItems)
+		}
+
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items", path, *schema.MaxItems)
+		}
+
+		if schema.Items != nil {
+			for i, item := range value {
+				if err := schema.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		n := len([]rune(value))
+		if schema.MinLength != nil && n < *schema.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters", path, *schema.MinLength)
+		}
+
+		if schema.MaxLength != nil && n > *schema.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters", path, *schema.MaxLength)
+		}
+
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: invalid number", path)
+		}
+
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return fmt.Errorf("%s: must be >= %v", path, *schema.Minimum)
+		}
+
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return fmt.Errorf("%s: must be <= %v", path, *schema.Maximum)
+		}
+	}
+
+	return nil
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+
+		return "number"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+func jsonTypeMatches(t string, v interface{}) bool {
+	actual := jsonTypeOf(v)
+	return actual == t || (t == "number" && actual == "integer")
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	if an, ok := a.(float64); ok {
+		if bn, ok := b.(json.Number); ok {
+			f, err := bn.Float64()
+			return err == nil && f == an
+		}
+	}
+
+	return reflect.DeepEqual(a, b)
+}
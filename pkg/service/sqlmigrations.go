@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+// SQLMigration is a versioned change to the SQL storage schema. Migrations
+// are applied in order and never edited once released; add a new one
+// instead. Statements write {text} for the type of columns that hold
+// documents, see sqlDialect.
+type SQLMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+var sqlMigrations = []*SQLMigration{
+	{
+		Version:     1,
+		Description: "recipes, recipe versions and transactions",
+		Statements: []string{
+			`CREATE TABLE recipes (
+				name VARCHAR(255) NOT NULL PRIMARY KEY,
+				id VARCHAR(64) NOT NULL,
+				status INTEGER NOT NULL,
+				definition {text} NOT NULL,
+				updated BIGINT NOT NULL
+			)`,
+			`CREATE TABLE recipe_versions (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				name VARCHAR(255) NOT NULL,
+				definition {text} NOT NULL,
+				created BIGINT NOT NULL
+			)`,
+			`CREATE INDEX recipe_versions_name ON recipe_versions (name, created)`,
+			`CREATE TABLE transactions (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				recipe_id VARCHAR(64) NOT NULL,
+				recipe_name VARCHAR(255) NOT NULL,
+				state VARCHAR(32) NOT NULL,
+				stage_key VARCHAR(255) NOT NULL,
+				started BIGINT NOT NULL,
+				expires BIGINT NULL,
+				updated BIGINT NOT NULL,
+				document {text} NOT NULL
+			)`,
+			`CREATE INDEX transactions_state ON transactions (state)`,
+			`CREATE INDEX transactions_recipe ON transactions (recipe_name, state)`,
+			`CREATE INDEX transactions_started ON transactions (started)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "transaction event journal",
+		Statements: []string{
+			`CREATE TABLE transaction_events (
+				transaction_id VARCHAR(64) NOT NULL,
+				seq BIGINT NOT NULL,
+				type VARCHAR(32) NOT NULL,
+				time BIGINT NOT NULL,
+				event {text} NOT NULL,
+				PRIMARY KEY (transaction_id, seq)
+			)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "trigger deduplication keys",
+		Statements: []string{
+			`CREATE TABLE trigger_keys (
+				recipe_name VARCHAR(255) NOT NULL,
+				dedup_key VARCHAR(64) NOT NULL,
+				transaction_id VARCHAR(64) NOT NULL,
+				expires BIGINT NOT NULL,
+				PRIMARY KEY (recipe_name, dedup_key)
+			)`,
+			`CREATE INDEX trigger_keys_expires ON trigger_keys (expires)`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "numbered recipe versions",
+		Statements: []string{
+			`ALTER TABLE recipe_versions ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE recipe_versions ADD COLUMN status INTEGER NOT NULL DEFAULT 0`,
+			// the derived table lets mysql read the table it updates.
+			`UPDATE recipe_versions SET version = (
+				SELECT ranked.n FROM (
+					SELECT v.id AS id, (SELECT COUNT(*) FROM recipe_versions w WHERE w.name = v.name AND w.created <= v.created) AS n
+					FROM recipe_versions v
+				) ranked WHERE ranked.id = recipe_versions.id
+			)`,
+			`UPDATE recipe_versions SET status = (SELECT r.status FROM recipes r WHERE r.id = recipe_versions.id)
+				WHERE id IN (SELECT id FROM recipes)`,
+			`CREATE UNIQUE INDEX recipe_versions_version ON recipe_versions (name, version)`,
+		},
+	},
+}
+
+// LatestSQLSchemaVersion is the schema version this build of the engine
+// expects.
+func LatestSQLSchemaVersion() int {
+	return sqlMigrations[len(sqlMigrations)-1].Version
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY,
+	description VARCHAR(255) NOT NULL,
+	applied BIGINT NOT NULL
+)`
+
+// SQLSchemaVersion returns the version of the latest migration applied to db.
+// A database that was never migrated is at version 0.
+func SQLSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	if _, err := db.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// MigrateSQL applies every pending migration, each in its own database
+// transaction, and returns the resulting schema version.
+func MigrateSQL(ctx context.Context, db *sql.DB, driver string) (int, error) {
+	dialect, err := sqlDialectFor(driver)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := SQLSchemaVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range sqlMigrations {
+		if m.Version <= version {
+			continue
+		}
+
+		log.Info("applying migration", zap.Int("version", m.Version), zap.String("description", m.Description))
+		if err := applySQLMigration(ctx, db, dialect, m); err != nil {
+			return version, fmt.Errorf("migration %d failed: %v", m.Version, err)
+		}
+
+		version = m.Version
+	}
+
+	return version, nil
+}
+
+func applySQLMigration(ctx context.Context, db *sql.DB, dialect *sqlDialect, m *SQLMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range m.Statements {
+		if _, err := tx.ExecContext(ctx, dialect.schema(stmt)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(strings.SplitN(stmt, "\n", 2)[0]))
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		dialect.rebind("INSERT INTO schema_migrations (version, description, applied) VALUES (?, ?, ?)"),
+		m.Version,
+		m.Description,
+		time.Now().UnixNano(),
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqlDialect covers the differences between the supported databases.
+type sqlDialect struct {
+	// numbered placeholders are $1, $2... instead of ?.
+	numbered bool
+	// text is the type of columns that hold documents.
+	text string
+}
+
+func sqlDialectFor(driver string) (*sqlDialect, error) {
+	switch driver {
+	case "postgres", "pgx":
+		return &sqlDialect{numbered: true, text: "TEXT"}, nil
+	case "sqlite3", "sqlite":
+		return &sqlDialect{text: "TEXT"}, nil
+	case "mysql":
+		// TEXT holds at most 64KB in mysql
+		return &sqlDialect{text: "LONGTEXT"}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported sql driver %q", driver)
+}
+
+// schema fills in the column types of a migration statement.
+func (dialect *sqlDialect) schema(stmt string) string {
+	return strings.Replace(stmt, "{text}", dialect.text, -1)
+}
+
+// rebind rewrites the ? placeholders of query for the dialect.
+func (dialect *sqlDialect) rebind(query string) string {
+	if !dialect.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,550 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterStorageDriver("sql", func(ctx context.Context, config *Config) (StorageService, error) {
+		return NewSQLStorage(ctx, config.SQL.Driver, config.SQL.DSN, config.SQL.AutoMigrate)
+	})
+}
+
+// SQLStorage keeps recipes and transactions in a relational database through
+// database/sql. The database driver must be linked into the binary.
+type SQLStorage struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+var _ StorageService = &SQLStorage{}
+var _ EventJournal = &SQLStorage{}
+
+// OpenSQL opens and pings the database.
+func OpenSQL(ctx context.Context, driver string, dsn string) (*sql.DB, error) {
+	if _, err := sqlDialectFor(driver); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func NewSQLStorage(ctx context.Context, driver string, dsn string, autoMigrate bool) (*SQLStorage, error) {
+	db, err := OpenSQL(ctx, driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, _ := sqlDialectFor(driver)
+	var version int
+	if autoMigrate {
+		version, err = MigrateSQL(ctx, db, driver)
+	} else {
+		version, err = SQLSchemaVersion(ctx, db)
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if latest := LatestSQLSchemaVersion(); version != latest {
+		db.Close()
+		return nil, fmt.Errorf("schema version is %d but %d is required, run `sake migrate`", version, latest)
+	}
+
+	log.Info("sql storage ready", zap.String("driver", driver), zap.Int("schema_version", version))
+	return &SQLStorage{
+		db:      db,
+		dialect: dialect,
+	}, nil
+}
+
+// replace deletes and inserts a row in one database transaction, which works
+// the same on every supported database unlike their upsert statements.
+func (storage *SQLStorage) replace(ctx context.Context, table string, key string, keyValue string, insert string, args ...interface{}) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, storage.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, key)), keyValue); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, storage.dialect.rebind(insert), args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (storage *SQLStorage) SaveTransaction(ctx context.Context, trx *Transaction) error {
+	document, err := json.Marshal(trx)
+	if err != nil {
+		return err
+	}
+
+	var expires sql.NullInt64
+	if trx.Expires != nil {
+		expires.Int64 = trx.Expires.UnixNano()
+		expires.Valid = true
+	}
+
+	return storage.replace(
+		ctx,
+		"transactions",
+		"id",
+		trx.ID,
+		"INSERT INTO transactions (id, recipe_id, recipe_name, state, stage_key, started, expires, updated, document) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		trx.ID,
+		trx.RecipeID,
+		trx.RecipeName,
+		string(trx.State),
+		trx.StageKey,
+		trx.Started.UnixNano(),
+		expires,
+		time.Now().UnixNano(),
+		string(document),
+	)
+}
+
+// SaveRecipe upserts the recipe's row in recipe_versions. The recipes table
+// points at the active version of every recipe.
+func (storage *SQLStorage) SaveRecipe(ctx context.Context, recipe *Recipe) error {
+	definition, err := json.Marshal(recipe)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	status := int(recipe.Status())
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, storage.dialect.rebind("DELETE FROM recipe_versions WHERE id = ?"), recipe.ID)
+	if err == nil {
+		_, err = tx.ExecContext(
+			ctx,
+			storage.dialect.rebind("INSERT INTO recipe_versions (id, name, version, status, definition, created) VALUES (?, ?, ?, ?, ?, ?)"),
+			recipe.ID,
+			recipe.Name,
+			recipe.Version,
+			status,
+			string(definition),
+			recipe.Created.UnixNano(),
+		)
+	}
+
+	if err == nil && recipe.Status() == StatusActive {
+		_, err = tx.ExecContext(ctx, storage.dialect.rebind("DELETE FROM recipes WHERE name = ?"), recipe.Name)
+		if err == nil {
+			_, err = tx.ExecContext(
+				ctx,
+				storage.dialect.rebind("INSERT INTO recipes (name, id, status, definition, updated) VALUES (?, ?, ?, ?, ?)"),
+				recipe.Name,
+				recipe.ID,
+				status,
+				string(definition),
+				now,
+			)
+		}
+	} else if err == nil {
+		_, err = tx.ExecContext(ctx, storage.dialect.rebind("DELETE FROM recipes WHERE id = ?"), recipe.ID)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (storage *SQLStorage) RemoveRecipe(ctx context.Context, recipe *Recipe) error {
+	return storage.SaveRecipe(ctx, recipe.retired())
+}
+
+func (storage *SQLStorage) LoadAllRecipes(ctx context.Context) ([]*Recipe, error) {
+	return storage.queryRecipes(ctx, "SELECT version, status, created, definition FROM recipe_versions WHERE status <> ? ORDER BY name, version", int(StatusInactive))
+}
+
+func (storage *SQLStorage) LoadRecipeVersions(ctx context.Context, name string) ([]*Recipe, error) {
+	return storage.queryRecipes(ctx, "SELECT version, status, created, definition FROM recipe_versions WHERE name = ? ORDER BY version", name)
+}
+
+// queryRecipes decodes recipe versions. The columns take precedence over the
+// definition, which predates them for migrated rows.
+func (storage *SQLStorage) queryRecipes(ctx context.Context, query string, args ...interface{}) ([]*Recipe, error) {
+	rows, err := storage.db.QueryContext(ctx, storage.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	result := make([]*Recipe, 0)
+	for rows.Next() {
+		var version int
+		var status int32
+		var created int64
+		var definition string
+		if err := rows.Scan(&version, &status, &created, &definition); err != nil {
+			return nil, err
+		}
+
+		recipe := &Recipe{}
+		if err := json.Unmarshal([]byte(definition), recipe); err != nil {
+			return nil, err
+		}
+
+		recipe.Version = version
+		recipe.StatusCode = status
+		if recipe.Created.IsZero() {
+			recipe.Created = time.Unix(0, created)
+		}
+
+		result = append(result, recipe)
+	}
+
+	return result, rows.Err()
+}
+
+func (storage *SQLStorage) LoadActiveTransactions(ctx context.Context) ([]*Transaction, error) {
+	rows, err := storage.db.QueryContext(
+		ctx,
+		storage.dialect.rebind("SELECT document FROM transactions WHERE state NOT IN (?, ?) ORDER BY started"),
+		IsSuccess,
+		IsFailed,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	snapshots := make([]*Transaction, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+
+		trx := &Transaction{}
+		if err := json.Unmarshal([]byte(document), trx); err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, trx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	idRows, err := storage.db.QueryContext(ctx, `SELECT DISTINCT e.transaction_id FROM transaction_events e
+		WHERE NOT EXISTS (SELECT 1 FROM transactions t WHERE t.id = e.transaction_id)`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer idRows.Close()
+	unsnapshotted := make([]string, 0)
+	for idRows.Next() {
+		var trxID string
+		if err := idRows.Scan(&trxID); err != nil {
+			return nil, err
+		}
+
+		unsnapshotted = append(unsnapshotted, trxID)
+	}
+
+	if err := idRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return replayActive(ctx, storage, snapshots, unsnapshotted)
+}
+
+func (storage *SQLStorage) LoadTransaction(ctx context.Context, id string) (*Transaction, error) {
+	var snapshot *Transaction
+	var document string
+	err := storage.db.QueryRowContext(ctx, storage.dialect.rebind("SELECT document FROM transactions WHERE id = ?"), id).Scan(&document)
+	if err == nil {
+		snapshot = &Transaction{}
+		if err := json.Unmarshal([]byte(document), snapshot); err != nil {
+			return nil, err
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var after int64
+	if snapshot != nil {
+		after = snapshot.Seq
+	}
+
+	events, err := storage.LoadEvents(ctx, id, after)
+	if err != nil {
+		return nil, err
+	} else if snapshot == nil && len(events) < 1 {
+		return nil, nil
+	}
+
+	return ReplayTransaction(snapshot, events), nil
+}
+
+func (storage *SQLStorage) FindTransactions(ctx context.Context, query *TransactionQuery) (*TransactionPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if query.Recipe != "" {
+		where = append(where, "recipe_name = ?")
+		args = append(args, query.Recipe)
+	}
+
+	if len(query.States) > 0 {
+		marks := make([]string, len(query.States))
+		for i, state := range query.States {
+			marks[i] = "?"
+			args = append(args, string(state))
+		}
+
+		where = append(where, fmt.Sprintf("state IN (%s)", strings.Join(marks, ", ")))
+	}
+
+	if query.StartedAfter != nil {
+		where = append(where, "started >= ?")
+		args = append(args, query.StartedAfter.UnixNano())
+	}
+
+	if query.StartedBefore != nil {
+		where = append(where, "started < ?")
+		args = append(args, query.StartedBefore.UnixNano())
+	}
+
+	if cursor != nil {
+		where = append(where, "(started < ? OR (started = ? AND id < ?))")
+		args = append(args, cursor.Started, cursor.Started, cursor.ID)
+	}
+
+	stmt := "SELECT document FROM transactions"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	limit := query.limit()
+	stmt += fmt.Sprintf(" ORDER BY started DESC, id DESC LIMIT %d", limit+1)
+	rows, err := storage.db.QueryContext(ctx, storage.dialect.rebind(stmt), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	page := &TransactionPage{
+		Transactions: make([]*Transaction, 0),
+	}
+
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+
+		trx := &Transaction{}
+		if err := json.Unmarshal([]byte(document), trx); err != nil {
+			return nil, err
+		}
+
+		page.Transactions = append(page.Transactions, trx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Transactions) > limit {
+		page.Transactions = page.Transactions[:limit]
+		page.NextCursor = encodeCursor(page.Transactions[limit-1])
+	}
+
+	return page, nil
+}
+
+func (storage *SQLStorage) AppendEvents(ctx context.Context, events ...*TransactionEvent) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	insert := storage.dialect.rebind("INSERT INTO transaction_events (transaction_id, seq, type, time, event) VALUES (?, ?, ?, ?, ?)")
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, insert, event.TransactionID, event.Seq, string(event.Type), event.Time.UnixNano(), string(data))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (storage *SQLStorage) LoadEvents(ctx context.Context, trxID string, afterSeq int64) ([]*TransactionEvent, error) {
+	rows, err := storage.db.QueryContext(
+		ctx,
+		storage.dialect.rebind("SELECT event FROM transaction_events WHERE transaction_id = ? AND seq > ? ORDER BY seq"),
+		trxID,
+		afterSeq,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	result := make([]*TransactionEvent, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		event := &TransactionEvent{}
+		if err := json.Unmarshal([]byte(data), event); err != nil {
+			return nil, err
+		}
+
+		result = append(result, event)
+	}
+
+	return result, rows.Err()
+}
+
+func (storage *SQLStorage) Close() error {
+	return storage.db.Close()
+}
+
+// sqlTriggerKey hashes a deduplication key, which is chosen by clients and
+// can be longer than the dedup_key column.
+func sqlTriggerKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClaimTriggerKey relies on the primary key of trigger_keys to settle
+// concurrent claims from several engines; the loser reads the winner's
+// claim.
+func (storage *SQLStorage) ClaimTriggerKey(ctx context.Context, claim *TriggerKey) (string, error) {
+	owner, err := storage.claimTriggerKey(ctx, claim)
+	if err == nil {
+		return owner, nil
+	}
+
+	var expires int64
+	selectErr := storage.db.QueryRowContext(
+		ctx,
+		storage.dialect.rebind("SELECT transaction_id, expires FROM trigger_keys WHERE recipe_name = ? AND dedup_key = ?"),
+		claim.Recipe,
+		sqlTriggerKey(claim.Key),
+	).Scan(&owner, &expires)
+
+	if selectErr == nil && time.Now().UnixNano() < expires {
+		return owner, nil
+	}
+
+	return "", err
+}
+
+func (storage *SQLStorage) claimTriggerKey(ctx context.Context, claim *TriggerKey) (string, error) {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var owner string
+	var expires int64
+	err = tx.QueryRowContext(
+		ctx,
+		storage.dialect.rebind("SELECT transaction_id, expires FROM trigger_keys WHERE recipe_name = ? AND dedup_key = ?"),
+		claim.Recipe,
+		sqlTriggerKey(claim.Key),
+	).Scan(&owner, &expires)
+
+	if err == nil && time.Now().UnixNano() < expires {
+		tx.Rollback()
+		return owner, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, storage.dialect.rebind("DELETE FROM trigger_keys WHERE recipe_name = ? AND dedup_key = ?"), claim.Recipe, sqlTriggerKey(claim.Key))
+	if err == nil {
+		_, err = tx.ExecContext(
+			ctx,
+			storage.dialect.rebind("INSERT INTO trigger_keys (recipe_name, dedup_key, transaction_id, expires) VALUES (?, ?, ?, ?)"),
+			claim.Recipe,
+			sqlTriggerKey(claim.Key),
+			claim.TransactionID,
+			claim.Expires.UnixNano(),
+		)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return claim.TransactionID, nil
+}
+
+func (storage *SQLStorage) ReleaseTriggerKey(ctx context.Context, recipeName string, key string) error {
+	_, err := storage.db.ExecContext(ctx, storage.dialect.rebind("DELETE FROM trigger_keys WHERE recipe_name = ? AND dedup_key = ?"), recipeName, sqlTriggerKey(key))
+	return err
+}
+
+func (storage *SQLStorage) PurgeTriggerKeys(ctx context.Context, before time.Time) (int, error) {
+	result, err := storage.db.ExecContext(ctx, storage.dialect.rebind("DELETE FROM trigger_keys WHERE expires < ?"), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
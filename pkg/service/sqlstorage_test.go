@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSQLStorage(t *testing.T) (*SQLStorage, func()) {
+	dir, cleanup := newTestDir(t)
+	storage, err := NewSQLStorage(context.Background(), "sqlite3", filepath.Join(dir, "sake.db"), true)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return storage, func() {
+		storage.Close()
+		cleanup()
+	}
+}
+
+func TestSQLMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	db, err := OpenSQL(ctx, "sqlite3", filepath.Join(dir, "sake.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	if version, err := SQLSchemaVersion(ctx, db); err != nil {
+		t.Fatal(err)
+	} else if version != 0 {
+		t.Fatalf("expected version 0 before migrating, got %d", version)
+	}
+
+	for i := 0; i < 2; i++ {
+		version, err := MigrateSQL(ctx, db, "sqlite3")
+		if err != nil {
+			t.Fatal(err)
+		} else if version != LatestSQLSchemaVersion() {
+			t.Fatalf("expected version %d, got %d", LatestSQLSchemaVersion(), version)
+		}
+	}
+}
+
+func TestSQLStorageRecipes(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestSQLStorage(t)
+	defer cleanup()
+	v1 := &Recipe{ID: "r1", Name: "checkout", Version: 1, Created: time.Now()}
+	v2 := &Recipe{ID: "r2", Name: "checkout", Version: 2, Created: time.Now()}
+	v1.SetStatus(StatusActive)
+	v2.SetStatus(StatusActive)
+	for _, recipe := range []*Recipe{v1, v2} {
+		if err := storage.SaveRecipe(ctx, recipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storage.RemoveRecipe(ctx, v1); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := storage.LoadAllRecipes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(active) != 1 || active[0].ID != "r2" {
+		t.Fatalf("expected only r2 to be loaded, got %+v", active)
+	}
+
+	versions, err := storage.LoadRecipeVersions(ctx, "checkout")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		t.Fatalf("expected versions 1 and 2, got %+v", versions)
+	}
+}
+
+func TestSQLStorageTransactions(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestSQLStorage(t)
+	defer cleanup()
+	recipe := &Recipe{ID: "r1", Name: "checkout"}
+	for id, state := range map[string]TransactionState{"t1": IsExecuting, "t2": IsSuccess} {
+		trx := NewTransaction(recipe, []byte(`{}`))
+		trx.ID = id
+		trx.State = state
+		if err := storage.SaveTransaction(ctx, trx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	active, err := storage.LoadActiveTransactions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(active) != 1 || active[0].ID != "t1" {
+		t.Fatalf("expected only t1 to be active, got %d transactions", len(active))
+	}
+
+	page, err := storage.FindTransactions(ctx, &TransactionQuery{Recipe: "checkout", States: []TransactionState{IsSuccess}})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(page.Transactions) != 1 || page.Transactions[0].ID != "t2" {
+		t.Fatalf("expected t2 to be found, got %d transactions", len(page.Transactions))
+	}
+
+	trx, err := storage.LoadTransaction(ctx, "missing")
+	if err != nil {
+		t.Fatal(err)
+	} else if trx != nil {
+		t.Fatal("expected no transaction")
+	}
+}
+
+func TestSQLStorageEvents(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestSQLStorage(t)
+	defer cleanup()
+	err := storage.AppendEvents(ctx,
+		&TransactionEvent{TransactionID: "t1", Seq: 1, Type: EventCreated},
+		&TransactionEvent{TransactionID: "t1", Seq: 2, Type: EventDispatched},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := storage.LoadEvents(ctx, "t1", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 || events[0].Seq != 2 {
+		t.Fatalf("expected event 2, got %+v", events)
+	}
+}
+
+func TestSQLStorageTriggerKeys(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestSQLStorage(t)
+	defer cleanup()
+	claim := &TriggerKey{Recipe: "checkout", Key: "k", TransactionID: "t1", Expires: time.Now().Add(time.Hour)}
+	if holder, err := storage.ClaimTriggerKey(ctx, claim); err != nil {
+		t.Fatal(err)
+	} else if holder != "t1" {
+		t.Fatalf("expected t1 to hold the key, got %q", holder)
+	}
+
+	other := &TriggerKey{Recipe: "checkout", Key: "k", TransactionID: "t2", Expires: time.Now().Add(time.Hour)}
+	if holder, err := storage.ClaimTriggerKey(ctx, other); err != nil {
+		t.Fatal(err)
+	} else if holder != "t1" {
+		t.Fatalf("expected t1 to keep the key, got %q", holder)
+	}
+
+	if n, err := storage.PurgeTriggerKeys(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1 purged key, got %d", n)
+	}
+}
+
+func TestSQLStorageLongTriggerKeys(t *testing.T) {
+	ctx := context.Background()
+	storage, cleanup := newTestSQLStorage(t)
+	defer cleanup()
+	key := strings.Repeat("k", 1000)
+	claim := &TriggerKey{Recipe: "checkout", Key: key, TransactionID: "t1", Expires: time.Now().Add(time.Hour)}
+	if _, err := storage.ClaimTriggerKey(ctx, claim); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := storage.db.QueryRowContext(ctx, "SELECT dedup_key FROM trigger_keys").Scan(&stored); err != nil {
+		t.Fatal(err)
+	} else if len(stored) != 64 {
+		t.Fatalf("expected the key to be stored hashed, got %d characters", len(stored))
+	}
+
+	other := &TriggerKey{Recipe: "checkout", Key: key, TransactionID: "t2", Expires: time.Now().Add(time.Hour)}
+	if holder, err := storage.ClaimTriggerKey(ctx, other); err != nil {
+		t.Fatal(err)
+	} else if holder != "t1" {
+		t.Fatalf("expected t1 to keep the key, got %q", holder)
+	}
+
+	if err := storage.ReleaseTriggerKey(ctx, "checkout", key); err != nil {
+		t.Fatal(err)
+	} else if holder, err := storage.ClaimTriggerKey(ctx, other); err != nil {
+		t.Fatal(err)
+	} else if holder != "t2" {
+		t.Fatalf("expected t2 to claim the released key, got %q", holder)
+	}
+}
+
+func TestSQLDialectSchema(t *testing.T) {
+	stmt := sqlMigrations[0].Statements[0]
+	for driver, want := range map[string]string{"sqlite3": "definition TEXT", "postgres": "definition TEXT", "mysql": "definition LONGTEXT"} {
+		dialect, err := sqlDialectFor(driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if schema := dialect.schema(stmt); !strings.Contains(schema, want) || strings.Contains(schema, "{") {
+			t.Errorf("%s: expected %q in\n%s", driver, want, schema)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/api/v1"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+// DefaultDedupWindow is how long a deduplication key keeps pointing at the
+// transaction it started when no window is configured.
+const DefaultDedupWindow = 24 * time.Hour
+
+// Start begins a transaction of the named recipe with a trigger payload, as
+// if it had been published to the recipe's trigger topic. The values set in
+// mc override the message context of the trigger envelope. The idempotency
+// key, or the recipe's deduplication key of the payload when it's empty,
+// is claimed like the key of a trigger. When a transaction already holds
+// the key, that transaction is returned instead and the second result is
+// false.
+func (c *Coordinator) Start(recipeName string, data []byte, idempotencyKey string, mc *MessageContext) (*Transaction, bool, error) {
+	recipes, err := c.Cache.FilterRecipes(c.Context, func(recipe *Recipe) (bool, error) {
+		return recipe.Name == recipeName && recipe.Status() == StatusActive, nil
+	})
+
+	if err != nil {
+		return nil, false, err
+	} else if len(recipes) < 1 {
+		return nil, false, v1.ErrorCodeRecipeUnknown.WithArgs(recipeName)
+	}
+
+	recipe := recipes[0]
+	payload, triggerContext, err := recipe.DecodeTrigger(data)
+	if err != nil {
+		return nil, false, v1.ErrorCodeRequestInvalid.WithDetail(err.Error())
+	}
+
+	triggerContext.Merge(mc)
+
+	key := idempotencyKey
+	if key == "" {
+		if key, err = recipe.DedupKey(data); err != nil {
+			return nil, false, v1.ErrorCodeRequestInvalid.WithDetail(err.Error())
+		}
+	}
+
+	return c.start(recipe, payload, key, triggerContext)
+}
+
+// start creates a transaction of the recipe and takes its first step. With
+// a deduplication key, the key is claimed first and the transaction that
+// holds it is returned when the claim fails.
+func (c *Coordinator) start(recipe *Recipe, payload []byte, key string, mc *MessageContext) (*Transaction, bool, error) {
+	trx := NewTransaction(recipe, payload)
+	trx.setContext(mc)
+	if key == "" {
+		return trx, true, c.begin(trx)
+	}
+
+	trx.IdempotencyKey = key
+	c.startMutex.Lock()
+	c.starting[trx.ID] = trx
+	c.startMutex.Unlock()
+	defer func() {
+		c.startMutex.Lock()
+		delete(c.starting, trx.ID)
+		c.startMutex.Unlock()
+	}()
+
+	window := c.Config.DedupWindow
+	if recipe.Dedup != nil && recipe.Dedup.Window > 0 {
+		window = recipe.Dedup.Window
+	} else if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	owner, err := c.Storage.ClaimTriggerKey(c.Context, &TriggerKey{
+		Recipe:        recipe.Name,
+		Key:           key,
+		TransactionID: trx.ID,
+		Expires:       trx.Started.Add(window),
+	})
+
+	if err != nil {
+		return nil, false, fmt.Errorf("claiming dedup key failed: %v", err)
+	}
+
+	if owner != trx.ID {
+		c.startMutex.Lock()
+		existing := c.starting[owner]
+		c.startMutex.Unlock()
+		if existing == nil {
+			if existing, err = c.findTransaction(owner); err != nil {
+				return nil, false, err
+			} else if existing == nil {
+				return nil, false, v1.ErrorCodeTransactionUnknown.WithArgs(owner)
+			}
+		}
+
+		log.Info("duplicate start matched transaction", TransactionFields(existing, zap.String("dedup_key", key))...)
+		return existing, false, nil
+	}
+
+	if err := c.begin(trx); err != nil {
+		if err := c.Storage.ReleaseTriggerKey(c.Context, recipe.Name, key); err != nil {
+			log.Error("releasing dedup key failed", TransactionFields(trx, zap.String("dedup_key", key), zap.Error(err))...)
+		}
+
+		return trx, true, err
+	}
+
+	return trx, true, nil
+}
+
+func (c *Coordinator) begin(trx *Transaction) error {
+	addActive(trx.Recipe, 1)
+	transactionsStarted.Inc(trx.RecipeName)
+	log.Info("start transaction", log.Combine(RecipeField(trx.Recipe), TransactionFields(trx)...)...)
+	trx.Lock()
+	defer trx.Unlock()
+	c.traceStart(trx)
+	c.record(trx, &TransactionEvent{
+		Type:           EventCreated,
+		Time:           trx.Started,
+		Data:           trx.Data,
+		RecipeID:       trx.RecipeID,
+		RecipeName:     trx.RecipeName,
+		RecipeVersion:  trx.RecipeVersion,
+		IdempotencyKey: trx.IdempotencyKey,
+		CorrelationID:  trx.CorrelationID,
+		Traceparent:    trx.Traceparent,
+		Tracestate:     trx.Tracestate,
+		Metadata:       trx.Metadata,
+		Trace:          trx.Trace.copy(),
+	})
+
+	if err := c.transition(trx); err != nil {
+		log.Error("transition failed", log.Combine(zap.Error(err), TransactionFields(trx)...)...)
+		return fmt.Errorf("failed to transition transaction: %v", err)
+	}
+
+	return nil
+}
+
+// findTransaction prefers the running copy of a transaction over the stored
+// one.
+func (c *Coordinator) findTransaction(id string) (*Transaction, error) {
+	trx, err := c.Cache.GetTransaction(c.Context, id)
+	if err != nil || trx != nil {
+		return trx, err
+	}
+
+	return c.Storage.LoadTransaction(c.Context, id)
+}
+
+// Await blocks until the transaction completes or the context is done.
+func (c *Coordinator) Await(ctx context.Context, trx *Transaction) error {
+	done := make(chan struct{})
+	c.waitMutex.Lock()
+	c.waiters[trx.ID] = append(c.waiters[trx.ID], done)
+	c.waitMutex.Unlock()
+	defer c.stopWaiting(trx.ID, done)
+
+	trx.Lock()
+	completed := trx.IsCompleted()
+	trx.Unlock()
+	if completed {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Coordinator) stopWaiting(id string, done chan struct{}) {
+	c.waitMutex.Lock()
+	defer c.waitMutex.Unlock()
+	waiters := c.waiters[id]
+	for i, waiter := range waiters {
+		if waiter == done {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) < 1 {
+		delete(c.waiters, id)
+	} else {
+		c.waiters[id] = waiters
+	}
+}
+
+// notifyCompleted wakes the callers awaiting the transaction.
+func (c *Coordinator) notifyCompleted(trx *Transaction) {
+	c.waitMutex.Lock()
+	defer c.waitMutex.Unlock()
+	for _, done := range c.waiters[trx.ID] {
+		close(done)
+	}
+
+	delete(c.waiters, trx.ID)
+}
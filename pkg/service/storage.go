@@ -2,6 +2,11 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/danielkrainas/sake/pkg/util/log"
 	memdb "github.com/hashicorp/go-memdb"
@@ -9,17 +14,116 @@ import (
 
 type StorageService interface {
 	SaveTransaction(ctx context.Context, trx *Transaction) error
+	// SaveRecipe saves a version of a recipe. Versions are kept when they're
+	// removed, so a recipe's history and the version a transaction runs can
+	// always be loaded.
 	SaveRecipe(ctx context.Context, recipe *Recipe) error
+	// RemoveRecipe retires a version of a recipe, marking it inactive.
 	RemoveRecipe(ctx context.Context, recipe *Recipe) error
+	// LoadAllRecipes returns the versions of recipes that aren't inactive.
 	LoadAllRecipes(ctx context.Context) ([]*Recipe, error)
+	// LoadRecipeVersions returns every version of a recipe, oldest first.
+	LoadRecipeVersions(ctx context.Context, name string) ([]*Recipe, error)
 	LoadActiveTransactions(ctx context.Context) ([]*Transaction, error)
+	// LoadTransaction returns nil when the transaction doesn't exist.
+	LoadTransaction(ctx context.Context, id string) (*Transaction, error)
+	FindTransactions(ctx context.Context, query *TransactionQuery) (*TransactionPage, error)
+	// ClaimTriggerKey records the claim unless an unexpired claim on the same
+	// recipe and key exists. It returns the ID of the transaction that holds
+	// the key, which is the claim's own when it was recorded.
+	ClaimTriggerKey(ctx context.Context, claim *TriggerKey) (string, error)
+	ReleaseTriggerKey(ctx context.Context, recipeName string, key string) error
+	// PurgeTriggerKeys removes the claims that expired before the given time.
+	PurgeTriggerKeys(ctx context.Context, before time.Time) (int, error)
+}
+
+// TransactionPurger is implemented by storage drivers that remove completed
+// transactions once they've been kept for a retention period.
+type TransactionPurger interface {
+	PurgeTransactions(ctx context.Context) (int, error)
+}
+
+// TriggerKey ties a deduplication key of a recipe to the transaction it
+// started until the key expires.
+type TriggerKey struct {
+	Recipe        string    `json:"recipe"`
+	Key           string    `json:"key"`
+	TransactionID string    `json:"transaction_id"`
+	Expires       time.Time `json:"expires"`
+}
+
+// StorageDriverFactory creates a storage service from the driver's section
+// of the configuration.
+type StorageDriverFactory func(ctx context.Context, config *Config) (StorageService, error)
+
+const DefaultStorageDriver = "debug"
+
+var (
+	storageDriversMutex sync.Mutex
+	storageDrivers      = make(map[string]StorageDriverFactory)
+)
+
+func RegisterStorageDriver(name string, factory StorageDriverFactory) {
+	storageDriversMutex.Lock()
+	defer storageDriversMutex.Unlock()
+	if _, ok := storageDrivers[name]; ok {
+		panic(fmt.Errorf("storage driver %q already registered", name))
+	}
+
+	storageDrivers[name] = factory
+}
+
+func StorageDrivers() []string {
+	storageDriversMutex.Lock()
+	defer storageDriversMutex.Unlock()
+	names := make([]string, 0, len(storageDrivers))
+	for name := range storageDrivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage creates the storage service of the configured driver.
+func NewStorage(ctx context.Context, config *Config) (StorageService, error) {
+	name := config.StorageDriver
+	if name == "" {
+		name = DefaultStorageDriver
+	}
+
+	storageDriversMutex.Lock()
+	factory, ok := storageDrivers[name]
+	storageDriversMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid storage driver %q", name)
+	}
+
+	return factory(ctx, config)
+}
+
+func init() {
+	RegisterStorageDriver("debug", func(ctx context.Context, config *Config) (StorageService, error) {
+		return NewDebugStorage([]*Recipe{Recipes[1]}, nil)
+	})
+
+	RegisterStorageDriver("in-memory", func(ctx context.Context, config *Config) (StorageService, error) {
+		return NewDebugStorage(nil, nil)
+	})
 }
 
 type DebugStorage struct {
 	db *memdb.MemDB
+
+	eventsMutex sync.Mutex
+	events      map[string][][]byte
+
+	keysMutex sync.Mutex
+	keys      map[string]*TriggerKey
 }
 
 var _ StorageService = &DebugStorage{}
+var _ EventJournal = &DebugStorage{}
 
 func NewDebugStorage(recipes []*Recipe, transactions []*Transaction) (*DebugStorage, error) {
 	schema := &memdb.DBSchema{
@@ -28,9 +132,14 @@ func NewDebugStorage(recipes []*Recipe, transactions []*Transaction) (*DebugStor
 				Name: "recipe",
 				Indexes: map[string]*memdb.IndexSchema{
 					"id": &memdb.IndexSchema{
-						Name:    "id",
-						Unique:  true,
-						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Name"},
+								&memdb.IntFieldIndex{Field: "Version"},
+							},
+						},
 					},
 				},
 			},
@@ -53,13 +162,20 @@ func NewDebugStorage(recipes []*Recipe, transactions []*Transaction) (*DebugStor
 	}
 
 	storage := &DebugStorage{
-		db: db,
+		db:     db,
+		events: make(map[string][][]byte),
+		keys:   make(map[string]*TriggerKey),
 	}
 
 	txn := db.Txn(true)
 	for _, wf := range recipes {
 		log.Info("pre-inserting recipe", RecipeField(wf))
-		if err := txn.Insert("recipe", wf); err != nil {
+		stored := wf.copy()
+		if stored.Version == 0 {
+			stored.Version = 1
+		}
+
+		if err := txn.Insert("recipe", stored); err != nil {
 			return nil, err
 		}
 	}
@@ -87,9 +203,11 @@ func (storage *DebugStorage) SaveTransaction(ctx context.Context, trx *Transacti
 	return nil
 }
 
+// SaveRecipe keeps a copy of the recipe, so that the stored versions don't
+// change with the registered ones.
 func (storage *DebugStorage) SaveRecipe(ctx context.Context, recipe *Recipe) error {
 	transact := storage.db.Txn(true)
-	if err := transact.Insert("recipe", recipe); err != nil {
+	if err := transact.Insert("recipe", recipe.copy()); err != nil {
 		transact.Abort()
 		return err
 	}
@@ -99,19 +217,36 @@ func (storage *DebugStorage) SaveRecipe(ctx context.Context, recipe *Recipe) err
 }
 
 func (storage *DebugStorage) LoadAllRecipes(ctx context.Context) ([]*Recipe, error) {
+	return storage.filterRecipes(func(recipe *Recipe) bool {
+		return recipe.Status() != StatusInactive || recipe.ID == ""
+	})
+}
+
+func (storage *DebugStorage) LoadRecipeVersions(ctx context.Context, name string) ([]*Recipe, error) {
+	return storage.filterRecipes(func(recipe *Recipe) bool {
+		return recipe.Name == name
+	})
+}
+
+// filterRecipes returns copies of the matching recipes, ordered by name and
+// version.
+func (storage *DebugStorage) filterRecipes(match func(recipe *Recipe) bool) ([]*Recipe, error) {
 	result := make([]*Recipe, 0)
 	transact := storage.db.Txn(false)
+	defer transact.Abort()
 	it, err := transact.Get("recipe", "id")
 	if err != nil {
-		transact.Abort()
 		return nil, err
 	}
 
 	for obj := it.Next(); obj != nil; obj = it.Next() {
 		wf := obj.(*Recipe)
-		result = append(result, wf)
+		if match(wf) {
+			result = append(result, wf.copy())
+		}
 	}
 
+	sortRecipes(result)
 	return result, nil
 }
 
@@ -134,18 +269,111 @@ func (storage *DebugStorage) LoadActiveTransactions(ctx context.Context) ([]*Tra
 	return result, nil
 }
 
-func (storage *DebugStorage) RemoveRecipe(ctx context.Context, recipe *Recipe) error {
-	transact := storage.db.Txn(true)
-	iwf, err := transact.First("recipe", "id", recipe.Name)
-	if err == nil && iwf != nil {
-		err = transact.Delete("recipe", iwf)
+func (storage *DebugStorage) LoadTransaction(ctx context.Context, id string) (*Transaction, error) {
+	transact := storage.db.Txn(false)
+	obj, err := transact.First("transaction", "id", id)
+	if err != nil || obj == nil {
+		return nil, err
 	}
 
+	return obj.(*Transaction), nil
+}
+
+func (storage *DebugStorage) FindTransactions(ctx context.Context, query *TransactionQuery) (*TransactionPage, error) {
+	transact := storage.db.Txn(false)
+	it, err := transact.Get("transaction", "id")
 	if err != nil {
 		transact.Abort()
-		return err
+		return nil, err
 	}
 
-	transact.Commit()
+	matched := make([]*Transaction, 0)
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		trx := obj.(*Transaction)
+		trx.Lock()
+		ok := query.Match(trx)
+		trx.Unlock()
+		if ok {
+			matched = append(matched, trx)
+		}
+	}
+
+	return query.paginate(matched)
+}
+
+func (storage *DebugStorage) RemoveRecipe(ctx context.Context, recipe *Recipe) error {
+	return storage.SaveRecipe(ctx, recipe.retired())
+}
+
+// AppendEvents keeps events encoded so that later changes to the transaction
+// don't leak into its history.
+func (storage *DebugStorage) AppendEvents(ctx context.Context, events ...*TransactionEvent) error {
+	storage.eventsMutex.Lock()
+	defer storage.eventsMutex.Unlock()
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		storage.events[event.TransactionID] = append(storage.events[event.TransactionID], data)
+	}
+
+	return nil
+}
+
+func (storage *DebugStorage) LoadEvents(ctx context.Context, trxID string, afterSeq int64) ([]*TransactionEvent, error) {
+	storage.eventsMutex.Lock()
+	defer storage.eventsMutex.Unlock()
+	result := make([]*TransactionEvent, 0)
+	for _, data := range storage.events[trxID] {
+		event := &TransactionEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return nil, err
+		}
+
+		if event.Seq > afterSeq {
+			result = append(result, event)
+		}
+	}
+
+	return result, nil
+}
+
+func triggerKeyIndex(recipeName string, key string) string {
+	return recipeName + "\x00" + key
+}
+
+func (storage *DebugStorage) ClaimTriggerKey(ctx context.Context, claim *TriggerKey) (string, error) {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	index := triggerKeyIndex(claim.Recipe, claim.Key)
+	if existing, ok := storage.keys[index]; ok && time.Now().Before(existing.Expires) {
+		return existing.TransactionID, nil
+	}
+
+	copied := *claim
+	storage.keys[index] = &copied
+	return claim.TransactionID, nil
+}
+
+func (storage *DebugStorage) ReleaseTriggerKey(ctx context.Context, recipeName string, key string) error {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	delete(storage.keys, triggerKeyIndex(recipeName, key))
 	return nil
 }
+
+func (storage *DebugStorage) PurgeTriggerKeys(ctx context.Context, before time.Time) (int, error) {
+	storage.keysMutex.Lock()
+	defer storage.keysMutex.Unlock()
+	n := 0
+	for index, claim := range storage.keys {
+		if claim.Expires.Before(before) {
+			delete(storage.keys, index)
+			n++
+		}
+	}
+
+	return n, nil
+}
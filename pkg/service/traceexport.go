@@ -0,0 +1,250 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+	TraceExporterOTLP   = "otlp"
+)
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(serviceName string, spans []*Span) error
+	Shutdown() error
+}
+
+// JSONExporter writes every span as a line of JSON.
+type JSONExporter struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+var _ SpanExporter = &JSONExporter{}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// OpenJSONExporter appends spans to the file at path.
+func OpenJSONExporter(path string) (*JSONExporter, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONExporter{w: fp, closer: fp}, nil
+}
+
+type jsonSpan struct {
+	Service string `json:"service"`
+	*Span
+}
+
+func (e *JSONExporter) ExportSpans(serviceName string, spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		if err := encoder.Encode(&jsonSpan{serviceName, span}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *JSONExporter) Shutdown() error {
+	if e.closer == nil {
+		return nil
+	}
+
+	return e.closer.Close()
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP,
+// in its JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the collector's base URL; spans are posted to its
+	// /v1/traces path unless the URL has a path of its own.
+	Endpoint string
+	Headers  map[string]string
+	Client   *http.Client
+}
+
+var _ SpanExporter = &OTLPExporter{}
+
+func NewOTLPExporter(endpoint string, headers map[string]string) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q", endpoint)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	return &OTLPExporter{
+		Endpoint: u.String(),
+		Headers:  headers,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (e *OTLPExporter) ExportSpans(serviceName string, spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector responded with %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown() error {
+	return nil
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest. IDs are hex and
+// 64 bit integers are strings.
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpRequest(serviceName string, spans []*Span) map[string]interface{} {
+	encoded := make([]*otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, &otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              otlpKind(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: otlpStatusCode(span.Status), Message: span.StatusMessage},
+		})
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "sake"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	result := make([]otlpAttribute, 0, len(attrs))
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		result = append(result, otlpAttribute{Key: key, Value: value})
+	}
+
+	return result
+}
+
+func otlpKind(kind SpanKind) int {
+	switch kind {
+	case SpanProducer:
+		return 4
+	case SpanConsumer:
+		return 5
+	default:
+		return 1
+	}
+}
+
+func otlpStatusCode(status SpanStatus) int {
+	switch status {
+	case SpanOK:
+		return 1
+	case SpanError:
+		return 2
+	default:
+		return 0
+	}
+}
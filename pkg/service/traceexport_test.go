@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type otlpCollected struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []*otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan *otlpCollected, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		} else if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		collected := &otlpCollected{}
+		if err := json.NewDecoder(r.Body).Decode(collected); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requests <- collected
+	}))
+
+	defer collector.Close()
+	exporter, err := NewOTLPExporter(collector.URL, map[string]string{"Authorization": "Bearer secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	err = exporter.ExportSpans("sake", []*Span{
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331", Name: "saga checkout", Kind: SpanInternal, Start: start, End: start.Add(time.Second), Status: SpanOK},
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "00f067aa0ba902b7", ParentID: "b7ad6b7169203331", Name: "stage a", Kind: SpanProducer, Start: start, End: start.Add(time.Second), Status: SpanError, StatusMessage: "timed out", Attributes: map[string]interface{}{"sake.stage": "a", "sake.attempt": 2}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var collected *otlpCollected
+	select {
+	case collected = <-requests:
+	default:
+		t.Fatal("collector received no spans")
+	}
+
+	if len(collected.ResourceSpans) != 1 || len(collected.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected one resource and scope, got %+v", collected)
+	}
+
+	resource := collected.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || resource[0].Value["stringValue"] != "sake" {
+		t.Errorf("expected the service name resource attribute, got %+v", resource)
+	}
+
+	spans := collected.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	root, stage := spans[0], spans[1]
+	if root.Name != "saga checkout" || root.Kind != 1 || root.Status.Code != 1 || root.ParentSpanID != "" {
+		t.Errorf("unexpected root span %+v", root)
+	}
+
+	if root.StartTimeUnixNano != strconv.FormatInt(start.UnixNano(), 10) || root.EndTimeUnixNano != strconv.FormatInt(start.Add(time.Second).UnixNano(), 10) {
+		t.Errorf("unexpected root span times %s-%s", root.StartTimeUnixNano, root.EndTimeUnixNano)
+	}
+
+	if stage.ParentSpanID != root.SpanID || stage.Kind != 4 || stage.Status.Code != 2 || stage.Status.Message != "timed out" {
+		t.Errorf("unexpected stage span %+v", stage)
+	}
+
+	if len(stage.Attributes) != 2 || stage.Attributes[0].Key != "sake.attempt" || stage.Attributes[0].Value["intValue"] != "2" || stage.Attributes[1].Value["stringValue"] != "a" {
+		t.Errorf("unexpected stage attributes %+v", stage.Attributes)
+	}
+}
+
+func TestOTLPExporterCollectorError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+
+	defer collector.Close()
+	exporter, err := NewOTLPExporter(collector.URL+"/otlp/traces", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exporter.ExportSpans("sake", []*Span{{Name: "saga checkout"}}); err == nil {
+		t.Fatal("expected the collector's error to be returned")
+	}
+}
@@ -0,0 +1,432 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"go.uber.org/zap"
+)
+
+type SpanKind string
+
+const (
+	SpanInternal SpanKind = "internal"
+	SpanProducer          = "producer"
+	SpanConsumer          = "consumer"
+)
+
+type SpanStatus string
+
+const (
+	SpanUnset SpanStatus = "unset"
+	SpanOK               = "ok"
+	SpanError            = "error"
+)
+
+// Span is a finished span. Spans are only reported once they've ended, so
+// that their start time can come from the transaction after a restart.
+type Span struct {
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentID      string                 `json:"parent_id,omitempty"`
+	Name          string                 `json:"name"`
+	Kind          SpanKind               `json:"kind"`
+	Start         time.Time              `json:"start"`
+	End           time.Time              `json:"end"`
+	Status        SpanStatus             `json:"status"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// TraceSpans identifies the spans of a traced transaction. It's kept with the
+// transaction so that the spans ended after a restart keep their parents.
+type TraceSpans struct {
+	TraceID string `json:"trace_id"`
+	// SpanID is the transaction's root span and ParentID the span of the
+	// trigger's traceparent, if any.
+	SpanID   string `json:"span_id"`
+	ParentID string `json:"parent_id,omitempty"`
+	Flags    string `json:"flags"`
+	// StageSpanID is the span of the current stage, which started in the
+	// given state.
+	StageSpanID  string           `json:"stage_span_id,omitempty"`
+	StageState   TransactionState `json:"stage_state,omitempty"`
+	StageStarted time.Time        `json:"stage_started"`
+}
+
+func (spans *TraceSpans) copy() *TraceSpans {
+	if spans == nil {
+		return nil
+	}
+
+	c := *spans
+	return &c
+}
+
+// Traceparent is the W3C traceparent of a child of the span.
+func (spans *TraceSpans) Traceparent(spanID string) string {
+	return "00-" + spans.TraceID + "-" + spanID + "-" + spans.Flags
+}
+
+// Tracer batches finished spans for its exporter. A nil tracer drops them.
+type Tracer struct {
+	ServiceName string
+	Exporter    SpanExporter
+	// BatchSize spans are exported at once, and at least every Interval.
+	BatchSize int
+	Interval  time.Duration
+
+	queue chan *Span
+}
+
+var _ Component = &Tracer{}
+
+func NewTracer(serviceName string, exporter SpanExporter) *Tracer {
+	return &Tracer{
+		ServiceName: serviceName,
+		Exporter:    exporter,
+		BatchSize:   100,
+		Interval:    time.Second,
+		queue:       make(chan *Span, 2048),
+	}
+}
+
+func (t *Tracer) ComponentName() string {
+	return "tracer"
+}
+
+func (t *Tracer) Run(ctx ComponentRunContext) error {
+	batch := make([]*Span, 0, t.BatchSize)
+	flush := func() {
+		if len(batch) < 1 {
+			return
+		}
+
+		if err := t.Exporter.ExportSpans(t.ServiceName, batch); err != nil {
+			log.Error("span export failed", zap.Int("spans", len(batch)), zap.Error(err))
+		}
+
+		batch = make([]*Span, 0, t.BatchSize)
+	}
+
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.BatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-ctx.QuitCh:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+
+			flush()
+			return t.Exporter.Shutdown()
+		}
+	}
+}
+
+// Record queues a finished span for export. Spans are dropped when the queue
+// is full rather than holding up transactions.
+func (t *Tracer) Record(span *Span) {
+	if t == nil {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		log.Warn("span queue full, dropping span", zap.String("span", span.Name))
+	}
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// awaitSpan is a request that is waiting on its reply.
+type awaitSpan struct {
+	topic   string
+	started time.Time
+}
+
+// traceStart starts the root span of a new transaction, as a child of the
+// trigger's traceparent when it has one.
+func (c *Coordinator) traceStart(trx *Transaction) {
+	if c.Tracer == nil {
+		return
+	}
+
+	spans := &TraceSpans{
+		TraceID: newTraceID(),
+		SpanID:  newSpanID(),
+		Flags:   "01",
+	}
+
+	if trx.Traceparent != "" {
+		parts := strings.Split(trx.Traceparent, "-")
+		spans.TraceID = parts[1]
+		spans.ParentID = parts[2]
+		spans.Flags = parts[3]
+	}
+
+	trx.Trace = spans
+}
+
+// traceStage ends the span of the stage the transaction is leaving. It's
+// called before the transaction steps.
+func (c *Coordinator) traceStage(trx *Transaction) {
+	spans := trx.Trace
+	if c.Tracer == nil || spans == nil || spans.StageSpanID == "" {
+		return
+	}
+
+	span := &Span{
+		TraceID:  spans.TraceID,
+		SpanID:   spans.StageSpanID,
+		ParentID: spans.SpanID,
+		Name:     stageSpanName(spans.StageState, trx.StageKey),
+		Kind:     SpanInternal,
+		Start:    spans.StageStarted,
+		End:      time.Now(),
+		Status:   SpanOK,
+		Attributes: map[string]interface{}{
+			"sake.transaction.id": trx.ID,
+			"sake.stage":          trx.StageKey,
+			"sake.stage.attempts": trx.Attempt,
+		},
+	}
+
+	if trx.Outcome != "" {
+		span.Attributes["sake.stage.outcome"] = trx.Outcome
+	}
+
+	if trx.errorRoute != "" {
+		span.Status = SpanError
+		span.StatusMessage = "failed, routed to " + trx.errorRoute
+	} else if spans.StageState == IsExecuting && trx.State == IsReverting {
+		span.Status = SpanError
+		span.StatusMessage = "failed"
+	}
+
+	spans.StageSpanID = ""
+	c.Tracer.Record(span)
+}
+
+// traceStep starts the span of the stage the transaction stepped to, or ends
+// the root span when it completed.
+func (c *Coordinator) traceStep(trx *Transaction) {
+	spans := trx.Trace
+	if c.Tracer == nil || spans == nil {
+		return
+	}
+
+	if !trx.IsCompleted() {
+		spans.StageSpanID = newSpanID()
+		spans.StageState = trx.State
+		spans.StageStarted = trx.StageStarted
+		return
+	}
+
+	span := &Span{
+		TraceID:  spans.TraceID,
+		SpanID:   spans.SpanID,
+		ParentID: spans.ParentID,
+		Name:     "saga " + trx.RecipeName,
+		Kind:     SpanInternal,
+		Start:    trx.Started,
+		End:      time.Now(),
+		Status:   SpanOK,
+		Attributes: map[string]interface{}{
+			"sake.transaction.id": trx.ID,
+			"sake.recipe":         trx.RecipeName,
+			"sake.correlation_id": trx.CorrelationID,
+			"sake.state":          string(trx.State),
+		},
+	}
+
+	if trx.State != IsSuccess {
+		span.Status = SpanError
+		span.StatusMessage = string(trx.State)
+	}
+
+	c.Tracer.Record(span)
+}
+
+func stageSpanName(state TransactionState, stageKey string) string {
+	if state == IsReverting {
+		return "compensate " + stageKey
+	}
+
+	return "stage " + stageKey
+}
+
+// tracePublish reports the publish of a request and starts waiting on its
+// reply. spanID is the publish span, which the request's traceparent points
+// at.
+func (c *Coordinator) tracePublish(trx *Transaction, topic string, req *protocol.Request, spanID string, started time.Time, err error) {
+	spans := trx.Trace
+	if c.Tracer == nil || spans == nil {
+		return
+	}
+
+	span := &Span{
+		TraceID:  spans.TraceID,
+		SpanID:   spanID,
+		ParentID: spans.StageSpanID,
+		Name:     "publish " + topic,
+		Kind:     SpanProducer,
+		Start:    started,
+		End:      time.Now(),
+		Status:   SpanOK,
+		Attributes: map[string]interface{}{
+			"messaging.destination": topic,
+			"sake.transaction.id":   trx.ID,
+			"sake.request.id":       req.ID,
+			"sake.request.attempt":  int(req.Attempt),
+		},
+	}
+
+	if err != nil {
+		span.Status = SpanError
+		span.StatusMessage = err.Error()
+	}
+
+	c.Tracer.Record(span)
+	c.awaitMutex.Lock()
+	c.awaits[req.ID] = &awaitSpan{topic: topic, started: span.End}
+	c.awaitMutex.Unlock()
+}
+
+// traceReply ends the wait on a request's reply. failure is nil for
+// successful replies.
+func (c *Coordinator) traceReply(trx *Transaction, reqID string, failure *StageFailure) {
+	var status SpanStatus = SpanOK
+	message := ""
+	if failure != nil {
+		status, message = SpanError, "failure"
+		if failure.Code != "" {
+			message = failure.Code
+		}
+	}
+
+	c.endAwait(trx, reqID, status, message)
+}
+
+// traceTimeout ends the waits of the current stage's requests and reports the
+// timeout, from the stage's deadline until it was noticed.
+func (c *Coordinator) traceTimeout(trx *Transaction) {
+	spans := trx.Trace
+	if c.Tracer == nil || spans == nil {
+		return
+	}
+
+	for _, reqID := range trx.outstandingRequests() {
+		c.endAwait(trx, reqID, SpanError, "timed out")
+	}
+
+	now := time.Now()
+	start := now
+	if trx.Expires != nil {
+		start = *trx.Expires
+	}
+
+	c.Tracer.Record(&Span{
+		TraceID:       spans.TraceID,
+		SpanID:        newSpanID(),
+		ParentID:      spans.StageSpanID,
+		Name:          "timeout " + trx.StageKey,
+		Kind:          SpanInternal,
+		Start:         start,
+		End:           now,
+		Status:        SpanError,
+		StatusMessage: "timed out",
+		Attributes: map[string]interface{}{
+			"sake.transaction.id":  trx.ID,
+			"sake.stage":           trx.StageKey,
+			"sake.request.attempt": trx.Attempt,
+		},
+	})
+}
+
+func (c *Coordinator) endAwait(trx *Transaction, reqID string, status SpanStatus, message string) {
+	c.awaitMutex.Lock()
+	await := c.awaits[reqID]
+	delete(c.awaits, reqID)
+	c.awaitMutex.Unlock()
+	spans := trx.Trace
+	if c.Tracer == nil || spans == nil {
+		return
+	}
+
+	// the wait started before a restart; it's reported from the start of
+	// the stage's current attempt instead.
+	if await == nil {
+		await = &awaitSpan{topic: trx.StageTopic, started: trx.StageStarted}
+	}
+
+	c.Tracer.Record(&Span{
+		TraceID:       spans.TraceID,
+		SpanID:        newSpanID(),
+		ParentID:      spans.StageSpanID,
+		Name:          "await " + await.topic,
+		Kind:          SpanConsumer,
+		Start:         await.started,
+		End:           time.Now(),
+		Status:        status,
+		StatusMessage: message,
+		Attributes: map[string]interface{}{
+			"messaging.destination": await.topic,
+			"sake.transaction.id":   trx.ID,
+			"sake.request.id":       reqID,
+		},
+	})
+}
+
+// dropAwait forgets the wait on a request that was cancelled.
+func (c *Coordinator) dropAwait(reqID string) {
+	c.awaitMutex.Lock()
+	delete(c.awaits, reqID)
+	c.awaitMutex.Unlock()
+}
+
+// outstandingRequests lists the requests of the current stage that are
+// waiting on a reply.
+func (trx *Transaction) outstandingRequests() []string {
+	if trx.RequestID != "" {
+		return []string{trx.RequestID}
+	}
+
+	reqIDs := make([]string, 0, len(trx.Branches))
+	for _, branch := range trx.Branches {
+		if branch.State == BranchPending && branch.RequestID != "" {
+			reqIDs = append(reqIDs, branch.RequestID)
+		}
+	}
+
+	return reqIDs
+}
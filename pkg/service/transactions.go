@@ -1,7 +1,9 @@
 package service
 
 import (
+	"encoding/json"
 	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +17,135 @@ type Stage struct {
 	RollbackTimeout time.Duration `json:"rollback_timeout,omitempty"`
 	Timeout         time.Duration `json:"timeout,omitempty"`
 	Terminate       bool          `json:"terminate,omitempty"`
+	// Branches turns the stage into a parallel stage that dispatches every
+	// branch at once and joins once Quorum branches have succeeded.
+	Branches map[string]*Branch `json:"branches,omitempty"`
+	Quorum   int                `json:"quorum,omitempty"`
+	// Outcomes routes a successful reply by its outcome code and Conditions
+	// by its data. Next is used when neither matches.
+	Outcomes   map[string]string `json:"outcomes,omitempty"`
+	Conditions []*Condition      `json:"conditions,omitempty"`
+	// Errors routes a failure reply by its error code once the stage can't
+	// be retried. The failed stage isn't compensated.
+	Errors map[string]string `json:"errors,omitempty"`
+	Retry  *RetryPolicy      `json:"retry,omitempty"`
+	// Headers are added to the metadata of the stage's requests, including
+	// its compensation requests.
+	Headers map[string]string `json:"headers,omitempty"`
+	// RollbackRetry applies to the stage's compensation requests.
+	RollbackRetry *RetryPolicy `json:"rollback_retry,omitempty"`
+	// Endpoint posts the stage's requests to an HTTP endpoint instead of
+	// publishing them to the stage's topics.
+	Endpoint *Endpoint `json:"endpoint,omitempty"`
+}
+
+// TimeoutFor is the timeout of the stage's requests while a transaction is in
+// the given state. Compensations use the stage's timeout unless they have
+// their own.
+func (stage *Stage) TimeoutFor(state TransactionState) time.Duration {
+	if state == IsReverting && stage.RollbackTimeout > 0 {
+		return stage.RollbackTimeout
+	}
+
+	return stage.Timeout
+}
+
+// RetryPolicyFor is the retry policy of the stage's requests while a
+// transaction is in the given state.
+func (stage *Stage) RetryPolicyFor(state TransactionState) *RetryPolicy {
+	if state == IsReverting {
+		return stage.RollbackRetry
+	}
+
+	return stage.Retry
+}
+
+type Condition struct {
+	When string `json:"when"`
+	Next string `json:"next"`
+
+	expr *Expression
+}
+
+// Route picks the stage that follows a successful reply.
+func (stage *Stage) Route(outcome string, data []byte) string {
+	if outcome != "" {
+		if next, ok := stage.Outcomes[outcome]; ok {
+			return next
+		}
+	}
+
+	for _, cond := range stage.Conditions {
+		if cond.expr != nil && cond.expr.Match(data) {
+			return cond.Next
+		}
+	}
+
+	return stage.Next
+}
+
+// RouteError picks the stage that handles a failure reply with the given
+// error code, if any.
+func (stage *Stage) RouteError(code string) string {
+	if code == "" {
+		return ""
+	}
+
+	return stage.Errors[code]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+type Branch struct {
+	Topic    string `json:"topic,omitempty"`
+	Rollback string `json:"rollback,omitempty"`
+}
+
+// IsCompensated is whether the stage sends compensation requests, either to
+// its rollback topic or its endpoint's rollback URL.
+func (stage *Stage) IsCompensated() bool {
+	return stage.Rollback != "" || stage.EndpointURL(IsReverting) != ""
+}
+
+func (stage *Stage) IsParallel() bool {
+	return len(stage.Branches) > 0
+}
+
+// RequiredBranches is the number of branches that must succeed for a
+// parallel stage to succeed. All branches are required unless a smaller
+// quorum is set.
+func (stage *Stage) RequiredBranches() int {
+	if stage.Quorum <= 0 || stage.Quorum > len(stage.Branches) {
+		return len(stage.Branches)
+	}
+
+	return stage.Quorum
+}
+
+func (stage *Stage) branchKeys() []string {
+	keys := make([]string, 0, len(stage.Branches))
+	for key := range stage.Branches {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (branch *Branch) topic(key string) string {
+	if branch.Topic == "" {
+		return key
+	}
+
+	return branch.Topic
 }
 
 type RecipeStatus int32
@@ -31,8 +162,19 @@ type Recipe struct {
 	TriggeredBy           string            `json:"trigger"`
 	StartAt               string            `json:"start"`
 	Stages                map[string]*Stage `json:"stages"`
+	TriggerEnvelope       string            `json:"trigger_envelope,omitempty"`
+	TriggerSchema         json.RawMessage   `json:"trigger_schema,omitempty"`
+	DeadLetterTopic       string            `json:"dead_letter,omitempty"`
+	Dedup                 *DedupPolicy      `json:"dedup,omitempty"`
 	NumActiveTransactions int32             `json:"num_active_transactions"`
 	StatusCode            int32             `json:"status"`
+	// Version numbers the recipes registered under a name, starting at 1.
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// RollbackOf is the version a rollback copied the recipe from.
+	RollbackOf int `json:"rollback_of,omitempty"`
+
+	schema *Schema
 }
 
 func (recipe *Recipe) SetStatus(status RecipeStatus) {
@@ -55,21 +197,100 @@ const (
 	IsInitializing                  = "initializing"
 	IsSuccess                       = "success"
 	IsFailed                        = "failed"
+	// IsCompensationFailed parks a transaction whose compensation couldn't be
+	// completed until an operator intervenes.
+	IsCompensationFailed = "compensation_failed"
 )
 
+// PathNode is an executed stage. Nodes of parallel stages hold a child node
+// for every branch that succeeded, and for every branch that was still
+// outstanding when the stage joined, which is Unconfirmed.
+type PathNode struct {
+	Key         string      `json:"key"`
+	Outcome     string      `json:"outcome,omitempty"`
+	Branches    []*PathNode `json:"branches,omitempty"`
+	Unconfirmed bool        `json:"unconfirmed,omitempty"`
+}
+
+type BranchState string
+
+const (
+	BranchPending   BranchState = "pending"
+	BranchSucceeded             = "succeeded"
+	BranchFailed                = "failed"
+)
+
+// ActiveBranch tracks a branch request of the current parallel stage.
+type ActiveBranch struct {
+	Key       string      `json:"key"`
+	Topic     string      `json:"topic"`
+	State     BranchState `json:"state"`
+	RequestID string      `json:"request_id"`
+}
+
+// StageFailure is a failure reply received by a transaction, with the error
+// the participant reported, if any.
+type StageFailure struct {
+	Stage     string           `json:"stage"`
+	Branch    string           `json:"branch,omitempty"`
+	State     TransactionState `json:"state"`
+	Attempt   int              `json:"attempt,omitempty"`
+	RequestID string           `json:"request_id,omitempty"`
+	Time      time.Time        `json:"time"`
+	Code      string           `json:"code,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	Retryable bool             `json:"retryable"`
+	Details   json.RawMessage  `json:"details,omitempty"`
+}
+
 type Transaction struct {
-	sync.Mutex
-	ID           string
-	State        TransactionState
-	Data         []byte
-	Stage        *Stage
-	StageKey     string
-	StageTopic   string
-	StageStarted time.Time
-	Started      time.Time
-	Expires      *time.Time
-	Recipe       *Recipe
-	ExecutedPath []string
+	sync.Mutex   `json:"-"`
+	ID           string           `json:"id"`
+	State        TransactionState `json:"state"`
+	Data         []byte           `json:"data"`
+	Stage        *Stage           `json:"-"`
+	StageKey     string           `json:"stage_key"`
+	StageTopic   string           `json:"stage_topic"`
+	StageStarted time.Time        `json:"stage_started"`
+	Started      time.Time        `json:"started"`
+	Expires      *time.Time       `json:"expires,omitempty"`
+	Recipe       *Recipe          `json:"-"`
+	RecipeID     string           `json:"recipe_id"`
+	RecipeName   string           `json:"recipe_name"`
+	ExecutedPath []*PathNode      `json:"executed_path"`
+	Branches     []*ActiveBranch  `json:"branches,omitempty"`
+	Outcome      string           `json:"outcome,omitempty"`
+	RequestID    string           `json:"request_id,omitempty"`
+	Attempt      int              `json:"attempt"`
+	RetryAt      *time.Time       `json:"retry_at,omitempty"`
+	Reason       string           `json:"reason,omitempty"`
+	// RepliedRequestID is the last request of the transaction that was
+	// replied to, so that redelivered replies are recognized.
+	RepliedRequestID string `json:"replied_request_id,omitempty"`
+	// Failures holds every failure reply the transaction received, oldest
+	// first.
+	Failures []*StageFailure `json:"failures,omitempty"`
+	// IdempotencyKey is the key the transaction was started with, if any.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// CorrelationID, the trace context and Metadata are sent with every
+	// request of the transaction.
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Traceparent   string            `json:"traceparent,omitempty"`
+	Tracestate    string            `json:"tracestate,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	// Trace is set on transactions that are traced.
+	Trace *TraceSpans `json:"trace,omitempty"`
+	// Seq is the sequence number of the last event applied to the
+	// transaction.
+	Seq int64 `json:"seq"`
+	// RecipeVersion is the version of the recipe the transaction runs. It
+	// keeps running that version when the recipe is upgraded.
+	RecipeVersion int `json:"recipe_version,omitempty"`
+
+	snapshotSeq int64
+	// errorRoute is the stage a failure reply was routed to by its error
+	// code, taken by the next Step.
+	errorRoute string
 }
 
 func NewTransaction(recipe *Recipe, data []byte) *Transaction {
@@ -84,11 +305,26 @@ func NewTransaction(recipe *Recipe, data []byte) *Transaction {
 		Started:      time.Now(),
 		Expires:      nil,
 		Recipe:       recipe,
+		RecipeID:     recipe.ID,
+		RecipeName:   recipe.Name,
 	}
 
+	trx.RecipeVersion = recipe.Version
 	return trx
 }
 
+// Bind attaches a transaction loaded from storage to its recipe.
+func (trx *Transaction) Bind(recipe *Recipe) {
+	trx.Recipe = recipe
+	trx.RecipeID = recipe.ID
+	trx.RecipeName = recipe.Name
+	trx.RecipeVersion = recipe.Version
+	trx.Stage = nil
+	if trx.StageKey != "" {
+		trx.Stage = recipe.Stages[trx.StageKey]
+	}
+}
+
 func (trx *Transaction) Commit(success bool) error {
 	if trx.IsCompleted() {
 		return errors.New("transaction is completed")
@@ -101,29 +337,54 @@ func (trx *Transaction) Commit(success bool) error {
 	return nil
 }
 
+// SetOutcome records the outcome code of a reply to the current stage so
+// that Step can route on it.
+func (trx *Transaction) SetOutcome(outcome string) {
+	if trx.State != IsExecuting {
+		return
+	}
+
+	trx.Outcome = outcome
+	if outcome != "" && len(trx.ExecutedPath) > 0 {
+		trx.ExecutedPath[len(trx.ExecutedPath)-1].Outcome = outcome
+	}
+}
+
 func (trx *Transaction) Step() {
 	var stageKey string
+	var node *PathNode
 	done := false
 	if trx.State == IsInitializing {
 		stageKey = trx.Recipe.StartAt
 		trx.State = IsExecuting
-		trx.ExecutedPath = []string{stageKey}
+		trx.ExecutedPath = []*PathNode{{Key: stageKey}}
 	} else if trx.State == IsExecuting {
-		if trx.Stage.Terminate {
+		if trx.errorRoute != "" {
+			// the failed stage is replaced so it's never compensated
+			stageKey = trx.errorRoute
+			trx.errorRoute = ""
+			trx.ExecutedPath[len(trx.ExecutedPath)-1] = &PathNode{Key: stageKey}
+		} else if trx.Stage.Terminate {
 			done = true
 		} else {
-			stageKey = trx.Stage.Next
-			trx.ExecutedPath = append(trx.ExecutedPath, stageKey)
+			stageKey = trx.Stage.Route(trx.Outcome, trx.Data)
+			trx.ExecutedPath = append(trx.ExecutedPath, &PathNode{Key: stageKey})
 		}
 	} else if trx.State == IsReverting {
 		if len(trx.ExecutedPath) < 1 {
 			done = true
 		} else {
-			stageKey = trx.ExecutedPath[len(trx.ExecutedPath)-1]
+			node = trx.ExecutedPath[len(trx.ExecutedPath)-1]
+			stageKey = node.Key
 			trx.ExecutedPath = trx.ExecutedPath[:len(trx.ExecutedPath)-1]
 		}
 	}
 
+	trx.Branches = nil
+	trx.Outcome = ""
+	trx.RequestID = ""
+	trx.Attempt = 1
+	trx.RetryAt = nil
 	if !done {
 		stage := trx.Recipe.Stages[stageKey]
 		trx.StageKey = stageKey
@@ -131,15 +392,29 @@ func (trx *Transaction) Step() {
 		trx.StageTopic = stageKey
 		trx.StageStarted = time.Now()
 		if stage != nil {
-			if trx.State == IsReverting && stage.Rollback == "" {
+			if stage.IsParallel() {
+				trx.StageTopic = ""
+				if trx.State == IsReverting {
+					trx.Branches = rollbackBranches(stage, node)
+				} else {
+					trx.Branches = dispatchBranches(stage)
+				}
+
+				if len(trx.Branches) < 1 {
+					trx.Step()
+					return
+				}
+
+				trx.SetTimeout(stage.TimeoutFor(trx.State))
+			} else if trx.State == IsReverting && !stage.IsCompensated() {
 				trx.Step()
 				return
 			} else {
-				if trx.State == IsReverting {
+				if trx.State == IsReverting && stage.Rollback != "" {
 					trx.StageTopic = stage.Rollback
 				}
 
-				trx.SetTimeout(stage.Timeout)
+				trx.SetTimeout(stage.TimeoutFor(trx.State))
 			}
 		}
 	} else {
@@ -151,6 +426,195 @@ func (trx *Transaction) Step() {
 	}
 }
 
+func dispatchBranches(stage *Stage) []*ActiveBranch {
+	branches := make([]*ActiveBranch, 0, len(stage.Branches))
+	for _, key := range stage.branchKeys() {
+		branches = append(branches, &ActiveBranch{
+			Key:   key,
+			Topic: stage.Branches[key].topic(key),
+			State: BranchPending,
+		})
+	}
+
+	return branches
+}
+
+// rollbackBranches builds compensation requests for the branches of node that
+// succeeded or were still outstanding when the stage joined. Branches that
+// failed are not compensated.
+func rollbackBranches(stage *Stage, node *PathNode) []*ActiveBranch {
+	branches := make([]*ActiveBranch, 0)
+	if node == nil {
+		return branches
+	}
+
+	for _, child := range node.Branches {
+		branch, ok := stage.Branches[child.Key]
+		if !ok || branch.Rollback == "" {
+			continue
+		}
+
+		branches = append(branches, &ActiveBranch{
+			Key:   child.Key,
+			Topic: branch.Rollback,
+			State: BranchPending,
+		})
+	}
+
+	return branches
+}
+
+// IsActiveBranch reports whether branch belongs to the current stage and is
+// still waiting on a reply.
+func (trx *Transaction) IsActiveBranch(branch *ActiveBranch) bool {
+	if branch.State != BranchPending {
+		return false
+	}
+
+	for _, b := range trx.Branches {
+		if b == branch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResolveBranch records the outcome of a branch reply. It reports whether the
+// parallel stage has joined and, if so, whether it succeeded.
+func (trx *Transaction) ResolveBranch(branch *ActiveBranch, success bool) (joined bool, succeeded bool) {
+	trx.markBranch(branch, success)
+	pending, successes := 0, 0
+	for _, b := range trx.Branches {
+		switch b.State {
+		case BranchPending:
+			pending++
+		case BranchSucceeded:
+			successes++
+		}
+	}
+
+	if trx.State != IsExecuting {
+		failed := 0
+		for _, b := range trx.Branches {
+			if b.State == BranchFailed {
+				failed++
+			}
+		}
+
+		return pending < 1, failed < 1
+	}
+
+	// a failed stage waits for every branch so that late successes are still
+	// compensated; timeouts are handled by the expiration task.
+	if successes >= trx.Stage.RequiredBranches() {
+		trx.keepPendingBranches()
+		return true, true
+	} else if pending < 1 {
+		return true, false
+	}
+
+	return false, false
+}
+
+func (trx *Transaction) markBranch(branch *ActiveBranch, success bool) {
+	if success {
+		branch.State = BranchSucceeded
+		if trx.State == IsExecuting && len(trx.ExecutedPath) > 0 {
+			node := trx.ExecutedPath[len(trx.ExecutedPath)-1]
+			node.Branches = append(node.Branches, &PathNode{Key: branch.Key})
+		}
+	} else {
+		branch.State = BranchFailed
+	}
+}
+
+// keepPendingBranches adds the branches that are still outstanding when a
+// parallel stage joins on its quorum to the executed path. Their replies are
+// no longer received, so they're compensated like the branches that
+// succeeded, in case they succeed late.
+func (trx *Transaction) keepPendingBranches() {
+	if len(trx.ExecutedPath) < 1 {
+		return
+	}
+
+	node := trx.ExecutedPath[len(trx.ExecutedPath)-1]
+	for _, b := range trx.Branches {
+		if b.State == BranchPending {
+			node.Branches = append(node.Branches, &PathNode{Key: b.Key, Unconfirmed: true})
+		}
+	}
+}
+
+func (trx *Transaction) branch(key string) *ActiveBranch {
+	for _, b := range trx.Branches {
+		if b.Key == key {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// ScheduleRetry schedules another attempt of the current stage if its retry
+// policy allows it for the failure class. The stage's timeout is cleared
+// until the retry is dispatched.
+func (trx *Transaction) ScheduleRetry(class string) bool {
+	if !trx.IsInProgress() || trx.Stage == nil || trx.Stage.IsParallel() {
+		return false
+	}
+
+	policy := trx.Stage.RetryPolicyFor(trx.State)
+	if !policy.Retries(class, trx.Attempt) {
+		return false
+	}
+
+	retryAt := time.Now().Add(policy.Delay(trx.Attempt))
+	trx.Attempt++
+	trx.RetryAt = &retryAt
+	trx.Expires = nil
+	return true
+}
+
+// RouteFailure routes the current stage to the stage that handles the error
+// code of a failure reply, if it has one. The route is taken by the next
+// Step.
+func (trx *Transaction) RouteFailure(code string) bool {
+	if trx.State != IsExecuting || trx.Stage == nil || trx.Stage.IsParallel() {
+		return false
+	}
+
+	next := trx.Stage.RouteError(code)
+	if next == "" {
+		return false
+	}
+
+	trx.errorRoute = next
+	return true
+}
+
+func (trx *Transaction) IsRetryDue() bool {
+	return trx.RetryAt != nil && !trx.RetryAt.After(time.Now())
+}
+
+// BeginRetry clears the scheduled retry and restarts the stage's timeout.
+func (trx *Transaction) BeginRetry() {
+	trx.RetryAt = nil
+	trx.StageStarted = time.Now()
+	if trx.Stage != nil {
+		trx.SetTimeout(trx.Stage.TimeoutFor(trx.State))
+	}
+}
+
+// Park stops a transaction whose compensation failed. It's left in place,
+// with its current stage, for an operator to resolve.
+func (trx *Transaction) Park(reason string) {
+	trx.State = IsCompensationFailed
+	trx.Reason = reason
+	trx.Expires = nil
+	trx.RetryAt = nil
+}
+
 func (trx *Transaction) SetTimeout(d time.Duration) {
 	if d > 0 {
 		expires := time.Now().Add(d)
@@ -168,6 +632,11 @@ func (trx *Transaction) IsExpired() bool {
 	return false
 }
 
+// IsInProgress reports whether the transaction is waiting on stage requests.
+func (trx *Transaction) IsInProgress() bool {
+	return trx.State == IsExecuting || trx.State == IsReverting
+}
+
 func (trx *Transaction) IsCompleted() bool {
 	return trx.State == IsFailed || trx.State == IsSuccess
 }
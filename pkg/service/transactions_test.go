@@ -0,0 +1,112 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStageTimeoutFor(t *testing.T) {
+	cases := []struct {
+		name  string
+		stage *Stage
+		state TransactionState
+		want  time.Duration
+	}{
+		{"executing", &Stage{Timeout: time.Second, RollbackTimeout: time.Minute}, IsExecuting, time.Second},
+		{"reverting", &Stage{Timeout: time.Second, RollbackTimeout: time.Minute}, IsReverting, time.Minute},
+		{"reverting without rollback timeout", &Stage{Timeout: time.Second}, IsReverting, time.Second},
+		{"no timeouts", &Stage{}, IsReverting, 0},
+	}
+
+	for _, c := range cases {
+		if got := c.stage.TimeoutFor(c.state); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStepSetsCompensationTimeout(t *testing.T) {
+	recipe := &Recipe{
+		Name:    "checkout",
+		StartAt: "a",
+		Stages: map[string]*Stage{
+			"a": {Next: "b", Rollback: "a.undo", Timeout: 500 * time.Millisecond},
+			"b": {Terminate: true},
+		},
+	}
+
+	trx := NewTransaction(recipe, nil)
+	trx.Step()
+	if trx.StageKey != "a" || trx.Expires == nil {
+		t.Fatalf("expected stage a with a timeout, got stage %q expiring %v", trx.StageKey, trx.Expires)
+	}
+
+	if err := trx.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+
+	trx.Step()
+	if trx.State != IsReverting || trx.StageTopic != "a.undo" {
+		t.Fatalf("expected a.undo while reverting, got %q while %s", trx.StageTopic, trx.State)
+	}
+
+	if trx.Expires == nil {
+		t.Fatal("compensation has no timeout")
+	} else if d := time.Until(*trx.Expires); d <= 0 || d > 500*time.Millisecond {
+		t.Errorf("compensation expires in %v, want at most 500ms", d)
+	}
+}
+
+func TestQuorumCompensatesPendingBranches(t *testing.T) {
+	recipe := &Recipe{
+		Name:    "checkout",
+		StartAt: "hold",
+		Stages: map[string]*Stage{
+			"hold": {
+				Next:   "confirm",
+				Quorum: 1,
+				Branches: map[string]*Branch{
+					"inventory": {Rollback: "inventory.release"},
+					"payment":   {Rollback: "payment.void"},
+					"shipping":  {Rollback: "shipping.cancel"},
+				},
+			},
+			"confirm": {Terminate: true},
+		},
+	}
+
+	trx := NewTransaction(recipe, nil)
+	trx.Step()
+	if joined, _ := trx.ResolveBranch(trx.branch("inventory"), false); joined {
+		t.Fatal("expected the stage to wait for the quorum")
+	}
+
+	// shipping is still outstanding when the quorum is met
+	if joined, succeeded := trx.ResolveBranch(trx.branch("payment"), true); !joined || !succeeded {
+		t.Fatalf("expected the stage to join on its quorum, got joined %v succeeded %v", joined, succeeded)
+	}
+
+	if err := trx.Commit(true); err != nil {
+		t.Fatal(err)
+	}
+
+	trx.Step()
+	if err := trx.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+
+	trx.Step()
+	if trx.State != IsReverting || trx.StageKey != "hold" {
+		t.Fatalf("expected hold to be compensated, got stage %q while %s", trx.StageKey, trx.State)
+	}
+
+	topics := make([]string, 0)
+	for _, branch := range trx.Branches {
+		topics = append(topics, branch.Topic)
+	}
+
+	if !reflect.DeepEqual(topics, []string{"payment.void", "shipping.cancel"}) {
+		t.Fatalf("expected the succeeded and the outstanding branch to be compensated, got %v", topics)
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	EnvelopeRaw  = "raw"
+	EnvelopeJSON = "json"
+)
+
+// TriggerEnvelope is the wrapper expected around trigger payloads when a
+// recipe uses the json envelope format.
+type TriggerEnvelope struct {
+	Data json.RawMessage `json:"data"`
+	MessageContext
+}
+
+// DedupPolicy makes a recipe start a single transaction for triggers that
+// share a deduplication key within a window, so that redelivered triggers
+// don't start the saga twice.
+type DedupPolicy struct {
+	// Field names the field of the json trigger envelope that holds the key.
+	// The key is a hash of the whole trigger message when it's empty.
+	Field string `json:"field,omitempty"`
+	// Window overrides the configured deduplication window.
+	Window time.Duration `json:"window,omitempty"`
+}
+
+// TriggerError is returned when a trigger message can't be turned into
+// transaction data. These triggers are rejected rather than retried.
+type TriggerError struct {
+	Reason string
+}
+
+func (err *TriggerError) Error() string {
+	return fmt.Sprintf("malformed trigger: %s", err.Reason)
+}
+
+// prepareTrigger compiles the trigger schema of a valid recipe.
+func (recipe *Recipe) prepareTrigger() error {
+	recipe.schema = nil
+	if len(recipe.TriggerSchema) > 0 {
+		schema, err := CompileSchema(recipe.TriggerSchema)
+		if err != nil {
+			return fmt.Errorf("recipe %q trigger schema: %v", recipe.Name, err)
+		}
+
+		recipe.schema = schema
+	}
+
+	return nil
+}
+
+// DecodeTrigger unwraps a raw trigger message according to the recipe's
+// envelope format and validates the result against the trigger schema. The
+// message context is only read from json envelopes.
+func (recipe *Recipe) DecodeTrigger(raw []byte) ([]byte, *MessageContext, error) {
+	data := raw
+	mc := &MessageContext{}
+	if recipe.TriggerEnvelope == EnvelopeJSON {
+		envelope := &TriggerEnvelope{}
+		if err := json.Unmarshal(raw, envelope); err != nil {
+			return nil, nil, &TriggerError{fmt.Sprintf("envelope decode failed: %v", err)}
+		}
+
+		data = []byte(envelope.Data)
+		mc = &envelope.MessageContext
+	}
+
+	if recipe.schema != nil {
+		if len(data) < 1 {
+			return nil, nil, &TriggerError{"payload is empty"}
+		}
+
+		if err := recipe.schema.ValidateJSON(data); err != nil {
+			return nil, nil, &TriggerError{err.Error()}
+		}
+	}
+
+	if len(data) < 1 {
+		return nil, mc, nil
+	}
+
+	return data, mc, nil
+}
+
+// DedupKey returns the deduplication key of a raw trigger message, or an
+// empty key when the recipe doesn't deduplicate its triggers.
+func (recipe *Recipe) DedupKey(raw []byte) (string, error) {
+	if recipe.Dedup == nil {
+		return "", nil
+	} else if recipe.Dedup.Field == "" {
+		sum := sha256.Sum256(raw)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", &TriggerError{fmt.Sprintf("envelope decode failed: %v", err)}
+	}
+
+	value, ok := fields[recipe.Dedup.Field]
+	if !ok {
+		return "", &TriggerError{fmt.Sprintf("dedup field %q is missing", recipe.Dedup.Field)}
+	}
+
+	key := string(value)
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		key = text
+	} else if key == "null" {
+		key = ""
+	}
+
+	if key == "" {
+		return "", &TriggerError{fmt.Sprintf("dedup field %q is empty", recipe.Dedup.Field)}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	hashed := &Recipe{Dedup: &DedupPolicy{}}
+	a, err := hashed.DedupKey([]byte(`{"id":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(a) != 64 {
+		t.Fatalf("expected a sha256 key, got %q", a)
+	}
+
+	if again, _ := hashed.DedupKey([]byte(`{"id":"a"}`)); again != a {
+		t.Error("expected the same message to have the same key")
+	}
+
+	if b, _ := hashed.DedupKey([]byte(`{"id":"b"}`)); b == a {
+		t.Error("expected different messages to have different keys")
+	}
+
+	if key, err := (&Recipe{}).DedupKey([]byte(`{"id":"a"}`)); err != nil || key != "" {
+		t.Errorf("expected no key without a dedup policy, got %q, %v", key, err)
+	}
+
+	field := &Recipe{Dedup: &DedupPolicy{Field: "id"}, TriggerEnvelope: EnvelopeJSON}
+	cases := []struct {
+		raw     string
+		want    string
+		invalid bool
+	}{
+		{`{"id":"order-1","data":{}}`, "order-1", false},
+		{`{"id":42,"data":{}}`, "42", false},
+		{`{"id":{"n":1}}`, `{"n":1}`, false},
+		{`{"data":{}}`, "", true},
+		{`{"id":null}`, "", true},
+		{`{"id":""}`, "", true},
+		{`not json`, "", true},
+	}
+
+	for _, c := range cases {
+		key, err := field.DedupKey([]byte(c.raw))
+		if c.invalid {
+			if _, ok := err.(*TriggerError); !ok {
+				t.Errorf("%s: expected a trigger error, got %q, %v", c.raw, key, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", c.raw, err)
+		} else if key != c.want {
+			t.Errorf("%s: got key %q, want %q", c.raw, key, c.want)
+		}
+	}
+}
+
+func TestClaimTriggerKey(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewDebugStorage(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(recipe string, trxID string, expires time.Time) string {
+		holder, err := storage.ClaimTriggerKey(ctx, &TriggerKey{Recipe: recipe, Key: "k", TransactionID: trxID, Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return holder
+	}
+
+	later := time.Now().Add(time.Hour)
+	if holder := claim("checkout", "t1", later); holder != "t1" {
+		t.Fatalf("expected t1 to hold the key, got %q", holder)
+	}
+
+	if holder := claim("checkout", "t2", later); holder != "t1" {
+		t.Fatalf("expected t1 to keep the key, got %q", holder)
+	}
+
+	if holder := claim("refund", "t3", later); holder != "t3" {
+		t.Fatalf("expected keys to be claimed per recipe, got %q", holder)
+	}
+
+	if err := storage.ReleaseTriggerKey(ctx, "checkout", "k"); err != nil {
+		t.Fatal(err)
+	}
+
+	if holder := claim("checkout", "t4", time.Now().Add(-time.Second)); holder != "t4" {
+		t.Fatalf("expected the released key to be claimed again, got %q", holder)
+	}
+
+	if holder := claim("checkout", "t5", later); holder != "t5" {
+		t.Fatalf("expected the expired claim to be replaced, got %q", holder)
+	}
+
+	if n, err := storage.PurgeTriggerKeys(ctx, later.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("expected 2 purged keys, got %d", n)
+	}
+}
+
+func TestStartDeduplicates(t *testing.T) {
+	c := newTestCoordinator(t)
+	recipe := &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "checkout.start",
+		StartAt:     "a",
+		Dedup:       &DedupPolicy{},
+		Stages: map[string]*Stage{
+			"a": {Rollback: "a.undo", Terminate: true},
+		},
+	}
+
+	if err := c.Register(recipe); err != nil {
+		t.Fatal(err)
+	}
+
+	first, started, err := c.Start("checkout", []byte(`{"id":1}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !started {
+		t.Fatal("expected the first trigger to start a transaction")
+	}
+
+	second, started, err := c.Start("checkout", []byte(`{"id":1}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if started || second.ID != first.ID {
+		t.Fatalf("expected the duplicate to match %s, got %s", first.ID, second.ID)
+	}
+
+	other, started, err := c.Start("checkout", []byte(`{"id":2}`), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !started || other.ID == first.ID {
+		t.Fatal("expected another trigger to start another transaction")
+	}
+}
@@ -1,11 +1,41 @@
 package service
 
-import "go.uber.org/zap"
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
 
 func RecipeField(recipe *Recipe) zap.Field {
 	return zap.String("recipe", recipe.Name)
 }
 
 func TransactionFields(trx *Transaction, others ...zap.Field) []zap.Field {
-	return append([]zap.Field{zap.Namespace("transaction"), zap.String("id", trx.ID), zap.String("state", string(trx.State))}, others...)
+	fields := []zap.Field{zap.Namespace("transaction"), zap.String("id", trx.ID), zap.String("state", string(trx.State))}
+	if trx.CorrelationID != "" && trx.CorrelationID != trx.ID {
+		fields = append(fields, zap.String("correlation_id", trx.CorrelationID))
+	}
+
+	return append(fields, others...)
+}
+
+// mergeData shallow-merges two JSON objects so that parallel branches can each
+// contribute to the transaction data. Anything else is replaced by newData.
+func mergeData(data []byte, newData []byte) []byte {
+	current := make(map[string]json.RawMessage)
+	update := make(map[string]json.RawMessage)
+	if json.Unmarshal(data, &current) != nil || json.Unmarshal(newData, &update) != nil {
+		return newData
+	}
+
+	for k, v := range update {
+		current[k] = v
+	}
+
+	merged, err := json.Marshal(current)
+	if err != nil {
+		return newData
+	}
+
+	return merged
 }
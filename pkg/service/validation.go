@@ -0,0 +1,390 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RecipeIssue is a problem found in a recipe. Path addresses the field with
+// the JSON names of the fields, stages and branches, separated by dots.
+type RecipeIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// RecipeReport lists the problems found in a recipe. A recipe with errors is
+// rejected; warnings point out definitions that are valid but likely to
+// misbehave at runtime.
+type RecipeReport struct {
+	Recipe   string         `json:"recipe"`
+	Errors   []*RecipeIssue `json:"errors"`
+	Warnings []*RecipeIssue `json:"warnings"`
+}
+
+func newRecipeReport(name string) *RecipeReport {
+	return &RecipeReport{
+		Recipe:   name,
+		Errors:   make([]*RecipeIssue, 0),
+		Warnings: make([]*RecipeIssue, 0),
+	}
+}
+
+func (report *RecipeReport) Valid() bool {
+	return len(report.Errors) < 1
+}
+
+func (report *RecipeReport) Error() string {
+	issues := make([]string, 0, len(report.Errors))
+	for _, issue := range report.Errors {
+		issues = append(issues, issue.Path+": "+issue.Message)
+	}
+
+	return fmt.Sprintf("recipe %q is invalid: %s", report.Recipe, strings.Join(issues, "; "))
+}
+
+func (report *RecipeReport) errorf(path string, format string, args ...interface{}) {
+	report.Errors = append(report.Errors, &RecipeIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (report *RecipeReport) warnf(path string, format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, &RecipeIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate fails with the RecipeReport of recipes that have errors. Warnings
+// don't fail validation.
+func (recipe *Recipe) Validate() error {
+	report := recipe.Analyze()
+	if !report.Valid() {
+		return report
+	}
+
+	return nil
+}
+
+// Analyze checks the recipe's fields and the graph its stages form, without
+// preparing the recipe.
+func (recipe *Recipe) Analyze() *RecipeReport {
+	report := newRecipeReport(recipe.Name)
+	if recipe.Name == "" {
+		report.errorf("name", "name is required")
+	}
+
+	recipe.checkTrigger(report)
+	for _, key := range recipe.stageKeys() {
+		recipe.checkStage(key, report)
+	}
+
+	recipe.checkGraph(report)
+	return report
+}
+
+// AnalyzeRecipe analyzes a recipe along with the registered recipes, which
+// reports triggers that another recipe is already triggered by.
+func (c *Coordinator) AnalyzeRecipe(recipe *Recipe) (*RecipeReport, error) {
+	report := recipe.Analyze()
+	return report, c.checkTriggerConflicts(recipe, report)
+}
+
+// checkTriggerConflicts reports the active recipes of other names that share
+// the recipe's trigger, which would split its triggers between them.
+func (c *Coordinator) checkTriggerConflicts(recipe *Recipe, report *RecipeReport) error {
+	if recipe.TriggeredBy == "" {
+		return nil
+	}
+
+	conflicts, err := c.Cache.FilterRecipes(c.Context, func(other *Recipe) (bool, error) {
+		return other.Name != recipe.Name && other.TriggeredBy == recipe.TriggeredBy && other.Status() == StatusActive, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sortRecipes(conflicts)
+	for _, other := range conflicts {
+		report.errorf("trigger", "trigger topic %q is already the trigger of recipe %q", recipe.TriggeredBy, other.Name)
+	}
+
+	return nil
+}
+
+// prepare compiles the recipe's trigger schema and stage conditions. It
+// doesn't validate the recipe.
+func (recipe *Recipe) prepare() error {
+	if err := recipe.prepareTrigger(); err != nil {
+		return err
+	}
+
+	for _, key := range recipe.stageKeys() {
+		for i, cond := range recipe.Stages[key].Conditions {
+			expr, err := CompileExpression(cond.When)
+			if err != nil {
+				return fmt.Errorf("recipe %q stage %q condition %d: %v", recipe.Name, key, i, err)
+			}
+
+			cond.expr = expr
+		}
+	}
+
+	return nil
+}
+
+func (recipe *Recipe) stageKeys() []string {
+	keys := make([]string, 0, len(recipe.Stages))
+	for key := range recipe.Stages {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (recipe *Recipe) checkTrigger(report *RecipeReport) {
+	if recipe.TriggeredBy == "" {
+		report.errorf("trigger", "trigger topic is required")
+	} else if _, ok := recipe.Stages[recipe.TriggeredBy]; ok {
+		report.warnf("trigger", "trigger topic %q is also the request topic of stage %q", recipe.TriggeredBy, recipe.TriggeredBy)
+	}
+
+	if recipe.DeadLetterTopic != "" && recipe.DeadLetterTopic == recipe.TriggeredBy {
+		report.errorf("dead_letter", "dead letter topic can't be the trigger topic")
+	}
+
+	switch recipe.TriggerEnvelope {
+	case "", EnvelopeRaw, EnvelopeJSON:
+	default:
+		report.errorf("trigger_envelope", "unsupported trigger envelope %q", recipe.TriggerEnvelope)
+	}
+
+	if recipe.Dedup != nil {
+		if recipe.Dedup.Field != "" && recipe.TriggerEnvelope != EnvelopeJSON {
+			report.errorf("dedup.field", "dedup field requires the %s trigger envelope", EnvelopeJSON)
+		}
+
+		if recipe.Dedup.Window < 0 {
+			report.errorf("dedup.window", "dedup window can't be negative")
+		}
+	}
+
+	if len(recipe.TriggerSchema) > 0 {
+		if _, err := CompileSchema(recipe.TriggerSchema); err != nil {
+			report.errorf("trigger_schema", "%v", err)
+		}
+	}
+}
+
+func (recipe *Recipe) checkStage(key string, report *RecipeReport) {
+	path := "stages." + key
+	stage := recipe.Stages[key]
+	if key == "" {
+		report.errorf(path, "stage keys are request topics and can't be empty")
+	}
+
+	if stage == nil {
+		report.errorf(path, "stage is empty")
+		return
+	}
+
+	if stage.Timeout < 0 {
+		report.errorf(path+".timeout", "timeout can't be negative")
+	} else if stage.Timeout == 0 {
+		report.warnf(path+".timeout", "stage has no timeout and waits for its reply indefinitely")
+	}
+
+	if stage.RollbackTimeout < 0 {
+		report.errorf(path+".rollback_timeout", "rollback timeout can't be negative")
+	}
+
+	for _, name := range stage.branchKeys() {
+		branchPath := path + ".branches." + name
+		branch := stage.Branches[name]
+		if branch == nil {
+			report.errorf(branchPath, "branch is empty")
+		} else if branch.topic(name) == "" {
+			report.errorf(branchPath+".topic", "branch needs a topic")
+		} else if branch.Rollback == "" && !stage.Terminate {
+			report.warnf(branchPath+".rollback", "branch has no rollback topic and isn't compensated")
+		}
+	}
+
+	if stage.Quorum < 0 || stage.Quorum > len(stage.Branches) {
+		report.errorf(path+".quorum", "quorum must be between 0 and %d", len(stage.Branches))
+	}
+
+	if !stage.IsParallel() && !stage.IsCompensated() && !stage.Terminate {
+		report.warnf(path+".rollback", "stage has no rollback topic and isn't compensated")
+	}
+
+	if stage.Endpoint != nil {
+		if stage.IsParallel() {
+			report.errorf(path+".endpoint", "endpoints aren't supported on parallel stages")
+		} else {
+			stage.Endpoint.check(path+".endpoint", report)
+		}
+	}
+
+	for _, field := range []string{"retry", "rollback_retry"} {
+		policy := stage.Retry
+		if field == "rollback_retry" {
+			policy = stage.RollbackRetry
+		}
+
+		if policy == nil {
+			continue
+		}
+
+		if stage.IsParallel() {
+			report.errorf(path+"."+field, "%s isn't supported on parallel stages", field)
+		} else if err := policy.validate(); err != nil {
+			report.errorf(path+"."+field, "%v", err)
+		}
+	}
+
+	if _, ok := stage.Headers[""]; ok {
+		report.errorf(path+".headers", "headers need a name")
+	}
+
+	if len(stage.Errors) > 0 && stage.IsParallel() {
+		report.errorf(path+".errors", "errors aren't supported on parallel stages")
+	}
+
+	if _, ok := stage.Errors[""]; ok {
+		report.errorf(path+".errors", "error routes need a code")
+	}
+
+	if _, ok := stage.Outcomes[""]; ok {
+		report.errorf(path+".outcomes", "outcome routes need an outcome code")
+	}
+
+	for i, cond := range stage.Conditions {
+		if _, err := CompileExpression(cond.When); err != nil {
+			report.errorf(fmt.Sprintf("%s.conditions.%d.when", path, i), "%v", err)
+		}
+	}
+
+	if stage.Terminate {
+		if stage.Next != "" || len(stage.Outcomes) > 0 || len(stage.Conditions) > 0 {
+			report.warnf(path+".terminate", "stage terminates, so its next, outcomes and conditions are never used")
+		}
+	} else if stage.Next == "" {
+		report.errorf(path+".next", "stage needs a next stage or must terminate")
+	}
+
+	for _, route := range stage.routes(path) {
+		if route.key == "" {
+			if route.path != path+".next" {
+				report.errorf(route.path, "route needs a stage")
+			}
+
+			continue
+		}
+
+		if _, ok := recipe.Stages[route.key]; !ok {
+			report.errorf(route.path, "routes to unknown stage %q", route.key)
+		}
+	}
+}
+
+// stageRoute is a route from a stage to the stage key at path.
+type stageRoute struct {
+	path string
+	key  string
+}
+
+// routes lists the routes that may be taken from the stage, in the order
+// they're considered.
+func (stage *Stage) routes(path string) []stageRoute {
+	routes := make([]stageRoute, 0)
+	for _, code := range sortedKeys(stage.Errors) {
+		routes = append(routes, stageRoute{path + ".errors." + code, stage.Errors[code]})
+	}
+
+	if stage.Terminate {
+		return routes
+	}
+
+	for _, outcome := range sortedKeys(stage.Outcomes) {
+		routes = append(routes, stageRoute{path + ".outcomes." + outcome, stage.Outcomes[outcome]})
+	}
+
+	for i, cond := range stage.Conditions {
+		routes = append(routes, stageRoute{fmt.Sprintf("%s.conditions.%d.next", path, i), cond.Next})
+	}
+
+	return append(routes, stageRoute{path + ".next", stage.Next})
+}
+
+// checkGraph reports a missing start stage, stages that can never be reached
+// from it, cycles between stages and graphs without a terminal stage.
+func (recipe *Recipe) checkGraph(report *RecipeReport) {
+	if len(recipe.Stages) < 1 {
+		report.errorf("stages", "recipe has no stages")
+		return
+	}
+
+	if recipe.StartAt == "" {
+		report.errorf("start", "start stage is required")
+		return
+	} else if _, ok := recipe.Stages[recipe.StartAt]; !ok {
+		report.errorf("start", "start stage %q does not exist", recipe.StartAt)
+		return
+	}
+
+	terminates := false
+	for _, stage := range recipe.Stages {
+		if stage != nil && stage.Terminate {
+			terminates = true
+		}
+	}
+
+	if !terminates {
+		report.errorf("stages", "no stage terminates")
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[string]int)
+	path := make([]string, 0)
+	var visit func(key string)
+	visit = func(key string) {
+		marks[key] = visiting
+		path = append(path, key)
+		stage := recipe.Stages[key]
+		if stage != nil {
+			for _, route := range stage.routes("stages." + key) {
+				if _, ok := recipe.Stages[route.key]; !ok {
+					continue
+				}
+
+				switch marks[route.key] {
+				case visiting:
+					start := 0
+					for i, k := range path {
+						if k == route.key {
+							start = i
+						}
+					}
+
+					report.errorf(route.path, "cycle: %s", strings.Join(append(path[start:], route.key), " -> "))
+				case unvisited:
+					visit(route.key)
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		marks[key] = visited
+	}
+
+	visit(recipe.StartAt)
+	for _, key := range recipe.stageKeys() {
+		if marks[key] == unvisited {
+			report.errorf("stages."+key, "stage is unreachable from the start stage")
+		}
+	}
+}
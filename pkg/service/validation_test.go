@@ -0,0 +1,269 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func issuePaths(issues []*RecipeIssue) []string {
+	paths := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		paths = append(paths, issue.Path)
+	}
+
+	return paths
+}
+
+func TestAnalyzeValidRecipe(t *testing.T) {
+	recipe := &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "checkout.start",
+		StartAt:     "reserve",
+		Stages: map[string]*Stage{
+			"reserve": {Rollback: "reserve.undo", Next: "pay", Timeout: time.Second, Outcomes: map[string]string{"backorder": "notify"}},
+			"pay":     {Rollback: "pay.undo", Next: "notify", Timeout: time.Second},
+			"notify":  {Terminate: true},
+		},
+	}
+
+	report := recipe.Analyze()
+	if !report.Valid() {
+		t.Fatalf("expected the recipe to be valid, got %v", report)
+	}
+
+	if got := issuePaths(report.Warnings); !reflect.DeepEqual(got, []string{"stages.notify.timeout"}) {
+		t.Errorf("unexpected warnings %v", got)
+	}
+
+	if err := recipe.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyzeGraph(t *testing.T) {
+	cases := []struct {
+		name   string
+		start  string
+		stages map[string]*Stage
+		want   map[string]string
+	}{
+		{
+			name:   "no stages",
+			start:  "a",
+			stages: map[string]*Stage{},
+			want:   map[string]string{"stages": "recipe has no stages"},
+		},
+		{
+			name:   "missing start",
+			stages: map[string]*Stage{"a": {Terminate: true}},
+			want:   map[string]string{"start": "start stage is required"},
+		},
+		{
+			name:   "unknown start",
+			start:  "b",
+			stages: map[string]*Stage{"a": {Terminate: true}},
+			want:   map[string]string{"start": `start stage "b" does not exist`},
+		},
+		{
+			name:  "cycle",
+			start: "a",
+			stages: map[string]*Stage{
+				"a": {Next: "b", Rollback: "a.undo", Errors: map[string]string{"gone": "c"}},
+				"b": {Next: "a", Rollback: "b.undo"},
+				"c": {Terminate: true},
+			},
+			want: map[string]string{"stages.b.next": "cycle: a -> b -> a"},
+		},
+		{
+			name:  "condition cycle",
+			start: "a",
+			stages: map[string]*Stage{
+				"a": {Next: "b", Rollback: "a.undo"},
+				"b": {Next: "c", Rollback: "b.undo", Conditions: []*Condition{{When: "retry", Next: "b"}}},
+				"c": {Terminate: true},
+			},
+			want: map[string]string{"stages.b.conditions.0.next": "cycle: b -> b"},
+		},
+		{
+			name:  "unreachable",
+			start: "a",
+			stages: map[string]*Stage{
+				"a": {Terminate: true},
+				"b": {Next: "a", Rollback: "b.undo"},
+			},
+			want: map[string]string{"stages.b": "stage is unreachable from the start stage"},
+		},
+		{
+			name:  "no terminal stage",
+			start: "a",
+			stages: map[string]*Stage{
+				"a": {Next: "a", Rollback: "a.undo"},
+			},
+			want: map[string]string{"stages": "no stage terminates", "stages.a.next": "cycle: a -> a"},
+		},
+		{
+			name:  "unknown route",
+			start: "a",
+			stages: map[string]*Stage{
+				"a": {Next: "c", Rollback: "a.undo", Outcomes: map[string]string{"partial": "d"}},
+				"c": {Terminate: true},
+			},
+			want: map[string]string{"stages.a.outcomes.partial": `routes to unknown stage "d"`},
+		},
+	}
+
+	for _, c := range cases {
+		recipe := &Recipe{Name: "checkout", TriggeredBy: "checkout.start", StartAt: c.start, Stages: c.stages}
+		report := recipe.Analyze()
+		got := make(map[string]string)
+		for _, issue := range report.Errors {
+			got[issue.Path] = issue.Message
+		}
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got errors %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAnalyzeIssuePaths(t *testing.T) {
+	recipe := &Recipe{
+		TriggeredBy:     "checkout.start",
+		TriggerEnvelope: EnvelopeRaw,
+		DeadLetterTopic: "checkout.start",
+		Dedup:           &DedupPolicy{Field: "id"},
+		StartAt:         "reserve",
+		Stages: map[string]*Stage{
+			"reserve": {
+				Next:   "pay",
+				Quorum: 3,
+				Branches: map[string]*Branch{
+					"stock":  {Rollback: "stock.undo"},
+					"credit": {},
+				},
+			},
+			"pay": {
+				Rollback:   "pay.undo",
+				Timeout:    -time.Second,
+				Retry:      &RetryPolicy{},
+				Conditions: []*Condition{{When: "total >", Next: "done"}},
+				Next:       "done",
+			},
+			"done": {Terminate: true, Next: "pay"},
+		},
+	}
+
+	report := recipe.Analyze()
+	wantErrors := []string{
+		"name",
+		"dead_letter",
+		"dedup.field",
+		"stages.pay.timeout",
+		"stages.pay.retry",
+		"stages.pay.conditions.0.when",
+		"stages.reserve.quorum",
+	}
+
+	if got := issuePaths(report.Errors); !reflect.DeepEqual(got, wantErrors) {
+		t.Errorf("got errors at %v, want %v", got, wantErrors)
+	}
+
+	wantWarnings := []string{
+		"stages.done.timeout",
+		"stages.done.terminate",
+		"stages.reserve.timeout",
+		"stages.reserve.branches.credit.rollback",
+	}
+
+	if got := issuePaths(report.Warnings); !reflect.DeepEqual(got, wantWarnings) {
+		t.Errorf("got warnings at %v, want %v", got, wantWarnings)
+	}
+
+	err := recipe.Validate()
+	if _, ok := err.(*RecipeReport); !ok {
+		t.Fatalf("expected a report, got %v", err)
+	}
+}
+
+func TestAnalyzeRecipeTriggerConflict(t *testing.T) {
+	c := newTestCoordinator(t)
+	checkout := &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "orders.created",
+		StartAt:     "a",
+		Stages:      map[string]*Stage{"a": {Rollback: "a.undo", Terminate: true}},
+	}
+
+	if err := c.Register(checkout); err != nil {
+		t.Fatal(err)
+	}
+
+	fulfil := &Recipe{
+		Name:        "fulfil",
+		TriggeredBy: "orders.created",
+		StartAt:     "a",
+		Stages:      map[string]*Stage{"a": {Rollback: "a.undo", Terminate: true}},
+	}
+
+	report, err := c.AnalyzeRecipe(fulfil)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := issuePaths(report.Errors); !reflect.DeepEqual(got, []string{"trigger"}) {
+		t.Fatalf("expected the trigger to conflict, got errors at %v", got)
+	}
+
+	if err := c.Register(fulfil); err == nil {
+		t.Fatal("expected the conflicting recipe to be rejected")
+	}
+
+	// a new version of the same recipe takes over its trigger
+	upgrade := &Recipe{
+		Name:        "checkout",
+		TriggeredBy: "orders.created",
+		StartAt:     "a",
+		Stages:      map[string]*Stage{"a": {Rollback: "a.undo", Terminate: true}},
+	}
+
+	if err := c.Register(upgrade); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterStoredRecipe(t *testing.T) {
+	c := newTestCoordinator(t)
+	// valid when it was stored, but its dead letter topic is its trigger
+	stored := &Recipe{
+		Name:            "checkout",
+		TriggeredBy:     "orders.created",
+		DeadLetterTopic: "orders.created",
+		StartAt:         "a",
+		Stages:          map[string]*Stage{"a": {Rollback: "a.undo", Terminate: true}},
+	}
+
+	if err := stored.Validate(); err == nil {
+		t.Fatal("expected the recipe to be invalid")
+	} else if err := c.Register(stored); err == nil {
+		t.Fatal("expected the new recipe to be rejected")
+	}
+
+	stored.ID = "r1"
+	stored.Version = 1
+	stored.SetStatus(StatusActive)
+	if err := c.Register(stored); err != nil {
+		t.Fatalf("expected the stored recipe to be registered, got %v", err)
+	}
+
+	// a stored recipe that can't run is still refused
+	broken := &Recipe{
+		ID:          "r2",
+		Name:        "refund",
+		TriggeredBy: "refunds.created",
+		StartAt:     "a",
+		Stages:      map[string]*Stage{"a": {Terminate: true, Conditions: []*Condition{{When: "data.total >", Next: "a"}}}},
+	}
+
+	if err := c.Register(broken); err == nil {
+		t.Fatal("expected a recipe whose condition doesn't compile to be refused")
+	}
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultWebhookTimeout = 30 * time.Second
+
+	EndpointFormatProtobuf = "protobuf"
+	EndpointFormatJSON     = "json"
+
+	// results of an endpoint's response status
+	ResponseSuccess  = "success"
+	ResponseFailure  = "failure"
+	ResponseRetry    = "retry"
+	ResponseAccepted = "accepted"
+
+	// headers of endpoint requests
+	WebhookSignatureHeader     = "Sake-Signature"
+	WebhookRequestIDHeader     = "Sake-Request-ID"
+	WebhookTransactionIDHeader = "Sake-Transaction-ID"
+	WebhookAttemptHeader       = "Sake-Attempt"
+	WebhookSuccessURLHeader    = "Sake-Success-Reply-URL"
+	WebhookFailureURLHeader    = "Sake-Failure-Reply-URL"
+
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+
+	// maxWebhookReplySize limits the bodies read from responses and callbacks.
+	maxWebhookReplySize = 4 << 20
+)
+
+// ErrInvalidReplySignature is returned for callbacks whose signature doesn't
+// match their reply topic.
+var ErrInvalidReplySignature = errors.New("invalid reply signature")
+
+// defaultResponses maps the response statuses that an endpoint doesn't map
+// itself.
+var defaultResponses = map[string]string{
+	"2xx": ResponseSuccess,
+	"202": ResponseAccepted,
+	"4xx": ResponseFailure,
+	"5xx": ResponseRetry,
+}
+
+// Endpoint sends the requests of a stage to an HTTP endpoint instead of the
+// hub. Responses maps response statuses, either a code such as "409" or a
+// class such as "4xx", to the result of the request: success, failure, retry,
+// which is a retryable failure, or accepted, which waits for the endpoint to
+// post its reply to the callback URL of the request.
+type Endpoint struct {
+	URL string `json:"url"`
+	// Rollback receives the stage's compensation requests.
+	Rollback  string            `json:"rollback,omitempty"`
+	Format    string            `json:"format,omitempty"`
+	Responses map[string]string `json:"responses,omitempty"`
+}
+
+// EndpointURL is the URL the stage's requests are posted to while a
+// transaction is in the given state, or empty when they're published to the
+// hub.
+func (stage *Stage) EndpointURL(state TransactionState) string {
+	if stage.Endpoint == nil {
+		return ""
+	} else if state == IsReverting {
+		return stage.Endpoint.Rollback
+	}
+
+	return stage.Endpoint.URL
+}
+
+// Result is the result of a response status, looking up the code before its
+// class and the endpoint's mapping before the defaults.
+func (endpoint *Endpoint) Result(status int) string {
+	code := strconv.Itoa(status)
+	class := code[:1] + "xx"
+	for _, responses := range []map[string]string{endpoint.Responses, defaultResponses} {
+		if result, ok := responses[code]; ok {
+			return result
+		} else if result, ok := responses[class]; ok {
+			return result
+		}
+	}
+
+	return ResponseFailure
+}
+
+func (endpoint *Endpoint) check(path string, report *RecipeReport) {
+	if err := checkEndpointURL(endpoint.URL); err != nil {
+		report.errorf(path+".url", "%v", err)
+	}
+
+	if endpoint.Rollback != "" {
+		if err := checkEndpointURL(endpoint.Rollback); err != nil {
+			report.errorf(path+".rollback", "%v", err)
+		}
+	}
+
+	switch endpoint.Format {
+	case "", EndpointFormatProtobuf, EndpointFormatJSON:
+	default:
+		report.errorf(path+".format", "unsupported format %q", endpoint.Format)
+	}
+
+	for _, status := range sortedKeys(endpoint.Responses) {
+		if !validResponseStatus(status) {
+			report.errorf(path+".responses."+status, "response status must be a code such as 409 or a class such as 4xx")
+		}
+
+		switch result := endpoint.Responses[status]; result {
+		case ResponseSuccess, ResponseFailure, ResponseRetry, ResponseAccepted:
+		default:
+			report.errorf(path+".responses."+status, "unsupported result %q", result)
+		}
+	}
+}
+
+func checkEndpointURL(rawURL string) error {
+	if rawURL == "" {
+		return errors.New("endpoint needs a url")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an absolute http or https url", rawURL)
+	}
+
+	return nil
+}
+
+func validResponseStatus(status string) bool {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	} else if status[1:] == "xx" {
+		return true
+	}
+
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+// WebhookConfig configures the signing and callbacks of a WebhookTransport.
+type WebhookConfig struct {
+	// Secret signs the requests posted to endpoints and the callback URLs of
+	// their replies. Requests aren't signed and callbacks are refused when
+	// it's empty.
+	Secret string
+	// CallbackURL is the base URL that endpoints reach the API at. Requests
+	// have no callback URLs when it's empty.
+	CallbackURL string
+	Timeout     time.Duration
+}
+
+// WebhookTransport posts the requests of stages with an endpoint and routes
+// their replies, from the response or a callback, to the reply groups of the
+// requests by their reply topic.
+type WebhookTransport struct {
+	Config WebhookConfig
+	Client *http.Client
+
+	groupMutex sync.Mutex
+	groups     map[interface{}][]string
+	replies    *replyRouter
+}
+
+func NewWebhookTransport(config WebhookConfig) *WebhookTransport {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+
+	config.CallbackURL = strings.TrimSuffix(config.CallbackURL, "/")
+	return &WebhookTransport{
+		Config:  config,
+		Client:  &http.Client{Timeout: config.Timeout},
+		groups:  make(map[interface{}][]string),
+		replies: newReplyRouter(),
+	}
+}
+
+func (wt *WebhookTransport) CancelAll() error {
+	wt.groupMutex.Lock()
+	defer wt.groupMutex.Unlock()
+	wt.groups = make(map[interface{}][]string)
+	wt.replies.reset()
+	return nil
+}
+
+func (wt *WebhookTransport) CancelGroup(groupKey interface{}) error {
+	wt.groupMutex.Lock()
+	defer wt.groupMutex.Unlock()
+	routes, ok := wt.groups[groupKey]
+	if !ok {
+		return nil
+	}
+
+	log.Debug("webhook cancel group", zap.Any("group", groupKey))
+	delete(wt.groups, groupKey)
+	wt.replies.remove(routes)
+	return nil
+}
+
+func (wt *WebhookTransport) SubReply(groupKey interface{}, finalizer func(), replyGroup ReplyGroup) error {
+	wt.groupMutex.Lock()
+	defer wt.groupMutex.Unlock()
+	if _, ok := wt.groups[groupKey]; ok {
+		return errors.New("group already exists")
+	}
+
+	gate := &replyGate{}
+	routes := make([]string, 0, len(replyGroup))
+	handlers := make(map[string]func(data []byte))
+	for topic, handler := range replyGroup {
+		log.Debug("webhook new reply route", zap.String("topic", topic), zap.Any("rgroup", groupKey))
+		handlers[topic] = wt.replyHandler(gate, finalizer, handler)
+		routes = append(routes, topic)
+	}
+
+	wt.replies.add(handlers)
+	wt.groups[groupKey] = routes
+	return nil
+}
+
+func (wt *WebhookTransport) replyHandler(gate *replyGate, finalizer func(), handler func(reply *protocol.Reply) error) func(data []byte) {
+	return func(data []byte) {
+		gate.handle(func() bool {
+			reply, err := UnmarshalReply(data)
+			if err != nil {
+				log.Error("webhook reply unmarshal failure", zap.Error(err))
+				return true
+			}
+
+			if err := handler(reply); err == ErrReplyDiscarded {
+				return false
+			} else if err != nil {
+				log.Error("webhook handler failure", zap.Error(err))
+				return true
+			}
+
+			finalizer()
+			return true
+		})
+	}
+}
+
+// Post sends a request to an endpoint and returns the reply of its response
+// along with the reply topic it's routed to. The topic is empty when the
+// endpoint accepted the request and replies through a callback. A request
+// that couldn't be sent is a retryable failure, and one that was accepted
+// while callbacks are disabled is a failure.
+func (wt *WebhookTransport) Post(endpointURL string, endpoint *Endpoint, req *protocol.Request) (*protocol.Reply, string, error) {
+	body, contentType, err := encodeEndpointRequest(endpoint.Format, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	header := httpReq.Header
+	header.Set("Content-Type", contentType)
+	header.Set("Accept", contentTypeProtobuf+", "+contentTypeJSON)
+	header.Set(WebhookRequestIDHeader, req.ID)
+	header.Set(WebhookTransactionIDHeader, req.TransactionID)
+	header.Set(WebhookAttemptHeader, strconv.Itoa(int(req.Attempt)))
+	if req.Traceparent != "" {
+		header.Set("traceparent", req.Traceparent)
+	}
+
+	if wt.Config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set(WebhookSignatureHeader, "t="+timestamp+",v1="+wt.sign(timestamp+"."+string(body)))
+		if wt.Config.CallbackURL != "" {
+			header.Set(WebhookSuccessURLHeader, wt.CallbackURL(req.SuccessReplyTopic))
+			header.Set(WebhookFailureURLHeader, wt.CallbackURL(req.FailureReplyTopic))
+		}
+	}
+
+	resp, err := wt.Client.Do(httpReq)
+	if err != nil {
+		return endpointFailure(req, "HTTP_UNREACHABLE", err.Error(), true), req.FailureReplyTopic, err
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookReplySize))
+	if err != nil {
+		return endpointFailure(req, "HTTP_UNREACHABLE", err.Error(), true), req.FailureReplyTopic, err
+	}
+
+	result := endpoint.Result(resp.StatusCode)
+	if result == ResponseAccepted {
+		if wt.Callbacks() {
+			return nil, "", nil
+		}
+
+		// the endpoint has nowhere to post its reply to, which would leave the
+		// request waiting until it times out
+		log.Warn("endpoint accepted a request without a callback url", zap.String("url", endpointURL), zap.String("req", req.ID))
+		return endpointFailure(req, "CALLBACKS_DISABLED", "endpoint accepted the request but callbacks are disabled", false), req.FailureReplyTopic, nil
+	}
+
+	reply := &protocol.Reply{RequestID: req.ID, Attempt: req.Attempt}
+	if len(data) > 0 {
+		if decoded, err := DecodeReply(resp.Header.Get("Content-Type"), data); err == nil {
+			reply = decoded
+		} else {
+			log.Debug("endpoint response isn't a reply", zap.String("url", endpointURL), zap.Error(err))
+		}
+	}
+
+	if result == ResponseSuccess {
+		return reply, req.SuccessReplyTopic, nil
+	}
+
+	if reply.Error == nil {
+		reply.Error = &protocol.ReplyError{
+			Code:    "HTTP_" + strconv.Itoa(resp.StatusCode),
+			Message: http.StatusText(resp.StatusCode),
+		}
+	}
+
+	if result == ResponseRetry {
+		reply.Error.Retryable = true
+	}
+
+	return reply, req.FailureReplyTopic, nil
+}
+
+func endpointFailure(req *protocol.Request, code string, message string, retryable bool) *protocol.Reply {
+	return &protocol.Reply{
+		RequestID: req.ID,
+		Attempt:   req.Attempt,
+		Error: &protocol.ReplyError{
+			Code:      code,
+			Message:   message,
+			Retryable: retryable,
+		},
+	}
+}
+
+// Route hands a reply to the reply group of its topic.
+func (wt *WebhookTransport) Route(topic string, reply *protocol.Reply) error {
+	data, err := MarshalReply(reply)
+	if err != nil {
+		return err
+	}
+
+	wt.replies.route(topic, data, time.Now())
+	return nil
+}
+
+// Callbacks is whether requests get callback URLs, which endpoints need to
+// accept requests and reply later.
+func (wt *WebhookTransport) Callbacks() bool {
+	return wt.Config.Secret != "" && wt.Config.CallbackURL != ""
+}
+
+// CallbackURL is the URL of the reply endpoint for a reply topic, signed so
+// that only the endpoint that received the request can reply to it.
+func (wt *WebhookTransport) CallbackURL(topic string) string {
+	query := url.Values{}
+	query.Set("topic", topic)
+	query.Set("signature", wt.sign(topic))
+	return wt.Config.CallbackURL + "/v1/replies?" + query.Encode()
+}
+
+// Deliver routes a reply posted to a callback URL once its signature is
+// verified.
+func (wt *WebhookTransport) Deliver(topic string, signature string, contentType string, body []byte) error {
+	if wt.Config.Secret == "" || !hmac.Equal([]byte(signature), []byte(wt.sign(topic))) {
+		return ErrInvalidReplySignature
+	}
+
+	reply, err := DecodeReply(contentType, body)
+	if err != nil {
+		return err
+	}
+
+	return wt.Route(topic, reply)
+}
+
+func (wt *WebhookTransport) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(wt.Config.Secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func encodeEndpointRequest(format string, req *protocol.Request) ([]byte, string, error) {
+	if format == EndpointFormatJSON {
+		data, err := json.Marshal(req)
+		return data, contentTypeJSON, err
+	}
+
+	data, err := MarshalRequest(req)
+	return data, contentTypeProtobuf, err
+}
+
+// DecodeReply decodes a reply by its content type, which is either JSON or
+// protobuf.
+func DecodeReply(contentType string, data []byte) (*protocol.Reply, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q", contentType)
+	}
+
+	reply := &protocol.Reply{}
+	switch mediaType {
+	case contentTypeJSON:
+		err = json.Unmarshal(data, reply)
+	case contentTypeProtobuf, "application/protobuf", "application/octet-stream":
+		err = proto.Unmarshal(data, reply)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
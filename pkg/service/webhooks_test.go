@@ -0,0 +1,309 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/service/protobuf"
+	"github.com/golang/protobuf/proto"
+)
+
+func testWebhookRequest() *protocol.Request {
+	return &protocol.Request{
+		ID:                "q1",
+		TransactionID:     "t1",
+		SuccessReplyTopic: "sake.reply.ok.t1@pay",
+		FailureReplyTopic: "sake.reply.fail.t1@pay",
+		Data:              []byte(`{"total":12}`),
+		Attempt:           2,
+	}
+}
+
+// replyError is the code of a reply's error and whether it's retryable.
+func replyError(reply *protocol.Reply) (string, bool) {
+	if err := reply.GetError(); err != nil {
+		return err.Code, err.Retryable
+	}
+
+	return "", false
+}
+
+func TestEndpointResult(t *testing.T) {
+	endpoint := &Endpoint{Responses: map[string]string{"409": ResponseSuccess, "4xx": ResponseRetry}}
+	cases := []struct {
+		status int
+		want   string
+	}{
+		{200, ResponseSuccess},
+		{204, ResponseSuccess},
+		{202, ResponseAccepted},
+		{409, ResponseSuccess},
+		{404, ResponseRetry},
+		{500, ResponseRetry},
+		{302, ResponseFailure},
+	}
+
+	for _, c := range cases {
+		if got := endpoint.Result(c.status); got != c.want {
+			t.Errorf("%d: got %s, want %s", c.status, got, c.want)
+		}
+	}
+
+	if got := (&Endpoint{}).Result(404); got != ResponseFailure {
+		t.Errorf("expected 4xx to fail by default, got %s", got)
+	}
+}
+
+func TestWebhookPost(t *testing.T) {
+	var status int
+	var contentType string
+	var body []byte
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- data
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+
+	defer server.Close()
+	wt := NewWebhookTransport(WebhookConfig{Secret: "s3cret", CallbackURL: "https://sake.example.com/"})
+	req := testWebhookRequest()
+	endpoint := &Endpoint{URL: server.URL, Format: EndpointFormatJSON}
+	cases := []struct {
+		status      int
+		contentType string
+		body        []byte
+		topic       string
+		code        string
+		retryable   bool
+		outcome     string
+	}{
+		{200, contentTypeJSON, []byte(`{"RequestID":"q1","Outcome":"paid"}`), req.SuccessReplyTopic, "", false, "paid"},
+		{200, "", nil, req.SuccessReplyTopic, "", false, ""},
+		{422, contentTypeJSON, []byte(`{"Error":{"Code":"DECLINED","Message":"card declined"}}`), req.FailureReplyTopic, "DECLINED", false, ""},
+		{404, "text/plain", []byte("not found"), req.FailureReplyTopic, "HTTP_404", false, ""},
+		{503, "", nil, req.FailureReplyTopic, "HTTP_503", true, ""},
+		{202, "", nil, "", "", false, ""},
+	}
+
+	for _, c := range cases {
+		status, contentType, body = c.status, c.contentType, c.body
+		reply, topic, err := wt.Post(endpoint.URL, endpoint, req)
+		if err != nil {
+			t.Fatalf("%d: %v", c.status, err)
+		}
+
+		r := <-received
+		data := <-bodies
+		if topic != c.topic {
+			t.Errorf("%d: got topic %q, want %q", c.status, topic, c.topic)
+		}
+
+		if topic == "" {
+			if reply != nil {
+				t.Errorf("%d: expected no reply to an accepted request", c.status)
+			}
+		} else if code, retryable := replyError(reply); code != c.code || retryable != c.retryable || reply.Outcome != c.outcome {
+			t.Errorf("%d: unexpected reply %+v", c.status, reply)
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON || r.Header.Get(WebhookRequestIDHeader) != "q1" || r.Header.Get(WebhookTransactionIDHeader) != "t1" || r.Header.Get(WebhookAttemptHeader) != "2" {
+			t.Errorf("%d: unexpected request headers %v", c.status, r.Header)
+		}
+
+		sent := &protocol.Request{}
+		if err := json.Unmarshal(data, sent); err != nil || sent.ID != "q1" || string(sent.Data) != `{"total":12}` {
+			t.Errorf("%d: unexpected request body %s", c.status, data)
+		}
+
+		signature := r.Header.Get(WebhookSignatureHeader)
+		parts := strings.SplitN(signature, ",", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") || !strings.HasPrefix(parts[1], "v1=") {
+			t.Fatalf("%d: malformed signature %q", c.status, signature)
+		}
+
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "." + string(data)))
+		if strings.TrimPrefix(parts[1], "v1=") != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("%d: signature doesn't match the body", c.status)
+		}
+
+		for header, topic := range map[string]string{WebhookSuccessURLHeader: req.SuccessReplyTopic, WebhookFailureURLHeader: req.FailureReplyTopic} {
+			callback, err := url.Parse(r.Header.Get(header))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if callback.Scheme != "https" || callback.Host != "sake.example.com" || callback.Path != "/v1/replies" || callback.Query().Get("topic") != topic {
+				t.Errorf("%d: unexpected callback url %s", c.status, callback)
+			} else if err := wt.Deliver(topic, callback.Query().Get("signature"), contentTypeJSON, []byte(`{}`)); err != nil {
+				t.Errorf("%d: callback signature was refused: %v", c.status, err)
+			}
+		}
+	}
+}
+
+func TestWebhookPostProtobuf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		req, err := UnmarshalRequest(data)
+		if r.Header.Get("Content-Type") != contentTypeProtobuf || err != nil || req.ID != "q1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reply, _ := MarshalReply(&protocol.Reply{RequestID: req.ID, Outcome: "paid"})
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		w.Write(reply)
+	}))
+
+	defer server.Close()
+	wt := NewWebhookTransport(WebhookConfig{})
+	reply, topic, err := wt.Post(server.URL, &Endpoint{URL: server.URL}, testWebhookRequest())
+	if err != nil {
+		t.Fatal(err)
+	} else if topic != "sake.reply.ok.t1@pay" || reply.Outcome != "paid" {
+		t.Fatalf("expected the paid reply on the success topic, got %+v on %q", reply, topic)
+	}
+}
+
+func TestWebhookPostAcceptedWithoutCallbacks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(WebhookSuccessURLHeader) != "" {
+			t.Errorf("expected no callback url, got %s", r.Header.Get(WebhookSuccessURLHeader))
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	defer server.Close()
+	for _, config := range []WebhookConfig{{}, {Secret: "s3cret"}, {CallbackURL: "https://sake.example.com"}} {
+		wt := NewWebhookTransport(config)
+		reply, topic, err := wt.Post(server.URL, &Endpoint{URL: server.URL}, testWebhookRequest())
+		if err != nil {
+			t.Fatal(err)
+		} else if code, retryable := replyError(reply); topic != "sake.reply.fail.t1@pay" || code != "CALLBACKS_DISABLED" || retryable {
+			t.Errorf("%+v: expected the accepted request to fail, got %+v on %q", config, reply, topic)
+		}
+	}
+}
+
+func TestWebhookPostUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	wt := NewWebhookTransport(WebhookConfig{Timeout: time.Second})
+	reply, topic, err := wt.Post(server.URL, &Endpoint{URL: server.URL}, testWebhookRequest())
+	code, retryable := replyError(reply)
+	if err == nil {
+		t.Fatal("expected the request to fail")
+	} else if topic != "sake.reply.fail.t1@pay" || code != "HTTP_UNREACHABLE" || !retryable {
+		t.Fatalf("expected a retryable failure, got %+v on %q", reply, topic)
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	wt := NewWebhookTransport(WebhookConfig{Secret: "s3cret", CallbackURL: "https://sake.example.com"})
+	topic := "sake.reply.ok.t1@pay"
+	replies := make(chan *protocol.Reply, 2)
+	finalized := make(chan struct{}, 1)
+	err := wt.SubReply("q1", func() { finalized <- struct{}{} }, ReplyGroup{
+		topic: func(reply *protocol.Reply) error {
+			replies <- reply
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := url.Parse(wt.CallbackURL(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := callback.Query().Get("signature")
+	if err := wt.Deliver(topic, signature+"0", contentTypeJSON, []byte(`{}`)); err != ErrInvalidReplySignature {
+		t.Fatalf("expected a bad signature to be refused, got %v", err)
+	}
+
+	if err := wt.Deliver("sake.reply.ok.t2@pay", signature, contentTypeJSON, []byte(`{}`)); err != ErrInvalidReplySignature {
+		t.Fatalf("expected the signature of another topic to be refused, got %v", err)
+	}
+
+	if err := wt.Deliver(topic, signature, "text/plain", []byte(`{}`)); err == nil {
+		t.Fatal("expected an unsupported content type to be refused")
+	}
+
+	if err := wt.Deliver(topic, signature, contentTypeJSON+"; charset=utf-8", []byte(`{"RequestID":"q1","Outcome":"paid"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.RequestID != "q1" || reply.Outcome != "paid" {
+			t.Fatalf("unexpected reply %+v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply wasn't routed")
+	}
+
+	<-finalized
+	unsigned := NewWebhookTransport(WebhookConfig{})
+	if err := unsigned.Deliver(topic, unsigned.sign(topic), contentTypeJSON, []byte(`{}`)); err != ErrInvalidReplySignature {
+		t.Fatalf("expected callbacks to be refused without a secret, got %v", err)
+	}
+}
+
+func TestDecodeReply(t *testing.T) {
+	pb, err := proto.Marshal(&protocol.Reply{RequestID: "q1", Outcome: "paid", Attempt: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		contentType string
+		data        []byte
+	}{
+		{contentTypeJSON, []byte(`{"RequestID":"q1","Outcome":"paid","Attempt":2}`)},
+		{"application/json; charset=utf-8", []byte(`{"RequestID":"q1","Outcome":"paid","Attempt":2}`)},
+		{contentTypeProtobuf, pb},
+		{"application/protobuf", pb},
+		{"application/octet-stream", pb},
+	}
+
+	for _, c := range cases {
+		reply, err := DecodeReply(c.contentType, c.data)
+		if err != nil {
+			t.Errorf("%s: %v", c.contentType, err)
+		} else if reply.RequestID != "q1" || reply.Outcome != "paid" || reply.Attempt != 2 {
+			t.Errorf("%s: unexpected reply %+v", c.contentType, reply)
+		}
+	}
+
+	for _, contentType := range []string{"", "text/plain", "application/xml"} {
+		if _, err := DecodeReply(contentType, []byte(`{}`)); err == nil {
+			t.Errorf("expected %q to be refused", contentType)
+		}
+	}
+
+	if _, err := DecodeReply(contentTypeJSON, []byte(`{"Outcome":`)); err == nil {
+		t.Error("expected malformed json to be refused")
+	}
+}
@@ -0,0 +1,424 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/danielkrainas/sake/pkg/util/log"
+	"github.com/danielkrainas/sake/pkg/util/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// WriteModeAsync acknowledges changes once they're queued for storage.
+	WriteModeAsync = "async"
+	// WriteModeDurable acknowledges changes once they're in storage, so a
+	// transaction doesn't dispatch its next request before its state is
+	// persisted.
+	WriteModeDurable = "durable"
+)
+
+// WriteBehindConfig tunes the storage writes of a WriteBehind.
+type WriteBehindConfig struct {
+	Mode string
+	// QueueSize bounds the writes that are waiting to start. Callers block
+	// while the queue is full.
+	QueueSize int
+	Workers   int
+	// A failed write is retried MaxRetries times, waiting RetryBackoff
+	// before the first retry and twice as long before each next one, up to
+	// MaxBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// LagThreshold is how long a change may wait to be persisted before
+	// storage is reported as lagging.
+	LagThreshold time.Duration
+	// DrainTimeout bounds how long the queue is drained for on shutdown.
+	DrainTimeout time.Duration
+}
+
+func DefaultWriteBehindConfig() WriteBehindConfig {
+	return WriteBehindConfig{
+		Mode:         WriteModeAsync,
+		QueueSize:    1024,
+		Workers:      4,
+		MaxRetries:   10,
+		RetryBackoff: 100 * time.Millisecond,
+		MaxBackoff:   10 * time.Second,
+		LagThreshold: 30 * time.Second,
+		DrainTimeout: 10 * time.Second,
+	}
+}
+
+var (
+	storageWriteQueue = metrics.NewGaugeVec(
+		"sake_storage_write_queue_length",
+		"Storage writes waiting to start.")
+
+	storageWriteLag = metrics.NewGaugeVec(
+		"sake_storage_write_lag_seconds",
+		"Age of the oldest change that isn't persisted yet.")
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(storageWriteQueue, storageWriteLag)
+}
+
+// storageWrite is a change waiting to be persisted. Writes to the same key
+// replace each other, so only the latest state of a key is written.
+type storageWrite struct {
+	key    string
+	op     string
+	write  func(ctx context.Context) error
+	fields []zap.Field
+	// queued is when the oldest change the write carries was queued.
+	queued  time.Time
+	waiters []chan error
+}
+
+func (w *storageWrite) done(err error) {
+	for _, waiter := range w.waiters {
+		waiter <- err
+	}
+
+	w.waiters = nil
+}
+
+// WriteBehind persists changes in the background. The writes of a key are
+// made one at a time and in order, and a write that is still queued is
+// replaced by a newer write of its key.
+type WriteBehind struct {
+	Config WriteBehindConfig
+
+	ctx     context.Context
+	mutex   sync.Mutex
+	work    *sync.Cond
+	notFull *sync.Cond
+	pending map[string]*storageWrite
+	running map[string]*storageWrite
+	ready   []string
+	// failed holds the keys whose last write gave up.
+	failed  map[string]error
+	stopped bool
+	workers sync.WaitGroup
+	quit    chan struct{}
+	lagging bool
+}
+
+var _ Component = &WriteBehind{}
+
+// NewWriteBehind starts the workers of a write-behind queue.
+func NewWriteBehind(ctx context.Context, config WriteBehindConfig) (*WriteBehind, error) {
+	switch config.Mode {
+	case "":
+		config.Mode = WriteModeAsync
+	case WriteModeAsync, WriteModeDurable:
+	default:
+		return nil, fmt.Errorf("invalid write mode %q", config.Mode)
+	}
+
+	defaults := DefaultWriteBehindConfig()
+	if config.QueueSize < 1 {
+		config.QueueSize = defaults.QueueSize
+	}
+
+	if config.Workers < 1 {
+		config.Workers = defaults.Workers
+	}
+
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaults.RetryBackoff
+	}
+
+	if config.MaxBackoff < config.RetryBackoff {
+		config.MaxBackoff = config.RetryBackoff
+	}
+
+	if config.LagThreshold <= 0 {
+		config.LagThreshold = defaults.LagThreshold
+	}
+
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = defaults.DrainTimeout
+	}
+
+	wb := &WriteBehind{
+		Config:  config,
+		ctx:     ctx,
+		pending: make(map[string]*storageWrite),
+		running: make(map[string]*storageWrite),
+		failed:  make(map[string]error),
+		quit:    make(chan struct{}),
+	}
+
+	wb.work = sync.NewCond(&wb.mutex)
+	wb.notFull = sync.NewCond(&wb.mutex)
+	wb.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go wb.worker()
+	}
+
+	return wb, nil
+}
+
+func (wb *WriteBehind) ComponentName() string {
+	return "storage_writer"
+}
+
+// Run reports the queue's lag until it quits, then drains the queue.
+func (wb *WriteBehind) Run(ctx ComponentRunContext) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wb.report()
+
+		case <-ctx.QuitCh:
+			return wb.Close()
+		}
+	}
+}
+
+// Write queues a write of key. In durable mode it returns once the write,
+// or a newer write of the key, is persisted or has given up.
+func (wb *WriteBehind) Write(key string, op string, write func(ctx context.Context) error, fields ...zap.Field) error {
+	w := &storageWrite{
+		key:    key,
+		op:     op,
+		write:  write,
+		fields: fields,
+		queued: time.Now(),
+	}
+
+	var waiter chan error
+	if wb.Config.Mode == WriteModeDurable {
+		waiter = make(chan error, 1)
+		w.waiters = append(w.waiters, waiter)
+	}
+
+	if !wb.enqueue(w) {
+		// the workers are gone; the write is made by the caller.
+		err := wb.persist(w)
+		w.done(err)
+		return err
+	}
+
+	if waiter == nil {
+		return nil
+	}
+
+	return <-waiter
+}
+
+func (wb *WriteBehind) enqueue(w *storageWrite) bool {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	if prev, ok := wb.pending[w.key]; ok {
+		w.queued = prev.queued
+		w.waiters = append(prev.waiters, w.waiters...)
+		wb.pending[w.key] = w
+		return true
+	}
+
+	for len(wb.pending) >= wb.Config.QueueSize && !wb.stopped {
+		log.Warn("storage write queue full, waiting", w.fields...)
+		wb.notFull.Wait()
+	}
+
+	if wb.stopped {
+		return false
+	}
+
+	wb.pending[w.key] = w
+	if _, ok := wb.running[w.key]; !ok {
+		wb.ready = append(wb.ready, w.key)
+		wb.work.Signal()
+	}
+
+	return true
+}
+
+func (wb *WriteBehind) worker() {
+	defer wb.workers.Done()
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for {
+		for len(wb.ready) < 1 && !wb.stopped {
+			wb.work.Wait()
+		}
+
+		if wb.stopped {
+			return
+		}
+
+		key := wb.ready[0]
+		wb.ready = wb.ready[1:]
+		w := wb.pending[key]
+		delete(wb.pending, key)
+		wb.running[key] = w
+		wb.notFull.Broadcast()
+		wb.mutex.Unlock()
+		err := wb.persist(w)
+		wb.mutex.Lock()
+		delete(wb.running, key)
+		if next, ok := wb.pending[key]; ok {
+			if err != nil {
+				// the newer write carries the failed one's changes.
+				next.queued = w.queued
+				next.waiters = append(w.waiters, next.waiters...)
+				w.waiters = nil
+			}
+
+			wb.ready = append(wb.ready, key)
+			wb.work.Signal()
+		}
+
+		w.done(err)
+	}
+}
+
+// persist makes a write, retrying it with backoff until it succeeds, it's
+// superseded by a newer write of its key or it runs out of retries.
+func (wb *WriteBehind) persist(w *storageWrite) error {
+	backoff := wb.Config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := observeWrite(w.op, func() error {
+			return w.write(wb.ctx)
+		})
+
+		if err == nil {
+			wb.mutex.Lock()
+			delete(wb.failed, w.key)
+			wb.mutex.Unlock()
+			return nil
+		}
+
+		fields := log.CombineAll([]zap.Field{zap.String("operation", w.op), zap.Int("attempt", attempt+1), zap.Error(err)}, w.fields)
+		if attempt >= wb.Config.MaxRetries {
+			log.Error("storage write failed, giving up", fields...)
+			wb.mutex.Lock()
+			wb.failed[w.key] = err
+			wb.mutex.Unlock()
+			return err
+		}
+
+		if wb.superseded(w) {
+			log.Warn("storage write failed, superseded by a newer write", fields...)
+			return err
+		}
+
+		log.Warn("storage write failed, retrying", log.Combine(zap.Duration("backoff", backoff), fields...)...)
+		select {
+		case <-time.After(backoff):
+		case <-wb.quit:
+			return err
+		}
+
+		backoff *= 2
+		if backoff > wb.Config.MaxBackoff {
+			backoff = wb.Config.MaxBackoff
+		}
+	}
+}
+
+func (wb *WriteBehind) superseded(w *storageWrite) bool {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	_, ok := wb.pending[w.key]
+	return ok && wb.running[w.key] == w
+}
+
+// Lag is the age of the oldest change that isn't persisted yet.
+func (wb *WriteBehind) Lag() time.Duration {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	return wb.lag()
+}
+
+func (wb *WriteBehind) lag() time.Duration {
+	var oldest time.Time
+	for _, writes := range []map[string]*storageWrite{wb.pending, wb.running} {
+		for _, w := range writes {
+			if oldest.IsZero() || w.queued.Before(oldest) {
+				oldest = w.queued
+			}
+		}
+	}
+
+	if oldest.IsZero() {
+		return 0
+	}
+
+	return time.Since(oldest)
+}
+
+// CheckHealth reports storage as unhealthy while it lags behind by more than
+// the lag threshold or some key's last write gave up.
+func (wb *WriteBehind) CheckHealth() error {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	if lag := wb.lag(); lag > wb.Config.LagThreshold {
+		return fmt.Errorf("storage is lagging by %s with %d writes queued", lag.Round(time.Millisecond), len(wb.pending))
+	}
+
+	if len(wb.failed) > 0 {
+		return fmt.Errorf("storage writes of %d keys failed", len(wb.failed))
+	}
+
+	return nil
+}
+
+func (wb *WriteBehind) report() {
+	wb.mutex.Lock()
+	lag := wb.lag()
+	queued := len(wb.pending)
+	wasLagging := wb.lagging
+	wb.lagging = lag > wb.Config.LagThreshold
+	wb.mutex.Unlock()
+	storageWriteQueue.Set(float64(queued))
+	storageWriteLag.Set(lag.Seconds())
+	if wb.lagging && !wasLagging {
+		log.Warn("storage is lagging", zap.Duration("lag", lag), zap.Int("queued", queued))
+	} else if !wb.lagging && wasLagging {
+		log.Info("storage caught up", zap.Int("queued", queued))
+	}
+}
+
+// Close waits for the queued writes to be persisted, up to the drain
+// timeout, and stops the workers. Writes made after it are made by their
+// callers.
+func (wb *WriteBehind) Close() error {
+	deadline := time.Now().Add(wb.Config.DrainTimeout)
+	for time.Now().Before(deadline) && wb.Lag() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wb.mutex.Lock()
+	if wb.stopped {
+		wb.mutex.Unlock()
+		return nil
+	}
+
+	wb.stopped = true
+	close(wb.quit)
+	lost := len(wb.pending)
+	for _, w := range wb.pending {
+		w.done(fmt.Errorf("storage writer stopped"))
+	}
+
+	wb.pending = make(map[string]*storageWrite)
+	wb.ready = nil
+	wb.work.Broadcast()
+	wb.notFull.Broadcast()
+	wb.mutex.Unlock()
+	wb.workers.Wait()
+	if lost > 0 {
+		return fmt.Errorf("%d storage writes weren't persisted", lost)
+	}
+
+	return nil
+}
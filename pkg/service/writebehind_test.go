@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestWriteBehind(t *testing.T, config WriteBehindConfig) *WriteBehind {
+	wb, err := NewWriteBehind(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wb
+}
+
+// waitPending waits until a write of key is queued behind the running one.
+func waitPending(t *testing.T, wb *WriteBehind, key string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wb.mutex.Lock()
+		_, ok := wb.pending[key]
+		wb.mutex.Unlock()
+		if ok {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("no write of %q is queued", key)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteBehindKeyOrder(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Workers: 4})
+	defer wb.Close()
+	var mutex sync.Mutex
+	running := make(map[string]bool)
+	written := make(map[string][]int)
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			key, i := key, i
+			err := wb.Write(key, "save", func(ctx context.Context) error {
+				mutex.Lock()
+				if running[key] {
+					t.Errorf("concurrent writes of %s", key)
+				}
+
+				running[key] = true
+				mutex.Unlock()
+				time.Sleep(100 * time.Microsecond)
+				mutex.Lock()
+				running[key] = false
+				written[key] = append(written[key], i)
+				mutex.Unlock()
+				return nil
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := wb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		writes := written[key]
+		if len(writes) < 1 || writes[len(writes)-1] != 49 {
+			t.Fatalf("expected the last write of %s to be persisted, got %v", key, writes)
+		}
+
+		for i := 1; i < len(writes); i++ {
+			if writes[i] <= writes[i-1] {
+				t.Fatalf("writes of %s were made out of order: %v", key, writes)
+			}
+		}
+	}
+}
+
+func TestWriteBehindCoalesces(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Workers: 1})
+	defer wb.Close()
+	release := make(chan struct{})
+	written := make(chan int, 4)
+	write := func(i int) {
+		err := wb.Write("a", "save", func(ctx context.Context) error {
+			if i == 1 {
+				<-release
+			}
+
+			written <- i
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(1)
+	for i := 2; i <= 4; i++ {
+		waitRunning(t, wb, "a")
+		write(i)
+	}
+
+	close(release)
+	if err := wb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(written)
+	got := make([]int, 0)
+	for i := range written {
+		got = append(got, i)
+	}
+
+	if len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Fatalf("expected the running and the latest write, got %v", got)
+	}
+}
+
+// waitRunning waits until a write of key is being made.
+func waitRunning(t *testing.T, wb *WriteBehind, key string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wb.mutex.Lock()
+		_, ok := wb.running[key]
+		wb.mutex.Unlock()
+		if ok {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("no write of %q is running", key)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteBehindDurable(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Mode: WriteModeDurable, Workers: 2})
+	defer wb.Close()
+	var mutex sync.Mutex
+	persisted := false
+	err := wb.Write("a", "save", func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		persisted = true
+		mutex.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !persisted {
+		t.Fatal("expected the durable write to be persisted when it returns")
+	}
+}
+
+func TestWriteBehindGivesUp(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Mode: WriteModeDurable, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	defer wb.Close()
+	attempts := 0
+	failure := errors.New("storage unavailable")
+	err := wb.Write("a", "save", func(ctx context.Context) error {
+		attempts++
+		return failure
+	})
+
+	if err != failure {
+		t.Fatalf("expected the write's error, got %v", err)
+	} else if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	if err := wb.CheckHealth(); err == nil {
+		t.Fatal("expected the failed key to be reported")
+	}
+
+	if err := wb.Write("a", "save", func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wb.CheckHealth(); err != nil {
+		t.Fatalf("expected the key to be healthy once written, got %v", err)
+	}
+}
+
+func TestWriteBehindSupersededRetry(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Mode: WriteModeDurable, Workers: 1, MaxRetries: 5, RetryBackoff: time.Hour})
+	defer wb.Close()
+	release := make(chan struct{})
+	attempts := make(chan string, 4)
+	results := make(chan error, 2)
+	go func() {
+		results <- wb.Write("a", "save", func(ctx context.Context) error {
+			attempts <- "first"
+			<-release
+			return errors.New("storage unavailable")
+		})
+	}()
+
+	waitRunning(t, wb, "a")
+	go func() {
+		results <- wb.Write("a", "save", func(ctx context.Context) error {
+			attempts <- "second"
+			return nil
+		})
+	}()
+
+	waitPending(t, wb, "a")
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatalf("expected both writes to be persisted by the second, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the failed write was retried instead of superseded")
+		}
+	}
+
+	close(attempts)
+	got := make([]string, 0)
+	for attempt := range attempts {
+		got = append(got, attempt)
+	}
+
+	if len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("expected a single attempt of each write, got %v", got)
+	}
+}
+
+func TestWriteBehindDrainsOnClose(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Workers: 2})
+	var mutex sync.Mutex
+	written := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("t%d", i)
+		err := wb.Write(key, "save", func(ctx context.Context) error {
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			written[key] = true
+			mutex.Unlock()
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := wb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	if len(written) != 20 {
+		t.Fatalf("expected the queue to be drained, %d of 20 writes were made", len(written))
+	}
+
+	mutex.Unlock()
+	// writes after Close are made by the caller
+	made := false
+	if err := wb.Write("late", "save", func(ctx context.Context) error { made = true; return nil }); err != nil {
+		t.Fatal(err)
+	} else if !made {
+		t.Fatal("expected the late write to be made before Write returned")
+	}
+}
+
+func TestWriteBehindCloseTimeout(t *testing.T) {
+	wb := newTestWriteBehind(t, WriteBehindConfig{Workers: 1, DrainTimeout: 50 * time.Millisecond})
+	release := make(chan struct{})
+	defer close(release)
+	for _, key := range []string{"a", "b"} {
+		err := wb.Write(key, "save", func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitRunning(t, wb, "a")
+	done := make(chan error, 1)
+	go func() { done <- wb.Close() }()
+	time.Sleep(100 * time.Millisecond)
+	release <- struct{}{}
+	if err := <-done; err == nil {
+		t.Fatal("expected the write that wasn't drained to be reported")
+	}
+}
@@ -0,0 +1,359 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is a family of samples that share a name.
+type Metric interface {
+	Name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics that are exposed together.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]Metric
+}
+
+// DefaultRegistry is the registry the metrics of the engine are kept in.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]Metric)}
+}
+
+// MustRegister adds metrics to the registry and panics when a name is
+// already taken.
+func (r *Registry) MustRegister(metrics ...Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, m := range metrics {
+		if _, ok := r.metrics[m.Name()]; ok {
+			panic(fmt.Sprintf("metric %q is already registered", m.Name()))
+		}
+
+		r.metrics[m.Name()] = m
+	}
+}
+
+// WriteText writes every metric, ordered by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	metrics := make([]Metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+
+	r.mutex.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves the registry's metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		r.WriteText(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) header(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %q takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the label set of a sample, with an extra pair when
+// extraName isn't empty.
+func (d *desc) labelPairs(values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range d.labels {
+		pairs = append(pairs, name+"=\""+escapeLabel(values[i])+"\"")
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+escapeLabel(extraValue)+"\"")
+	}
+
+	if len(pairs) < 1 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// series holds the values of a metric by label set.
+type series struct {
+	mutex  sync.Mutex
+	values map[string][]string
+}
+
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	desc
+	series
+	counts map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		desc:   desc{name, help, labels},
+		series: series{values: make(map[string][]string)},
+		counts: make(map[string]float64),
+	}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by delta, which can't be negative.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %q can't decrease", c.name))
+	}
+
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = append([]string(nil), labelValues...)
+	}
+
+	c.counts[key] += delta
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.values[key], "", ""), formatValue(c.counts[key]))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	desc
+	series
+	gauges map[string]float64
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{
+		desc:   desc{name, help, labels},
+		series: series{values: make(map[string][]string)},
+		gauges: make(map[string]float64),
+	}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return value })
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.update(labelValues, func(v float64) float64 { return v + delta })
+}
+
+func (g *GaugeVec) update(labelValues []string, fn func(float64) float64) {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.values[key]; !ok {
+		g.values[key] = append([]string(nil), labelValues...)
+	}
+
+	g.gauges[key] = fn(g.gauges[key])
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(g.values[key], "", ""), formatValue(g.gauges[key]))
+	}
+}
+
+// GaugeFunc is a gauge whose values are collected when it's written.
+type GaugeFunc struct {
+	desc
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc creates a gauge that calls collect on every scrape; collect
+// reports each value with set.
+func NewGaugeFunc(name string, help string, labels []string, collect func(set func(value float64, labelValues ...string))) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    desc{name, help, labels},
+		collect: collect,
+	}
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	samples := make(map[string]string)
+	g.collect(func(value float64, labelValues ...string) {
+		g.key(labelValues)
+		labels := g.labelPairs(labelValues, "", "")
+		samples[labels] = fmt.Sprintf("%s%s %s\n", g.name, labels, formatValue(value))
+	})
+
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		w.WriteString(samples[key])
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	desc
+	series
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bucket bounds,
+// or DefBuckets when there are none.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) < 1 {
+		buckets = DefBuckets
+	}
+
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{
+		desc:       desc{name, help, labels},
+		series:     series{values: make(map[string][]string)},
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		h.values[key] = append([]string(nil), labelValues...)
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range h.sortedKeys() {
+		values := h.values[key]
+		hist := h.histograms[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", formatValue(bound)), hist.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values, "", ""), formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values, "", ""), hist.count)
+	}
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func writeText(t *testing.T, metrics ...Metric) string {
+	r := NewRegistry()
+	r.MustRegister(metrics...)
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("sake_started_total", "Transactions started.", "recipe")
+	c.Inc("refund")
+	c.Add(2.5, "checkout")
+	c.Inc("checkout")
+	want := `# HELP sake_started_total Transactions started.
+# TYPE sake_started_total counter
+sake_started_total{recipe="checkout"} 3.5
+sake_started_total{recipe="refund"} 1
+`
+
+	if got := writeText(t, c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGauges(t *testing.T) {
+	g := NewGaugeVec("sake_active", "Active transactions.")
+	g.Add(3)
+	g.Add(-1)
+	f := NewGaugeFunc("sake_queue", "Queued writes.", []string{"queue"}, func(set func(float64, ...string)) {
+		set(4, "b")
+		set(1, "a")
+	})
+
+	want := `# HELP sake_active Active transactions.
+# TYPE sake_active gauge
+sake_active 2
+# HELP sake_queue Queued writes.
+# TYPE sake_queue gauge
+sake_queue{queue="a"} 1
+sake_queue{queue="b"} 4
+`
+
+	if got := writeText(t, f, g); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("sake_stage_seconds", "Stage durations.", []float64{1, 0.5, 2}, "stage")
+	for _, v := range []float64{0.1, 0.5, 0.7, 3} {
+		h.Observe(v, "pay")
+	}
+
+	want := `# HELP sake_stage_seconds Stage durations.
+# TYPE sake_stage_seconds histogram
+sake_stage_seconds_bucket{stage="pay",le="0.5"} 2
+sake_stage_seconds_bucket{stage="pay",le="1"} 3
+sake_stage_seconds_bucket{stage="pay",le="2"} 3
+sake_stage_seconds_bucket{stage="pay",le="+Inf"} 4
+sake_stage_seconds_sum{stage="pay"} 4.3
+sake_stage_seconds_count{stage="pay"} 4
+`
+
+	if got := writeText(t, h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramDefaultBuckets(t *testing.T) {
+	h := NewHistogramVec("d", "", nil)
+	h.Observe(0.2)
+	got := writeText(t, h)
+	for _, line := range []string{
+		"d_bucket{le=\"0.1\"} 0\n",
+		"d_bucket{le=\"0.25\"} 1\n",
+		"d_bucket{le=\"10\"} 1\n",
+		"d_bucket{le=\"+Inf\"} 1\n",
+		"d_count 1\n",
+	} {
+		if !bytes.Contains([]byte(got), []byte(line)) {
+			t.Errorf("expected %q in\n%s", line, got)
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounterVec("sake_errors_total", "Errors by \\ reason\nand \"kind\".", "reason")
+	c.Inc("a \"quoted\" \\path\\\nline")
+	want := `# HELP sake_errors_total Errors by \\ reason\nand "kind".
+# TYPE sake_errors_total counter
+sake_errors_total{reason="a \"quoted\" \\path\\\nline"} 1
+`
+
+	if got := writeText(t, c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelValueCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for missing label values")
+		}
+	}()
+
+	NewCounterVec("c", "", "a", "b").Inc("x")
+}
+
+func TestMustRegisterDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a duplicate name")
+		}
+	}()
+
+	NewRegistry().MustRegister(NewCounterVec("c", ""), NewGaugeVec("c", ""))
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounterVec("c", "")
+	c.Inc()
+	r.MustRegister(c)
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("expected content type %q, got %q", ContentType, ct)
+	}
+
+	if body := rec.Body.String(); body != "# HELP c \n# TYPE c counter\nc 1\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
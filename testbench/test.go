@@ -63,22 +63,22 @@ func addSagaListeners(conn stan.Conn) sync.WaitGroup {
 	subscribe(conn, "start", func(req *sakeprotocol.Request) {
 		log.Debug("coordinator called start")
 		log.Debug("replying success")
-		conn.Publish(req.SuccessReplyTopic, marshalReply(&sakeprotocol.Reply{
-			NewData: []byte("started"),
-		}))
+		reply := req.NewReply()
+		reply.NewData = []byte("started")
+		conn.Publish(req.SuccessReplyTopic, marshalReply(reply))
 	})
 
 	subscribe(conn, "cancel-start", func(req *sakeprotocol.Request) {
 		log.Debug("coordinator rollback start")
 		log.Debug("replying success")
-		conn.Publish(req.SuccessReplyTopic, marshalReply(&sakeprotocol.Reply{}))
+		conn.Publish(req.SuccessReplyTopic, marshalReply(req.NewReply()))
 		wg.Done()
 	})
 
 	subscribe(conn, "middle2", func(req *sakeprotocol.Request) {
 		log.Debug("coordinator called middle")
 		log.Debug("replying success")
-		conn.Publish(req.SuccessReplyTopic, marshalReply(&sakeprotocol.Reply{}))
+		conn.Publish(req.SuccessReplyTopic, marshalReply(req.NewReply()))
 		wg.Done()
 	})
 
@@ -90,11 +90,12 @@ func addSagaListeners(conn stan.Conn) sync.WaitGroup {
 			log.Debug("replying success")
 		}
 
-		replyData := marshalReply(&sakeprotocol.Reply{})
+		reply := req.NewReply()
 		if simulateFailure {
-			conn.Publish(req.FailureReplyTopic, replyData)
+			reply.Error = &sakeprotocol.ReplyError{Code: "simulated", Message: "simulated failure"}
+			conn.Publish(req.FailureReplyTopic, marshalReply(reply))
 		} else {
-			conn.Publish(req.SuccessReplyTopic, replyData)
+			conn.Publish(req.SuccessReplyTopic, marshalReply(reply))
 		}
 
 		wg.Done()
@@ -104,7 +105,7 @@ func addSagaListeners(conn stan.Conn) sync.WaitGroup {
 		log.Debug("coordinator rollback middle")
 		log.Debug("replying success")
 
-		conn.Publish(req.SuccessReplyTopic, marshalReply(&sakeprotocol.Reply{}))
+		conn.Publish(req.SuccessReplyTopic, marshalReply(req.NewReply()))
 		wg.Done()
 	})
 